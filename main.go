@@ -4,6 +4,9 @@ package main
 
 import (
 	"context"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/harness-community/drone-azure-oidc/plugin"
 
@@ -14,9 +17,19 @@ import (
 func main() {
 	logrus.SetFormatter(new(formatter))
 
+	settings, err := plugin.ApplySettings()
+	if err != nil {
+		fatal(err)
+	}
+	aliases := plugin.ApplyAliases()
 	var args plugin.Args
 	if err := envconfig.Process("", &args); err != nil {
-		logrus.Fatalln(err)
+		fatal(plugin.SettingsError(err, settings))
+	}
+	if args.Strict {
+		if err := plugin.CheckUnknownSettings(); err != nil {
+			fatal(err)
+		}
 	}
 
 	switch args.Level {
@@ -29,12 +42,30 @@ func main() {
 	default:
 		logrus.SetFormatter(new(formatter))
 	}
+	if args.LogFormat == "json" {
+		logrus.SetFormatter(jsonFormatter)
+	}
+	if args.Quiet {
+		logrus.SetLevel(logrus.ErrorLevel)
+	}
+	for name, alias := range aliases {
+		logrus.Debugf("%s is not set, using %s", name, alias)
+	}
 
-	if err := plugin.Exec(context.Background(), args); err != nil {
-		logrus.Fatalln(err)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	if err := plugin.Exec(ctx, args); err != nil {
+		fatal(err)
 	}
 }
 
+// fatal logs the error and exits with the exit code of its class.
+func fatal(err error) {
+	logrus.Errorln(err)
+	os.Exit(plugin.ExitCode(err))
+}
+
 // default formatter that writes logs without including timestamp
 // or level information.
 type formatter struct{}
@@ -47,3 +78,6 @@ func (*formatter) Format(entry *logrus.Entry) ([]byte, error) {
 var textFormatter = &logrus.TextFormatter{
 	DisableTimestamp: true,
 }
+
+// json formatter that writes structured logs with fields
+var jsonFormatter = &logrus.JSONFormatter{}
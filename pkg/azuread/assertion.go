@@ -0,0 +1,71 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package azuread
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// assertionLifetime is the lifetime of a signed client assertion.
+// The assertion is used once, right after it is signed.
+const assertionLifetime = 10 * time.Minute
+
+// signAssertion returns a client assertion for the application,
+// addressed to the token endpoint and signed with the RS256
+// algorithm. Azure AD identifies the certificate by the x5t header,
+// the base64url encoded SHA-1 thumbprint of the certificate.
+func signAssertion(cert tls.Certificate, clientID, audience string) (string, error) {
+	if len(cert.Certificate) == 0 {
+		return "", errors.New("client assertion certificate is not provided")
+	}
+	key, ok := cert.PrivateKey.(*rsa.PrivateKey)
+	if !ok {
+		return "", errors.New("client assertion certificate must have an RSA private key")
+	}
+	thumbprint := sha1.Sum(cert.Certificate[0])
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", err
+	}
+
+	now := time.Now()
+	header, err := json.Marshal(map[string]string{
+		"alg": "RS256",
+		"typ": "JWT",
+		"x5t": base64.RawURLEncoding.EncodeToString(thumbprint[:]),
+	})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": audience,
+		"iss": clientID,
+		"sub": clientID,
+		"jti": hex.EncodeToString(id[:]),
+		"iat": now.Unix(),
+		"nbf": now.Unix(),
+		"exp": now.Add(assertionLifetime).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(signed))
+	signature, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		return "", fmt.Errorf("failed to sign client assertion: %w", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature), nil
+}
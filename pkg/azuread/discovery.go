@@ -0,0 +1,150 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package azuread
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// discoveryTTL is how long memoized discovery metadata is reused.
+const discoveryTTL = 24 * time.Hour
+
+// OpenIDConfiguration is the subset of the OpenID Connect discovery
+// document used by the exchange and assertion verification.
+type OpenIDConfiguration struct {
+	Issuer        string `json:"issuer"`
+	TokenEndpoint string `json:"token_endpoint"`
+	JWKSURI       string `json:"jwks_uri"`
+}
+
+// discoveryEntry is a discovery document memoized in the workspace.
+type discoveryEntry struct {
+	FetchedAt int64               `json:"fetched_at"`
+	Config    OpenIDConfiguration `json:"config"`
+}
+
+// TenantDiscoveryURL returns the openid-configuration address for
+// the tenant on the authority host.
+func TenantDiscoveryURL(authorityHost, tenantID string) string {
+	return fmt.Sprintf("%s/%s/v2.0/.well-known/openid-configuration", authorityHost, tenantID)
+}
+
+// FetchOpenIDConfiguration fetches the discovery document at the
+// address. The document is never memoized.
+func FetchOpenIDConfiguration(ctx context.Context, client *http.Client, address string) (*OpenIDConfiguration, error) {
+	Logger(ctx).Debugf("fetching discovery metadata from %s", address)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, address, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create discovery request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := WithoutRedirects(client).Do(req)
+	if err != nil {
+		return nil, &RetryableError{&NetworkError{fmt.Errorf("failed to fetch discovery metadata: %w", err)}}
+	}
+	defer drainAndClose(resp.Body)
+	if err := CheckRedirect(resp); err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		err := fmt.Errorf("failed to fetch discovery metadata from %s: %s", address, resp.Status)
+		if IsRetryableStatus(resp.StatusCode) {
+			return nil, &RetryableError{err}
+		}
+		return nil, err
+	}
+
+	config := new(OpenIDConfiguration)
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(config); err != nil {
+		return nil, fmt.Errorf("failed to decode discovery metadata: %w", err)
+	}
+	return config, nil
+}
+
+// discover returns the discovery document at the address, memoized
+// in the discovery cache directory when a cache key is configured.
+// The workspace is shared with other steps, so a memoized document
+// is only used when its HMAC, keyed with the cache key, is valid.
+func (e *Exchanger) discover(ctx context.Context, address string) (*OpenIDConfiguration, error) {
+	if e.DiscoveryCacheDir == "" || len(e.DiscoveryCacheKey) == 0 {
+		return FetchOpenIDConfiguration(ctx, e.HTTPClient(), address)
+	}
+	sum := sha256.Sum256([]byte(address))
+	path := filepath.Join(e.DiscoveryCacheDir, "discovery-"+hex.EncodeToString(sum[:8])+".json")
+	if entry, err := loadDiscovery(path, e.DiscoveryCacheKey, address); err == nil && time.Since(time.Unix(entry.FetchedAt, 0)) < discoveryTTL {
+		Logger(ctx).Debugf("using memoized discovery metadata for %s", address)
+		return &entry.Config, nil
+	} else if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		Logger(ctx).Debugf("ignoring memoized discovery metadata: %s", err)
+	}
+
+	config, err := FetchOpenIDConfiguration(ctx, e.HTTPClient(), address)
+	if err != nil {
+		return nil, err
+	}
+	if err := storeDiscovery(path, e.DiscoveryCacheKey, address, &discoveryEntry{FetchedAt: time.Now().Unix(), Config: *config}); err != nil {
+		Logger(ctx).Debugf("failed to memoize discovery metadata: %s", err)
+	}
+	return config, nil
+}
+
+// loadDiscovery reads a memoized discovery document, verifying its
+// HMAC. The file holds the hex encoded HMAC on its first line and
+// the document on the second.
+func loadDiscovery(path string, key []byte, address string) (*discoveryEntry, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	mac, payload, ok := bytes.Cut(data, []byte{'\n'})
+	if !ok {
+		return nil, errors.New("malformed discovery cache file")
+	}
+	want, err := hex.DecodeString(string(mac))
+	if err != nil || !hmac.Equal(want, discoveryMAC(key, address, payload)) {
+		return nil, errors.New("discovery cache file failed the integrity check")
+	}
+	entry := new(discoveryEntry)
+	if err := json.Unmarshal(payload, entry); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+// storeDiscovery memoizes the discovery document with its HMAC.
+func storeDiscovery(path string, key []byte, address string, entry *discoveryEntry) error {
+	payload, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	data := hex.AppendEncode(nil, discoveryMAC(key, address, payload))
+	data = append(append(data, '\n'), payload...)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0600)
+}
+
+// discoveryMAC authenticates a memoized document and the address it
+// was fetched from, so a document cannot be replayed for another
+// tenant or authority host.
+func discoveryMAC(key []byte, address string, payload []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(address))
+	h.Write([]byte{0})
+	h.Write(payload)
+	return h.Sum(nil)
+}
@@ -0,0 +1,103 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package azuread
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// CheckEndpoint verifies that the OIDC assertion may be sent to the
+// endpoint. Plain HTTP is refused except for loopback addresses used
+// by local mock servers, and when an allowlist is configured the
+// endpoint host must match one of its entries. A leading "*." in an
+// entry matches any subdomain.
+func CheckEndpoint(endpoint string, allowed []string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid authority endpoint %q", endpoint)
+	}
+	host := strings.ToLower(u.Hostname())
+
+	switch u.Scheme {
+	case "https":
+	case "http":
+		if !IsLoopback(host) {
+			return fmt.Errorf("refusing to send the OIDC assertion over plain HTTP to %s", u.Host)
+		}
+	default:
+		return fmt.Errorf("unsupported authority scheme %q", u.Scheme)
+	}
+
+	if len(allowed) == 0 {
+		return nil
+	}
+	for _, pattern := range allowed {
+		if matchHost(host, pattern) {
+			return nil
+		}
+	}
+	return fmt.Errorf("authority host %s is not in the allowed authority hosts", host)
+}
+
+// WithoutRedirects returns a copy of the client that returns
+// redirect responses instead of following them. The authority never
+// redirects token or discovery requests, so a redirect means a
+// captive portal or proxy intercepted the request, and following it
+// would send the assertion elsewhere or hide the interception.
+func WithoutRedirects(client *http.Client) *http.Client {
+	c := *client
+	c.CheckRedirect = func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}
+	return &c
+}
+
+// CheckRedirect returns a NetworkError naming the target of a
+// redirect response, and nil for any other response. Only the
+// scheme, host and path of the target are reported.
+func CheckRedirect(resp *http.Response) error {
+	if resp.StatusCode < 300 || resp.StatusCode > 399 {
+		return nil
+	}
+	target := "an unknown location"
+	if location, err := resp.Location(); err == nil {
+		location.User, location.RawQuery, location.Fragment = nil, "", ""
+		target = location.String()
+		if len(target) > 200 {
+			target = target[:200] + "..."
+		}
+	}
+	return &NetworkError{fmt.Errorf("unexpected redirect to %s (%s), a captive portal or proxy may be intercepting requests to the authority",
+		target, resp.Status)}
+}
+
+// IsLoopback reports whether the host is a loopback name or address.
+func IsLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// matchHost reports whether the host matches the allowlist entry.
+// A leading "*." matches any subdomain of the entry.
+func matchHost(host, pattern string) bool {
+	pattern = strings.ToLower(strings.TrimSpace(pattern))
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return strings.HasSuffix(host, "."+suffix)
+	}
+	return host == pattern
+}
+
+// drainAndClose discards any unread response body before closing
+// it, allowing the underlying connection to be reused.
+func drainAndClose(body io.ReadCloser) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(body, 64<<10))
+	body.Close()
+}
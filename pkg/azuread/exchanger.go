@@ -0,0 +1,438 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+// Package azuread exchanges external OIDC tokens for Azure AD access
+// tokens using the client credentials grant with a federated client
+// assertion, and the on-behalf-of grant.
+//
+// The exported API is stable: Exchanger and its fields, the response
+// and error types, and the endpoint helpers. Programs observe the
+// exchange through a logger carried by the context (WithLogger) and
+// the hooks installed with SetHooks, such as to redact secrets from
+// their logs or trace each token request.
+package azuread
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Default settings of the exchange, applied when the corresponding
+// Exchanger field or argument is empty.
+const (
+	DefaultAuthorityHost  = "https://login.microsoftonline.com"
+	DefaultTimeout        = 30 * time.Second
+	DefaultAttemptTimeout = 10 * time.Second
+	DefaultMaxAttempts    = 3
+	DefaultRetryBackoff   = time.Second
+	DefaultScope          = "https://management.azure.com/.default"
+)
+
+// Exchanger exchanges external OIDC tokens for Azure AD access
+// tokens. The zero value is ready to use and applies the default
+// timeouts and retry settings.
+type Exchanger struct {
+	// Client is the HTTP client used to call the token endpoint.
+	Client *http.Client
+
+	// Timeout bounds the entire exchange, including retries.
+	Timeout time.Duration
+
+	// AttemptTimeout bounds each individual token request.
+	AttemptTimeout time.Duration
+
+	// MaxAttempts is the maximum number of token requests made
+	// before giving up on transient failures.
+	MaxAttempts int
+
+	// RetryBackoff is the base delay between attempts. The delay
+	// grows linearly with the attempt number.
+	RetryBackoff time.Duration
+
+	// Region selects the regional (ESTS-R) token endpoint, such
+	// as westus2. The global authority is used when empty.
+	Region string
+
+	// HedgeDelay enables hedged requests when a region is set. If
+	// the regional endpoint has not succeeded after the delay, the
+	// global authority is raced against it.
+	HedgeDelay time.Duration
+
+	// Discovery resolves the token endpoint from the tenant's
+	// openid-configuration document instead of deriving it.
+	Discovery bool
+
+	// DiscoveryCacheDir is where discovery documents are memoized.
+	// Documents are not memoized when empty.
+	DiscoveryCacheDir string
+
+	// DiscoveryCacheKey authenticates the memoized discovery
+	// documents with HMAC-SHA256, so a document rewritten by another
+	// process cannot redirect the assertion. Documents are not
+	// memoized when empty.
+	DiscoveryCacheKey []byte
+
+	// AllowedHosts restricts the hosts the assertion may be sent
+	// to. Any host is allowed when empty.
+	AllowedHosts []string
+
+	// ClientRequestID returns the client-request-id header of a
+	// token request, so requests can be correlated with Azure AD
+	// sign-in logs. It is called for every attempt, so retries and
+	// failover hosts are told apart. No header is sent when nil.
+	ClientRequestID func() string
+}
+
+// Exchange exchanges an external OIDC token for an Azure AD access
+// token, retrying transient failures until the overall timeout or
+// the maximum number of attempts is reached.
+func (e *Exchanger) Exchange(ctx context.Context, oidcToken, tenantID, clientID, scope, authorityHost string) (*TokenResponse, error) {
+	hooks.secret(oidcToken)
+	return e.exchange(ctx, tenantID, clientID, scope, authorityHost, []formField{
+		{"client_assertion", oidcToken},
+		{"client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		{"grant_type", "client_credentials"},
+	})
+}
+
+// ExchangeOnBehalfOf exchanges an access token for a token to a
+// downstream API using the on-behalf-of grant. The downstream client
+// authenticates with the external OIDC token, which requires a
+// federated credential on the downstream application.
+func (e *Exchanger) ExchangeOnBehalfOf(ctx context.Context, accessToken, oidcToken, tenantID, clientID, scope, authorityHost string) (*TokenResponse, error) {
+	hooks.secret(accessToken)
+	hooks.secret(oidcToken)
+	return e.exchange(ctx, tenantID, clientID, scope, authorityHost, []formField{
+		{"assertion", accessToken},
+		{"client_assertion", oidcToken},
+		{"client_assertion_type", "urn:ietf:params:oauth:client-assertion-type:jwt-bearer"},
+		{"grant_type", "urn:ietf:params:oauth:grant-type:jwt-bearer"},
+		{"requested_token_use", "on_behalf_of"},
+	})
+}
+
+// ExchangeClientSecret requests an access token for the application
+// with its client secret, using the client credentials grant.
+func (e *Exchanger) ExchangeClientSecret(ctx context.Context, secret, tenantID, clientID, scope, authorityHost string) (*TokenResponse, error) {
+	hooks.secret(secret)
+	return e.exchange(ctx, tenantID, clientID, scope, authorityHost, []formField{
+		{"client_secret", secret},
+		{"grant_type", "client_credentials"},
+	})
+}
+
+// exchange requests a token with the grant-specific form fields,
+// trying each authority host in order.
+func (e *Exchanger) exchange(ctx context.Context, tenantID, clientID, scope, authorityHost string, grant []formField) (*TokenResponse, error) {
+	// Create context with the overall timeout
+	ctx, cancel := context.WithTimeout(ctx, e.timeout())
+	defer cancel()
+
+	// Apply default values if not provided
+	hosts := SplitAuthorityHosts(authorityHost)
+	if len(hosts) == 0 {
+		hosts = []string{DefaultAuthorityHost}
+	}
+	if strings.TrimSpace(scope) == "" {
+		scope = DefaultScope
+	}
+
+	log := Logger(ctx).WithFields(logrus.Fields{"tenant": tenantID, "client": clientID, "scope": scope})
+	ctx = WithLogger(ctx, log)
+	log.Debugf("client_id: %s", clientID)
+	log.Debugf("scope: %s", scope)
+	log.Debugf("azure_authority_host: %s", strings.Join(hosts, ", "))
+
+	// Prepare request body. The encoded body is wiped once the
+	// exchange completes; the assertion string it was built from is
+	// owned by the caller.
+	fields := append(grant, formField{"client_id", clientID}, formField{"scope", scope})
+	body := encodeForm(fields...)
+	defer wipe(body)
+
+	// Try each authority host in order, failing over to the next
+	// host only when the failure is transient. Each host gets an
+	// equal share of the remaining time, so a hanging host cannot
+	// run out the clock on the hosts after it.
+	deadline, _ := ctx.Deadline()
+	for i, host := range hosts {
+		hostCtx, cancelHost := context.WithTimeout(ctx, time.Until(deadline)/time.Duration(len(hosts)-i))
+		tokenResp, err := e.exchangeAt(hostCtx, host, tenantID, body)
+		cancelHost()
+		if err == nil {
+			return tokenResp, nil
+		}
+		var retryErr *RetryableError
+		if i == len(hosts)-1 || !errors.As(err, &retryErr) || ctx.Err() != nil {
+			return nil, err
+		}
+		log.Warnf("authority host %s failed: %s, failing over to %s", host, err, hosts[i+1])
+	}
+	return nil, errors.New("no authority host configured")
+}
+
+// exchangeAt requests a token from a single authority host, using
+// the regional endpoint and hedging when configured.
+func (e *Exchanger) exchangeAt(ctx context.Context, authorityHost, tenantID string, body []byte) (*TokenResponse, error) {
+	tokenEndpoint := TokenEndpoint(authorityHost, tenantID)
+	if e.Discovery {
+		config, err := e.discover(ctx, TenantDiscoveryURL(authorityHost, tenantID))
+		if err != nil {
+			return nil, err
+		}
+		if config.TokenEndpoint == "" {
+			return nil, fmt.Errorf("discovery metadata for tenant %s has no token endpoint", tenantID)
+		}
+		tokenEndpoint = config.TokenEndpoint
+	}
+	Logger(ctx).Debugf("token endpoint: %s", tokenEndpoint)
+
+	if e.Region == "" {
+		return e.exchangeWithRetry(ctx, tokenEndpoint, body)
+	}
+
+	regionalEndpoint := TokenEndpoint(RegionalAuthorityHost(authorityHost, e.Region), tenantID)
+	Logger(ctx).Debugf("regional token endpoint: %s", regionalEndpoint)
+	if e.HedgeDelay <= 0 {
+		return e.exchangeWithRetry(ctx, regionalEndpoint, body)
+	}
+	return e.hedge(ctx, regionalEndpoint, tokenEndpoint, body)
+}
+
+// SplitAuthorityHosts parses a comma-separated list of authority
+// hosts, dropping empty entries and trailing slashes.
+func SplitAuthorityHosts(value string) []string {
+	var hosts []string
+	for _, host := range strings.Split(value, ",") {
+		if host = strings.TrimRight(strings.TrimSpace(host), "/"); host != "" {
+			hosts = append(hosts, host)
+		}
+	}
+	return hosts
+}
+
+// exchangeWithRetry requests a token from the endpoint, retrying
+// transient failures.
+func (e *Exchanger) exchangeWithRetry(ctx context.Context, tokenEndpoint string, body []byte) (*TokenResponse, error) {
+	if err := CheckEndpoint(tokenEndpoint, e.AllowedHosts); err != nil {
+		return nil, err
+	}
+
+	maxAttempts := e.maxAttempts()
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		// The lines logged during the attempt carry its number.
+		log := Logger(ctx).WithField("attempt", attempt)
+		clientRequestID := e.clientRequestID()
+		if clientRequestID != "" {
+			log = log.WithField("client_request_id", clientRequestID)
+		}
+		attemptCtx := WithLogger(ctx, log)
+		attemptCtx, done := hooks.attempt(attemptCtx, attempt, tokenEndpoint)
+		tokenResp, err := e.attempt(attemptCtx, tokenEndpoint, clientRequestID, body)
+		done(err)
+		log = Logger(attemptCtx).WithField("duration_ms", time.Since(start).Milliseconds())
+		if err == nil {
+			log.Debugf("attempt %d of %d succeeded", attempt, maxAttempts)
+			return tokenResp, nil
+		}
+		var retryErr *RetryableError
+		if !errors.As(err, &retryErr) || attempt >= maxAttempts {
+			return nil, err
+		}
+
+		delay := time.Duration(attempt) * e.retryBackoff()
+		log.Debugf("attempt %d of %d failed: %s, retrying in %s", attempt, maxAttempts, err, delay)
+		select {
+		case <-ctx.Done():
+			return nil, fmt.Errorf("%w (giving up after %d attempts: %s)", err, attempt, ctx.Err())
+		case <-time.After(delay):
+		}
+	}
+}
+
+// TokenEndpoint returns the OAuth2 v2.0 token endpoint for the tenant.
+func TokenEndpoint(authorityHost, tenantID string) string {
+	return fmt.Sprintf("%s/%s/oauth2/v2.0/token", authorityHost, tenantID)
+}
+
+// attempt makes a single token request bounded by the attempt timeout.
+func (e *Exchanger) attempt(ctx context.Context, tokenEndpoint, clientRequestID string, body []byte) (*TokenResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, e.attemptTimeout())
+	defer cancel()
+
+	// Make HTTP request
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tokenEndpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Accept", "application/json")
+	if clientRequestID != "" {
+		req.Header.Set("client-request-id", clientRequestID)
+		req.Header.Set("return-client-request-id", "true")
+	}
+
+	resp, err := WithoutRedirects(e.HTTPClient()).Do(req)
+	if err != nil {
+		return nil, &RetryableError{&NetworkError{fmt.Errorf("failed to exchange token: %w", err)}}
+	}
+	defer drainAndClose(resp.Body)
+	if err := CheckRedirect(resp); err != nil {
+		return nil, err
+	}
+
+	// Parse response
+	if resp.StatusCode != http.StatusOK {
+		// Limit error body to avoid logging large payloads
+		var azureErr ErrorResponse
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		_ = json.Unmarshal(data, &azureErr)
+		err := &AuthError{
+			StatusCode:      resp.StatusCode,
+			Status:          resp.Status,
+			Code:            azureErr.Error,
+			Description:     SanitizeErrorDescription(azureErr.ErrorDescription),
+			ErrorCodes:      azureErr.ErrorCodes,
+			TraceID:         azureErr.TraceID,
+			CorrelationID:   azureErr.CorrelationID,
+			RequestID:       resp.Header.Get("x-ms-request-id"),
+			ClientRequestID: clientRequestID,
+		}
+		// Report the ID that was sent, which Azure AD records in
+		// the sign-in logs, and the echoed one only without it.
+		if err.ClientRequestID == "" {
+			err.ClientRequestID = resp.Header.Get("client-request-id")
+		}
+		if azureErr.Error == "" && len(bytes.TrimSpace(data)) > 0 {
+			err.ContentType = resp.Header.Get("Content-Type")
+			if err.ContentType == "" {
+				err.ContentType = "no content type"
+			}
+			err.Snippet = responseSnippet(data)
+		}
+		if IsRetryableStatus(resp.StatusCode) {
+			return nil, &RetryableError{err}
+		}
+		return nil, err
+	}
+
+	// Check the response is JSON before reading it, so a misrouted
+	// endpoint answering with a page fails with a clear message.
+	if err := checkJSONContentType(resp.Header.Get("Content-Type")); err != nil {
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return nil, fmt.Errorf("unexpected token response %s: %w, the token endpoint may be misrouted: %q", resp.Status, err, responseSnippet(data))
+	}
+
+	// Read the response into a buffer that is wiped after decoding.
+	// The decoded access token is a string and is not wiped.
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxTokenResponseSize+1))
+	defer wipe(data)
+	if err != nil {
+		return nil, &RetryableError{&NetworkError{fmt.Errorf("failed to read response: %w", err)}}
+	}
+	if len(data) > maxTokenResponseSize {
+		return nil, fmt.Errorf("token response exceeds %d bytes, the token endpoint may be misrouted", maxTokenResponseSize)
+	}
+	var tokenResp TokenResponse
+	if err := json.Unmarshal(data, &tokenResp); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	hooks.secret(tokenResp.AccessToken)
+	hooks.secret(tokenResp.RefreshToken)
+
+	return &tokenResp, nil
+}
+
+// HTTPClient returns the HTTP client of the exchanger, the default
+// client when none is set.
+func (e *Exchanger) HTTPClient() *http.Client {
+	if e.Client != nil {
+		return e.Client
+	}
+	return http.DefaultClient
+}
+
+func (e *Exchanger) timeout() time.Duration {
+	if e.Timeout > 0 {
+		return e.Timeout
+	}
+	return DefaultTimeout
+}
+
+func (e *Exchanger) attemptTimeout() time.Duration {
+	if e.AttemptTimeout > 0 {
+		return e.AttemptTimeout
+	}
+	return DefaultAttemptTimeout
+}
+
+func (e *Exchanger) clientRequestID() string {
+	if e.ClientRequestID == nil {
+		return ""
+	}
+	return e.ClientRequestID()
+}
+
+func (e *Exchanger) maxAttempts() int {
+	if e.MaxAttempts > 0 {
+		return e.MaxAttempts
+	}
+	return DefaultMaxAttempts
+}
+
+func (e *Exchanger) retryBackoff() time.Duration {
+	if e.RetryBackoff > 0 {
+		return e.RetryBackoff
+	}
+	return DefaultRetryBackoff
+}
+
+// maxTokenResponseSize bounds the size of a token response. Access
+// tokens are a few kilobytes, even with many group claims.
+const maxTokenResponseSize = 256 << 10
+
+// checkJSONContentType checks the content type is a JSON media type.
+func checkJSONContentType(contentType string) error {
+	if contentType == "" {
+		return errors.New("response has no content type")
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return fmt.Errorf("invalid content type %q", contentType)
+	}
+	if mediaType != "application/json" && !strings.HasSuffix(mediaType, "+json") {
+		return fmt.Errorf("content type %s is not JSON", mediaType)
+	}
+	return nil
+}
+
+// markupPattern matches HTML and XML tags.
+var markupPattern = regexp.MustCompile(`<[^>]*>`)
+
+// responseSnippet returns a short, single-line excerpt of a response
+// body for diagnostics, with markup and control characters removed
+// and secrets redacted.
+func responseSnippet(body []byte) string {
+	text := markupPattern.ReplaceAllString(string(body), " ")
+	text = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || r == utf8.RuneError {
+			return ' '
+		}
+		return r
+	}, text)
+	text = strings.Join(strings.Fields(text), " ")
+	return SanitizeErrorDescription(hooks.redact(text))
+}
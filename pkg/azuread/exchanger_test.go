@@ -0,0 +1,251 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package azuread
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestExchange_NonAzureErrorResponse(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		w.WriteHeader(http.StatusForbidden)
+		_, _ = w.Write([]byte("<html>\n<head><title>Access Denied</title></head>\n<body><h1>Blocked by   policy</h1></body></html>"))
+	}))
+	defer srv.Close()
+
+	_, err := new(Exchanger).Exchange(context.Background(), "id-token", "mytenant", "client", DefaultScope, srv.URL)
+	var authErr *AuthError
+	if !errors.As(err, &authErr) {
+		t.Fatalf("expected AuthError, got %v", err)
+	}
+	if authErr.Snippet != "Access Denied Blocked by policy" || authErr.ContentType != "text/html; charset=utf-8" {
+		t.Errorf("unexpected error details: %+v", authErr)
+	}
+	if !strings.Contains(err.Error(), "non-Azure response 403 Forbidden") || !strings.Contains(err.Error(), "Blocked by policy") {
+		t.Errorf("unexpected error message: %v", err)
+	}
+
+	if got := responseSnippet([]byte(strings.Repeat("x", 300))); len(got) != 203 {
+		t.Errorf("snippet not truncated: %d bytes", len(got))
+	}
+}
+
+func TestExchange_ResponseHardening(t *testing.T) {
+	for name, tc := range map[string]struct {
+		contentType string
+		body        string
+		want        string
+	}{
+		"html":      {"text/html", "<html><body>Sign in</body></html>", `content type text/html is not JSON, the token endpoint may be misrouted: "Sign in"`},
+		"untyped":   {"", `{"access_token":"token"}`, "response has no content type"},
+		"oversized": {"application/json", `{"access_token":"` + strings.Repeat("x", maxTokenResponseSize) + `"}`, "token response exceeds"},
+	} {
+		t.Run(name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header()["Content-Type"] = []string{tc.contentType}
+				_, _ = w.Write([]byte(tc.body))
+			}))
+			defer srv.Close()
+
+			_, err := new(Exchanger).Exchange(context.Background(), "id-token", "mytenant", "client", DefaultScope, srv.URL)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Fatalf("expected error containing %q, got %v", tc.want, err)
+			}
+		})
+	}
+
+	for _, contentType := range []string{"application/json", "application/json; charset=utf-8", "application/problem+json"} {
+		if err := checkJSONContentType(contentType); err != nil {
+			t.Errorf("%s: %v", contentType, err)
+		}
+	}
+}
+
+func TestRegionalAuthorityHost(t *testing.T) {
+	tests := []struct {
+		host, region, want string
+	}{
+		{"https://login.microsoftonline.com", "westus2", "https://westus2.login.microsoft.com"},
+		{"https://login.microsoftonline.us", "usgovvirginia", "https://usgovvirginia.login.microsoftonline.us"},
+		{"https://login.microsoftonline.com/", "WestEurope", "https://westeurope.login.microsoft.com"},
+	}
+	for _, tt := range tests {
+		if got := RegionalAuthorityHost(tt.host, tt.region); got != tt.want {
+			t.Errorf("RegionalAuthorityHost(%q, %q) = %q, want %q", tt.host, tt.region, got, tt.want)
+		}
+	}
+}
+
+func TestExchange_Hedge(t *testing.T) {
+	tokenHandler := func(token string, delay time.Duration) http.HandlerFunc {
+		return func(w http.ResponseWriter, r *http.Request) {
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(delay):
+			}
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"` + token + `"}`))
+		}
+	}
+
+	slow := httptest.NewServer(tokenHandler("slow", time.Second))
+	defer slow.Close()
+	fast := httptest.NewServer(tokenHandler("fast", 0))
+	defer fast.Close()
+
+	e := &Exchanger{HedgeDelay: 20 * time.Millisecond}
+	token, err := e.hedge(context.Background(), slow.URL, fast.URL, nil)
+	if err != nil {
+		t.Fatalf("hedge returned error: %v", err)
+	}
+	if token.AccessToken != "fast" {
+		t.Fatalf("expected the hedged request to win, got %q", token.AccessToken)
+	}
+
+	// a fast regional response wins without hedging
+	e.HedgeDelay = time.Second
+	token, err = e.hedge(context.Background(), fast.URL, slow.URL, nil)
+	if err != nil || token.AccessToken != "fast" {
+		t.Fatalf("unexpected result: %+v, %v", token, err)
+	}
+}
+
+func TestExchange_HedgeErrors(t *testing.T) {
+	rejected := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"invalid_client","error_description":"AADSTS700016: not found","error_codes":[700016]}`))
+	}))
+	defer rejected.Close()
+	unavailable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer unavailable.Close()
+
+	e := &Exchanger{HedgeDelay: time.Second, MaxAttempts: 1}
+	_, err := e.hedge(context.Background(), rejected.URL, unavailable.URL, nil)
+	if err == nil {
+		t.Fatalf("expected hedge to fail")
+	}
+	var authErr *AuthError
+	if !errors.As(err, &authErr) || !authErr.HasErrorCode(700016) || !errors.Is(err, ErrAuth) {
+		t.Errorf("expected the Azure AD rejection to be kept, got %v", err)
+	}
+	var retryErr *RetryableError
+	if !errors.As(err, &retryErr) {
+		t.Errorf("expected the transient failure to be kept, got %v", err)
+	}
+}
+
+func TestEncodeForm(t *testing.T) {
+	body := encodeForm(
+		formField{"client_assertion", "a.b-c_d~e"},
+		formField{"scope", "https://management.azure.com/.default openid"},
+		formField{"client_secret", "p@ss/w%rd+="},
+	)
+	want := url.Values{
+		"client_assertion": {"a.b-c_d~e"},
+		"scope":            {"https://management.azure.com/.default openid"},
+		"client_secret":    {"p@ss/w%rd+="},
+	}
+	if got, err := url.ParseQuery(string(body)); err != nil || !reflect.DeepEqual(got, want) {
+		t.Fatalf("encodeForm() = %q, want %q", body, want.Encode())
+	}
+	// the body must have been allocated at its exact length, or
+	// appending left unwiped copies of the values behind
+	if len(body) != cap(body) {
+		t.Errorf("encodeForm() len = %d, cap = %d", len(body), cap(body))
+	}
+	if body := encodeForm(); len(body) != 0 {
+		t.Errorf("encodeForm() = %q, want empty", body)
+	}
+}
+
+func TestAppendFormValue(t *testing.T) {
+	var body []byte
+	body = appendFormValue(body, "client_assertion", "a.b-c_d~e")
+	body = appendFormValue(body, "scope", "https://management.azure.com/.default openid")
+	want := url.Values{
+		"client_assertion": {"a.b-c_d~e"},
+		"scope":            {"https://management.azure.com/.default openid"},
+	}.Encode()
+	if string(body) != want {
+		t.Fatalf("appendFormValue() = %q, want %q", body, want)
+	}
+
+	wipe(body)
+	for _, b := range body {
+		if b != 0 {
+			t.Fatalf("wipe left secret material in the buffer: %q", body)
+		}
+	}
+}
+
+func TestCheckEndpoint(t *testing.T) {
+	tests := []struct {
+		name     string
+		endpoint string
+		allowed  []string
+		wantErr  bool
+	}{
+		{name: "https", endpoint: "https://login.microsoftonline.com"},
+		{name: "loopback http", endpoint: "http://127.0.0.1:8080"},
+		{name: "plain http", endpoint: "http://login.example.com", wantErr: true},
+		{name: "unsupported scheme", endpoint: "ftp://login.example.com", wantErr: true},
+		{name: "allowed", endpoint: "https://login.microsoftonline.us/tenant/oauth2/v2.0/token", allowed: []string{"login.microsoftonline.com", "login.microsoftonline.us"}},
+		{name: "wildcard", endpoint: "https://westus2.login.microsoft.com", allowed: []string{"*.login.microsoft.com"}},
+		{name: "not allowed", endpoint: "https://attacker.example.com", allowed: []string{"login.microsoftonline.com"}, wantErr: true},
+		{name: "suffix is not a subdomain", endpoint: "https://evillogin.microsoft.com", allowed: []string{"*.login.microsoft.com"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := CheckEndpoint(tt.endpoint, tt.allowed)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("CheckEndpoint() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSetHooks(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"access-token"}`))
+	}))
+	defer srv.Close()
+
+	var secrets []string
+	var attempts []string
+	SetHooks(Hooks{
+		Secret: func(secret string) { secrets = append(secrets, secret) },
+		Attempt: func(ctx context.Context, attempt int, endpoint string) (context.Context, func(error)) {
+			return ctx, func(err error) {
+				attempts = append(attempts, endpoint)
+				if err != nil {
+					t.Errorf("attempt %d failed: %v", attempt, err)
+				}
+			}
+		},
+	})
+	t.Cleanup(func() { SetHooks(Hooks{}) })
+
+	if _, err := new(Exchanger).Exchange(context.Background(), "id-token", "mytenant", "client", DefaultScope, srv.URL); err != nil {
+		t.Fatalf("Exchange returned error: %v", err)
+	}
+	if strings.Join(secrets, ",") != "id-token,access-token," {
+		t.Errorf("unexpected secrets %q", secrets)
+	}
+	if want := TokenEndpoint(srv.URL, "mytenant"); len(attempts) != 1 || attempts[0] != want {
+		t.Errorf("unexpected attempts %q, want %q", attempts, want)
+	}
+}
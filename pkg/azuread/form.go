@@ -0,0 +1,89 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package azuread
+
+// wipe zeroes a transient buffer, such as the encoded form body or
+// the raw token response, once it has been used. It only clears that
+// copy: the assertion and the access token are held as strings by the
+// caller and the TokenResponse, and those stay in memory until they
+// are garbage collected.
+func wipe(b []byte) {
+	clear(b)
+}
+
+// formField is a key=value pair of a form body.
+type formField struct {
+	key, value string
+}
+
+// encodeForm URL-encodes the fields into a buffer allocated at the
+// exact encoded length. Appending never outgrows the buffer, so it
+// holds the only encoded copy of the values and wiping it leaves no
+// stale copies behind. The value strings themselves cannot be wiped.
+func encodeForm(fields ...formField) []byte {
+	n := len(fields) - 1
+	for _, f := range fields {
+		n += queryEscapeLen(f.key) + 1 + queryEscapeLen(f.value)
+	}
+	body := make([]byte, 0, max(n, 0))
+	for _, f := range fields {
+		body = appendFormValue(body, f.key, f.value)
+	}
+	return body
+}
+
+// appendFormValue appends a URL-encoded key=value pair to the form
+// body without routing the value through string formatting. Like
+// append, it reallocates when dst lacks capacity and leaves the old
+// array unwiped, so secret values are encoded with encodeForm.
+func appendFormValue(dst []byte, key, value string) []byte {
+	if len(dst) > 0 {
+		dst = append(dst, '&')
+	}
+	dst = appendQueryEscape(dst, key)
+	dst = append(dst, '=')
+	return appendQueryEscape(dst, value)
+}
+
+// queryEscapeLen returns the length of s escaped by
+// appendQueryEscape.
+func queryEscapeLen(s string) int {
+	n := 0
+	for i := 0; i < len(s); i++ {
+		if shouldEscape(s[i]) {
+			n += 3
+		} else {
+			n++
+		}
+	}
+	return n
+}
+
+// shouldEscape reports whether the byte is percent-encoded in a URL
+// query. Spaces are not, they are encoded as '+'.
+func shouldEscape(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9',
+		c == '-', c == '_', c == '.', c == '~', c == ' ':
+		return false
+	}
+	return true
+}
+
+// appendQueryEscape appends s escaped for use in a URL query,
+// matching url.QueryEscape.
+func appendQueryEscape(dst []byte, s string) []byte {
+	const hex = "0123456789ABCDEF"
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == ' ':
+			dst = append(dst, '+')
+		case shouldEscape(c):
+			dst = append(dst, '%', hex[c>>4], hex[c&15])
+		default:
+			dst = append(dst, c)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,89 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package azuread
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// RegionalAuthorityHost returns the regional (ESTS-R) authority
+// host for the region. The public cloud uses login.microsoft.com
+// for regional endpoints; other clouds prefix the region to the
+// configured host.
+func RegionalAuthorityHost(authorityHost, region string) string {
+	u, err := url.Parse(authorityHost)
+	if err != nil || u.Host == "" {
+		return authorityHost
+	}
+	host := u.Host
+	if strings.EqualFold(host, "login.microsoftonline.com") {
+		host = "login.microsoft.com"
+	}
+	u.Host = strings.ToLower(region) + "." + host
+	return strings.TrimRight(u.String(), "/")
+}
+
+// hedge requests a token from the regional endpoint and, if it has
+// not succeeded after the hedge delay or fails earlier, races the
+// global endpoint against it. The first successful response wins
+// and the slower request is cancelled. hedge does not return until
+// every request has finished, so the caller may wipe the body. When
+// every endpoint fails, the typed errors of the endpoints are joined
+// so they still match with errors.Is and errors.As.
+func (e *Exchanger) hedge(ctx context.Context, regionalEndpoint, globalEndpoint string, body []byte) (*TokenResponse, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	type result struct {
+		endpoint string
+		token    *TokenResponse
+		err      error
+	}
+	results := make(chan result, 2)
+	start := func(endpoint string) {
+		go func() {
+			token, err := e.exchangeWithRetry(ctx, endpoint, body)
+			results <- result{endpoint: endpoint, token: token, err: err}
+		}()
+	}
+
+	start(regionalEndpoint)
+	timer := time.NewTimer(e.HedgeDelay)
+	defer timer.Stop()
+
+	var errs []error
+	pending, hedged := 1, false
+	defer func() {
+		cancel()
+		for ; pending > 0; pending-- {
+			<-results
+		}
+	}()
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if !hedged {
+				Logger(ctx).Debugf("regional endpoint has not responded after %s, hedging with %s", e.HedgeDelay, globalEndpoint)
+				start(globalEndpoint)
+				pending, hedged = pending+1, true
+			}
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				Logger(ctx).Debugf("token issued by %s", r.endpoint)
+				return r.token, nil
+			}
+			errs = append(errs, fmt.Errorf("%s: %w", r.endpoint, r.err))
+			if !hedged {
+				Logger(ctx).Debugf("regional endpoint failed, falling back to %s", globalEndpoint)
+				start(globalEndpoint)
+				pending, hedged = pending+1, true
+			}
+		}
+	}
+	return nil, fmt.Errorf("token exchange failed on all endpoints: %w", errors.Join(errs...))
+}
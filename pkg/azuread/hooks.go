@@ -0,0 +1,75 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package azuread
+
+import (
+	"context"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Hooks let the program embedding the package observe the exchange.
+// Every hook is optional.
+type Hooks struct {
+	// Secret is called with every secret the exchange handles, such
+	// as the assertion and the issued tokens, so they can be redacted
+	// from logs.
+	Secret func(secret string)
+
+	// Redact returns the text with known secrets removed. It is
+	// applied to response excerpts included in errors.
+	Redact func(text string) string
+
+	// Attempt is called before every token request with its attempt
+	// number and endpoint. It returns the context of the request and
+	// a function called with the result of the request.
+	Attempt func(ctx context.Context, attempt int, endpoint string) (context.Context, func(error))
+}
+
+// hooks are the hooks installed with SetHooks.
+var hooks Hooks
+
+// SetHooks installs the hooks for every exchange of the process. It
+// is not safe to call concurrently with an exchange and is meant to
+// be called once, from an init function.
+func SetHooks(h Hooks) {
+	hooks = h
+}
+
+func (h Hooks) secret(secret string) {
+	if h.Secret != nil {
+		h.Secret(secret)
+	}
+}
+
+func (h Hooks) redact(text string) string {
+	if h.Redact != nil {
+		return h.Redact(text)
+	}
+	return text
+}
+
+func (h Hooks) attempt(ctx context.Context, attempt int, endpoint string) (context.Context, func(error)) {
+	if h.Attempt != nil {
+		return h.Attempt(ctx, attempt, endpoint)
+	}
+	return ctx, func(error) {}
+}
+
+// loggerKey is the context key of the logger.
+type loggerKey struct{}
+
+// WithLogger returns a context carrying the logger. The exchange logs
+// through it, so the lines carry the fields of the caller.
+func WithLogger(ctx context.Context, log *logrus.Entry) context.Context {
+	return context.WithValue(ctx, loggerKey{}, log)
+}
+
+// Logger returns the logger of the context, or a logger without
+// fields when there is none.
+func Logger(ctx context.Context) *logrus.Entry {
+	if log, ok := ctx.Value(loggerKey{}).(*logrus.Entry); ok {
+		return log
+	}
+	return logrus.NewEntry(logrus.StandardLogger())
+}
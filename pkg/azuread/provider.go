@@ -0,0 +1,200 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package azuread
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// TokenProvider acquires Azure AD access tokens from a credential.
+// Implementations must be safe for concurrent use.
+type TokenProvider interface {
+	// Token returns an access token for the scope.
+	Token(ctx context.Context, scope string) (*TokenResponse, error)
+}
+
+// DefaultIMDSEndpoint is the token endpoint of the Azure Instance
+// Metadata Service.
+const DefaultIMDSEndpoint = "http://169.254.169.254/metadata/identity/oauth2/token"
+
+// IMDSAPIVersion is the Instance Metadata Service API version.
+const IMDSAPIVersion = "2018-02-01"
+
+// AssertionProvider exchanges a client assertion, such as the OIDC
+// token of a pipeline, for access tokens of the application. It
+// requires a federated identity credential on the application.
+type AssertionProvider struct {
+	// Exchanger makes the token requests. The zero value of
+	// Exchanger is used when nil.
+	Exchanger *Exchanger
+
+	// TenantID, ClientID and AuthorityHost identify the
+	// application. AuthorityHost is a comma-separated list of hosts
+	// and defaults to DefaultAuthorityHost.
+	TenantID      string
+	ClientID      string
+	AuthorityHost string
+
+	// Assertion is the client assertion.
+	Assertion string
+}
+
+// Token exchanges the assertion for an access token for the scope.
+func (p *AssertionProvider) Token(ctx context.Context, scope string) (*TokenResponse, error) {
+	return exchanger(p.Exchanger).Exchange(ctx, p.Assertion, p.TenantID, p.ClientID, scope, p.AuthorityHost)
+}
+
+// CertificateProvider authenticates the application with a
+// certificate credential. Each token request carries a client
+// assertion signed with the private key of the certificate.
+type CertificateProvider struct {
+	// Exchanger makes the token requests. The zero value of
+	// Exchanger is used when nil.
+	Exchanger *Exchanger
+
+	// TenantID, ClientID and AuthorityHost identify the
+	// application. AuthorityHost is a comma-separated list of hosts
+	// and defaults to DefaultAuthorityHost.
+	TenantID      string
+	ClientID      string
+	AuthorityHost string
+
+	// Certificate is the certificate registered on the application
+	// and its RSA private key.
+	Certificate tls.Certificate
+}
+
+// Token signs a client assertion and exchanges it for an access
+// token for the scope. The assertion is addressed to the token
+// endpoint of the first authority host.
+func (p *CertificateProvider) Token(ctx context.Context, scope string) (*TokenResponse, error) {
+	hosts := SplitAuthorityHosts(p.AuthorityHost)
+	if len(hosts) == 0 {
+		hosts = []string{DefaultAuthorityHost}
+	}
+	assertion, err := signAssertion(p.Certificate, p.ClientID, TokenEndpoint(hosts[0], p.TenantID))
+	if err != nil {
+		return nil, err
+	}
+	return exchanger(p.Exchanger).Exchange(ctx, assertion, p.TenantID, p.ClientID, scope, p.AuthorityHost)
+}
+
+// SecretProvider authenticates the application with a client secret.
+type SecretProvider struct {
+	// Exchanger makes the token requests. The zero value of
+	// Exchanger is used when nil.
+	Exchanger *Exchanger
+
+	// TenantID, ClientID and AuthorityHost identify the
+	// application. AuthorityHost is a comma-separated list of hosts
+	// and defaults to DefaultAuthorityHost.
+	TenantID      string
+	ClientID      string
+	AuthorityHost string
+
+	// Secret is the client secret.
+	Secret string
+}
+
+// Token requests an access token for the scope with the secret.
+func (p *SecretProvider) Token(ctx context.Context, scope string) (*TokenResponse, error) {
+	return exchanger(p.Exchanger).ExchangeClientSecret(ctx, p.Secret, p.TenantID, p.ClientID, scope, p.AuthorityHost)
+}
+
+// ManagedIdentityProvider acquires access tokens of a managed
+// identity from the Instance Metadata Service. The request is never
+// proxied since the endpoint is link-local.
+type ManagedIdentityProvider struct {
+	// Client is the HTTP client used to call the endpoint. A client
+	// without proxy is used when nil.
+	Client *http.Client
+
+	// Endpoint is the token endpoint and defaults to
+	// DefaultIMDSEndpoint.
+	Endpoint string
+
+	// ClientID selects a user-assigned managed identity. The
+	// system-assigned identity is used when empty.
+	ClientID string
+
+	// Timeout bounds the request and defaults to
+	// DefaultAttemptTimeout, so a host without an Instance Metadata
+	// Service fails fast.
+	Timeout time.Duration
+}
+
+// Token requests an access token for the scope. The scope is sent
+// as the resource, without its /.default suffix.
+func (p *ManagedIdentityProvider) Token(ctx context.Context, scope string) (*TokenResponse, error) {
+	endpoint := p.Endpoint
+	if endpoint == "" {
+		endpoint = DefaultIMDSEndpoint
+	}
+	timeout := p.Timeout
+	if timeout <= 0 {
+		timeout = DefaultAttemptTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	query := url.Values{}
+	query.Set("api-version", IMDSAPIVersion)
+	query.Set("resource", strings.TrimSuffix(scope, "/.default"))
+	if p.ClientID != "" {
+		query.Set("client_id", p.ClientID)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint+"?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Metadata", "true")
+	client := p.Client
+	if client == nil {
+		client = &http.Client{Transport: &http.Transport{Proxy: nil}}
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, &NetworkError{err}
+	}
+	defer drainAndClose(resp.Body)
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxTokenResponseSize))
+	defer wipe(data)
+	if err != nil {
+		return nil, &NetworkError{fmt.Errorf("failed to read response: %w", err)}
+	}
+	if resp.StatusCode != http.StatusOK {
+		var body ErrorResponse
+		if json.Unmarshal(data, &body) == nil && body.Error != "" {
+			return nil, fmt.Errorf("%s: %s (%s)", resp.Status, body.Error, SanitizeErrorDescription(body.ErrorDescription))
+		}
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	token := new(TokenResponse)
+	if err := json.Unmarshal(data, token); err != nil {
+		return nil, fmt.Errorf("failed to decode response: %w", err)
+	}
+	if token.AccessToken == "" {
+		return nil, errors.New("response has no access token")
+	}
+	hooks.secret(token.AccessToken)
+	return token, nil
+}
+
+// exchanger returns the exchanger, or the zero value when nil.
+func exchanger(e *Exchanger) *Exchanger {
+	if e == nil {
+		return new(Exchanger)
+	}
+	return e
+}
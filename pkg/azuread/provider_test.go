@@ -0,0 +1,130 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package azuread
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// tokenServer returns a token endpoint that passes the form of each
+// request to check.
+func tokenServer(t *testing.T, check func(r *http.Request)) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := r.ParseForm(); err != nil {
+			t.Errorf("invalid form: %v", err)
+		}
+		check(r)
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"access-token"}`))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestSecretProvider(t *testing.T) {
+	srv := tokenServer(t, func(r *http.Request) {
+		if r.PostForm.Get("client_secret") != "secret" || r.PostForm.Get("grant_type") != "client_credentials" ||
+			r.PostForm.Get("client_assertion") != "" || r.PostForm.Get("scope") != "https://vault.azure.net/.default" {
+			t.Errorf("unexpected form: %v", r.PostForm)
+		}
+	})
+
+	var p TokenProvider = &SecretProvider{TenantID: "mytenant", ClientID: "client", AuthorityHost: srv.URL, Secret: "secret"}
+	token, err := p.Token(context.Background(), "https://vault.azure.net/.default")
+	if err != nil || token.AccessToken != "access-token" {
+		t.Fatalf("unexpected result: %+v, %v", token, err)
+	}
+}
+
+func TestCertificateProvider(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "client"},
+		NotBefore:    time.Now(),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var srv *httptest.Server
+	srv = tokenServer(t, func(r *http.Request) {
+		parts := strings.Split(r.PostForm.Get("client_assertion"), ".")
+		if len(parts) != 3 {
+			t.Fatalf("invalid assertion %q", r.PostForm.Get("client_assertion"))
+		}
+		digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+		signature, _ := base64.RawURLEncoding.DecodeString(parts[2])
+		if err := rsa.VerifyPKCS1v15(&key.PublicKey, crypto.SHA256, digest[:], signature); err != nil {
+			t.Errorf("invalid signature: %v", err)
+		}
+		var header, claims map[string]interface{}
+		data, _ := base64.RawURLEncoding.DecodeString(parts[0])
+		_ = json.Unmarshal(data, &header)
+		data, _ = base64.RawURLEncoding.DecodeString(parts[1])
+		_ = json.Unmarshal(data, &claims)
+		if header["alg"] != "RS256" || header["x5t"] == "" {
+			t.Errorf("unexpected header: %v", header)
+		}
+		if claims["aud"] != TokenEndpoint(srv.URL, "mytenant") || claims["iss"] != "client" || claims["sub"] != "client" {
+			t.Errorf("unexpected claims: %v", claims)
+		}
+	})
+
+	p := &CertificateProvider{
+		TenantID:      "mytenant",
+		ClientID:      "client",
+		AuthorityHost: srv.URL,
+		Certificate:   tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key},
+	}
+	if _, err := p.Token(context.Background(), DefaultScope); err != nil {
+		t.Fatalf("Token returned error: %v", err)
+	}
+
+	p.Certificate = tls.Certificate{}
+	if _, err := p.Token(context.Background(), DefaultScope); err == nil {
+		t.Fatal("expected an error without certificate")
+	}
+}
+
+func TestManagedIdentityProvider(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.Header.Get("Metadata") != "true" || query.Get("resource") != "https://vault.azure.net" ||
+			query.Get("client_id") != "identity" || query.Get("api-version") != IMDSAPIVersion {
+			t.Errorf("unexpected request: %s", r.URL)
+		}
+		_, _ = w.Write([]byte(`{"access_token":"access-token","expires_in":"3599","token_type":"Bearer"}`))
+	}))
+	defer srv.Close()
+
+	p := &ManagedIdentityProvider{Endpoint: srv.URL, ClientID: "identity"}
+	token, err := p.Token(context.Background(), "https://vault.azure.net/.default")
+	if err != nil {
+		t.Fatalf("Token returned error: %v", err)
+	}
+	if token.AccessToken != "access-token" || token.ExpiresIn != 3599 {
+		t.Errorf("unexpected token: %+v", token)
+	}
+}
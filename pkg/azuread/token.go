@@ -0,0 +1,204 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package azuread
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Error classes. Errors returned by the exchange that belong to a
+// class match its sentinel with errors.Is, and its type with
+// errors.As.
+var (
+	// ErrAuth matches an AuthError.
+	ErrAuth = errors.New("azure ad rejected the request")
+
+	// ErrNetwork matches a NetworkError.
+	ErrNetwork = errors.New("network error")
+)
+
+// TokenResponse represents the response from Azure AD token endpoint.
+type TokenResponse struct {
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	AccessToken  string `json:"access_token"`
+	RefreshToken string `json:"refresh_token,omitempty"`
+
+	// ExtExpiresIn is the extended lifetime of the token in seconds.
+	// Resources that support it keep accepting the token until then
+	// while Azure AD is unavailable.
+	ExtExpiresIn int `json:"ext_expires_in,omitempty"`
+
+	// ExpiresOn is the expiry of the token in seconds since the
+	// epoch, returned by the Instance Metadata Service and ADFS.
+	ExpiresOn int64 `json:"expires_on,omitempty"`
+
+	// Scope is the space-separated list of scopes granted, which
+	// may differ from the scopes requested.
+	Scope string `json:"scope,omitempty"`
+}
+
+// UnmarshalJSON decodes the token response, accepting the lifetimes
+// as numbers or as strings, which ADFS, Azure Stack and the Instance
+// Metadata Service return.
+func (r *TokenResponse) UnmarshalJSON(data []byte) error {
+	type tokenResponse TokenResponse
+	aux := struct {
+		*tokenResponse
+		ExpiresIn    json.RawMessage `json:"expires_in"`
+		ExtExpiresIn json.RawMessage `json:"ext_expires_in"`
+		ExpiresOn    json.RawMessage `json:"expires_on"`
+	}{tokenResponse: (*tokenResponse)(r)}
+	if err := json.Unmarshal(data, &aux); err != nil {
+		return err
+	}
+	expiresIn, err := decodeSeconds("expires_in", aux.ExpiresIn)
+	if err != nil {
+		return err
+	}
+	extExpiresIn, err := decodeSeconds("ext_expires_in", aux.ExtExpiresIn)
+	if err != nil {
+		return err
+	}
+	expiresOn, err := decodeSeconds("expires_on", aux.ExpiresOn)
+	if err != nil {
+		return err
+	}
+	r.ExpiresIn, r.ExtExpiresIn, r.ExpiresOn = int(expiresIn), int(extExpiresIn), expiresOn
+	return nil
+}
+
+// decodeSeconds decodes a number of seconds given as a number or as
+// a string. A missing or null value is zero.
+func decodeSeconds(name string, value json.RawMessage) (int64, error) {
+	value = bytes.TrimSpace(value)
+	if len(value) == 0 || string(value) == "null" {
+		return 0, nil
+	}
+	var seconds int64
+	if value[0] == '"' {
+		var text string
+		if err := json.Unmarshal(value, &text); err != nil {
+			return 0, err
+		}
+		n, err := strconv.ParseInt(strings.TrimSpace(text), 10, 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid %s %q", name, text)
+		}
+		return n, nil
+	}
+	err := json.Unmarshal(value, &seconds)
+	return seconds, err
+}
+
+// ExpiresAt returns the expiry of a token issued at the time, from
+// expires_in, or from expires_on when expires_in is missing.
+func (r *TokenResponse) ExpiresAt(issued time.Time) time.Time {
+	if r.ExpiresIn <= 0 && r.ExpiresOn > 0 {
+		return time.Unix(r.ExpiresOn, 0)
+	}
+	return issued.Add(time.Duration(r.ExpiresIn) * time.Second)
+}
+
+// ExtendedExpiresAt returns the extended expiry of a token issued at
+// the time, which is its expiry when Azure AD returned no extended
+// lifetime.
+func (r *TokenResponse) ExtendedExpiresAt(issued time.Time) time.Time {
+	expires := r.ExpiresAt(issued)
+	if extended := issued.Add(time.Duration(r.ExtExpiresIn) * time.Second); extended.After(expires) {
+		return extended
+	}
+	return expires
+}
+
+// ErrorResponse represents an error response from Azure AD.
+type ErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description"`
+	ErrorCodes       []int  `json:"error_codes"`
+	Timestamp        string `json:"timestamp"`
+	TraceID          string `json:"trace_id"`
+	CorrelationID    string `json:"correlation_id"`
+}
+
+// AuthError is returned when Azure AD rejects a token request. It
+// carries the identifiers Microsoft support needs to locate the
+// request.
+type AuthError struct {
+	StatusCode      int
+	Status          string
+	Code            string
+	Description     string
+	ErrorCodes      []int
+	TraceID         string
+	CorrelationID   string
+	RequestID       string
+	ClientRequestID string
+
+	// ContentType and Snippet describe a response that is not an
+	// Azure AD error, such as the HTML page of an egress proxy or
+	// firewall. Snippet is a truncated, sanitized excerpt.
+	ContentType string
+	Snippet     string
+}
+
+// Is reports whether the target is ErrAuth.
+func (e *AuthError) Is(target error) bool { return target == ErrAuth }
+
+// HasErrorCode reports whether Azure AD returned the AADSTS code.
+func (e *AuthError) HasErrorCode(code int) bool {
+	return slices.Contains(e.ErrorCodes, code)
+}
+
+func (e *AuthError) Error() string {
+	if e.Code == "" && e.Snippet != "" {
+		return fmt.Sprintf("token exchange failed: non-Azure response %s (%s): %q, a proxy or firewall may have answered instead of the authority", e.Status, e.ContentType, e.Snippet)
+	}
+	if e.Code == "" {
+		return fmt.Sprintf("token exchange failed: %s", e.Status)
+	}
+	return fmt.Sprintf("token exchange failed: %s - %s (status=%d)", e.Code, e.Description, e.StatusCode)
+}
+
+// NetworkError is returned when a request fails before a response
+// is received, such as on DNS, connection or TLS failures.
+type NetworkError struct {
+	Err error
+}
+
+func (e *NetworkError) Error() string        { return e.Err.Error() }
+func (e *NetworkError) Unwrap() error        { return e.Err }
+func (e *NetworkError) Is(target error) bool { return target == ErrNetwork }
+
+// RetryableError marks a failure as transient so the request can be
+// attempted again.
+type RetryableError struct {
+	Err error
+}
+
+func (e *RetryableError) Error() string { return e.Err.Error() }
+func (e *RetryableError) Unwrap() error { return e.Err }
+
+// IsRetryableStatus reports whether the HTTP status code indicates
+// a transient failure of the endpoint.
+func IsRetryableStatus(code int) bool {
+	return code == http.StatusTooManyRequests || code >= http.StatusInternalServerError
+}
+
+// SanitizeErrorDescription removes potentially sensitive information
+// from error messages.
+func SanitizeErrorDescription(desc string) string {
+	// Azure error descriptions are generally safe, but truncate if too long
+	if len(desc) > 200 {
+		return desc[:200] + "..."
+	}
+	return desc
+}
@@ -0,0 +1,43 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package azuread
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestTokenResponse_Lifetimes(t *testing.T) {
+	issued := time.Unix(1700000000, 0)
+	tests := []struct {
+		body             string
+		expires, extends int64
+		scope            string
+	}{
+		{`{"expires_in":3599,"ext_expires_in":7199,"scope":"https://graph.microsoft.com/User.Read"}`, 1700003599, 1700007199, "https://graph.microsoft.com/User.Read"},
+		{`{"expires_in":"3600","ext_expires_in":"10800"}`, 1700003600, 1700010800, ""},
+		{`{"expires_in":3600}`, 1700003600, 1700003600, ""},
+		{`{"expires_on":"1700001800"}`, 1700001800, 1700001800, ""},
+	}
+	for _, tt := range tests {
+		var token TokenResponse
+		if err := json.Unmarshal([]byte(tt.body), &token); err != nil {
+			t.Fatalf("%s: %v", tt.body, err)
+		}
+		if got := token.ExpiresAt(issued).Unix(); got != tt.expires {
+			t.Errorf("%s: ExpiresAt = %d, want %d", tt.body, got, tt.expires)
+		}
+		if got := token.ExtendedExpiresAt(issued).Unix(); got != tt.extends {
+			t.Errorf("%s: ExtendedExpiresAt = %d, want %d", tt.body, got, tt.extends)
+		}
+		if token.Scope != tt.scope {
+			t.Errorf("%s: Scope = %q, want %q", tt.body, token.Scope, tt.scope)
+		}
+	}
+
+	var token TokenResponse
+	if err := json.Unmarshal([]byte(`{"ext_expires_in":"soon"}`), &token); err == nil {
+		t.Error("expected an error for an invalid ext_expires_in")
+	}
+}
@@ -0,0 +1,124 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+// Package outputs writes step outputs to the key=value output files
+// of Harness and Drone, such as the files named by
+// HARNESS_OUTPUT_SECRET_FILE and DRONE_OUTPUT.
+package outputs
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/sirupsen/logrus"
+)
+
+// File writes key=value pairs to an output file.
+type File struct {
+	// Path is the path of the output file.
+	Path string
+
+	// Mode is the permission of the output file. The permissions of
+	// a pre-existing file are tightened to it, never loosened.
+	Mode os.FileMode
+
+	// Log receives the diagnostics of the writes, so they carry the
+	// fields of the caller. The standard logger is used when nil.
+	Log *logrus.Entry
+}
+
+// Write appends the key-value pair to the output file, creating the
+// file with the configured permissions and tightening the
+// permissions of a pre-existing file. A key already in the file, as
+// left by an earlier attempt of a retried step, has its line replaced
+// instead, so writing the same outputs again is idempotent.
+func (f *File) Write(key, value string) error {
+	file, err := os.OpenFile(f.Path, os.O_RDWR|os.O_CREATE, f.Mode)
+	if err != nil {
+		return fmt.Errorf("failed to open output file: %w", err)
+	}
+	defer file.Close()
+
+	// Permissions are only ever tightened, so a file shared by secret
+	// and non-secret outputs keeps the stricter mode.
+	if info, err := file.Stat(); err == nil && info.Mode().Perm()&^f.Mode != 0 {
+		mode := info.Mode().Perm() & f.Mode
+		if err := file.Chmod(mode); err != nil {
+			f.log().Warnf("failed to set output file permissions to %04o: %s", mode, err)
+		}
+	}
+
+	// Assemble the line in a buffer that is wiped after writing,
+	// keeping the value out of fmt formatting paths. The value
+	// string passed in is not wiped.
+	line := make([]byte, 0, len(key)+len(value)+2)
+	line = append(line, key...)
+	line = append(line, '=')
+	line = append(line, value...)
+	line = append(line, '\n')
+	defer clear(line)
+
+	content, err := io.ReadAll(file)
+	defer clear(content)
+	if err != nil {
+		return fmt.Errorf("failed to read output file: %w", err)
+	}
+	if replaced, ok := replaceLine(content, key, line); ok {
+		defer clear(replaced)
+		if err := file.Truncate(0); err != nil {
+			return fmt.Errorf("failed to write to env: %w", err)
+		}
+		if _, err := file.WriteAt(replaced, 0); err != nil {
+			return fmt.Errorf("failed to write to env: %w", err)
+		}
+		f.log().Debugf("output %s already written, replaced", key)
+		return nil
+	}
+
+	// A file left by another plugin may lack the trailing newline,
+	// which would glue the line onto its last value.
+	if len(content) > 0 && content[len(content)-1] != '\n' {
+		f.log().Debugf("output file has no trailing newline, adding one")
+		if _, err := file.Write([]byte{'\n'}); err != nil {
+			return fmt.Errorf("failed to write to env: %w", err)
+		}
+	}
+	if _, err := file.Write(line); err != nil {
+		return fmt.Errorf("failed to write to env: %w", err)
+	}
+	return nil
+}
+
+// log returns the logger of the file.
+func (f *File) log() *logrus.Entry {
+	if f.Log == nil {
+		return logrus.NewEntry(logrus.StandardLogger())
+	}
+	return f.Log
+}
+
+// replaceLine returns the output file content with the lines of the
+// key replaced by the line, reporting whether the key was found.
+func replaceLine(content []byte, key string, line []byte) ([]byte, bool) {
+	prefix := []byte(key + "=")
+	var out []byte
+	found := false
+	for rest := content; len(rest) > 0; {
+		current := rest
+		if i := bytes.IndexByte(rest, '\n'); i >= 0 {
+			current, rest = rest[:i+1], rest[i+1:]
+		} else {
+			rest = nil
+		}
+		if !bytes.HasPrefix(current, prefix) {
+			out = append(out, current...)
+			continue
+		}
+		if !found {
+			out = append(out, line...)
+			found = true
+		}
+	}
+	return out, found
+}
@@ -0,0 +1,34 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package outputs
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFile_Write(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "output.env")
+	if err := os.WriteFile(path, []byte("OTHER=value"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	f := &File{Path: path, Mode: 0600}
+	for _, kv := range [][2]string{{"KEY", "first"}, {"KEY", "second"}, {"NEXT", "value"}} {
+		if err := f.Write(kv[0], kv[1]); err != nil {
+			t.Fatalf("Write(%q) returned error: %v", kv[0], err)
+		}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "OTHER=value\nKEY=second\nNEXT=value\n"; string(data) != want {
+		t.Errorf("output file = %q, want %q", data, want)
+	}
+	if info, err := os.Stat(path); err != nil || info.Mode().Perm() != 0600 {
+		t.Errorf("unexpected permissions: %v, %v", info, err)
+	}
+}
@@ -0,0 +1,258 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/harness-community/drone-azure-oidc/pkg/azuread"
+)
+
+// acrUsername is the user name that authenticates to a container
+// registry with an ACR refresh token.
+const acrUsername = "00000000-0000-0000-0000-000000000000"
+
+// kanikoDockerConfig is the docker configuration directory read by
+// kaniko.
+const kanikoDockerConfig = "/kaniko/.docker"
+
+// registryAuth is the auths section shared by docker config.json and
+// the containers auth.json used by buildah and podman.
+type registryAuth struct {
+	Auths map[string]registryCredential `json:"auths"`
+}
+
+type registryCredential struct {
+	Auth string `json:"auth"`
+}
+
+// acrRegistryHost returns the host of the registry, accepting a
+// login server with or without scheme.
+func acrRegistryHost(registry string) string {
+	registry = strings.TrimPrefix(strings.TrimPrefix(registry, "https://"), "http://")
+	return strings.TrimRight(registry, "/")
+}
+
+// exchangeACRRefreshToken exchanges the Azure AD access token for an
+// ACR refresh token, used as the registry password.
+func exchangeACRRefreshToken(ctx context.Context, client *http.Client, registry, tenantID, accessToken string) (string, error) {
+	scheme := "https"
+	if azuread.IsLoopback(strings.Split(registry, ":")[0]) {
+		scheme = "http"
+	}
+	form := url.Values{}
+	form.Set("grant_type", "access_token")
+	form.Set("service", registry)
+	form.Set("tenant", tenantID)
+	form.Set("access_token", accessToken)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, scheme+"://"+registry+"/oauth2/exchange", strings.NewReader(form.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", &NetworkError{Err: err}
+	}
+	defer drainAndClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	var body struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return "", fmt.Errorf("failed to decode response: %w", err)
+	}
+	if body.RefreshToken == "" {
+		return "", errors.New("response has no refresh token")
+	}
+	return body.RefreshToken, nil
+}
+
+// registryAuthFiles returns the docker config.json and containers
+// auth.json paths to write. The docker configuration is read from
+// DOCKER_CONFIG, the kaniko directory in a kaniko image, or ~/.docker,
+// and the containers auth file from REGISTRY_AUTH_FILE, or under
+// XDG_RUNTIME_DIR or the home directory.
+func registryAuthFiles() []string {
+	home, _ := os.UserHomeDir()
+	dockerConfig := os.Getenv("DOCKER_CONFIG")
+	if dockerConfig == "" {
+		if _, err := os.Stat(filepath.Dir(kanikoDockerConfig)); err == nil {
+			dockerConfig = kanikoDockerConfig
+		} else {
+			dockerConfig = filepath.Join(home, ".docker")
+		}
+	}
+	authFile := os.Getenv("REGISTRY_AUTH_FILE")
+	if authFile == "" {
+		if dir := os.Getenv("XDG_RUNTIME_DIR"); dir != "" {
+			authFile = filepath.Join(dir, "containers", "auth.json")
+		} else {
+			authFile = filepath.Join(home, ".config", "containers", "auth.json")
+		}
+	}
+	return []string{filepath.Join(dockerConfig, "config.json"), authFile}
+}
+
+// writeRegistryAuth adds the credential for the registry to the auth
+// file, keeping the credentials of other registries.
+func writeRegistryAuth(path, registry, password string) error {
+	config := map[string]interface{}{}
+	if data, err := os.ReadFile(path); err == nil {
+		if err := json.Unmarshal(data, &config); err != nil {
+			return fmt.Errorf("failed to parse %s: %w", path, err)
+		}
+	}
+	auths := registryAuth{Auths: map[string]registryCredential{}}
+	if existing, ok := config["auths"]; ok {
+		data, _ := json.Marshal(existing)
+		_ = json.Unmarshal(data, &auths.Auths)
+	}
+	auths.Auths[registry] = registryCredential{
+		Auth: base64.StdEncoding.EncodeToString([]byte(acrUsername + ":" + password)),
+	}
+	config["auths"] = auths.Auths
+
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	defer wipe(data)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write %s: %w", path, err)
+	}
+	return nil
+}
+
+// writeACRCredentials exchanges the access token for an ACR refresh
+// token and writes it to the docker and containers auth files, so
+// kaniko, buildah and podman can push to the registry.
+func writeACRCredentials(ctx context.Context, args Args, client *http.Client, token *AzureTokenResponse) error {
+	registry := acrRegistryHost(args.ACRRegistry)
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+	ctx, span := startSpan(ctx, "acr_exchange")
+	refreshToken, err := exchangeACRRefreshToken(ctx, client, registry, args.TenantID, token.AccessToken)
+	span.End(err)
+	if err != nil {
+		return fmt.Errorf("failed to exchange token for registry %s: %w", registry, err)
+	}
+	redactSecret(refreshToken)
+
+	for _, path := range registryAuthFiles() {
+		if err := writeRegistryAuth(path, registry, refreshToken); err != nil {
+			return err
+		}
+		logger(ctx).Infof("wrote credentials for registry %s to %s", registry, path)
+	}
+	if args.ACRPullSecret != "" {
+		return writePullSecret(ctx, args, registry, refreshToken)
+	}
+	return nil
+}
+
+// defaultPullSecretName is the name of the generated pull secret.
+const defaultPullSecretName = "acr-pull"
+
+// pullSecretManifest is a kubernetes.io/dockerconfigjson secret.
+type pullSecretManifest struct {
+	APIVersion string            `json:"apiVersion"`
+	Kind       string            `json:"kind"`
+	Metadata   pullSecretMeta    `json:"metadata"`
+	Type       string            `json:"type"`
+	Data       map[string]string `json:"data"`
+}
+
+type pullSecretMeta struct {
+	Name      string `json:"name"`
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// verifyPullSecretName checks the name is a Kubernetes resource name.
+func verifyPullSecretName(name string) error {
+	if len(name) > 253 {
+		return fmt.Errorf("invalid acr-pull-secret-name %q, longer than 253 characters", name)
+	}
+	for i, c := range name {
+		if (c < 'a' || c > 'z') && (c < '0' || c > '9') && ((c != '-' && c != '.') || i == 0 || i == len(name)-1) {
+			return fmt.Errorf("invalid acr-pull-secret-name %q, expected lowercase letters, digits, '-' and '.'", name)
+		}
+	}
+	return nil
+}
+
+// writePullSecret writes a Kubernetes pull secret manifest for the
+// registry, and applies it with kubectl when requested, so GitOps
+// pipelines get short-lived pull secrets. The manifest is written as
+// JSON, which kubectl reads as YAML.
+func writePullSecret(ctx context.Context, args Args, registry, refreshToken string) error {
+	name := args.ACRPullSecretName
+	if name == "" {
+		name = defaultPullSecretName
+	}
+	config, err := json.Marshal(map[string]interface{}{
+		"auths": map[string]interface{}{
+			registry: map[string]string{
+				"username": acrUsername,
+				"password": refreshToken,
+				"auth":     base64.StdEncoding.EncodeToString([]byte(acrUsername + ":" + refreshToken)),
+			},
+		},
+	})
+	if err != nil {
+		return err
+	}
+	defer wipe(config)
+	data, err := json.MarshalIndent(pullSecretManifest{
+		APIVersion: "v1",
+		Kind:       "Secret",
+		Metadata:   pullSecretMeta{Name: name, Namespace: args.ACRPullSecretNamespace},
+		Type:       "kubernetes.io/dockerconfigjson",
+		Data:       map[string]string{".dockerconfigjson": base64.StdEncoding.EncodeToString(config)},
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	defer wipe(data)
+
+	path, err := filepath.Abs(args.ACRPullSecret)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %w", filepath.Dir(path), err)
+	}
+	if err := os.WriteFile(path, data, 0600); err != nil {
+		return fmt.Errorf("failed to write pull secret: %w", err)
+	}
+	logger(ctx).Infof("wrote pull secret %s for registry %s to %s", name, registry, path)
+	if output := plainOutput(ctx); output != nil {
+		if err := output.Write("AZURE_ACR_PULL_SECRET", path); err != nil {
+			return err
+		}
+	}
+
+	if args.ACRPullSecretApply {
+		out, err := runCLI(ctx, os.Environ(), "kubectl", "apply", "-f", path)
+		if err != nil {
+			return fmt.Errorf("kubectl apply failed: %w", err)
+		}
+		logger(ctx).Info(strings.TrimSpace(out))
+	}
+	return nil
+}
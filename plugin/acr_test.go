@@ -0,0 +1,160 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExec_ACRRegistry(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/oauth2/exchange":
+			if r.PostFormValue("grant_type") != "access_token" || r.PostFormValue("access_token") != "arm-token" ||
+				r.PostFormValue("tenant") != "12345678-1234-1234-1234-1234567890ab" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = w.Write([]byte(`{"refresh_token":"acr-refresh-token"}`))
+		default:
+			_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"arm-token"}`))
+		}
+	}))
+	defer srv.Close()
+	registry := strings.TrimPrefix(srv.URL, "http://")
+
+	dir := t.TempDir()
+	t.Setenv("HARNESS_OUTPUT_SECRET_FILE", filepath.Join(dir, "secret.env"))
+	t.Setenv("DRONE_OUTPUT", filepath.Join(dir, "out.env"))
+	t.Setenv("DOCKER_CONFIG", filepath.Join(dir, "docker"))
+	t.Setenv("REGISTRY_AUTH_FILE", filepath.Join(dir, "containers", "auth.json"))
+	if err := os.MkdirAll(filepath.Join(dir, "docker"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "docker", "config.json"), []byte(`{"auths":{"docker.io":{"auth":"b3RoZXI="}},"credsStore":"desktop"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	args := Args{
+		OIDCToken:     testOIDCToken,
+		TenantID:      "12345678-1234-1234-1234-1234567890ab",
+		ClientID:      "00000000-0000-0000-0000-000000000001",
+		AuthorityHost: srv.URL,
+		ACRRegistry:   "https://" + registry + "/",
+		Command:       `grep -q 127.0.0.1 "$DOCKER_CONFIG/config.json" && test -f "$REGISTRY_AUTH_FILE"`,
+		SkipAzLogin:   true,
+	}
+	if err := Exec(context.Background(), args); err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+
+	want := base64.StdEncoding.EncodeToString([]byte(acrUsername + ":acr-refresh-token"))
+	for _, path := range []string{filepath.Join(dir, "docker", "config.json"), filepath.Join(dir, "containers", "auth.json")} {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var config registryAuth
+		if err := json.Unmarshal(data, &config); err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		if got := config.Auths[registry].Auth; got != want {
+			t.Errorf("%s: auth for %s = %q, want %q", path, registry, got, want)
+		}
+		if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+			t.Errorf("%s: mode = %v, want 0600", path, info.Mode().Perm())
+		}
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "docker", "config.json"))
+	if !strings.Contains(string(data), `"docker.io"`) || !strings.Contains(string(data), `"credsStore": "desktop"`) {
+		t.Errorf("existing docker configuration not kept: %s", data)
+	}
+
+	args.Command = "exit 3"
+	if err := Exec(context.Background(), args); err == nil || err.Error() != "command exited with code 3" {
+		t.Fatalf("expected command error, got %v", err)
+	}
+}
+
+func TestExec_ACRPullSecret(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Path == "/oauth2/exchange" {
+			_, _ = w.Write([]byte(`{"refresh_token":"acr-refresh-token"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"arm-token"}`))
+	}))
+	defer srv.Close()
+	registry := strings.TrimPrefix(srv.URL, "http://")
+
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "bin")
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(bin, "kubectl"), []byte("#!/bin/sh\necho \"$@\" > \"$KUBECTL_LOG\"\necho secret/registry configured\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("KUBECTL_LOG", filepath.Join(dir, "kubectl.log"))
+	t.Setenv("HARNESS_OUTPUT_SECRET_FILE", filepath.Join(dir, "secret.env"))
+	t.Setenv("DRONE_OUTPUT", filepath.Join(dir, "out.env"))
+	t.Setenv("DOCKER_CONFIG", filepath.Join(dir, "docker"))
+	t.Setenv("REGISTRY_AUTH_FILE", filepath.Join(dir, "containers", "auth.json"))
+
+	path := filepath.Join(dir, "manifests", "pull-secret.yaml")
+	args := Args{
+		OIDCToken:              testOIDCToken,
+		TenantID:               "12345678-1234-1234-1234-1234567890ab",
+		ClientID:               "00000000-0000-0000-0000-000000000001",
+		AuthorityHost:          srv.URL,
+		ACRRegistry:            registry,
+		ACRPullSecret:          path,
+		ACRPullSecretName:      "registry",
+		ACRPullSecretNamespace: "apps",
+		ACRPullSecretApply:     true,
+	}
+	if err := Exec(context.Background(), args); err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var manifest pullSecretManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		t.Fatal(err)
+	}
+	if manifest.Kind != "Secret" || manifest.Type != "kubernetes.io/dockerconfigjson" || manifest.Metadata.Name != "registry" || manifest.Metadata.Namespace != "apps" {
+		t.Errorf("unexpected manifest %s", data)
+	}
+	config, _ := base64.StdEncoding.DecodeString(manifest.Data[".dockerconfigjson"])
+	if !strings.Contains(string(config), `"password":"acr-refresh-token"`) || !strings.Contains(string(config), registry) {
+		t.Errorf("unexpected docker config %s", config)
+	}
+	if info, _ := os.Stat(path); info.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v, want 0600", info.Mode().Perm())
+	}
+	if log, _ := os.ReadFile(filepath.Join(dir, "kubectl.log")); string(log) != "apply -f "+path+"\n" {
+		t.Errorf("kubectl arguments = %q", log)
+	}
+	plain, _ := readOutputFile(filepath.Join(dir, "out.env"))
+	if plain["AZURE_ACR_PULL_SECRET"] != path {
+		t.Errorf("unexpected outputs %v", plain)
+	}
+
+	if err := verifyPullSecretName("Registry"); err == nil {
+		t.Errorf("expected error for an invalid secret name")
+	}
+}
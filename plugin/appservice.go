@@ -0,0 +1,165 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/harness-community/drone-azure-oidc/pkg/azuread"
+)
+
+// webAppsAPIVersion is the Resource Manager API version used to read
+// the publishing credentials of App Service sites.
+const webAppsAPIVersion = "2022-03-01"
+
+// maxPublishProfileSize bounds the publish profile read.
+const maxPublishProfileSize = 1 << 20
+
+// publishingCredentials are the deployment credentials of an App
+// Service site, used by zip deployments and Kudu.
+type publishingCredentials struct {
+	Properties struct {
+		PublishingUserName string `json:"publishingUserName"`
+		PublishingPassword string `json:"publishingPassword"`
+		ScmURI             string `json:"scmUri"`
+	} `json:"properties"`
+}
+
+// appServiceSite is an App Service site whose credentials are
+// written: a function app or a web app.
+type appServiceSite struct {
+	setting string // name of the setting, used in errors
+	kind    string // kind of site, used in errors
+	span    string // name of the trace span
+	prefix  string // prefix of the output keys
+	name    string
+}
+
+// writeFunctionAppCredentials writes the publishing credentials of the
+// function app, so function deployments work without stored publish
+// profiles.
+func writeFunctionAppCredentials(ctx context.Context, args Args, client *http.Client, token *AzureTokenResponse) error {
+	return writeSiteCredentials(ctx, args, client, token, appServiceSite{
+		setting: "function-app",
+		kind:    "function app",
+		span:    "function_app_credentials",
+		prefix:  "AZURE_FUNCTIONAPP",
+		name:    args.FunctionApp,
+	})
+}
+
+// writeWebAppCredentials writes the publishing credentials of the web
+// app, so zip deployments work without stored publish profiles.
+func writeWebAppCredentials(ctx context.Context, args Args, client *http.Client, token *AzureTokenResponse) error {
+	return writeSiteCredentials(ctx, args, client, token, appServiceSite{
+		setting: "web-app",
+		kind:    "web app",
+		span:    "web_app_credentials",
+		prefix:  "AZURE_WEBAPP",
+		name:    args.WebApp,
+	})
+}
+
+// fetchPublishProfile reads the publish profile XML of the site.
+func fetchPublishProfile(ctx context.Context, client *http.Client, address, accessToken string) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, address, strings.NewReader(`{"format":"WebDeploy"}`))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", &NetworkError{Err: err}
+	}
+	defer drainAndClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxPublishProfileSize))
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Contains(data, []byte("<publishData")) {
+		return "", fmt.Errorf("response is not a publish profile")
+	}
+	// Output values are single lines, and the whitespace between the
+	// elements of the profile is not significant.
+	var profile strings.Builder
+	for _, line := range strings.Split(string(data), "\n") {
+		profile.WriteString(strings.TrimSpace(line))
+	}
+	wipe(data)
+	return profile.String(), nil
+}
+
+// writeSiteCredentials fetches the publishing credentials of the site
+// and writes them to the secret output file, with the site name and
+// Kudu address as non-secret outputs. With publish-profile, the
+// publish profile is also written.
+func writeSiteCredentials(ctx context.Context, args Args, client *http.Client, token *AzureTokenResponse, site appServiceSite) error {
+	scope := args.Scope
+	if scope == "" {
+		scope = defaultScope
+	}
+	endpoint, err := resourceManagerEndpoint(scope)
+	if err != nil {
+		return fmt.Errorf("%s requires a Resource Manager scope such as %s", site.setting, defaultScope)
+	}
+	base := fmt.Sprintf("%s/subscriptions/%s/resourceGroups/%s/providers/Microsoft.Web/sites/%s",
+		endpoint, url.PathEscape(args.SubscriptionID), url.PathEscape(args.ResourceGroup), url.PathEscape(site.name))
+	address := base + "/config/publishingcredentials/list?api-version=" + webAppsAPIVersion
+	if err := azuread.CheckEndpoint(address, nil); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+	ctx, span := startSpan(ctx, site.span)
+	creds := new(publishingCredentials)
+	err = postJSON(ctx, client, address, token.AccessToken, creds)
+	var profile string
+	if err == nil && args.PublishProfile {
+		profile, err = fetchPublishProfile(ctx, client, base+"/publishxml?api-version="+webAppsAPIVersion, token.AccessToken)
+		if err != nil {
+			err = fmt.Errorf("publish profile: %w", err)
+		}
+	}
+	span.End(err)
+	if err != nil {
+		return fmt.Errorf("failed to read the publishing credentials of %s %s: %w", site.kind, site.name, err)
+	}
+	redactSecret(creds.Properties.PublishingPassword)
+
+	output := secretOutput(ctx, args)
+	if err := output.Write(site.prefix+"_PUBLISH_USERNAME", creds.Properties.PublishingUserName); err != nil {
+		return err
+	}
+	if err := output.Write(site.prefix+"_PUBLISH_PASSWORD", creds.Properties.PublishingPassword); err != nil {
+		return err
+	}
+	if profile != "" {
+		if err := output.Write(site.prefix+"_PUBLISH_PROFILE", profile); err != nil {
+			return err
+		}
+	}
+	if plain := plainOutput(ctx); plain != nil {
+		if err := plain.Write(site.prefix+"_NAME", site.name); err != nil {
+			return err
+		}
+		// The SCM address embeds the credentials, which are removed.
+		if u, err := url.Parse(creds.Properties.ScmURI); err == nil && u.Host != "" {
+			u.User = nil
+			if err := plain.Write(site.prefix+"_SCM_URI", u.String()); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+)
+
+// artifactsUsername is the user name sent with the token to Azure
+// Artifacts feeds, which ignore it.
+const artifactsUsername = "azure-oidc"
+
+// feedEndpointCredential is an entry of the feed endpoints read by the
+// Azure Artifacts credential provider.
+type feedEndpointCredential struct {
+	Endpoint string `json:"endpoint"`
+	Username string `json:"username"`
+	Password string `json:"password"`
+}
+
+// verifyArtifactsFeeds checks every feed is an HTTPS URL.
+func verifyArtifactsFeeds(feeds []string) error {
+	for _, feed := range feeds {
+		u, err := url.Parse(feed)
+		if err != nil || u.Scheme != "https" || u.Host == "" {
+			return fmt.Errorf("invalid artifacts feed %q, expected a feed URL such as https://pkgs.dev.azure.com/contoso/_packaging/packages/nuget/v3/index.json", feed)
+		}
+	}
+	return nil
+}
+
+// writeArtifactsCredentials writes the variables read by the Azure
+// Artifacts credential provider to the secret output file, so NuGet
+// and MSBuild restores authenticate with the Azure DevOps token:
+// VSS_NUGET_ACCESSTOKEN, and the per-feed credentials under both the
+// current and legacy feed endpoint variables.
+func writeArtifactsCredentials(ctx context.Context, args Args, token *AzureTokenResponse) error {
+	endpoints := struct {
+		EndpointCredentials []feedEndpointCredential `json:"endpointCredentials"`
+	}{}
+	for _, feed := range args.ArtifactsFeeds {
+		endpoints.EndpointCredentials = append(endpoints.EndpointCredentials, feedEndpointCredential{
+			Endpoint: feed,
+			Username: artifactsUsername,
+			Password: token.AccessToken,
+		})
+	}
+	data, err := json.Marshal(endpoints)
+	if err != nil {
+		return err
+	}
+	defer wipe(data)
+
+	output := secretOutput(ctx, args)
+	for _, kv := range [][2]string{
+		{"VSS_NUGET_ACCESSTOKEN", token.AccessToken},
+		{"ARTIFACTS_CREDENTIALPROVIDER_FEED_ENDPOINTS", string(data)},
+		{"VSS_NUGET_EXTERNAL_FEED_ENDPOINTS", string(data)},
+	} {
+		if err := output.Write(kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,43 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteArtifactsCredentials(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HARNESS_OUTPUT_SECRET_FILE", filepath.Join(dir, "secret.env"))
+
+	feed := "https://pkgs.dev.azure.com/contoso/_packaging/packages/nuget/v3/index.json"
+	args := Args{ArtifactsFeeds: []string{feed}}
+	if err := writeArtifactsCredentials(context.Background(), args, &AzureTokenResponse{AccessToken: "ado-token"}); err != nil {
+		t.Fatalf("writeArtifactsCredentials returned error: %v", err)
+	}
+	secrets, _ := readOutputFile(filepath.Join(dir, "secret.env"))
+	if secrets["VSS_NUGET_ACCESSTOKEN"] != "ado-token" {
+		t.Errorf("unexpected secret outputs %v", secrets)
+	}
+	for _, key := range []string{"ARTIFACTS_CREDENTIALPROVIDER_FEED_ENDPOINTS", "VSS_NUGET_EXTERNAL_FEED_ENDPOINTS"} {
+		var endpoints struct {
+			EndpointCredentials []feedEndpointCredential `json:"endpointCredentials"`
+		}
+		if err := json.Unmarshal([]byte(secrets[key]), &endpoints); err != nil {
+			t.Fatalf("%s: %v", key, err)
+		}
+		if len(endpoints.EndpointCredentials) != 1 || endpoints.EndpointCredentials[0].Endpoint != feed || endpoints.EndpointCredentials[0].Password != "ado-token" {
+			t.Errorf("%s = %s", key, secrets[key])
+		}
+	}
+
+	if err := verifyDevOps(Args{ArtifactsFeeds: []string{"http://pkgs.dev.azure.com/feed"}}); err == nil {
+		t.Errorf("expected error for a plain HTTP feed")
+	}
+	if err := verifyDevOps(Args{ArtifactsFeeds: []string{feed}, Scope: defaultScope}); err == nil {
+		t.Errorf("expected error for a scope other than Azure DevOps")
+	}
+}
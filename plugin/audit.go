@@ -0,0 +1,137 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+// audit events
+const (
+	auditTokenIssued = "token_issued"
+	auditTokenFailed = "token_exchange_failed"
+)
+
+// auditRecord is a credential issuance record. It never contains
+// the assertion or the access token.
+type auditRecord struct {
+	Time        string `json:"time"`
+	Event       string `json:"event"`
+	Issuer      string `json:"issuer,omitempty"`
+	Subject     string `json:"subject,omitempty"`
+	TenantID    string `json:"tenant_id"`
+	ClientID    string `json:"client_id"`
+	Scope       string `json:"scope"`
+	Repo        string `json:"repo,omitempty"`
+	BuildNumber int    `json:"build_number,omitempty"`
+	Stage       string `json:"stage,omitempty"`
+	Step        string `json:"step,omitempty"`
+	ExecutionID string `json:"execution_id,omitempty"`
+	ExpiresIn   int    `json:"expires_in,omitempty"`
+	Fingerprint string `json:"token_fingerprint,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// newAuditRecord returns an audit record for the event with the
+// identity and pipeline details of the execution.
+func newAuditRecord(args Args, event, scope string) *auditRecord {
+	rec := &auditRecord{
+		Time:        time.Now().UTC().Format(time.RFC3339),
+		Event:       event,
+		TenantID:    args.TenantID,
+		ClientID:    args.ClientID,
+		Scope:       scope,
+		Repo:        args.Repo.Slug,
+		BuildNumber: args.Build.Number,
+		Stage:       args.Stage.Name,
+		Step:        args.Step.Name,
+		ExecutionID: os.Getenv("HARNESS_EXECUTION_ID"),
+	}
+	if token, err := parseJWT(args.OIDCToken); err == nil {
+		rec.Issuer = token.StringClaim("iss")
+		rec.Subject = token.StringClaim("sub")
+	}
+	return rec
+}
+
+// writeAudit appends the record to the configured audit log. Audit
+// failures are logged and do not fail the step.
+func writeAudit(ctx context.Context, dest string, rec *auditRecord) {
+	if dest == "" {
+		return
+	}
+	if err := appendAuditRecord(dest, rec); err != nil {
+		logger(ctx).Warnf("failed to write audit record: %s", err)
+	}
+}
+
+// appendAuditRecord writes the record as a JSON line to a file, or
+// as an RFC 5424 message to a syslog://, syslog+udp:// or
+// syslog+tcp:// endpoint.
+func appendAuditRecord(dest string, rec *auditRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+
+	u, err := url.Parse(dest)
+	if err != nil || u.Host == "" {
+		file, err := os.OpenFile(dest, os.O_APPEND|os.O_CREATE|os.O_RDWR, 0600)
+		if err != nil {
+			return err
+		}
+		defer file.Close()
+		// Keep records on their own lines when the last line of the
+		// file has no trailing newline.
+		if info, err := file.Stat(); err == nil && info.Size() > 0 {
+			last := make([]byte, 1)
+			if _, err := file.ReadAt(last, info.Size()-1); err == nil && last[0] != '\n' {
+				data = append([]byte{'\n'}, data...)
+			}
+		}
+		_, err = file.Write(append(data, '\n'))
+		return err
+	}
+
+	var network string
+	switch u.Scheme {
+	case "syslog", "syslog+udp":
+		network = "udp"
+	case "syslog+tcp":
+		network = "tcp"
+	default:
+		return fmt.Errorf("unsupported audit log scheme %q", u.Scheme)
+	}
+
+	// facility auth (4) with informational or warning severity
+	priority := 4*8 + 6
+	if rec.Event == auditTokenFailed {
+		priority = 4*8 + 4
+	}
+	hostname, _ := os.Hostname()
+	if hostname == "" {
+		hostname = "-"
+	}
+	msg := fmt.Sprintf("<%d>1 %s %s drone-azure-oidc %d %s - %s",
+		priority, time.Now().UTC().Format(time.RFC3339), hostname, os.Getpid(), rec.Event, data)
+
+	conn, err := net.DialTimeout(network, u.Host, 5*time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	_ = conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if network == "tcp" {
+		// octet-counting framing, RFC 6587
+		msg = strconv.Itoa(len(msg)) + " " + msg
+	}
+	_, err = conn.Write([]byte(msg))
+	return err
+}
@@ -0,0 +1,196 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAcquireToken_AuditLog(t *testing.T) {
+	fail := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if fail {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_client","error_description":"AADSTS700016"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"secret-access-token"}`))
+	}))
+	defer srv.Close()
+
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	args := Args{
+		OIDCToken:     testOIDCToken,
+		TenantID:      "12345678-1234-1234-1234-1234567890ab",
+		ClientID:      "12345678-1234-1234-1234-1234567890ab",
+		AuthorityHost: srv.URL,
+		AuditLog:      auditPath,
+	}
+	args.Repo.Slug = "octocat/hello-world"
+	args.Build.Number = 42
+
+	if _, err := acquireToken(context.Background(), args, new(Exchanger)); err != nil {
+		t.Fatalf("acquireToken returned error: %v", err)
+	}
+	fail = true
+	if _, err := acquireToken(context.Background(), args, new(Exchanger)); err == nil {
+		t.Fatalf("expected exchange error")
+	}
+
+	data, err := os.ReadFile(auditPath)
+	if err != nil {
+		t.Fatalf("failed reading audit log: %v", err)
+	}
+	if strings.Contains(string(data), "secret-access-token") || strings.Contains(string(data), testOIDCToken) {
+		t.Fatalf("audit log contains a token: %s", data)
+	}
+	lines := strings.Split(strings.TrimSpace(string(data)), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected 2 audit records, got %d", len(lines))
+	}
+	var issued, failed auditRecord
+	if err := json.Unmarshal([]byte(lines[0]), &issued); err != nil {
+		t.Fatalf("invalid audit record: %v", err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &failed); err != nil {
+		t.Fatalf("invalid audit record: %v", err)
+	}
+	if issued.Event != auditTokenIssued || issued.Repo != "octocat/hello-world" || issued.BuildNumber != 42 || issued.Scope != defaultScope || issued.ExpiresIn != 3600 {
+		t.Fatalf("unexpected issued record: %+v", issued)
+	}
+	if failed.Event != auditTokenFailed || !strings.Contains(failed.Error, "invalid_client") {
+		t.Fatalf("unexpected failure record: %+v", failed)
+	}
+}
+
+func TestAppendAuditRecord_MissingTrailingNewline(t *testing.T) {
+	auditPath := filepath.Join(t.TempDir(), "audit.log")
+	if err := os.WriteFile(auditPath, []byte(`{"event":"previous"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := appendAuditRecord(auditPath, &auditRecord{Event: auditTokenIssued}); err != nil {
+		t.Fatalf("appendAuditRecord returned error: %v", err)
+	}
+	data, _ := os.ReadFile(auditPath)
+	lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")
+	if len(lines) != 2 || lines[0] != `{"event":"previous"}` || !json.Valid([]byte(lines[1])) {
+		t.Errorf("unexpected audit log %q", data)
+	}
+}
+
+func TestAppendAuditRecord_Syslog(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer conn.Close()
+
+	rec := &auditRecord{Event: auditTokenIssued, TenantID: "tenant", ClientID: "client"}
+	if err := appendAuditRecord("syslog://"+conn.LocalAddr().String(), rec); err != nil {
+		t.Fatalf("appendAuditRecord returned error: %v", err)
+	}
+
+	buf := make([]byte, 4096)
+	_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatalf("failed reading syslog message: %v", err)
+	}
+	msg := string(buf[:n])
+	if !strings.HasPrefix(msg, "<38>1 ") || !strings.Contains(msg, " drone-azure-oidc ") || !strings.Contains(msg, `"client_id":"client"`) {
+		t.Fatalf("unexpected syslog message: %s", msg)
+	}
+
+	if err := appendAuditRecord("https://audit.example.com", rec); err == nil {
+		t.Fatalf("expected error for an unsupported scheme")
+	}
+}
+
+func TestAcquireToken_Webhooks(t *testing.T) {
+	fail := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if fail {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_client","error_description":"AADSTS700016"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"webhook-access-token"}`))
+	}))
+	defer srv.Close()
+
+	events := make(chan string, 2)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var rec auditRecord
+		if err := json.NewDecoder(r.Body).Decode(&rec); err != nil {
+			t.Errorf("failed to decode webhook event: %v", err)
+		}
+		events <- r.URL.Path + " " + rec.Event
+	}))
+	defer hook.Close()
+
+	args := Args{
+		OIDCToken:        testOIDCToken,
+		TenantID:         "tenant",
+		ClientID:         "client",
+		AuthorityHost:    srv.URL,
+		OnSuccessWebhook: hook.URL + "/success",
+		OnFailureWebhook: hook.URL + "/failure",
+	}
+	if _, err := acquireToken(context.Background(), args, new(Exchanger)); err != nil {
+		t.Fatalf("acquireToken returned error: %v", err)
+	}
+	fail = true
+	if _, err := acquireToken(context.Background(), args, new(Exchanger)); err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	if got := <-events; got != "/success "+auditTokenIssued {
+		t.Errorf("unexpected success event %q", got)
+	}
+	if got := <-events; got != "/failure "+auditTokenFailed {
+		t.Errorf("unexpected failure event %q", got)
+	}
+
+	if err := verifyWebhooks(Args{OnFailureWebhook: "ftp://example.com"}); err == nil {
+		t.Errorf("expected error for a non-http webhook")
+	}
+}
+
+func TestNotifyWebhook_Retry(t *testing.T) {
+	t.Setenv("HARNESS_EXECUTION_ID", "exec-1234")
+	var calls int
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	}))
+	defer hook.Close()
+
+	args := Args{
+		TenantID:         "tenant",
+		ClientID:         "client",
+		CacheDir:         t.TempDir(),
+		OnSuccessWebhook: hook.URL,
+	}
+	rec := newAuditRecord(args, auditTokenIssued, defaultScope)
+	notifyWebhook(context.Background(), args, http.DefaultClient, rec)
+	notifyWebhook(context.Background(), args, http.DefaultClient, rec)
+	if calls != 1 {
+		t.Errorf("webhook called %d times for a retried step, want 1", calls)
+	}
+
+	args.Step.Name = "deploy"
+	notifyWebhook(context.Background(), args, http.DefaultClient, newAuditRecord(args, auditTokenIssued, defaultScope))
+	if calls != 2 {
+		t.Errorf("webhook called %d times for another step, want 2", calls)
+	}
+}
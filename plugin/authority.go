@@ -0,0 +1,38 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// verifyAuthorityURL verifies that the authority host is an absolute
+// URL the token endpoint can be appended to. A path is only accepted
+// for custom authorities, such as a gateway serving Azure AD under a
+// path prefix.
+func verifyAuthorityURL(host string, custom bool) error {
+	if !strings.Contains(host, "://") {
+		return fmt.Errorf("azure-authority-host %q must be an absolute URL such as https://%s", host, host)
+	}
+	u, err := url.Parse(host)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("azure-authority-host %q must be an absolute URL such as https://login.microsoftonline.com", host)
+	}
+	if u.User != nil || u.RawQuery != "" || u.Fragment != "" || strings.HasSuffix(host, "?") || strings.HasSuffix(host, "#") {
+		return fmt.Errorf("azure-authority-host %q must not contain credentials, a query or a fragment", u.Redacted())
+	}
+	if u.Path == "" || custom {
+		return nil
+	}
+	authority := u.Scheme + "://" + u.Host
+	switch first, _, _ := strings.Cut(strings.TrimPrefix(u.Path, "/"), "/"); {
+	case strings.Contains(u.Path, "/oauth2/"):
+		return fmt.Errorf("azure-authority-host %q is a token endpoint, set it to the authority %s: the tenant and token path are appended by the plugin", host, authority)
+	case validateGUID(first, "") == nil || strings.Contains(first, ".") || strings.EqualFold(first, tenantCommon) || strings.EqualFold(first, tenantOrganizations):
+		return fmt.Errorf("azure-authority-host %q includes the tenant %q, set it to %s and the tenant with tenant-id", host, first, authority)
+	default:
+		return fmt.Errorf("azure-authority-host %q must not have a path, set it to %s, or set custom-authority for an authority served under a path", host, authority)
+	}
+}
@@ -0,0 +1,102 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/harness-community/drone-azure-oidc/pkg/azuread"
+)
+
+// supported azcopy login types
+const (
+	azcopyWorkload = "workload"
+	azcopyAzCLI    = "azcli"
+)
+
+// defaultFederatedTokenFile is the file, relative to the workspace,
+// where the OIDC token is written for workload identity logins.
+const defaultFederatedTokenFile = ".azure-oidc/federated-token"
+
+// verifyAzcopyLogin validates the azcopy login type.
+func verifyAzcopyLogin(value string) error {
+	switch strings.ToLower(value) {
+	case "", azcopyWorkload, azcopyAzCLI:
+		return nil
+	}
+	return fmt.Errorf("unsupported azcopy-login %q, must be %s or %s", value, azcopyWorkload, azcopyAzCLI)
+}
+
+// federatedTokenFile returns the absolute path of the federated token
+// file.
+func federatedTokenFile(args Args) string {
+	path := args.FederatedTokenFile
+	if path == "" {
+		path = defaultFederatedTokenFile
+	}
+	if abs, err := filepath.Abs(path); err == nil {
+		return abs
+	}
+	return path
+}
+
+// writeFederatedTokenFile writes the OIDC token to the federated
+// token file.
+func writeFederatedTokenFile(args Args) error {
+	path := federatedTokenFile(args)
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create federated token file directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(args.OIDCToken), 0600); err != nil {
+		return fmt.Errorf("failed to write federated token file: %w", err)
+	}
+	return nil
+}
+
+// azcopyEnv returns the variables that make azcopy log in
+// automatically. Workload logins read the OIDC token from the
+// federated token file, like the Azure SDK workload identity
+// credential, while Azure CLI logins reuse the az login of the step.
+func azcopyEnv(args Args) [][2]string {
+	if strings.EqualFold(args.AzcopyLogin, azcopyAzCLI) {
+		return [][2]string{
+			{"AZCOPY_AUTO_LOGIN_TYPE", "AZCLI"},
+			{"AZCOPY_TENANT_ID", args.TenantID},
+		}
+	}
+	env := [][2]string{
+		{"AZCOPY_AUTO_LOGIN_TYPE", "WORKLOAD"},
+		{"AZCOPY_TENANT_ID", args.TenantID},
+		{"AZURE_FEDERATED_TOKEN_FILE", federatedTokenFile(args)},
+	}
+	if hosts := azuread.SplitAuthorityHosts(args.AuthorityHost); len(hosts) > 0 {
+		env = append(env, [2]string{"AZURE_AUTHORITY_HOST", hosts[0]})
+	}
+	return env
+}
+
+// writeAzcopyOutputs writes the federated token file for workload
+// logins and the azcopy variables to the non-secret output file.
+// AZURE_TENANT_ID and AZURE_CLIENT_ID are written with the token
+// metadata.
+func writeAzcopyOutputs(ctx context.Context, args Args) error {
+	if !strings.EqualFold(args.AzcopyLogin, azcopyAzCLI) {
+		if err := writeFederatedTokenFile(args); err != nil {
+			return err
+		}
+	}
+	output := plainOutput(ctx)
+	if output == nil {
+		return nil
+	}
+	for _, kv := range azcopyEnv(args) {
+		if err := output.Write(kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExec_AzcopyLogin(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"abc"}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	t.Setenv("HARNESS_OUTPUT_SECRET_FILE", filepath.Join(dir, "secret.env"))
+	t.Setenv("DRONE_OUTPUT", filepath.Join(dir, "out.env"))
+
+	tokenFile := filepath.Join(dir, "tokens", "federated-token")
+	args := Args{
+		OIDCToken:          testOIDCToken,
+		TenantID:           "12345678-1234-1234-1234-1234567890ab",
+		ClientID:           "00000000-0000-0000-0000-000000000001",
+		AuthorityHost:      srv.URL,
+		AzcopyLogin:        "workload",
+		FederatedTokenFile: tokenFile,
+		Command:            `test "$AZCOPY_AUTO_LOGIN_TYPE" = WORKLOAD && test "$(cat "$AZURE_FEDERATED_TOKEN_FILE")" = "` + testOIDCToken + `"`,
+		SkipAzLogin:        true,
+	}
+	if err := Exec(context.Background(), args); err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+	outputs, err := readOutputFile(filepath.Join(dir, "out.env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for key, want := range map[string]string{
+		"AZCOPY_AUTO_LOGIN_TYPE":     "WORKLOAD",
+		"AZCOPY_TENANT_ID":           args.TenantID,
+		"AZURE_TENANT_ID":            args.TenantID,
+		"AZURE_CLIENT_ID":            args.ClientID,
+		"AZURE_FEDERATED_TOKEN_FILE": tokenFile,
+		"AZURE_AUTHORITY_HOST":       srv.URL,
+	} {
+		if got := outputs[key]; got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+	info, err := os.Stat(tokenFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0600 {
+		t.Errorf("federated token file mode = %v, want 0600", info.Mode().Perm())
+	}
+
+	args.AzcopyLogin = "AZCLI"
+	args.Command = ""
+	os.Remove(filepath.Join(dir, "out.env"))
+	if err := Exec(context.Background(), args); err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+	outputs, _ = readOutputFile(filepath.Join(dir, "out.env"))
+	if outputs["AZCOPY_AUTO_LOGIN_TYPE"] != "AZCLI" || outputs["AZURE_FEDERATED_TOKEN_FILE"] != "" {
+		t.Errorf("unexpected azcli outputs %v", outputs)
+	}
+
+	args.AzcopyLogin = "spn"
+	if err := VerifyEnv(context.Background(), args); err == nil {
+		t.Errorf("expected error for an unsupported login type")
+	}
+}
@@ -0,0 +1,169 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/harness-community/drone-azure-oidc/pkg/azuread"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/cloud"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/runtime"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+)
+
+// supported exchange engines
+const (
+	engineHTTP       = "http"
+	engineAzidentity = "azidentity"
+)
+
+// knownAuthorityHosts are the authority hosts of the Azure clouds,
+// which the Azure SDK validates with instance discovery.
+var knownAuthorityHosts = []string{
+	cloud.AzurePublic.ActiveDirectoryAuthorityHost,
+	cloud.AzureGovernment.ActiveDirectoryAuthorityHost,
+	cloud.AzureChina.ActiveDirectoryAuthorityHost,
+}
+
+// exchangeEngine returns the configured exchange engine, the raw
+// HTTP exchange when none is set.
+func exchangeEngine(args Args) string {
+	if args.ExchangeEngine == "" {
+		return engineHTTP
+	}
+	return strings.ToLower(args.ExchangeEngine)
+}
+
+// verifyExchangeEngine validates the exchange engine. The azidentity
+// engine handles the authority, retries and regional endpoints
+// itself, so the settings of the raw HTTP exchange are rejected.
+func verifyExchangeEngine(args Args) error {
+	switch exchangeEngine(args) {
+	case engineHTTP:
+		return nil
+	case engineAzidentity:
+	default:
+		return fmt.Errorf("unsupported exchange-engine %q, must be %s or %s", args.ExchangeEngine, engineHTTP, engineAzidentity)
+	}
+	switch {
+	case credential(args) != credentialOIDC:
+		return fmt.Errorf("exchange-engine %s requires the %s credential", engineAzidentity, credentialOIDC)
+	case len(azuread.SplitAuthorityHosts(args.AuthorityHost)) > 1:
+		return fmt.Errorf("exchange-engine %s does not support authority host failover", engineAzidentity)
+	case args.Region != "":
+		return fmt.Errorf("azure-region is not supported with exchange-engine %s, set AZURE_REGIONAL_AUTHORITY_NAME instead", engineAzidentity)
+	case args.HedgeDelay != 0:
+		return fmt.Errorf("hedge-delay is not supported with exchange-engine %s", engineAzidentity)
+	case args.Discovery:
+		return fmt.Errorf("discovery is not supported with exchange-engine %s", engineAzidentity)
+	case args.DownstreamScope != "":
+		return fmt.Errorf("downstream-scope is not supported with exchange-engine %s", engineAzidentity)
+	}
+	return nil
+}
+
+// azidentityProvider exchanges the OIDC token with the client
+// assertion credential of the Azure SDK, which brings Microsoft's
+// handling of sovereign clouds, regional endpoints, retries and
+// in-memory token caching.
+type azidentityProvider struct {
+	cred    *azidentity.ClientAssertionCredential
+	timeout time.Duration
+}
+
+// newAzidentityProvider returns the azidentity provider of the
+// plugin arguments. Requests are sent with the HTTP client of the
+// plugin, so the proxy and TLS settings apply.
+func newAzidentityProvider(args Args, client *http.Client) (*azidentityProvider, error) {
+	authorityHost := strings.TrimSuffix(args.AuthorityHost, "/")
+	if authorityHost == "" {
+		authorityHost = defaultAuthorityHost
+	}
+	authorityHost += "/"
+	if err := azuread.CheckEndpoint(authorityHost, args.AllowedAuthorityHosts); err != nil {
+		return nil, err
+	}
+
+	opts := &azidentity.ClientAssertionCredentialOptions{
+		ClientOptions: azcore.ClientOptions{
+			Cloud:     cloud.Configuration{ActiveDirectoryAuthorityHost: authorityHost},
+			Retry:     policy.RetryOptions{TryTimeout: args.AttemptTimeout},
+			Transport: client,
+		},
+		// Instance discovery only knows the Azure clouds; other
+		// hosts, such as Azure Stack, are trusted as configured.
+		DisableInstanceDiscovery: !slices.Contains(knownAuthorityHosts, authorityHost),
+	}
+	assertion := args.OIDCToken
+	cred, err := azidentity.NewClientAssertionCredential(args.TenantID, args.ClientID, func(context.Context) (string, error) {
+		return assertion, nil
+	}, opts)
+	if err != nil {
+		return nil, err
+	}
+	timeout := args.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+	return &azidentityProvider{cred: cred, timeout: timeout}, nil
+}
+
+// Token exchanges the OIDC token for an access token for the scope.
+func (p *azidentityProvider) Token(ctx context.Context, scope string) (*AzureTokenResponse, error) {
+	ctx, cancel := context.WithTimeout(ctx, p.timeout)
+	defer cancel()
+
+	token, err := p.cred.GetToken(ctx, policy.TokenRequestOptions{Scopes: strings.Fields(scope)})
+	if err != nil {
+		return nil, azidentityError(err)
+	}
+	redactSecret(token.Token)
+	return &AzureTokenResponse{
+		TokenType:   "Bearer",
+		AccessToken: token.Token,
+		ExpiresIn:   int(token.ExpiresOn.Sub(wallClock.Now()).Seconds()),
+	}, nil
+}
+
+// azidentityError converts an authentication failure reported by
+// the Azure SDK to the error of the raw HTTP exchange, so it is
+// logged and classified the same way.
+func azidentityError(err error) error {
+	var authErr *azidentity.AuthenticationFailedError
+	if !errors.As(err, &authErr) || authErr.RawResponse == nil {
+		return err
+	}
+	resp := authErr.RawResponse
+	var azureErr AzureErrorResponse
+	if data, readErr := runtime.Payload(resp); readErr == nil {
+		_ = json.Unmarshal(data, &azureErr)
+	}
+	if azureErr.Error == "" {
+		return err
+	}
+	converted := &AzureAuthError{
+		StatusCode:      resp.StatusCode,
+		Status:          resp.Status,
+		Code:            azureErr.Error,
+		Description:     azuread.SanitizeErrorDescription(azureErr.ErrorDescription),
+		ErrorCodes:      azureErr.ErrorCodes,
+		TraceID:         azureErr.TraceID,
+		CorrelationID:   azureErr.CorrelationID,
+		RequestID:       resp.Header.Get("x-ms-request-id"),
+		ClientRequestID: resp.Header.Get("client-request-id"),
+	}
+	if azuread.IsRetryableStatus(resp.StatusCode) {
+		return &retryableError{Err: converted}
+	}
+	return converted
+}
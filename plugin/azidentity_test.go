@@ -0,0 +1,96 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAzidentityProvider(t *testing.T) {
+	fail := false
+	var srv *httptest.Server
+	srv = httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/.well-known/openid-configuration"):
+			_, _ = w.Write([]byte(`{"token_endpoint":"` + srv.URL + `/mytenant/oauth2/v2.0/token","authorization_endpoint":"` + srv.URL + `/mytenant/oauth2/v2.0/authorize","issuer":"` + srv.URL + `/mytenant/v2.0"}`))
+		case r.URL.Path == "/mytenant/oauth2/v2.0/token":
+			if err := r.ParseForm(); err != nil || r.PostForm.Get("client_assertion") != testOIDCToken {
+				t.Errorf("expected the OIDC token as client assertion, got %v", r.PostForm)
+			}
+			if fail {
+				w.WriteHeader(http.StatusUnauthorized)
+				_, _ = w.Write([]byte(`{"error":"invalid_client","error_description":"AADSTS700016: Application not found.","error_codes":[700016]}`))
+				return
+			}
+			_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"abc"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	args := Args{
+		OIDCToken:      testOIDCToken,
+		TenantID:       "mytenant",
+		ClientID:       "12345678-1234-1234-1234-1234567890ab",
+		AuthorityHost:  srv.URL,
+		ExchangeEngine: engineAzidentity,
+	}
+	// the lifetime is measured on the clock of the plugin
+	setClock(t, &fakeClock{now: time.Now().Add(-time.Hour)})
+	provider, err := newTokenProvider(args, &Exchanger{Client: srv.Client()})
+	if err != nil {
+		t.Fatalf("newTokenProvider returned error: %v", err)
+	}
+	token, err := provider.Token(context.Background(), defaultScope)
+	if err != nil {
+		t.Fatalf("Token returned error: %v", err)
+	}
+	if token.AccessToken != "abc" || token.ExpiresIn <= 7100 || token.ExpiresIn > 7200 {
+		t.Fatalf("unexpected token %+v", token)
+	}
+
+	fail = true
+	provider, err = newTokenProvider(args, &Exchanger{Client: srv.Client()})
+	if err != nil {
+		t.Fatalf("newTokenProvider returned error: %v", err)
+	}
+	_, err = provider.Token(context.Background(), defaultScope)
+	var authErr *AzureAuthError
+	if !errors.As(err, &authErr) || !authErr.HasErrorCode(700016) {
+		t.Fatalf("expected an Azure AD error with code 700016, got %v", err)
+	}
+}
+
+func TestVerifyExchangeEngine(t *testing.T) {
+	base := Args{ExchangeEngine: engineAzidentity}
+	tests := []struct {
+		name    string
+		modify  func(*Args)
+		wantErr bool
+	}{
+		{name: "default", modify: func(a *Args) { a.ExchangeEngine = "" }},
+		{name: "http", modify: func(a *Args) { a.ExchangeEngine = "HTTP" }},
+		{name: "azidentity", modify: func(a *Args) {}},
+		{name: "secret credential", modify: func(a *Args) { a.Credential = credentialSecret }, wantErr: true},
+		{name: "unsupported", modify: func(a *Args) { a.ExchangeEngine = "msal" }, wantErr: true},
+		{name: "failover", modify: func(a *Args) { a.AuthorityHost = "https://a.example,https://b.example" }, wantErr: true},
+		{name: "region", modify: func(a *Args) { a.Region = "westus2" }, wantErr: true},
+		{name: "discovery", modify: func(a *Args) { a.Discovery = true }, wantErr: true},
+		{name: "downstream", modify: func(a *Args) { a.DownstreamScope = "api://downstream/.default" }, wantErr: true},
+	}
+	for _, test := range tests {
+		args := base
+		test.modify(&args)
+		if err := verifyExchangeEngine(args); (err != nil) != test.wantErr {
+			t.Errorf("%s: verifyExchangeEngine() error = %v, wantErr %v", test.name, err, test.wantErr)
+		}
+	}
+}
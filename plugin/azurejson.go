@@ -0,0 +1,110 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// supported azure.json formats
+const (
+	azureJSONCloudProvider = "cloud-provider"
+	azureJSONExternalDNS   = "external-dns"
+)
+
+// verifyAzureJSONFormat validates the azure.json format.
+func verifyAzureJSONFormat(value string) error {
+	switch strings.ToLower(value) {
+	case "", azureJSONCloudProvider, azureJSONExternalDNS:
+		return nil
+	}
+	return fmt.Errorf("unsupported azure-json-format %q, must be %s or %s", value, azureJSONCloudProvider, azureJSONExternalDNS)
+}
+
+// cloudProviderConfig is the azure.json layout of the Azure cloud
+// provider, read by controllers such as the cluster autoscaler and
+// the Secrets Store CSI driver. The controller reads the projected
+// service account token at its default path.
+type cloudProviderConfig struct {
+	Cloud                                 string `json:"cloud"`
+	TenantID                              string `json:"tenantId"`
+	SubscriptionID                        string `json:"subscriptionId,omitempty"`
+	ResourceGroup                         string `json:"resourceGroup,omitempty"`
+	AADClientID                           string `json:"aadClientId"`
+	UseFederatedWorkloadIdentityExtension bool   `json:"useFederatedWorkloadIdentityExtension"`
+}
+
+// externalDNSConfig is the azure.json layout of external-dns. With the
+// workload identity extension, external-dns exchanges the projected
+// service account token of its pod.
+type externalDNSConfig struct {
+	Cloud                        string `json:"cloud"`
+	TenantID                     string `json:"tenantId"`
+	SubscriptionID               string `json:"subscriptionId"`
+	ResourceGroup                string `json:"resourceGroup"`
+	AADClientID                  string `json:"aadClientId"`
+	UseWorkloadIdentityExtension bool   `json:"useWorkloadIdentityExtension"`
+}
+
+// writeAzureJSON writes the azure.json configuration of the identity,
+// with the cloud name and resource group as non-secret outputs for
+// templating cert-manager Azure DNS solvers and similar controllers.
+// The file holds no credential: the controllers exchange their own
+// workload identity token.
+func writeAzureJSON(ctx context.Context, args Args) error {
+	var config interface{} = cloudProviderConfig{
+		Cloud:                                 cloudName(args),
+		TenantID:                              args.TenantID,
+		SubscriptionID:                        args.SubscriptionID,
+		ResourceGroup:                         args.ResourceGroup,
+		AADClientID:                           args.ClientID,
+		UseFederatedWorkloadIdentityExtension: true,
+	}
+	if strings.EqualFold(args.AzureJSONFormat, azureJSONExternalDNS) {
+		config = externalDNSConfig{
+			Cloud:                        cloudName(args),
+			TenantID:                     args.TenantID,
+			SubscriptionID:               args.SubscriptionID,
+			ResourceGroup:                args.ResourceGroup,
+			AADClientID:                  args.ClientID,
+			UseWorkloadIdentityExtension: true,
+		}
+	}
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return err
+	}
+	path, err := filepath.Abs(args.AzureJSON)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create azure.json directory: %w", err)
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write azure.json: %w", err)
+	}
+
+	output := plainOutput(ctx)
+	if output == nil {
+		return nil
+	}
+	for _, kv := range [][2]string{
+		{"AZURE_JSON", path},
+		{"AZURE_CLOUD_NAME", cloudName(args)},
+		{"AZURE_RESOURCE_GROUP", args.ResourceGroup},
+	} {
+		if kv[1] == "" {
+			continue
+		}
+		if err := output.Write(kv[0], kv[1]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
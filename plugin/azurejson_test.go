@@ -0,0 +1,84 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteAzureJSON(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("DRONE_OUTPUT", filepath.Join(dir, "out.env"))
+
+	args := Args{
+		TenantID:       "12345678-1234-1234-1234-1234567890ab",
+		ClientID:       "00000000-0000-0000-0000-000000000001",
+		SubscriptionID: "11111111-1111-1111-1111-111111111111",
+		ResourceGroup:  "dns",
+		AuthorityHost:  "https://login.chinacloudapi.cn",
+		AzureJSON:      filepath.Join(dir, "config", "azure.json"),
+	}
+	if err := writeAzureJSON(context.Background(), args); err != nil {
+		t.Fatalf("writeAzureJSON returned error: %v", err)
+	}
+	data, err := os.ReadFile(args.AzureJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+  "cloud": "AzureChinaCloud",
+  "tenantId": "12345678-1234-1234-1234-1234567890ab",
+  "subscriptionId": "11111111-1111-1111-1111-111111111111",
+  "resourceGroup": "dns",
+  "aadClientId": "00000000-0000-0000-0000-000000000001",
+  "useFederatedWorkloadIdentityExtension": true
+}
+`
+	if string(data) != want {
+		t.Errorf("azure.json = %s, want %s", data, want)
+	}
+	outputs, _ := readOutputFile(filepath.Join(dir, "out.env"))
+	if outputs["AZURE_JSON"] != args.AzureJSON || outputs["AZURE_CLOUD_NAME"] != "AzureChinaCloud" || outputs["AZURE_RESOURCE_GROUP"] != "dns" {
+		t.Errorf("unexpected outputs %v", outputs)
+	}
+}
+
+func TestWriteAzureJSON_ExternalDNS(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("DRONE_OUTPUT", "")
+
+	args := Args{
+		TenantID:        "12345678-1234-1234-1234-1234567890ab",
+		ClientID:        "00000000-0000-0000-0000-000000000001",
+		SubscriptionID:  "11111111-1111-1111-1111-111111111111",
+		ResourceGroup:   "dns",
+		AzureJSON:       filepath.Join(dir, "azure.json"),
+		AzureJSONFormat: "external-dns",
+	}
+	if err := writeAzureJSON(context.Background(), args); err != nil {
+		t.Fatalf("writeAzureJSON returned error: %v", err)
+	}
+	data, err := os.ReadFile(args.AzureJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{
+  "cloud": "AzurePublicCloud",
+  "tenantId": "12345678-1234-1234-1234-1234567890ab",
+  "subscriptionId": "11111111-1111-1111-1111-111111111111",
+  "resourceGroup": "dns",
+  "aadClientId": "00000000-0000-0000-0000-000000000001",
+  "useWorkloadIdentityExtension": true
+}
+`
+	if string(data) != want {
+		t.Errorf("azure.json = %s, want %s", data, want)
+	}
+
+	if err := verifyAzureJSONFormat("helm"); err == nil {
+		t.Errorf("expected error for an unsupported format")
+	}
+}
@@ -0,0 +1,55 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"strings"
+)
+
+// writeAzureLoginOutputs writes the outputs under the names used by
+// the azure/login GitHub action ecosystem: the AZURE_* variables read
+// by the Azure SDKs and the ARM_* variables read by the Terraform
+// azurerm provider, which performs its own exchange of the OIDC
+// token.
+func writeAzureLoginOutputs(ctx context.Context, args Args) error {
+	if output := plainOutput(ctx); output != nil {
+		pairs := [][2]string{
+			{"ARM_TENANT_ID", args.TenantID},
+			{"ARM_CLIENT_ID", args.ClientID},
+			{"ARM_USE_OIDC", "true"},
+		}
+		if args.SubscriptionID != "" {
+			pairs = append(pairs, [2]string{"ARM_SUBSCRIPTION_ID", args.SubscriptionID})
+		}
+		for _, kv := range pairs {
+			if err := output.Write(kv[0], kv[1]); err != nil {
+				return err
+			}
+		}
+	}
+	return secretOutput(ctx, args).Write("ARM_OIDC_TOKEN", args.OIDCToken)
+}
+
+// writeTerraformVars writes the credentials of a batch identity as
+// Terraform input variables prefixed with the alias, such as
+// TF_VAR_prod_client_id, so aliased azurerm providers can each be
+// configured with use_oidc for their own tenant and subscription.
+func writeTerraformVars(ctx context.Context, args Args, alias string) error {
+	prefix := "TF_VAR_" + strings.ToLower(outputSuffix(alias)) + "_"
+	if output := plainOutput(ctx); output != nil {
+		pairs := [][2]string{
+			{prefix + "tenant_id", args.TenantID},
+			{prefix + "client_id", args.ClientID},
+		}
+		if args.SubscriptionID != "" {
+			pairs = append(pairs, [2]string{prefix + "subscription_id", args.SubscriptionID})
+		}
+		for _, kv := range pairs {
+			if err := output.Write(kv[0], kv[1]); err != nil {
+				return err
+			}
+		}
+	}
+	return secretOutput(ctx, args).Write(prefix+"oidc_token", args.OIDCToken)
+}
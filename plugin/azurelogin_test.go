@@ -0,0 +1,56 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExec_AzureLoginCompat(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"abc"}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	t.Setenv("HARNESS_OUTPUT_SECRET_FILE", filepath.Join(dir, "secret.env"))
+	t.Setenv("DRONE_OUTPUT", filepath.Join(dir, "out.env"))
+
+	args := Args{
+		OIDCToken:        testOIDCToken,
+		TenantID:         "12345678-1234-1234-1234-1234567890ab",
+		ClientID:         "00000000-0000-0000-0000-000000000001",
+		SubscriptionID:   "11111111-1111-1111-1111-111111111111",
+		AuthorityHost:    srv.URL,
+		AzureLoginCompat: true,
+	}
+	if err := Exec(context.Background(), args); err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+
+	plain, _ := os.ReadFile(filepath.Join(dir, "out.env"))
+	for _, want := range []string{
+		"AZURE_TENANT_ID=12345678-1234-1234-1234-1234567890ab\n",
+		"AZURE_CLIENT_ID=00000000-0000-0000-0000-000000000001\n",
+		"AZURE_SUBSCRIPTION_ID=11111111-1111-1111-1111-111111111111\n",
+		"ARM_TENANT_ID=12345678-1234-1234-1234-1234567890ab\n",
+		"ARM_CLIENT_ID=00000000-0000-0000-0000-000000000001\n",
+		"ARM_SUBSCRIPTION_ID=11111111-1111-1111-1111-111111111111\n",
+		"ARM_USE_OIDC=true\n",
+	} {
+		if !strings.Contains(string(plain), want) {
+			t.Errorf("outputs %q missing %q", plain, want)
+		}
+	}
+	secret, _ := os.ReadFile(filepath.Join(dir, "secret.env"))
+	if !strings.HasSuffix(string(secret), "ARM_OIDC_TOKEN="+testOIDCToken+"\n") || strings.Contains(string(plain), testOIDCToken) {
+		t.Errorf("expected the OIDC token in the secret outputs only, got %q", secret)
+	}
+}
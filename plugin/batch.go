@@ -0,0 +1,382 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+// defaultConcurrency is the number of batch exchanges run at once.
+const defaultConcurrency = 4
+
+// Identity describes a single token exchange performed in batch
+// mode. Empty fields inherit the top-level plugin settings.
+type Identity struct {
+	Alias          string `json:"alias"`
+	TenantID       string `json:"tenant_id"`
+	ClientID       string `json:"client_id"`
+	SubscriptionID string `json:"subscription_id"`
+	Scope          string `json:"scope"`
+}
+
+// Identities is a list of identities decoded from a JSON array.
+type Identities []Identity
+
+// Decode implements the envconfig.Decoder interface.
+func (i *Identities) Decode(value string) error {
+	if strings.TrimSpace(value) == "" {
+		return nil
+	}
+	if err := json.Unmarshal([]byte(value), (*[]Identity)(i)); err != nil {
+		return fmt.Errorf("identities must be a JSON array: %w", err)
+	}
+	return nil
+}
+
+// ClientIDs maps aliases to application (client) IDs that are all
+// exchanged with the same assertion.
+type ClientIDs map[string]string
+
+// Decode implements the envconfig.Decoder interface. The value is a
+// JSON object or a comma-separated list of alias=client-id pairs.
+func (c *ClientIDs) Decode(value string) error {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+	ids := ClientIDs{}
+	if strings.HasPrefix(value, "{") {
+		if err := json.Unmarshal([]byte(value), (*map[string]string)(&ids)); err != nil {
+			return fmt.Errorf("client-ids must be a JSON object: %w", err)
+		}
+	} else {
+		for _, pair := range strings.Split(value, ",") {
+			alias, id, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("client-ids must be a list of alias=client-id pairs")
+			}
+			ids[strings.TrimSpace(alias)] = strings.TrimSpace(id)
+		}
+	}
+	*c = ids
+	return nil
+}
+
+// Identities returns a batch identity for each alias, sorted by
+// alias so outputs are written in a stable order.
+func (c ClientIDs) Identities() []Identity {
+	aliases := make([]string, 0, len(c))
+	for alias := range c {
+		aliases = append(aliases, alias)
+	}
+	sort.Strings(aliases)
+
+	identities := make([]Identity, 0, len(c))
+	for _, alias := range aliases {
+		identities = append(identities, Identity{Alias: alias, ClientID: c[alias]})
+	}
+	return identities
+}
+
+// supported batch failure policies
+const (
+	failurePolicyAny      = "any"
+	failurePolicyAll      = "all"
+	failurePolicyRequired = "required"
+)
+
+// TokenResult is the outcome of the exchange of a batch identity.
+type TokenResult struct {
+	// Token is the access token, nil when the exchange failed.
+	Token *AzureTokenResponse
+
+	// ExpiresOn is the expiry of the token.
+	ExpiresOn time.Time
+
+	// Err is the error of a failed exchange.
+	Err error
+
+	stats *exchangeStats
+}
+
+// batchSummaryEntry is the outcome of an identity in the batch
+// summary output.
+type batchSummaryEntry struct {
+	Status    string `json:"status"`
+	ExpiresOn string `json:"expires_on,omitempty"`
+	ErrorCode string `json:"error_code,omitempty"`
+}
+
+// resolveIdentity returns the plugin arguments for a batch identity,
+// inheriting unset fields from the top-level arguments.
+func resolveIdentity(args Args, identity Identity) Args {
+	if identity.TenantID != "" {
+		args.TenantID = identity.TenantID
+	}
+	if identity.ClientID != "" {
+		args.ClientID = identity.ClientID
+	}
+	if identity.SubscriptionID != "" {
+		args.SubscriptionID = identity.SubscriptionID
+	}
+	if identity.Scope != "" {
+		args.Scope = identity.Scope
+	}
+	return args
+}
+
+// verifyIdentities validates the batch identities.
+func verifyIdentities(args Args) error {
+	seen := map[string]bool{}
+	for i, identity := range args.Identities {
+		if identity.Alias == "" {
+			return fmt.Errorf("identities[%d]: alias is not provided", i)
+		}
+		name := outputSuffix(identity.Alias)
+		if seen[name] {
+			return fmt.Errorf("identities[%d]: duplicate alias %q", i, identity.Alias)
+		}
+		seen[name] = true
+
+		resolved := resolveIdentity(args, identity)
+		if resolved.TenantID == "" {
+			return fmt.Errorf("identities[%d]: tenant-id is not provided", i)
+		}
+		if resolved.ClientID == "" {
+			return fmt.Errorf("identities[%d]: client-id is not provided", i)
+		}
+		if err := validateTenant(args, resolved.TenantID); err != nil {
+			return fmt.Errorf("identities[%d]: %w", i, err)
+		}
+		if err := validateGUID(resolved.ClientID, "client-id"); err != nil {
+			return fmt.Errorf("identities[%d]: %w", i, err)
+		}
+		if identity.SubscriptionID != "" {
+			if err := validateGUID(identity.SubscriptionID, "subscription-id"); err != nil {
+				return fmt.Errorf("identities[%d]: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+// failurePolicy returns the configured batch failure policy. The
+// step fails when any identity fails unless required aliases are set.
+func failurePolicy(args Args) string {
+	switch {
+	case args.FailurePolicy != "":
+		return strings.ToLower(args.FailurePolicy)
+	case len(args.RequiredAliases) > 0:
+		return failurePolicyRequired
+	default:
+		return failurePolicyAny
+	}
+}
+
+// verifyFailurePolicy validates the batch failure policy and its
+// required aliases.
+func verifyFailurePolicy(args Args) error {
+	policy := failurePolicy(args)
+	switch policy {
+	case failurePolicyAny, failurePolicyAll:
+		if len(args.RequiredAliases) > 0 {
+			return fmt.Errorf("required-aliases requires the %s failure-policy", failurePolicyRequired)
+		}
+		return nil
+	case failurePolicyRequired:
+	default:
+		return fmt.Errorf("unsupported failure-policy %q, must be %s, %s or %s", args.FailurePolicy,
+			failurePolicyAny, failurePolicyAll, failurePolicyRequired)
+	}
+	if len(args.RequiredAliases) == 0 {
+		return fmt.Errorf("failure-policy %s requires required-aliases", policy)
+	}
+	aliases := map[string]bool{}
+	for _, identity := range args.Identities {
+		aliases[outputSuffix(identity.Alias)] = true
+	}
+	for _, alias := range args.RequiredAliases {
+		if !aliases[outputSuffix(alias)] {
+			return fmt.Errorf("required alias %q is not an identity alias", alias)
+		}
+	}
+	return nil
+}
+
+// ExchangeBatch exchanges tokens for every configured identity with
+// bounded concurrency and returns the result of each identity by
+// alias. A failed identity does not cancel the others.
+func ExchangeBatch(ctx context.Context, args Args, exchanger *Exchanger) map[string]TokenResult {
+	limit := args.Concurrency
+	if limit <= 0 {
+		limit = defaultConcurrency
+	}
+
+	var mu sync.Mutex
+	results := make(map[string]TokenResult, len(args.Identities))
+	var g errgroup.Group
+	g.SetLimit(limit)
+	for _, identity := range args.Identities {
+		g.Go(func() error {
+			resolved := resolveIdentity(args, identity)
+			exchangeCtx, stats := withExchangeStats(withLogger(ctx, logger(ctx).WithFields(logrus.Fields{
+				"alias":  identity.Alias,
+				"tenant": resolved.TenantID,
+				"client": resolved.ClientID,
+			})))
+			token, err := acquireToken(exchangeCtx, resolved, exchanger)
+			stats.Stop()
+			result := TokenResult{Token: token, Err: err, stats: stats}
+			if err == nil {
+				result.ExpiresOn = token.ExpiresAt(wallClock.Now())
+			}
+			mu.Lock()
+			results[identity.Alias] = result
+			mu.Unlock()
+			return nil
+		})
+	}
+	_ = g.Wait()
+	return results
+}
+
+// execBatch exchanges tokens for every configured identity, writes
+// the successful tokens and a summary of the batch, and reports the
+// failures according to the failure policy.
+func execBatch(ctx context.Context, args Args, exchanger *Exchanger) error {
+	results := ExchangeBatch(ctx, args, exchanger)
+
+	entries := make([]cardIdentity, 0, len(results))
+	for _, identity := range args.Identities {
+		result := results[identity.Alias]
+		entry := newCardIdentity(resolveIdentity(args, identity), result.Token, result.Err)
+		entry.Alias = identity.Alias
+		entries = append(entries, entry)
+	}
+	defer writeCard(ctx, entries...)
+
+	var failed []string
+	for _, identity := range args.Identities {
+		result := results[identity.Alias]
+		// The lines and outputs of the identity carry its alias.
+		ctx := withLogger(ctx, logger(ctx).WithField("alias", identity.Alias))
+		output := secretOutput(ctx, args)
+		writeTimingOutputs(ctx, "_"+outputSuffix(identity.Alias), result.stats)
+		if result.Err != nil {
+			logger(ctx).Errorf("identity %s: %s", identity.Alias, result.Err)
+			writeErrorOutputs(ctx, "_"+outputSuffix(identity.Alias), result.Err)
+			failed = append(failed, identity.Alias)
+			continue
+		}
+		suffix := outputSuffix(identity.Alias)
+		if err := output.Write("AZURE_ACCESS_TOKEN_"+suffix, result.Token.AccessToken); err != nil {
+			return err
+		}
+		if err := writeFingerprint(ctx, "AZURE_ACCESS_TOKEN_FINGERPRINT_"+suffix, result.Token.AccessToken); err != nil {
+			return err
+		}
+		if err := writeTokenMetadata(ctx, resolveIdentity(args, identity), "_"+suffix, result.Token); err != nil {
+			return err
+		}
+		if args.ClaimsOutput {
+			if err := writeClaimsOutput(ctx, args, "_"+suffix, result.Token); err != nil {
+				return err
+			}
+		}
+		if args.TerraformVars {
+			if err := writeTerraformVars(ctx, resolveIdentity(args, identity), identity.Alias); err != nil {
+				return err
+			}
+		}
+		checkTokenLifetime(ctx, args, "_"+suffix, result.Token)
+		logger(ctx).Infof("identity %s: Azure access token retrieved successfully", identity.Alias)
+	}
+	if err := writeBatchSummary(ctx, results, failed); err != nil {
+		return err
+	}
+	return batchError(ctx, args, failed)
+}
+
+// batchError returns the error of a batch with failed identities
+// according to the failure policy. Failures the policy tolerates are
+// logged as warnings.
+func batchError(ctx context.Context, args Args, failed []string) error {
+	if len(failed) == 0 {
+		return nil
+	}
+	total := len(args.Identities)
+	var err error
+	switch failurePolicy(args) {
+	case failurePolicyAll:
+		if len(failed) == total {
+			err = fmt.Errorf("token exchange failed for all %d identities: %s", total, strings.Join(failed, ", "))
+		}
+	case failurePolicyRequired:
+		var required []string
+		for _, alias := range failed {
+			if slices.ContainsFunc(args.RequiredAliases, func(r string) bool { return outputSuffix(r) == outputSuffix(alias) }) {
+				required = append(required, alias)
+			}
+		}
+		if len(required) > 0 {
+			err = fmt.Errorf("token exchange failed for %d required identities: %s", len(required), strings.Join(required, ", "))
+		}
+	default:
+		err = fmt.Errorf("token exchange failed for %d of %d identities: %s", len(failed), total, strings.Join(failed, ", "))
+	}
+	if err == nil {
+		logger(ctx).Warnf("token exchange failed for %d of %d identities: %s, allowed by the %s failure policy",
+			len(failed), total, strings.Join(failed, ", "), failurePolicy(args))
+	}
+	return err
+}
+
+// writeBatchSummary writes the outcome of every identity as a JSON
+// object keyed by alias, and the failed aliases, to the non-secret
+// output file.
+func writeBatchSummary(ctx context.Context, results map[string]TokenResult, failed []string) error {
+	output := plainOutput(ctx)
+	if output == nil {
+		return nil
+	}
+	summary := make(map[string]batchSummaryEntry, len(results))
+	for alias, result := range results {
+		if result.Err != nil {
+			summary[alias] = batchSummaryEntry{Status: "failed", ErrorCode: errorCode(result.Err)}
+			continue
+		}
+		summary[alias] = batchSummaryEntry{Status: "succeeded", ExpiresOn: result.ExpiresOn.UTC().Format(time.RFC3339)}
+	}
+	data, err := json.Marshal(summary)
+	if err != nil {
+		return err
+	}
+	if err := output.Write("AZURE_OIDC_BATCH_SUMMARY", string(data)); err != nil {
+		return err
+	}
+	return output.Write("AZURE_OIDC_BATCH_FAILED", strings.Join(failed, ","))
+}
+
+// outputSuffix converts an alias to an output variable suffix.
+func outputSuffix(alias string) string {
+	return strings.Map(func(r rune) rune {
+		switch {
+		case r >= 'a' && r <= 'z':
+			return r - 'a' + 'A'
+		case r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			return r
+		default:
+			return '_'
+		}
+	}, alias)
+}
@@ -0,0 +1,317 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestIdentities_Decode(t *testing.T) {
+	var ids Identities
+	if err := ids.Decode(`[{"alias":"reader","client_id":"c1"},{"alias":"deployer","scope":"s"}]`); err != nil {
+		t.Fatalf("Decode returned error: %v", err)
+	}
+	if len(ids) != 2 || ids[0].Alias != "reader" || ids[0].ClientID != "c1" || ids[1].Scope != "s" {
+		t.Fatalf("unexpected identities: %+v", ids)
+	}
+	if err := ids.Decode(`{"alias":"x"}`); err == nil {
+		t.Fatalf("expected error for non-array value")
+	}
+}
+
+func TestVerifyEnv_Identities(t *testing.T) {
+	guid := "12345678-1234-1234-1234-1234567890ab"
+	args := Args{
+		OIDCToken: testOIDCToken,
+		TenantID:  guid,
+		Identities: Identities{
+			{Alias: "reader", ClientID: guid},
+			{Alias: "deployer", ClientID: guid},
+		},
+	}
+	if err := VerifyEnv(context.Background(), args); err != nil {
+		t.Fatalf("VerifyEnv returned error: %v", err)
+	}
+
+	args.Identities = append(args.Identities, Identity{Alias: "Reader", ClientID: guid})
+	if err := VerifyEnv(context.Background(), args); err == nil || !strings.Contains(err.Error(), "duplicate alias") {
+		t.Fatalf("expected duplicate alias error, got %v", err)
+	}
+
+	args.Identities = Identities{{Alias: "reader"}}
+	if err := VerifyEnv(context.Background(), args); err == nil || !strings.Contains(err.Error(), "client-id is not provided") {
+		t.Fatalf("expected missing client-id error, got %v", err)
+	}
+}
+
+func TestExecBatch(t *testing.T) {
+	failing := "00000000-0000-0000-0000-000000000002"
+	var active, peak int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := atomic.AddInt32(&active, 1)
+		defer atomic.AddInt32(&active, -1)
+		for {
+			p := atomic.LoadInt32(&peak)
+			if n <= p || atomic.CompareAndSwapInt32(&peak, p, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+
+		if r.PostFormValue("client_id") == failing {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_client","error_description":"AADSTS700016"}`))
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"token-` + r.PostFormValue("client_id")[35:] + `"}`))
+	}))
+	defer srv.Close()
+
+	outPath := filepath.Join(t.TempDir(), "out.env")
+	t.Setenv("HARNESS_OUTPUT_SECRET_FILE", outPath)
+
+	args := Args{
+		OIDCToken:     testOIDCToken,
+		TenantID:      "12345678-1234-1234-1234-1234567890ab",
+		AuthorityHost: srv.URL,
+		Concurrency:   2,
+		Identities: Identities{
+			{Alias: "one", ClientID: "00000000-0000-0000-0000-000000000001"},
+			{Alias: "two", ClientID: failing},
+			{Alias: "three", ClientID: "00000000-0000-0000-0000-000000000003"},
+			{Alias: "four", ClientID: "00000000-0000-0000-0000-000000000004"},
+		},
+	}
+	err := execBatch(context.Background(), args, &Exchanger{Client: mustHTTPClient(t, transportOptions{})})
+	if err == nil || !strings.Contains(err.Error(), "1 of 4 identities: two") {
+		t.Fatalf("expected failure for identity two, got %v", err)
+	}
+	if got := atomic.LoadInt32(&peak); got > 2 {
+		t.Fatalf("expected at most 2 concurrent exchanges, got %d", got)
+	}
+
+	data, err := os.ReadFile(outPath)
+	if err != nil {
+		t.Fatalf("failed reading output file: %v", err)
+	}
+	want := "AZURE_ACCESS_TOKEN_ONE=token-1\nAZURE_ACCESS_TOKEN_THREE=token-3\nAZURE_ACCESS_TOKEN_FOUR=token-4\n"
+	if string(data) != want {
+		t.Fatalf("unexpected outputs: got %q want %q", data, want)
+	}
+}
+
+func TestClientIDs_Decode(t *testing.T) {
+	for _, value := range []string{
+		`{"reader":"00000000-0000-0000-0000-000000000001","deployer":"00000000-0000-0000-0000-000000000002"}`,
+		"reader=00000000-0000-0000-0000-000000000001, deployer=00000000-0000-0000-0000-000000000002",
+	} {
+		var ids ClientIDs
+		if err := ids.Decode(value); err != nil {
+			t.Fatalf("Decode(%q) returned error: %v", value, err)
+		}
+		want := []Identity{
+			{Alias: "deployer", ClientID: "00000000-0000-0000-0000-000000000002"},
+			{Alias: "reader", ClientID: "00000000-0000-0000-0000-000000000001"},
+		}
+		if got := ids.Identities(); !reflect.DeepEqual(got, want) {
+			t.Errorf("unexpected identities for %q: %+v", value, got)
+		}
+	}
+
+	var ids ClientIDs
+	if err := ids.Decode("reader"); err == nil {
+		t.Errorf("expected error for a pair without a client id")
+	}
+}
+
+func TestExec_ClientIDs(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"token-` + r.PostFormValue("client_id")[35:] + `"}`))
+	}))
+	defer srv.Close()
+
+	outPath := filepath.Join(t.TempDir(), "out.env")
+	t.Setenv("HARNESS_OUTPUT_SECRET_FILE", outPath)
+
+	args := Args{
+		OIDCToken:     testOIDCToken,
+		TenantID:      "12345678-1234-1234-1234-1234567890ab",
+		AuthorityHost: srv.URL,
+		ClientIDs: ClientIDs{
+			"reader":   "00000000-0000-0000-0000-000000000001",
+			"deployer": "00000000-0000-0000-0000-000000000002",
+		},
+	}
+	if err := Exec(context.Background(), args); err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+	data, _ := os.ReadFile(outPath)
+	if want := "AZURE_ACCESS_TOKEN_DEPLOYER=token-2\nAZURE_ACCESS_TOKEN_READER=token-1\n"; string(data) != want {
+		t.Fatalf("unexpected outputs: got %q want %q", data, want)
+	}
+}
+
+func TestExec_TerraformVars(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"abc"}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	t.Setenv("HARNESS_OUTPUT_SECRET_FILE", filepath.Join(dir, "secret.env"))
+	t.Setenv("DRONE_OUTPUT", filepath.Join(dir, "out.env"))
+
+	args := Args{
+		OIDCToken:     testOIDCToken,
+		TenantID:      "12345678-1234-1234-1234-1234567890ab",
+		AuthorityHost: srv.URL,
+		TerraformVars: true,
+		Identities: Identities{
+			{Alias: "prod", ClientID: "00000000-0000-0000-0000-000000000001", SubscriptionID: "11111111-1111-1111-1111-111111111111"},
+			{Alias: "shared-dns", TenantID: "22222222-2222-2222-2222-222222222222", ClientID: "00000000-0000-0000-0000-000000000002"},
+		},
+	}
+	if err := Exec(context.Background(), args); err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+	plain, _ := readOutputFile(filepath.Join(dir, "out.env"))
+	for key, want := range map[string]string{
+		"TF_VAR_prod_tenant_id":       "12345678-1234-1234-1234-1234567890ab",
+		"TF_VAR_prod_client_id":       "00000000-0000-0000-0000-000000000001",
+		"TF_VAR_prod_subscription_id": "11111111-1111-1111-1111-111111111111",
+		"AZURE_SUBSCRIPTION_ID_PROD":  "11111111-1111-1111-1111-111111111111",
+		"TF_VAR_shared_dns_tenant_id": "22222222-2222-2222-2222-222222222222",
+		"TF_VAR_shared_dns_client_id": "00000000-0000-0000-0000-000000000002",
+	} {
+		if got := plain[key]; got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+	if _, ok := plain["TF_VAR_shared_dns_subscription_id"]; ok {
+		t.Errorf("unexpected subscription output for shared-dns")
+	}
+	secrets, _ := readOutputFile(filepath.Join(dir, "secret.env"))
+	if secrets["TF_VAR_prod_oidc_token"] != testOIDCToken || secrets["TF_VAR_shared_dns_oidc_token"] != testOIDCToken {
+		t.Errorf("unexpected secret outputs %v", secrets)
+	}
+
+	args.Identities = nil
+	args.ClientID = "00000000-0000-0000-0000-000000000001"
+	if err := VerifyEnv(context.Background(), args); err == nil || !strings.Contains(err.Error(), "terraform-vars requires identities") {
+		t.Errorf("expected error without identities, got %v", err)
+	}
+}
+
+func TestExecBatch_FailurePolicy(t *testing.T) {
+	failing := "00000000-0000-0000-0000-000000000002"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if r.PostFormValue("client_id") == failing {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_client","error_description":"AADSTS700016: not found","error_codes":[700016]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"abc"}`))
+	}))
+	defer srv.Close()
+
+	args := Args{
+		OIDCToken:     testOIDCToken,
+		TenantID:      "12345678-1234-1234-1234-1234567890ab",
+		AuthorityHost: srv.URL,
+		Identities: Identities{
+			{Alias: "reader", ClientID: "00000000-0000-0000-0000-000000000001"},
+			{Alias: "optional", ClientID: failing},
+		},
+	}
+	exchanger := &Exchanger{Client: mustHTTPClient(t, transportOptions{})}
+
+	results := ExchangeBatch(context.Background(), args, exchanger)
+	if got := results["reader"]; got.Err != nil || got.Token.AccessToken != "abc" || got.ExpiresOn.IsZero() {
+		t.Errorf("unexpected result for reader: %+v", got)
+	}
+	if got := results["optional"]; got.Err == nil || got.Token != nil {
+		t.Errorf("expected failure for optional, got %+v", got)
+	}
+
+	tests := []struct {
+		policy   string
+		required []string
+		wantErr  string
+	}{
+		{policy: "", wantErr: "1 of 2 identities: optional"},
+		{policy: "any", wantErr: "1 of 2 identities: optional"},
+		{policy: "all"},
+		{policy: "required", required: []string{"reader"}},
+		{required: []string{"Optional"}, wantErr: "1 required identities: optional"},
+	}
+	for _, test := range tests {
+		dir := t.TempDir()
+		t.Setenv("HARNESS_OUTPUT_SECRET_FILE", filepath.Join(dir, "secret.env"))
+		t.Setenv("DRONE_OUTPUT", filepath.Join(dir, "out.env"))
+
+		args.FailurePolicy, args.RequiredAliases = test.policy, test.required
+		if err := VerifyEnv(context.Background(), args); err != nil {
+			t.Fatalf("policy %q: VerifyEnv returned error: %v", test.policy, err)
+		}
+		err := execBatch(context.Background(), args, exchanger)
+		if test.wantErr == "" && err != nil {
+			t.Errorf("policy %q: unexpected error: %v", test.policy, err)
+		}
+		if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("policy %q: expected error %q, got %v", test.policy, test.wantErr, err)
+		}
+
+		plain, _ := readOutputFile(filepath.Join(dir, "out.env"))
+		if got := plain["AZURE_OIDC_BATCH_FAILED"]; got != "optional" {
+			t.Errorf("AZURE_OIDC_BATCH_FAILED = %q, want optional", got)
+		}
+		var summary map[string]batchSummaryEntry
+		if err := json.Unmarshal([]byte(plain["AZURE_OIDC_BATCH_SUMMARY"]), &summary); err != nil {
+			t.Fatalf("invalid summary %q: %v", plain["AZURE_OIDC_BATCH_SUMMARY"], err)
+		}
+		if summary["reader"].Status != "succeeded" || summary["reader"].ExpiresOn == "" ||
+			summary["optional"].Status != "failed" || summary["optional"].ErrorCode != "AADSTS700016" {
+			t.Errorf("unexpected summary %+v", summary)
+		}
+	}
+}
+
+func TestVerifyFailurePolicy(t *testing.T) {
+	args := Args{Identities: Identities{{Alias: "reader"}, {Alias: "deployer"}}}
+	for _, test := range []struct {
+		policy   string
+		required []string
+		wantErr  string
+	}{
+		{policy: "ALL"},
+		{required: []string{"Deployer"}},
+		{policy: "first", wantErr: "unsupported failure-policy"},
+		{policy: "required", wantErr: "requires required-aliases"},
+		{policy: "any", required: []string{"reader"}, wantErr: "requires the required failure-policy"},
+		{required: []string{"writer"}, wantErr: `required alias "writer"`},
+	} {
+		args.FailurePolicy, args.RequiredAliases = test.policy, test.required
+		err := verifyFailurePolicy(args)
+		if test.wantErr == "" && err != nil {
+			t.Errorf("policy %q %v: unexpected error: %v", test.policy, test.required, err)
+		}
+		if test.wantErr != "" && (err == nil || !strings.Contains(err.Error(), test.wantErr)) {
+			t.Errorf("policy %q %v: expected error %q, got %v", test.policy, test.required, test.wantErr, err)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"sync"
+	"time"
+)
+
+// default settings for the circuit breaker
+const (
+	defaultBreakerThreshold   = 3
+	defaultBreakerCooldown    = 30 * time.Second
+	defaultBreakerMaxCooldown = 5 * time.Minute
+)
+
+// circuitBreaker stops calling Azure after repeated failures. Once
+// the failure threshold is reached the circuit opens for a cooldown
+// that doubles with every further failure, up to a maximum. After
+// the cooldown a single trial request is allowed through.
+type circuitBreaker struct {
+	mu          sync.Mutex
+	threshold   int
+	cooldown    time.Duration
+	maxCooldown time.Duration
+	failures    int
+	openUntil   time.Time
+}
+
+// newCircuitBreaker returns a circuit breaker that opens after
+// threshold consecutive failures.
+func newCircuitBreaker(threshold int, cooldown time.Duration) *circuitBreaker {
+	if threshold <= 0 {
+		threshold = defaultBreakerThreshold
+	}
+	if cooldown <= 0 {
+		cooldown = defaultBreakerCooldown
+	}
+	maxCooldown := defaultBreakerMaxCooldown
+	if cooldown > maxCooldown {
+		maxCooldown = cooldown
+	}
+	return &circuitBreaker{
+		threshold:   threshold,
+		cooldown:    cooldown,
+		maxCooldown: maxCooldown,
+	}
+}
+
+// Allow reports whether a request may be sent to Azure.
+func (b *circuitBreaker) Allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return !now.Before(b.openUntil)
+}
+
+// Success records a successful request and closes the circuit.
+func (b *circuitBreaker) Success() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures = 0
+	b.openUntil = time.Time{}
+}
+
+// Failure records a failed request, opening the circuit once the
+// threshold is reached. It returns the time the circuit stays open
+// until, or the zero time if the circuit is still closed.
+func (b *circuitBreaker) Failure(now time.Time) time.Time {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.failures++
+	if b.failures < b.threshold {
+		return time.Time{}
+	}
+	cooldown := b.cooldown
+	for i := b.threshold; i < b.failures && cooldown < b.maxCooldown; i++ {
+		cooldown *= 2
+	}
+	if cooldown > b.maxCooldown {
+		cooldown = b.maxCooldown
+	}
+	b.openUntil = now.Add(cooldown)
+	return b.openUntil
+}
@@ -0,0 +1,277 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// default settings for the workspace token cache
+const (
+	defaultCacheDir    = ".azure-oidc-cache"
+	defaultCacheBuffer = 5 * time.Minute
+)
+
+// cacheEntry is a token persisted in the workspace cache.
+type cacheEntry struct {
+	TokenType    string `json:"token_type"`
+	AccessToken  string `json:"access_token"`
+	ExpiresOn    int64  `json:"expires_on"`
+	ExtExpiresOn int64  `json:"ext_expires_on,omitempty"`
+	Scope        string `json:"scope,omitempty"`
+
+	// expires and extExpires are the expiries with the monotonic
+	// clock reading of the process that acquired the token. They are
+	// not persisted.
+	expires    time.Time
+	extExpires time.Time
+}
+
+// newCacheEntry returns the cache entry of the token acquired at now.
+func newCacheEntry(now time.Time, token *AzureTokenResponse) *cacheEntry {
+	expires, extExpires := token.ExpiresAt(now), token.ExtendedExpiresAt(now)
+	entry := &cacheEntry{
+		TokenType:   token.TokenType,
+		AccessToken: token.AccessToken,
+		ExpiresOn:   expires.Unix(),
+		Scope:       token.Scope,
+		expires:     expires,
+		extExpires:  extExpires,
+	}
+	if extExpires.After(expires) {
+		entry.ExtExpiresOn = extExpires.Unix()
+	}
+	return entry
+}
+
+// remaining returns the lifetime left on the cached token. Within
+// the process that acquired the token, the monotonic clock also
+// bounds the lifetime, so a wall clock that is frozen or set back
+// does not keep an expired token alive.
+func (e *cacheEntry) remaining(now time.Time) time.Duration {
+	remaining := time.Unix(e.ExpiresOn, 0).Sub(now)
+	if !e.expires.IsZero() {
+		remaining = min(remaining, e.expires.Sub(now))
+	}
+	return remaining
+}
+
+// extendedRemaining returns the extended lifetime left on the cached
+// token, which is its lifetime when Azure AD returned no extended
+// lifetime.
+func (e *cacheEntry) extendedRemaining(now time.Time) time.Duration {
+	if e.ExtExpiresOn == 0 {
+		return e.remaining(now)
+	}
+	remaining := time.Unix(e.ExtExpiresOn, 0).Sub(now)
+	if !e.extExpires.IsZero() {
+		remaining = min(remaining, e.extExpires.Sub(now))
+	}
+	return remaining
+}
+
+// usable returns the lifetime left on the cached token, or its
+// extended lifetime once the token has expired.
+func (e *cacheEntry) usable(now time.Time) time.Duration {
+	if remaining := e.remaining(now); remaining > 0 {
+		return remaining
+	}
+	return e.extendedRemaining(now)
+}
+
+// token returns the cached token with the lifetimes left at now.
+func (e *cacheEntry) token(now time.Time) *AzureTokenResponse {
+	token := &AzureTokenResponse{
+		TokenType:   e.TokenType,
+		AccessToken: e.AccessToken,
+		ExpiresIn:   int(e.usable(now).Truncate(time.Second).Seconds()),
+		Scope:       e.Scope,
+	}
+	if e.ExtExpiresOn != 0 {
+		token.ExtExpiresIn = int(e.extendedRemaining(now).Truncate(time.Second).Seconds())
+	}
+	return token
+}
+
+// isOutage reports whether the error is a transient failure of the
+// authority rather than a rejection of the request, during which
+// tokens may be used for their extended lifetime.
+func isOutage(err error) bool {
+	var retryErr *retryableError
+	return errors.As(err, &retryErr) || errors.Is(err, ErrNetwork) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// tokenCache stores exchanged tokens in the shared workspace so
+// later steps of the same execution can reuse them. Entries are
+// encrypted with AES-GCM using a key derived from a secret and
+// scoped to the execution, so that steps without access to the
+// secret cannot read them.
+type tokenCache struct {
+	dir string
+	key []byte
+}
+
+// errNoEncryptionKey is returned when the token cache is used
+// without a secret. The execution metadata alone is readable by
+// every step of the execution.
+var errNoEncryptionKey = errors.New("token cache requires encryption-key")
+
+// newTokenCache returns a token cache rooted at dir. The encryption
+// key is derived from the secret and the execution key material
+// using HMAC-SHA256. Without a secret entries can be neither written
+// nor read.
+func newTokenCache(dir string, secret string, material ...string) *tokenCache {
+	if dir == "" {
+		dir = defaultCacheDir
+	}
+	cache := &tokenCache{dir: dir}
+	if secret != "" {
+		cache.key = deriveKey(secret, "drone-azure-oidc/cache", material...)
+	}
+	return cache
+}
+
+// deriveKey derives a 256-bit key from the secret, a purpose label
+// and the key material.
+func deriveKey(secret, label string, material ...string) []byte {
+	h := hmac.New(sha256.New, []byte(secret))
+	io.WriteString(h, label)
+	for _, m := range material {
+		io.WriteString(h, "\x00"+m)
+	}
+	return h.Sum(nil)
+}
+
+// discoveryCacheKey returns the key authenticating the discovery
+// documents memoized in the workspace, or nil when encryption_key is
+// not set. The execution metadata alone is readable by every step,
+// so without a secret an earlier step could forge a document.
+func discoveryCacheKey(args Args) []byte {
+	if args.EncryptionKey == "" {
+		return nil
+	}
+	return deriveKey(args.EncryptionKey, "drone-azure-oidc/discovery", executionKeyMaterial(args)...)
+}
+
+// executionKeyMaterial returns values that identify the current
+// pipeline execution, used to scope the cache encryption key.
+func executionKeyMaterial(args Args) []string {
+	return []string{
+		args.Repo.Slug,
+		fmt.Sprint(args.Build.Number),
+		fmt.Sprint(args.Build.Created),
+		os.Getenv("HARNESS_EXECUTION_ID"),
+	}
+}
+
+// path returns the cache file for the tenant, client and scope.
+func (c *tokenCache) path(authorityHost, tenantID, clientID, scope string) string {
+	sum := sha256.Sum256([]byte(strings.Join([]string{authorityHost, tenantID, clientID, scope}, "\x00")))
+	return filepath.Join(c.dir, hex.EncodeToString(sum[:])+".bin")
+}
+
+// Load returns the cached token for the tenant, client and scope.
+// A missing or undecryptable entry returns a nil entry and no error.
+func (c *tokenCache) Load(authorityHost, tenantID, clientID, scope string) (*cacheEntry, error) {
+	data, err := os.ReadFile(c.path(authorityHost, tenantID, clientID, scope))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read token cache: %w", err)
+	}
+	plain, err := c.open(data)
+	if err != nil {
+		// entries written by a different execution cannot be
+		// decrypted and are treated as a cache miss.
+		return nil, nil
+	}
+	entry := new(cacheEntry)
+	if err := json.Unmarshal(plain, entry); err != nil {
+		return nil, nil
+	}
+	return entry, nil
+}
+
+// Store writes the token to the cache for the tenant, client and scope.
+func (c *tokenCache) Store(authorityHost, tenantID, clientID, scope string, entry *cacheEntry) error {
+	plain, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode token cache entry: %w", err)
+	}
+	data, err := c.seal(plain)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(c.dir, 0700); err != nil {
+		return fmt.Errorf("failed to create token cache directory: %w", err)
+	}
+
+	// write to a temporary file and rename so concurrent readers
+	// never observe a partially written entry.
+	tmp, err := os.CreateTemp(c.dir, ".tmp-*")
+	if err != nil {
+		return fmt.Errorf("failed to write token cache: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write token cache: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write token cache: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), c.path(authorityHost, tenantID, clientID, scope)); err != nil {
+		return fmt.Errorf("failed to write token cache: %w", err)
+	}
+	return nil
+}
+
+func (c *tokenCache) seal(plain []byte) ([]byte, error) {
+	gcm, err := c.aead()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return gcm.Seal(nonce, nonce, plain, nil), nil
+}
+
+func (c *tokenCache) open(data []byte) ([]byte, error) {
+	gcm, err := c.aead()
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("token cache entry is truncated")
+	}
+	nonce, ciphertext := data[:gcm.NonceSize()], data[gcm.NonceSize():]
+	return gcm.Open(nil, nonce, ciphertext, nil)
+}
+
+func (c *tokenCache) aead() (cipher.AEAD, error) {
+	if c.key == nil {
+		return nil, errNoEncryptionKey
+	}
+	block, err := aes.NewCipher(c.key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to initialize token cache cipher: %w", err)
+	}
+	return cipher.NewGCM(block)
+}
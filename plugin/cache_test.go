@@ -0,0 +1,216 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenCache_RoundTrip(t *testing.T) {
+	cache := newTokenCache(t.TempDir(), "step-secret", "execution-1")
+	entry := &cacheEntry{TokenType: "Bearer", AccessToken: "abc", ExpiresOn: time.Now().Add(time.Hour).Unix()}
+
+	if err := cache.Store("host", "tenant", "client", "scope", entry); err != nil {
+		t.Fatalf("Store returned error: %v", err)
+	}
+	got, err := cache.Load("host", "tenant", "client", "scope")
+	if err != nil {
+		t.Fatalf("Load returned error: %v", err)
+	}
+	if got == nil || *got != *entry {
+		t.Fatalf("unexpected cache entry: got %+v want %+v", got, entry)
+	}
+
+	// a different scope must not share the entry
+	if got, _ := cache.Load("host", "tenant", "client", "other"); got != nil {
+		t.Fatalf("expected cache miss for a different scope, got %+v", got)
+	}
+}
+
+func TestTokenCache_Encrypted(t *testing.T) {
+	dir := t.TempDir()
+	cache := newTokenCache(dir, "step-secret", "execution-1")
+	entry := &cacheEntry{AccessToken: "super-secret-token", ExpiresOn: time.Now().Add(time.Hour).Unix()}
+	if err := cache.Store("host", "tenant", "client", "scope", entry); err != nil {
+		t.Fatalf("Store returned error: %v", err)
+	}
+
+	data, err := os.ReadFile(cache.path("host", "tenant", "client", "scope"))
+	if err != nil {
+		t.Fatalf("failed reading cache file: %v", err)
+	}
+	if strings.Contains(string(data), "super-secret-token") {
+		t.Fatalf("cache file contains the plaintext token")
+	}
+
+	// another execution cannot read the entry
+	other := newTokenCache(dir, "step-secret", "execution-2")
+	if got, err := other.Load("host", "tenant", "client", "scope"); got != nil || err != nil {
+		t.Fatalf("expected cache miss for another execution, got %+v, %v", got, err)
+	}
+}
+
+func TestTokenCache_EncryptionKey(t *testing.T) {
+	dir := t.TempDir()
+	entry := &cacheEntry{AccessToken: "abc", ExpiresOn: time.Now().Add(time.Hour).Unix()}
+	if err := newTokenCache(dir, "step-secret", "execution-1").Store("host", "tenant", "client", "scope", entry); err != nil {
+		t.Fatalf("Store returned error: %v", err)
+	}
+
+	// a cache without a secret cannot write entries
+	if err := newTokenCache(dir, "", "execution-1").Store("host", "tenant", "client", "other", entry); !errors.Is(err, errNoEncryptionKey) {
+		t.Fatalf("expected Store without the encryption key to fail, got %v", err)
+	}
+	if _, err := os.Stat(newTokenCache(dir, "", "execution-1").path("host", "tenant", "client", "other")); !os.IsNotExist(err) {
+		t.Fatalf("expected no entry written without the encryption key, got %v", err)
+	}
+
+	// the same execution without the secret cannot read the entry
+	if got, _ := newTokenCache(dir, "", "execution-1").Load("host", "tenant", "client", "scope"); got != nil {
+		t.Fatalf("expected cache miss without the encryption key, got %+v", got)
+	}
+	if got, _ := newTokenCache(dir, "other-secret", "execution-1").Load("host", "tenant", "client", "scope"); got != nil {
+		t.Fatalf("expected cache miss with a different encryption key, got %+v", got)
+	}
+	if got, _ := newTokenCache(dir, "step-secret", "execution-1").Load("host", "tenant", "client", "scope"); got == nil || got.AccessToken != "abc" {
+		t.Fatalf("expected cache hit with the encryption key, got %+v", got)
+	}
+}
+
+func TestVerifyEnv_CacheRequiresEncryptionKey(t *testing.T) {
+	args := Args{
+		OIDCToken: testOIDCToken,
+		TenantID:  "12345678-1234-1234-1234-1234567890ab",
+		ClientID:  "12345678-1234-1234-1234-1234567890ab",
+		Cache:     true,
+	}
+	if err := VerifyEnv(context.Background(), args); err == nil || !strings.Contains(err.Error(), "cache requires encryption-key") {
+		t.Fatalf("expected encryption-key error, got %v", err)
+	}
+	args.EncryptionKey = "step-secret"
+	if err := VerifyEnv(context.Background(), args); err != nil {
+		t.Fatalf("VerifyEnv returned error: %v", err)
+	}
+}
+
+func TestAcquireToken_ReusesCachedToken(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"abc"}`))
+	}))
+	defer srv.Close()
+
+	args := Args{
+		OIDCToken:     testOIDCToken,
+		TenantID:      "12345678-1234-1234-1234-1234567890ab",
+		ClientID:      "12345678-1234-1234-1234-1234567890ab",
+		AuthorityHost: srv.URL,
+		Cache:         true,
+		CacheDir:      filepath.Join(t.TempDir(), "cache"),
+		EncryptionKey: "step-secret",
+	}
+	for i := 0; i < 3; i++ {
+		token, err := acquireToken(context.Background(), args, new(Exchanger))
+		if err != nil {
+			t.Fatalf("acquireToken returned error: %v", err)
+		}
+		if token.AccessToken != "abc" {
+			t.Fatalf("unexpected access token %q", token.AccessToken)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("expected a single exchange, got %d", calls)
+	}
+
+	// a buffer longer than the token lifetime forces a new exchange
+	args.CacheBuffer = 2 * time.Hour
+	if _, err := acquireToken(context.Background(), args, new(Exchanger)); err != nil {
+		t.Fatalf("acquireToken returned error: %v", err)
+	}
+	if calls != 2 {
+		t.Fatalf("expected a second exchange, got %d", calls)
+	}
+
+	// force refresh bypasses a valid cached token
+	args.CacheBuffer = 0
+	args.ForceRefresh = true
+	if _, err := acquireToken(context.Background(), args, new(Exchanger)); err != nil {
+		t.Fatalf("acquireToken returned error: %v", err)
+	}
+	if calls != 3 {
+		t.Fatalf("expected force refresh to exchange, got %d calls", calls)
+	}
+}
+
+func TestExchange_DiscoveryMemoized(t *testing.T) {
+	discoveries := 0
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/mytenant/v2.0/.well-known/openid-configuration":
+			discoveries++
+			_, _ = w.Write([]byte(`{"issuer":"issuer","token_endpoint":"` + srv.URL + `/custom/token"}`))
+		case "/custom/token":
+			_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"abc"}`))
+		default:
+			t.Errorf("unexpected path %s", r.URL.Path)
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	e := &Exchanger{Discovery: true, DiscoveryCacheDir: dir, DiscoveryCacheKey: discoveryCacheKey(Args{EncryptionKey: "secret"})}
+	for i := 0; i < 2; i++ {
+		token, err := e.Exchange(context.Background(), "id-token", "mytenant", "client", "", srv.URL)
+		if err != nil {
+			t.Fatalf("Exchange returned error: %v", err)
+		}
+		if token.AccessToken != "abc" {
+			t.Fatalf("unexpected access token %q", token.AccessToken)
+		}
+	}
+	if discoveries != 1 {
+		t.Fatalf("expected discovery to be memoized, got %d requests", discoveries)
+	}
+
+	// a memoized document rewritten by another step is not used
+	files, _ := filepath.Glob(filepath.Join(dir, "discovery-*.json"))
+	if len(files) != 1 {
+		t.Fatalf("expected one memoized document, got %v", files)
+	}
+	data, _ := os.ReadFile(files[0])
+	data = bytes.Replace(data, []byte("/custom/token"), []byte("/attacker/token"), 1)
+	if err := os.WriteFile(files[0], data, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.Exchange(context.Background(), "id-token", "mytenant", "client", "", srv.URL); err != nil {
+		t.Fatalf("Exchange returned error: %v", err)
+	}
+	if discoveries != 2 {
+		t.Fatalf("expected the tampered document to be fetched again, got %d requests", discoveries)
+	}
+
+	// without a cache key the document is never memoized
+	e = &Exchanger{Discovery: true, DiscoveryCacheDir: t.TempDir(), DiscoveryCacheKey: discoveryCacheKey(Args{})}
+	for i := 0; i < 2; i++ {
+		if _, err := e.Exchange(context.Background(), "id-token", "mytenant", "client", "", srv.URL); err != nil {
+			t.Fatalf("Exchange returned error: %v", err)
+		}
+	}
+	if discoveries != 4 {
+		t.Fatalf("expected discovery without memoization, got %d requests", discoveries)
+	}
+}
@@ -0,0 +1,133 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// cardSchema is the adaptive card template used to render the card.
+const cardSchema = "https://raw.githubusercontent.com/harness-community/drone-azure-oidc/main/card.json"
+
+// card summarizes the outcome of the step for display in the UI. It
+// never contains tokens.
+type card struct {
+	Identities []cardIdentity `json:"identities"`
+	Warnings   []string       `json:"warnings,omitempty"`
+}
+
+// cardIdentity is the outcome for a single identity.
+type cardIdentity struct {
+	Alias       string `json:"alias,omitempty"`
+	TenantID    string `json:"tenant_id"`
+	ClientID    string `json:"client_id"`
+	Scope       string `json:"scope"`
+	ExpiresOn   string `json:"expires_on,omitempty"`
+	Fingerprint string `json:"fingerprint,omitempty"`
+	Error       string `json:"error,omitempty"`
+}
+
+// newCardIdentity returns the card entry for an exchange.
+func newCardIdentity(args Args, token *AzureTokenResponse, err error) cardIdentity {
+	entry := cardIdentity{
+		TenantID: args.TenantID,
+		ClientID: args.ClientID,
+		Scope:    args.Scope,
+	}
+	if entry.Scope == "" {
+		entry.Scope = defaultScope
+	}
+	if err != nil {
+		entry.Error = redactor.Redact(err.Error())
+		return entry
+	}
+	entry.ExpiresOn = token.ExpiresAt(wallClock.Now()).UTC().Format(time.RFC3339)
+	entry.Fingerprint = tokenFingerprint(token.AccessToken)
+	return entry
+}
+
+// writeCard writes the card to the DRONE_CARD_PATH file, or encoded
+// to the log stream when the path is stdout or stderr. Card
+// failures are logged and do not fail the step.
+func writeCard(ctx context.Context, identities ...cardIdentity) {
+	path := os.Getenv("DRONE_CARD_PATH")
+	if path == "" {
+		return
+	}
+	data, err := json.Marshal(map[string]interface{}{
+		"schema": cardSchema,
+		"data":   card{Identities: identities, Warnings: warnings.List()},
+	})
+	if err != nil {
+		logger(ctx).Warnf("failed to encode card: %s", err)
+		return
+	}
+	switch path {
+	case "/dev/stdout":
+		writeCardTo(os.Stdout, data)
+	case "/dev/stderr":
+		writeCardTo(os.Stderr, data)
+	default:
+		if err := os.WriteFile(path, data, 0644); err != nil {
+			logger(ctx).Warnf("failed to write card: %s", err)
+		}
+	}
+}
+
+func writeCardTo(out io.Writer, data []byte) {
+	encoded := base64.StdEncoding.EncodeToString(data)
+	_, _ = io.WriteString(out, "\u001B]1338;")
+	_, _ = io.WriteString(out, encoded)
+	_, _ = io.WriteString(out, "\u001B]0m")
+	_, _ = io.WriteString(out, "\n")
+}
+
+// warnings collects the warnings logged during the run so they can
+// be shown on the card.
+var warnings = new(warningHook)
+
+func init() {
+	logrus.AddHook(warnings)
+}
+
+// warningHook is a logrus hook recording warning messages.
+type warningHook struct {
+	mu       sync.Mutex
+	messages []string
+}
+
+// Levels implements the logrus.Hook interface.
+func (h *warningHook) Levels() []logrus.Level {
+	return []logrus.Level{logrus.WarnLevel}
+}
+
+// Fire implements the logrus.Hook interface. Messages are redacted
+// independently since hooks run in registration order.
+func (h *warningHook) Fire(entry *logrus.Entry) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.messages = append(h.messages, redactor.Redact(entry.Message))
+	return nil
+}
+
+// List returns the recorded warnings.
+func (h *warningHook) List() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return append([]string(nil), h.messages...)
+}
+
+// Reset discards the recorded warnings.
+func (h *warningHook) Reset() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.messages = nil
+}
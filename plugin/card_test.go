@@ -0,0 +1,64 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExec_Card(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"card-access-token"}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	cardPath := filepath.Join(dir, "card.json")
+	t.Setenv("DRONE_CARD_PATH", cardPath)
+	t.Setenv("HARNESS_OUTPUT_SECRET_FILE", filepath.Join(dir, "out.env"))
+
+	args := Args{
+		OIDCToken:          testOIDCToken,
+		TenantID:           "2d4b6c8e-1f3a-4b5c-9d7e-0a1b2c3d4e5f",
+		ClientID:           "8f7e6d5c-4b3a-4291-8e7f-6a5b4c3d2e1f",
+		AuthorityHost:      srv.URL,
+		InsecureSkipVerify: true,
+	}
+	if err := Exec(context.Background(), args); err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+
+	data, err := os.ReadFile(cardPath)
+	if err != nil {
+		t.Fatalf("failed to read card: %v", err)
+	}
+	if strings.Contains(string(data), "card-access-token") {
+		t.Fatalf("card contains the access token: %s", data)
+	}
+	var got struct {
+		Schema string `json:"schema"`
+		Data   card   `json:"data"`
+	}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatalf("failed to decode card: %v", err)
+	}
+	if got.Schema != cardSchema || len(got.Data.Identities) != 1 {
+		t.Fatalf("unexpected card: %s", data)
+	}
+	identity := got.Data.Identities[0]
+	if identity.ClientID != args.ClientID || identity.Scope != defaultScope ||
+		identity.ExpiresOn == "" || identity.Fingerprint != tokenFingerprint("card-access-token") {
+		t.Errorf("unexpected card identity: %+v", identity)
+	}
+	if len(got.Data.Warnings) == 0 || !strings.Contains(got.Data.Warnings[0], "insecure_skip_verify") {
+		t.Errorf("expected the insecure_skip_verify warning on the card, got %v", got.Data.Warnings)
+	}
+}
@@ -0,0 +1,161 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// verifyAssertionClaims checks the unverified claims of the OIDC
+// assertion against the configured expectations before the
+// assertion is forwarded to Azure.
+func verifyAssertionClaims(ctx context.Context, args Args) error {
+	if len(args.AllowedIssuers) == 0 && args.ExpectedSubject == "" && args.ClaimsMatchingExpression == "" {
+		return nil
+	}
+	token, err := parseJWT(args.OIDCToken)
+	if err != nil {
+		return fmt.Errorf("oidc-token: %w", err)
+	}
+	if len(args.AllowedIssuers) > 0 {
+		if err := checkIssuer(token.StringClaim("iss"), args.AllowedIssuers); err != nil {
+			return err
+		}
+	}
+	if args.ExpectedSubject != "" {
+		if err := checkSubject(token.StringClaim("sub"), args.ExpectedSubject); err != nil {
+			return err
+		}
+	}
+	if args.ClaimsMatchingExpression != "" {
+		if err := checkClaimsExpression(ctx, token, args.ClaimsMatchingExpression); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkSubject verifies the subject matches the expected subject,
+// where * matches any sequence of characters. A mismatch would
+// otherwise surface as AADSTS70021 (no matching federated identity
+// record) from Azure.
+func checkSubject(subject, expected string) error {
+	if subject == "" {
+		return fmt.Errorf("oidc-token has no subject (sub) claim")
+	}
+	if !matchGlob(expected, subject) {
+		return fmt.Errorf("oidc-token subject %q does not match the expected subject %q", subject, expected)
+	}
+	return nil
+}
+
+// matchGlob reports whether the value matches the pattern, where *
+// matches any sequence of characters and ? matches one character.
+func matchGlob(pattern, value string) bool {
+	expr := regexp.QuoteMeta(pattern)
+	expr = strings.ReplaceAll(expr, `\*`, ".*")
+	expr = strings.ReplaceAll(expr, `\?`, ".")
+	ok, err := regexp.MatchString("^"+expr+"$", value)
+	return err == nil && ok
+}
+
+// checkIssuer verifies the issuer is in the allowed list. Entries
+// may use path.Match wildcards, such as
+// https://app.harness.io/ng/api/oidc/account/*.
+func checkIssuer(issuer string, allowed []string) error {
+	if issuer == "" {
+		return fmt.Errorf("oidc-token has no issuer (iss) claim")
+	}
+	issuer = strings.TrimRight(issuer, "/")
+	for _, pattern := range allowed {
+		pattern = strings.TrimRight(strings.TrimSpace(pattern), "/")
+		if pattern == issuer {
+			return nil
+		}
+		if ok, err := path.Match(pattern, issuer); err == nil && ok {
+			return nil
+		}
+	}
+	return fmt.Errorf("oidc-token issuer %q is not in the allowed issuers", issuer)
+}
+
+// checkTokenRoles verifies the access token grants every required
+// app role (roles claim) or delegated scope (scp claim). A missing
+// role usually means admin consent or the role assignment is missing.
+func checkTokenRoles(accessToken string, required []string) error {
+	if len(required) == 0 {
+		return nil
+	}
+	token, err := parseJWT(accessToken)
+	if err != nil {
+		return fmt.Errorf("cannot verify required roles: access %w", err)
+	}
+	granted := map[string]bool{}
+	for _, role := range token.StringsClaim("roles") {
+		granted[role] = true
+	}
+	for _, scope := range strings.Fields(token.StringClaim("scp")) {
+		granted[scope] = true
+	}
+	var missing []string
+	for _, role := range required {
+		if role = strings.TrimSpace(role); role != "" && !granted[role] {
+			missing = append(missing, role)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("access token is missing required roles or scopes: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// assertionOutputClaims are the claims of the OIDC assertion written
+// to the claims output.
+var assertionOutputClaims = []string{"iss", "sub", "aud", "account_id", "organization_id", "project_id", "pipeline_id"}
+
+// tokenOutputClaims are the claims of the access token written to
+// the claims output.
+var tokenOutputClaims = []string{"iss", "aud", "tid", "appid", "azp", "oid", "sub", "idtyp", "roles"}
+
+// selectClaims returns the named claims present in the token, or nil
+// when the token is not a JWT.
+func selectClaims(token string, names []string) map[string]interface{} {
+	t, err := parseJWT(token)
+	if err != nil {
+		return nil
+	}
+	claims := map[string]interface{}{}
+	for _, name := range names {
+		if value, ok := t.Claims[name]; ok {
+			claims[name] = value
+		}
+	}
+	return claims
+}
+
+// writeClaimsOutput writes the selected claims of the assertion and
+// the access token as JSON to the non-secret output file, so policy
+// and approval steps can gate deployments on the identity. The
+// suffix distinguishes identities in batch mode.
+func writeClaimsOutput(ctx context.Context, args Args, suffix string, token *AzureTokenResponse) error {
+	output := plainOutput(ctx)
+	if output == nil {
+		return nil
+	}
+	data, err := json.Marshal(struct {
+		Assertion map[string]interface{} `json:"assertion,omitempty"`
+		Token     map[string]interface{} `json:"token,omitempty"`
+	}{
+		Assertion: selectClaims(args.OIDCToken, assertionOutputClaims),
+		Token:     selectClaims(token.AccessToken, tokenOutputClaims),
+	})
+	if err != nil {
+		return err
+	}
+	return output.Write("AZURE_OIDC_CLAIMS"+suffix, string(data))
+}
@@ -0,0 +1,21 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import "time"
+
+// clock reports the current time to the token caching, expiry and
+// refresh logic, so tests can control time.
+type clock interface {
+	Now() time.Time
+}
+
+// realClock is the system clock.
+type realClock struct{}
+
+// Now implements the clock interface.
+func (realClock) Now() time.Time { return time.Now() }
+
+// wallClock is the clock of the token caching, expiry and refresh
+// logic. It is replaced in tests.
+var wallClock clock = realClock{}
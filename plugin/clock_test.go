@@ -0,0 +1,196 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// fakeClock is a clock that only moves when advanced.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time { return c.now }
+
+func (c *fakeClock) Advance(d time.Duration) { c.now = c.now.Add(d) }
+
+// setClock replaces the clock for the duration of the test.
+func setClock(t *testing.T, c clock) {
+	t.Helper()
+	saved := wallClock
+	wallClock = c
+	t.Cleanup(func() { wallClock = saved })
+}
+
+func TestTokenServer_RefreshSchedule(t *testing.T) {
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"abc"}`))
+	}))
+	defer srv.Close()
+
+	c := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	setClock(t, c)
+	ts := newTokenServer(context.Background(), Args{
+		OIDCToken:     testOIDCToken,
+		TenantID:      "12345678-1234-1234-1234-1234567890ab",
+		ClientID:      "12345678-1234-1234-1234-1234567890ab",
+		AuthorityHost: srv.URL,
+	}, new(Exchanger))
+
+	for _, step := range []struct {
+		advance time.Duration
+		calls   int
+	}{
+		{0, 1},
+		{50 * time.Minute, 1},
+		{4 * time.Minute, 1},
+		{2 * time.Minute, 2},
+		{0, 2},
+	} {
+		c.Advance(step.advance)
+		entry, err := ts.Token(context.Background())
+		if err != nil {
+			t.Fatalf("Token returned error: %v", err)
+		}
+		if calls != step.calls {
+			t.Fatalf("at %s: %d exchanges, want %d", c.now.Format(time.TimeOnly), calls, step.calls)
+		}
+		if want := c.now.Add(time.Hour).Unix(); step.advance == 2*time.Minute && entry.ExpiresOn != want {
+			t.Errorf("expires on %d, want %d", entry.ExpiresOn, want)
+		}
+	}
+}
+
+func TestLookupCachedToken_Clock(t *testing.T) {
+	c := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	setClock(t, c)
+	cache := newTokenCache(t.TempDir(), "step-secret")
+	args := Args{TenantID: "tenant", ClientID: "client"}
+	entry := newCacheEntry(c.Now(), &AzureTokenResponse{TokenType: "Bearer", AccessToken: "cached", ExpiresIn: 3600})
+	if err := cache.Store("host", "tenant", "client", "scope", entry); err != nil {
+		t.Fatal(err)
+	}
+
+	c.Advance(30 * time.Minute)
+	token := lookupCachedToken(context.Background(), cache, args, "host", "scope")
+	if token == nil || token.ExpiresIn != 1800 {
+		t.Fatalf("expected the cached token valid for 1800 seconds, got %+v", token)
+	}
+	c.Advance(26 * time.Minute)
+	if token := lookupCachedToken(context.Background(), cache, args, "host", "scope"); token != nil {
+		t.Errorf("expected a token within the refresh buffer to be bypassed, got %+v", token)
+	}
+}
+
+func TestCacheEntry_FrozenWallClock(t *testing.T) {
+	// the wall clock of the expiry says an hour is left, but the
+	// monotonic clock of the process says the token has expired
+	acquired := time.Now()
+	entry := newCacheEntry(acquired.Add(-2*time.Hour), &AzureTokenResponse{ExpiresIn: 3600})
+	entry.ExpiresOn = acquired.Add(time.Hour).Unix()
+	if remaining := entry.remaining(time.Now()); remaining > -time.Hour+time.Second {
+		t.Errorf("remaining = %s, want about -1h", remaining)
+	}
+
+	// entries loaded from the cache file only have the wall clock
+	loaded := &cacheEntry{ExpiresOn: acquired.Add(time.Hour).Unix()}
+	if remaining := loaded.remaining(acquired); remaining <= 59*time.Minute {
+		t.Errorf("remaining = %s, want about 1h", remaining)
+	}
+}
+
+func TestTokenServer_ExtendedLifetime(t *testing.T) {
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":600,"ext_expires_in":3600,"access_token":"abc"}`))
+		}
+	}))
+	defer srv.Close()
+
+	c := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	setClock(t, c)
+	ts := newTokenServer(context.Background(), Args{
+		OIDCToken:        testOIDCToken,
+		TenantID:         "12345678-1234-1234-1234-1234567890ab",
+		ClientID:         "12345678-1234-1234-1234-1234567890ab",
+		AuthorityHost:    srv.URL,
+		BreakerThreshold: 100,
+	}, &Exchanger{MaxAttempts: 1})
+
+	if _, err := ts.Token(context.Background()); err != nil {
+		t.Fatalf("Token returned error: %v", err)
+	}
+
+	// past its expiry the token is served during an outage
+	c.Advance(20 * time.Minute)
+	status = http.StatusServiceUnavailable
+	if entry, err := ts.Token(context.Background()); err != nil || entry.AccessToken != "abc" {
+		t.Fatalf("expected the token within its extended lifetime, got %+v, %v", entry, err)
+	}
+
+	// but not when azure ad rejects the request
+	status = http.StatusBadRequest
+	if _, err := ts.Token(context.Background()); err == nil {
+		t.Fatal("expected the rejection to be returned")
+	}
+
+	// nor past its extended lifetime
+	c.Advance(time.Hour)
+	status = http.StatusServiceUnavailable
+	if _, err := ts.Token(context.Background()); err == nil {
+		t.Fatal("expected an error past the extended lifetime")
+	}
+}
+
+func TestAcquireToken_ExtendedLifetime(t *testing.T) {
+	status := http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		if status == http.StatusOK {
+			_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":600,"ext_expires_in":3600,"access_token":"abc","scope":"https://management.azure.com/user_impersonation"}`))
+		}
+	}))
+	defer srv.Close()
+
+	c := &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	setClock(t, c)
+	args := Args{
+		OIDCToken:     testOIDCToken,
+		TenantID:      "12345678-1234-1234-1234-1234567890ab",
+		ClientID:      "12345678-1234-1234-1234-1234567890ab",
+		AuthorityHost: srv.URL,
+		Cache:         true,
+		CacheDir:      t.TempDir(),
+		EncryptionKey: "step-secret",
+	}
+	if _, err := acquireToken(context.Background(), args, new(Exchanger)); err != nil {
+		t.Fatalf("acquireToken returned error: %v", err)
+	}
+
+	c.Advance(20 * time.Minute)
+	status = http.StatusServiceUnavailable
+	token, err := acquireToken(context.Background(), args, &Exchanger{MaxAttempts: 1})
+	if err != nil {
+		t.Fatalf("expected the cached token within its extended lifetime, got %v", err)
+	}
+	if token.AccessToken != "abc" || token.ExpiresIn != 40*60 || token.Scope != "https://management.azure.com/user_impersonation" {
+		t.Errorf("unexpected token %+v", token)
+	}
+
+	c.Advance(time.Hour)
+	if _, err := acquireToken(context.Background(), args, &Exchanger{MaxAttempts: 1}); err == nil {
+		t.Fatal("expected an error past the extended lifetime")
+	}
+}
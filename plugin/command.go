@@ -0,0 +1,160 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// runCommand runs the wrapped command with the shell once the outputs
+// are written, passing its output through. When registry credentials
+// were written, DOCKER_CONFIG and REGISTRY_AUTH_FILE point the command
+// at them, and the azcopy login variables are set when configured.
+// When the Azure CLI is installed, it is logged in first, and the
+// Azure Developer CLI is configured to use its login.
+func runCommand(ctx context.Context, args Args) error {
+	cmd := exec.CommandContext(ctx, "/bin/sh", "-c", args.Command)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	cmd.Env = os.Environ()
+	if args.ACRRegistry != "" {
+		files := registryAuthFiles()
+		cmd.Env = append(cmd.Env,
+			"DOCKER_CONFIG="+filepath.Dir(files[0]),
+			"REGISTRY_AUTH_FILE="+files[1],
+		)
+	}
+
+	if args.AzcopyLogin != "" {
+		for _, kv := range azcopyEnv(args) {
+			cmd.Env = append(cmd.Env, kv[0]+"="+kv[1])
+		}
+	}
+
+	cmd.Env = append(cmd.Env, "AZURE_TENANT_ID="+args.TenantID, "AZURE_CLIENT_ID="+args.ClientID)
+	if args.SubscriptionID != "" {
+		cmd.Env = append(cmd.Env, "AZURE_SUBSCRIPTION_ID="+args.SubscriptionID)
+	}
+	if !args.SkipAzLogin && credential(args) != credentialOIDC {
+		logger(ctx).Infof("az login skipped: it requires the %s credential", credentialOIDC)
+	} else if !args.SkipAzLogin {
+		if _, err := exec.LookPath("az"); err == nil {
+			if err := azLogin(ctx, args, cmd.Env); err != nil {
+				return err
+			}
+			if _, err := exec.LookPath("azd"); err == nil {
+				if err := azdUseAzLogin(ctx, cmd.Env); err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	logger(ctx).Infof("running command: %s", args.Command)
+	_, span := startSpan(ctx, "command")
+	err := cmd.Run()
+	span.End(err)
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return fmt.Errorf("command exited with code %d", exitErr.ExitCode())
+	}
+	if err != nil {
+		return fmt.Errorf("failed to run command: %w", err)
+	}
+	return nil
+}
+
+// azLogin signs the Azure CLI in with the federated token, selects
+// the subscription when one is configured and verifies the account,
+// so scripts using az need no changes. The token is passed in a
+// temporary file readable only by the user, which az reads with its
+// @file syntax, so it never appears on the command line of the
+// process.
+func azLogin(ctx context.Context, args Args, env []string) (err error) {
+	ctx, span := startSpan(ctx, "az_login")
+	defer func() { span.End(err) }()
+
+	tokenFile, err := writeTempSecret("az-federated-token-*", args.OIDCToken)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tokenFile)
+
+	login := []string{"login", "--service-principal",
+		"--username", args.ClientID,
+		"--tenant", args.TenantID,
+		"--federated-token", "@" + tokenFile,
+		"--output", "none",
+	}
+	if args.SubscriptionID == "" {
+		login = append(login, "--allow-no-subscriptions")
+	}
+	if _, err := runCLI(ctx, env, "az", login...); err != nil {
+		return fmt.Errorf("az login failed: %w", err)
+	}
+	if args.SubscriptionID != "" {
+		if _, err := runCLI(ctx, env, "az", "account", "set", "--subscription", args.SubscriptionID); err != nil {
+			return fmt.Errorf("az account set failed: %w", err)
+		}
+	}
+	account, err := runCLI(ctx, env, "az", "account", "show", "--query", "[name, id, tenantId]", "--output", "tsv")
+	if err != nil {
+		return fmt.Errorf("az account show failed: %w", err)
+	}
+	logger(ctx).Infof("az logged in: %s", strings.Join(strings.Fields(account), " "))
+	return nil
+}
+
+// writeTempSecret writes the secret to a new temporary file, which
+// os.CreateTemp creates with mode 0600, and returns its path.
+func writeTempSecret(pattern, secret string) (string, error) {
+	f, err := os.CreateTemp("", pattern)
+	if err != nil {
+		return "", fmt.Errorf("failed to write the federated token: %w", err)
+	}
+	_, err = f.WriteString(secret)
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", fmt.Errorf("failed to write the federated token: %w", err)
+	}
+	return f.Name(), nil
+}
+
+// azdUseAzLogin configures the Azure Developer CLI to authenticate
+// with the Azure CLI login, so azd provision and deploy work without
+// azd auth login. AZURE_SUBSCRIPTION_ID selects the subscription.
+func azdUseAzLogin(ctx context.Context, env []string) error {
+	if _, err := runCLI(ctx, env, "azd", "config", "set", "auth.useAzCliAuth", "true"); err != nil {
+		return fmt.Errorf("azd config set failed: %w", err)
+	}
+	logger(ctx).Infof("azd configured to use the az login")
+	return nil
+}
+
+// runCLI runs the command line tool and returns its output. The
+// error includes the redacted error output of the tool.
+func runCLI(ctx context.Context, env []string, name string, arg ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	cmd := exec.CommandContext(ctx, name, arg...)
+	cmd.Env = env
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		if msg := strings.TrimSpace(redactor.Redact(stderr.String())); msg != "" {
+			return "", fmt.Errorf("%w: %s", err, msg)
+		}
+		return "", err
+	}
+	return stdout.String(), nil
+}
@@ -0,0 +1,116 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// fakeAz is an az executable recording its arguments, failing login
+// for the rejected client.
+const fakeAz = `#!/bin/sh
+echo "$@" >> "$AZ_LOG"
+for arg in "$@"; do
+  case "$arg" in @*) cat "${arg#@}" >> "$AZ_LOG.token" ;; esac
+done
+case "$*" in
+  *00000000-0000-0000-0000-000000000002*) echo "AADSTS700213: No matching federated identity record found" >&2; exit 1 ;;
+  "account show"*) printf 'deploy\t11111111-1111-1111-1111-111111111111\t12345678-1234-1234-1234-1234567890ab\n' ;;
+esac
+`
+
+func TestExec_AzLogin(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"arm-token"}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "bin")
+	if err := os.MkdirAll(bin, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(bin, "az"), []byte(fakeAz), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(bin, "azd"), []byte("#!/bin/sh\necho azd \"$@\" >> \"$AZ_LOG\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("PATH", bin+string(os.PathListSeparator)+os.Getenv("PATH"))
+	t.Setenv("AZ_LOG", filepath.Join(dir, "az.log"))
+	t.Setenv("HARNESS_OUTPUT_SECRET_FILE", filepath.Join(dir, "secret.env"))
+	t.Setenv("DRONE_OUTPUT", filepath.Join(dir, "out.env"))
+
+	args := Args{
+		OIDCToken:      testOIDCToken,
+		TenantID:       "12345678-1234-1234-1234-1234567890ab",
+		ClientID:       "00000000-0000-0000-0000-000000000001",
+		SubscriptionID: "11111111-1111-1111-1111-111111111111",
+		AuthorityHost:  srv.URL,
+		Command:        `test "$AZURE_SUBSCRIPTION_ID" = 11111111-1111-1111-1111-111111111111 && az group list >/dev/null`,
+	}
+	if err := Exec(context.Background(), args); err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "az.log"))
+	// the token is read by az from a file that is removed after login
+	got := strings.Split(strings.TrimSpace(string(data)), "\n")
+	login := strings.Fields(got[0])
+	if len(login) < 8 || !strings.HasPrefix(login[7], "@") || strings.Contains(got[0], testOIDCToken) {
+		t.Fatalf("expected the federated token passed as a file, got %q", got[0])
+	}
+	if _, err := os.Stat(strings.TrimPrefix(login[7], "@")); !os.IsNotExist(err) {
+		t.Errorf("expected the token file removed after login, got %v", err)
+	}
+	if token, _ := os.ReadFile(filepath.Join(dir, "az.log.token")); string(token) != testOIDCToken {
+		t.Errorf("az read token %q from the file, want the OIDC token", token)
+	}
+	got[0] = strings.Replace(got[0], login[7], "@<token-file>", 1)
+	want := []string{
+		"login --service-principal --username 00000000-0000-0000-0000-000000000001 --tenant 12345678-1234-1234-1234-1234567890ab --federated-token @<token-file> --output none",
+		"account set --subscription 11111111-1111-1111-1111-111111111111",
+		"account show --query [name, id, tenantId] --output tsv",
+		"azd config set auth.useAzCliAuth true",
+		"group list",
+	}
+	if strings.Join(got, "\n") != strings.Join(want, "\n") {
+		t.Errorf("az calls = %q, want %q", got, want)
+	}
+
+	args.ClientID = "00000000-0000-0000-0000-000000000002"
+	err := Exec(context.Background(), args)
+	if err == nil || !strings.Contains(err.Error(), "az login failed") || !strings.Contains(err.Error(), "AADSTS700213") {
+		t.Fatalf("expected az login error, got %v", err)
+	}
+
+	os.Remove(filepath.Join(dir, "az.log"))
+	args.ClientID = "00000000-0000-0000-0000-000000000001"
+	args.SkipAzLogin = true
+	if err := Exec(context.Background(), args); err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "az.log")); string(data) != "group list\n" {
+		t.Errorf("az calls with skip-az-login = %q", data)
+	}
+
+	// az login requires the federated token, other credentials run
+	// the command without it
+	os.Remove(filepath.Join(dir, "az.log"))
+	args.SkipAzLogin = false
+	args.OIDCToken = ""
+	args.Credential = credentialSecret
+	args.ClientSecret = "client-secret"
+	if err := Exec(context.Background(), args); err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dir, "az.log")); string(data) != "group list\n" {
+		t.Errorf("az calls with the secret credential = %q", data)
+	}
+}
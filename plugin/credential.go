@@ -0,0 +1,140 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"crypto/tls"
+	"fmt"
+	"strings"
+
+	"github.com/harness-community/drone-azure-oidc/pkg/azuread"
+)
+
+// supported credentials
+const (
+	credentialOIDC            = "oidc"
+	credentialManagedIdentity = "managed-identity"
+	credentialCertificate     = "certificate"
+	credentialSecret          = "secret"
+)
+
+// tokenProviders creates the token provider of each credential. A
+// credential source is added by registering its provider here.
+var tokenProviders = map[string]func(args Args, exchanger *Exchanger) (azuread.TokenProvider, error){
+	credentialOIDC: func(args Args, exchanger *Exchanger) (azuread.TokenProvider, error) {
+		if exchangeEngine(args) == engineAzidentity {
+			return newAzidentityProvider(args, exchanger.HTTPClient())
+		}
+		return &azuread.AssertionProvider{
+			Exchanger:     exchanger,
+			TenantID:      args.TenantID,
+			ClientID:      args.ClientID,
+			AuthorityHost: args.AuthorityHost,
+			Assertion:     args.OIDCToken,
+		}, nil
+	},
+	credentialManagedIdentity: func(args Args, exchanger *Exchanger) (azuread.TokenProvider, error) {
+		return &azuread.ManagedIdentityProvider{
+			Client:   exchanger.HTTPClient(),
+			Endpoint: args.ManagedIdentityEndpoint,
+			ClientID: args.ManagedIdentityClientID,
+			Timeout:  args.AttemptTimeout,
+		}, nil
+	},
+	credentialCertificate: func(args Args, exchanger *Exchanger) (azuread.TokenProvider, error) {
+		cert, err := loadAssertionCertificate(args)
+		if err != nil {
+			return nil, err
+		}
+		return &azuread.CertificateProvider{
+			Exchanger:     exchanger,
+			TenantID:      args.TenantID,
+			ClientID:      args.ClientID,
+			AuthorityHost: args.AuthorityHost,
+			Certificate:   cert,
+		}, nil
+	},
+	credentialSecret: func(args Args, exchanger *Exchanger) (azuread.TokenProvider, error) {
+		return &azuread.SecretProvider{
+			Exchanger:     exchanger,
+			TenantID:      args.TenantID,
+			ClientID:      args.ClientID,
+			AuthorityHost: args.AuthorityHost,
+			Secret:        args.ClientSecret,
+		}, nil
+	},
+}
+
+// credential returns the configured credential, the OIDC token when
+// none is set.
+func credential(args Args) string {
+	if args.Credential == "" {
+		return credentialOIDC
+	}
+	return strings.ToLower(args.Credential)
+}
+
+// newTokenProvider returns the token provider of the configured
+// credential.
+func newTokenProvider(args Args, exchanger *Exchanger) (azuread.TokenProvider, error) {
+	newProvider, ok := tokenProviders[credential(args)]
+	if !ok {
+		return nil, fmt.Errorf("unsupported credential %q", args.Credential)
+	}
+	return newProvider(args, exchanger)
+}
+
+// verifyCredential validates the settings of the configured
+// credential. Features built on the OIDC assertion are only
+// supported with the oidc credential.
+func verifyCredential(args Args) error {
+	name := credential(args)
+	if _, ok := tokenProviders[name]; !ok {
+		return fmt.Errorf("unsupported credential %q, must be %s, %s, %s or %s", args.Credential,
+			credentialOIDC, credentialManagedIdentity, credentialCertificate, credentialSecret)
+	}
+	if name == credentialOIDC {
+		if args.ClientSecret != "" || args.ClientAssertionCert != "" {
+			return fmt.Errorf("client-secret and client-assertion-cert require the %s or %s credential", credentialSecret, credentialCertificate)
+		}
+		return nil
+	}
+	switch {
+	case args.OIDCToken != "":
+		return fmt.Errorf("oidc-token is not used by the %s credential", name)
+	case args.VerifyAssertion:
+		return fmt.Errorf("verify-assertion is not supported with the %s credential", name)
+	case len(args.AllowedIssuers) > 0 || args.ExpectedSubject != "" || args.ClaimsMatchingExpression != "":
+		return fmt.Errorf("assertion claim checks are not supported with the %s credential", name)
+	case args.DownstreamScope != "":
+		return fmt.Errorf("downstream-scope is not supported with the %s credential", name)
+	case name == credentialManagedIdentity && len(args.Identities) > 0:
+		return fmt.Errorf("identities are not supported with the %s credential", name)
+	case name != credentialManagedIdentity && args.ManagedIdentityClientID != "":
+		return fmt.Errorf("managed-identity-client-id is not supported with the %s credential", name)
+	case name == credentialSecret && args.ClientSecret == "":
+		return fmt.Errorf("client-secret is not provided")
+	case name == credentialCertificate && (args.ClientAssertionCert == "" || args.ClientAssertionKey == ""):
+		return fmt.Errorf("client-assertion-cert and client-assertion-key are not provided")
+	}
+	return nil
+}
+
+// loadAssertionCertificate loads the certificate and private key
+// used to sign client assertions.
+func loadAssertionCertificate(args Args) (tls.Certificate, error) {
+	certPEM, err := loadPEM(args.ClientAssertionCert)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to load client-assertion-cert: %w", err)
+	}
+	keyPEM, err := loadPEM(args.ClientAssertionKey)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to load client-assertion-key: %w", err)
+	}
+	defer wipe(keyPEM)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("invalid client assertion certificate: %w", err)
+	}
+	return cert, nil
+}
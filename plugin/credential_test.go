@@ -0,0 +1,160 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/harness-community/drone-azure-oidc/pkg/azuread"
+)
+
+// fakeProvider is a token provider returning a fixed token.
+type fakeProvider struct {
+	scopes []string
+}
+
+func (p *fakeProvider) Token(ctx context.Context, scope string) (*AzureTokenResponse, error) {
+	p.scopes = append(p.scopes, scope)
+	return &AzureTokenResponse{TokenType: "Bearer", ExpiresIn: 3600, AccessToken: "fake-token"}, nil
+}
+
+func TestAcquireToken_TokenProvider(t *testing.T) {
+	fake := new(fakeProvider)
+	tokenProviders["fake"] = func(Args, *Exchanger) (azuread.TokenProvider, error) { return fake, nil }
+	t.Cleanup(func() { delete(tokenProviders, "fake") })
+
+	args := Args{Credential: "fake", Scope: "https://vault.azure.net/.default"}
+	token, err := acquireToken(context.Background(), args, new(Exchanger))
+	if err != nil {
+		t.Fatalf("acquireToken returned error: %v", err)
+	}
+	if token.AccessToken != "fake-token" || len(fake.scopes) != 1 || fake.scopes[0] != args.Scope {
+		t.Errorf("unexpected token %+v for scopes %q", token, fake.scopes)
+	}
+}
+
+func TestExec_SecretCredential(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("client_secret") != "app-secret" || r.PostFormValue("client_assertion") != "" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"app-token"}`))
+	}))
+	defer srv.Close()
+
+	outPath := filepath.Join(t.TempDir(), "out.env")
+	t.Setenv("HARNESS_OUTPUT_SECRET_FILE", outPath)
+
+	args := Args{
+		Credential:    credentialSecret,
+		TenantID:      "12345678-1234-1234-1234-1234567890ab",
+		ClientID:      "00000000-0000-0000-0000-000000000001",
+		ClientSecret:  "app-secret",
+		AuthorityHost: srv.URL,
+	}
+	if err := Exec(context.Background(), args); err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+	data, _ := os.ReadFile(outPath)
+	if !strings.Contains(string(data), "AZURE_ACCESS_TOKEN=app-token\n") {
+		t.Fatalf("unexpected outputs %q", data)
+	}
+}
+
+func TestExec_ManagedIdentityCredential(t *testing.T) {
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("resource") != "https://management.azure.com" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		_, _ = w.Write([]byte(`{"access_token":"identity-token","expires_in":"3600","token_type":"Bearer"}`))
+	}))
+	defer imds.Close()
+
+	outPath := filepath.Join(t.TempDir(), "out.env")
+	t.Setenv("HARNESS_OUTPUT_SECRET_FILE", outPath)
+
+	args := Args{Credential: credentialManagedIdentity, ManagedIdentityEndpoint: imds.URL}
+	if err := Exec(context.Background(), args); err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+	data, _ := os.ReadFile(outPath)
+	if !strings.Contains(string(data), "AZURE_ACCESS_TOKEN=identity-token\n") {
+		t.Fatalf("unexpected outputs %q", data)
+	}
+}
+
+func TestAcquireToken_ManagedIdentityStalled(t *testing.T) {
+	release := make(chan struct{})
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer imds.Close()
+	defer close(release)
+
+	var requests int32
+	client := &http.Client{Transport: roundTripFunc(func(r *http.Request) (*http.Response, error) {
+		atomic.AddInt32(&requests, 1)
+		return http.DefaultTransport.RoundTrip(r)
+	})}
+	args := Args{
+		Credential:              credentialManagedIdentity,
+		ManagedIdentityEndpoint: imds.URL,
+		AttemptTimeout:          100 * time.Millisecond,
+	}
+	start := time.Now()
+	if _, err := acquireToken(context.Background(), args, &Exchanger{Client: client}); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the attempt timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("expected the request to give up after the attempt timeout, took %s", elapsed)
+	}
+	if atomic.LoadInt32(&requests) != 1 {
+		t.Errorf("expected the request sent with the exchanger's client")
+	}
+}
+
+func TestVerifyCredential(t *testing.T) {
+	tests := map[string]struct {
+		args Args
+		want string
+	}{
+		"default":            {Args{}, ""},
+		"secret":             {Args{Credential: "Secret", ClientSecret: "secret"}, ""},
+		"certificate":        {Args{Credential: "certificate", ClientAssertionCert: "cert.pem", ClientAssertionKey: "key.pem"}, ""},
+		"managed identity":   {Args{Credential: "managed-identity"}, ""},
+		"unsupported":        {Args{Credential: "password"}, "unsupported credential"},
+		"missing secret":     {Args{Credential: "secret"}, "client-secret is not provided"},
+		"missing key":        {Args{Credential: "certificate", ClientAssertionCert: "cert.pem"}, "client-assertion-key"},
+		"oidc token":         {Args{Credential: "secret", ClientSecret: "secret", OIDCToken: testOIDCToken}, "oidc-token is not used"},
+		"verify assertion":   {Args{Credential: "secret", ClientSecret: "secret", VerifyAssertion: true}, "verify-assertion"},
+		"secret without":     {Args{ClientSecret: "secret"}, "require the secret or certificate credential"},
+		"identities":         {Args{Credential: "managed-identity", Identities: Identities{{Alias: "prod"}}}, "identities are not supported"},
+		"assertion identity": {Args{Credential: "secret", ClientSecret: "secret", ManagedIdentityClientID: "id"}, "managed-identity-client-id"},
+	}
+	for name, tt := range tests {
+		err := verifyCredential(tt.args)
+		if tt.want == "" && err != nil {
+			t.Errorf("%s: unexpected error %v", name, err)
+		}
+		if tt.want != "" && (err == nil || !strings.Contains(err.Error(), tt.want)) {
+			t.Errorf("%s: expected error containing %q, got %v", name, tt.want, err)
+		}
+	}
+}
+
+// roundTripFunc adapts a function to http.RoundTripper.
+type roundTripFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripFunc) RoundTrip(r *http.Request) (*http.Response, error) { return f(r) }
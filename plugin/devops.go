@@ -0,0 +1,112 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/harness-community/drone-azure-oidc/pkg/azuread"
+)
+
+// devopsScope is the Azure DevOps scope, the application ID of the
+// Azure DevOps resource.
+const devopsScope = "499b84ac-1321-427f-aa17-267ca6975798/.default"
+
+// devopsEndpoint is the Azure DevOps Services endpoint.
+const devopsEndpoint = "https://dev.azure.com"
+
+// devopsAPIVersion is the Azure DevOps REST API version.
+const devopsAPIVersion = "7.1"
+
+// devopsProject is a project returned by the Azure DevOps REST API.
+type devopsProject struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// devopsOrganizationURL returns the URL of the organization, accepting
+// an organization name or URL.
+func devopsOrganizationURL(organization string) string {
+	if strings.Contains(organization, "://") {
+		return strings.TrimRight(organization, "/")
+	}
+	return devopsEndpoint + "/" + url.PathEscape(organization)
+}
+
+// verifyDevOps checks the Azure DevOps settings. The organization
+// and the Azure Artifacts feeds require the Azure DevOps scope, which
+// is the default when they are set.
+func verifyDevOps(args Args) error {
+	if args.DevOpsProject != "" && args.DevOpsOrganization == "" {
+		return fmt.Errorf("devops-project requires devops-organization")
+	}
+	if len(args.ArtifactsFeeds) > 0 {
+		if !isDevOpsScope(args.Scope) {
+			return fmt.Errorf("artifacts-feeds requires the Azure DevOps scope %s", devopsScope)
+		}
+		if err := verifyArtifactsFeeds(args.ArtifactsFeeds); err != nil {
+			return err
+		}
+	}
+	if args.DevOpsOrganization == "" {
+		return nil
+	}
+	if !isDevOpsScope(args.Scope) {
+		return fmt.Errorf("devops-organization requires the Azure DevOps scope %s", devopsScope)
+	}
+	return azuread.CheckEndpoint(devopsOrganizationURL(args.DevOpsOrganization), nil)
+}
+
+// isDevOpsScope reports whether the scope is unset, and so defaults
+// to Azure DevOps, or is the Azure DevOps scope.
+func isDevOpsScope(scope string) bool {
+	return scope == "" || strings.EqualFold(strings.TrimSuffix(scope, defaultScopeSuffix), strings.TrimSuffix(devopsScope, defaultScopeSuffix))
+}
+
+// checkDevOps verifies the token can access the Azure DevOps
+// organization and, when set, the project, and writes the
+// organization URL and project ID as non-secret outputs. Azure DevOps
+// answers requests it does not authenticate with a sign-in page and a
+// status other than 200, which fails the check.
+func checkDevOps(ctx context.Context, args Args, client *http.Client, token *AzureTokenResponse) (err error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+	ctx, span := startSpan(ctx, "devops_verify")
+	defer func() { span.End(err) }()
+
+	orgURL := devopsOrganizationURL(args.DevOpsOrganization)
+	var connection struct {
+		AuthenticatedUser struct {
+			ProviderDisplayName string `json:"providerDisplayName"`
+		} `json:"authenticatedUser"`
+	}
+	if err := getJSON(ctx, client, orgURL+"/_apis/connectionData", token.AccessToken, &connection); err != nil {
+		return fmt.Errorf("failed to access Azure DevOps organization %s: %w", orgURL, err)
+	}
+	logger(ctx).Infof("Azure DevOps organization %s accessible as %s", orgURL, connection.AuthenticatedUser.ProviderDisplayName)
+
+	var project devopsProject
+	if args.DevOpsProject != "" {
+		address := orgURL + "/_apis/projects/" + url.PathEscape(args.DevOpsProject) + "?api-version=" + devopsAPIVersion
+		if err := getJSON(ctx, client, address, token.AccessToken, &project); err != nil {
+			return fmt.Errorf("failed to access Azure DevOps project %s: %w", args.DevOpsProject, err)
+		}
+		logger(ctx).Infof("Azure DevOps project %s accessible", project.Name)
+	}
+
+	output := plainOutput(ctx)
+	if output == nil {
+		return nil
+	}
+	if err := output.Write("AZURE_DEVOPS_ORG_URL", orgURL); err != nil {
+		return err
+	}
+	if project.ID != "" {
+		return output.Write("AZURE_DEVOPS_PROJECT_ID", project.ID)
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExec_DevOps(t *testing.T) {
+	var scope string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if strings.HasSuffix(r.URL.Path, "/oauth2/v2.0/token") {
+			scope = r.PostFormValue("scope")
+			_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"ado-token"}`))
+			return
+		}
+		if r.Header.Get("Authorization") != "Bearer ado-token" {
+			w.WriteHeader(http.StatusNonAuthoritativeInfo)
+			return
+		}
+		switch r.URL.Path {
+		case "/contoso/_apis/connectionData":
+			_, _ = w.Write([]byte(`{"authenticatedUser":{"providerDisplayName":"deploy"}}`))
+		case "/contoso/_apis/projects/web":
+			_, _ = w.Write([]byte(`{"id":"22222222-2222-2222-2222-222222222222","name":"web"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	t.Setenv("HARNESS_OUTPUT_SECRET_FILE", filepath.Join(dir, "secret.env"))
+	t.Setenv("DRONE_OUTPUT", filepath.Join(dir, "out.env"))
+
+	args := Args{
+		OIDCToken:          testOIDCToken,
+		TenantID:           "12345678-1234-1234-1234-1234567890ab",
+		ClientID:           "00000000-0000-0000-0000-000000000001",
+		AuthorityHost:      srv.URL,
+		DevOpsOrganization: srv.URL + "/contoso/",
+		DevOpsProject:      "web",
+	}
+	if err := Exec(context.Background(), args); err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+	if scope != devopsScope {
+		t.Errorf("scope = %q, want %q", scope, devopsScope)
+	}
+	outputs, _ := readOutputFile(filepath.Join(dir, "out.env"))
+	if outputs["AZURE_DEVOPS_ORG_URL"] != srv.URL+"/contoso" || outputs["AZURE_DEVOPS_PROJECT_ID"] != "22222222-2222-2222-2222-222222222222" {
+		t.Errorf("unexpected outputs %v", outputs)
+	}
+
+	args.DevOpsProject = "missing"
+	if err := Exec(context.Background(), args); err == nil || !strings.Contains(err.Error(), "project missing") {
+		t.Errorf("expected project error, got %v", err)
+	}
+
+	if got := devopsOrganizationURL("contoso"); got != "https://dev.azure.com/contoso" {
+		t.Errorf("devopsOrganizationURL = %q", got)
+	}
+	if err := verifyDevOps(Args{DevOpsOrganization: "contoso", Scope: defaultScope}); err == nil {
+		t.Errorf("expected error for a scope other than Azure DevOps")
+	}
+	if err := verifyDevOps(Args{DevOpsProject: "web"}); err == nil {
+		t.Errorf("expected error for a project without organization")
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+)
+
+// maxDumpBody is the maximum number of body bytes included in an
+// HTTP trace dump.
+const maxDumpBody = 64 << 10
+
+// sensitiveFields are form and JSON fields replaced by their hash in
+// HTTP trace dumps.
+var sensitiveFields = map[string]bool{
+	"client_assertion": true,
+	"client_secret":    true,
+	"assertion":        true,
+	"access_token":     true,
+	"refresh_token":    true,
+	"id_token":         true,
+}
+
+// sensitiveHeaders are headers replaced by their hash in HTTP trace
+// dumps.
+var sensitiveHeaders = []string{"Authorization", "Proxy-Authorization", "Cookie", "Set-Cookie"}
+
+// dumpTransport logs requests and responses at trace level, with
+// credentials replaced by hashes so dumps can be compared without
+// exposing the values.
+type dumpTransport struct {
+	base http.RoundTripper
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *dumpTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	var reqBody []byte
+	if req.GetBody != nil {
+		if body, err := req.GetBody(); err == nil {
+			reqBody, _ = io.ReadAll(io.LimitReader(body, maxDumpBody))
+			body.Close()
+		}
+	}
+	logger(req.Context()).Tracef("> %s %s\n%s%s", req.Method, req.URL, dumpHeaders(req.Header), dumpBody(req.Header, reqBody))
+	wipe(reqBody)
+
+	resp, err := t.base.RoundTrip(req)
+	if err != nil {
+		logger(req.Context()).Tracef("< %s %s: %s", req.Method, req.URL, err)
+		return nil, err
+	}
+
+	// The body is buffered for the dump and handed to the caller,
+	// and wiped once the caller closes it.
+	data, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		wipe(data)
+		return nil, err
+	}
+	resp.Body = &wipingReader{Reader: bytes.NewReader(data), data: data}
+
+	dumped := data
+	if len(dumped) > maxDumpBody {
+		dumped = dumped[:maxDumpBody]
+	}
+	logger(req.Context()).Tracef("< %s\n%s%s", resp.Status, dumpHeaders(resp.Header), dumpBody(resp.Header, dumped))
+	return resp, nil
+}
+
+// wipingReader is a response body that wipes its buffer on close.
+type wipingReader struct {
+	*bytes.Reader
+	data []byte
+}
+
+func (r *wipingReader) Close() error {
+	wipe(r.data)
+	return nil
+}
+
+// hashValue returns a short SHA-256 hash standing in for a secret
+// value in trace dumps.
+func hashValue(value string) string {
+	return "sha256:" + tokenFingerprint(value)[:16]
+}
+
+// dumpHeaders formats the headers with sensitive values hashed.
+func dumpHeaders(header http.Header) string {
+	header = header.Clone()
+	for _, key := range sensitiveHeaders {
+		for i, value := range header.Values(key) {
+			header[http.CanonicalHeaderKey(key)][i] = hashValue(value)
+		}
+	}
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var b strings.Builder
+	for _, key := range keys {
+		for _, value := range header[key] {
+			fmt.Fprintf(&b, "%s: %s\n", key, value)
+		}
+	}
+	return b.String()
+}
+
+// dumpBody formats a form or JSON body with sensitive fields hashed.
+// Other bodies are included as is and rely on log redaction.
+func dumpBody(header http.Header, body []byte) string {
+	if len(body) == 0 {
+		return ""
+	}
+	contentType := header.Get("Content-Type")
+	switch {
+	case strings.HasPrefix(contentType, "application/x-www-form-urlencoded"):
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			break
+		}
+		for key, vals := range values {
+			if sensitiveFields[key] {
+				for i := range vals {
+					vals[i] = hashValue(vals[i])
+				}
+			}
+		}
+		return "\n" + values.Encode()
+	case strings.HasPrefix(contentType, "application/json"):
+		var fields map[string]interface{}
+		if err := json.Unmarshal(body, &fields); err != nil {
+			break
+		}
+		for key, value := range fields {
+			if s, ok := value.(string); ok && sensitiveFields[key] {
+				fields[key] = hashValue(s)
+			}
+		}
+		data, _ := json.Marshal(fields)
+		return "\n" + string(data)
+	}
+	return "\n" + string(body)
+}
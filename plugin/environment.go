@@ -0,0 +1,98 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+)
+
+// Environment is the identity used for a deployment environment.
+// Empty fields inherit the top-level plugin settings.
+type Environment struct {
+	TenantID       string `json:"tenant_id"`
+	ClientID       string `json:"client_id"`
+	SubscriptionID string `json:"subscription_id"`
+	Scope          string `json:"scope"`
+}
+
+// Environments maps environment names to identities.
+type Environments map[string]Environment
+
+// Decode implements the envconfig.Decoder interface. The value is a
+// JSON object, or the path of a file containing one.
+func (e *Environments) Decode(value string) error {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+	data := []byte(value)
+	if !strings.HasPrefix(value, "{") {
+		var err error
+		if data, err = os.ReadFile(value); err != nil {
+			return fmt.Errorf("failed to read environments file: %w", err)
+		}
+	}
+	envs := Environments{}
+	if err := json.Unmarshal(data, (*map[string]Environment)(&envs)); err != nil {
+		return fmt.Errorf("environments must be a JSON object: %w", err)
+	}
+	*e = envs
+	return nil
+}
+
+// Names returns the sorted environment names.
+func (e Environments) Names() []string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// selectEnvironment returns the plugin arguments with the identity
+// of the selected environment applied. Names are matched case
+// insensitively.
+func selectEnvironment(ctx context.Context, args Args) (Args, error) {
+	env, ok := args.Environments[args.Environment]
+	if !ok {
+		for _, name := range args.Environments.Names() {
+			if strings.EqualFold(name, args.Environment) {
+				env, ok = args.Environments[name], true
+				break
+			}
+		}
+	}
+	if !ok {
+		return args, fmt.Errorf("environment %q is not defined in environments, must be one of: %s", args.Environment, strings.Join(args.Environments.Names(), ", "))
+	}
+	if env.TenantID != "" {
+		args.TenantID = env.TenantID
+	}
+	if env.ClientID != "" {
+		args.ClientID = env.ClientID
+	}
+	if env.SubscriptionID != "" {
+		args.SubscriptionID = env.SubscriptionID
+	}
+	if env.Scope != "" {
+		args.Scope = env.Scope
+	}
+	logger(ctx).Infof("using the identity of environment %q", args.Environment)
+	return args, nil
+}
+
+// writeEnvironmentOutputs writes the selected environment to the
+// non-secret output file. Its identity is written with the token
+// metadata.
+func writeEnvironmentOutputs(ctx context.Context, args Args) error {
+	if output := plainOutput(ctx); output != nil {
+		return output.Write("AZURE_ENVIRONMENT", args.Environment)
+	}
+	return nil
+}
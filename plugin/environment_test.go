@@ -0,0 +1,93 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestEnvironments_Decode(t *testing.T) {
+	const value = `{"dev":{"client_id":"aaaaaaaa-aaaa-aaaa-aaaa-aaaaaaaaaaaa"},"prod":{"tenant_id":"12345678-1234-1234-1234-1234567890ab","subscription_id":"22222222-2222-2222-2222-222222222222"}}`
+	var envs Environments
+	if err := envs.Decode(value); err != nil {
+		t.Fatalf("Decode returned error: %v", err)
+	}
+	if got := strings.Join(envs.Names(), ","); got != "dev,prod" {
+		t.Fatalf("unexpected environments %q", got)
+	}
+
+	path := filepath.Join(t.TempDir(), "environments.json")
+	if err := os.WriteFile(path, []byte(value), 0600); err != nil {
+		t.Fatal(err)
+	}
+	var fromFile Environments
+	if err := fromFile.Decode(path); err != nil {
+		t.Fatalf("Decode returned error: %v", err)
+	}
+	if fromFile["prod"].SubscriptionID != "22222222-2222-2222-2222-222222222222" {
+		t.Fatalf("unexpected environments %+v", fromFile)
+	}
+
+	for _, value := range []string{`{"dev":"x"}`, filepath.Join(t.TempDir(), "missing.json")} {
+		if err := new(Environments).Decode(value); err == nil {
+			t.Errorf("expected error for %q", value)
+		}
+	}
+}
+
+func TestExec_Environment(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/87654321-4321-4321-4321-ba0987654321/oauth2/v2.0/token" || r.PostFormValue("client_id") != "bbbbbbbb-bbbb-bbbb-bbbb-bbbbbbbbbbbb" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"prod-token"}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	t.Setenv("HARNESS_OUTPUT_SECRET_FILE", filepath.Join(dir, "secret.env"))
+	t.Setenv("DRONE_OUTPUT", filepath.Join(dir, "out.env"))
+
+	args := Args{
+		OIDCToken:     testOIDCToken,
+		TenantID:      "12345678-1234-1234-1234-1234567890ab",
+		ClientID:      "aaaaaaaa-aaaa-aaaa-aaaa-aaaaaaaaaaaa",
+		AuthorityHost: srv.URL,
+		Environment:   "Prod",
+		Environments: Environments{
+			"dev": {ClientID: "aaaaaaaa-aaaa-aaaa-aaaa-aaaaaaaaaaaa"},
+			"prod": {
+				TenantID:       "87654321-4321-4321-4321-ba0987654321",
+				ClientID:       "bbbbbbbb-bbbb-bbbb-bbbb-bbbbbbbbbbbb",
+				SubscriptionID: "22222222-2222-2222-2222-222222222222",
+			},
+		},
+	}
+	if err := Exec(context.Background(), args); err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "out.env"))
+	for _, want := range []string{
+		"AZURE_ENVIRONMENT=Prod\n",
+		"AZURE_TENANT_ID=87654321-4321-4321-4321-ba0987654321\n",
+		"AZURE_CLIENT_ID=bbbbbbbb-bbbb-bbbb-bbbb-bbbbbbbbbbbb\n",
+		"AZURE_SUBSCRIPTION_ID=22222222-2222-2222-2222-222222222222\n",
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("outputs %q missing %q", data, want)
+		}
+	}
+
+	args.Environment = "staging"
+	if err := Exec(context.Background(), args); err == nil || !strings.Contains(err.Error(), "must be one of: dev, prod") {
+		t.Fatalf("expected unknown environment error, got %v", err)
+	}
+}
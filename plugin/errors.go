@@ -0,0 +1,83 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"errors"
+
+	"github.com/harness-community/drone-azure-oidc/pkg/azuread"
+)
+
+// Error classes. Every error returned by Exec that belongs to a class
+// matches its sentinel with errors.Is, and its type with errors.As.
+var (
+	// ErrConfig matches a ConfigError.
+	ErrConfig = errors.New("invalid configuration")
+
+	// ErrAssertion matches an AssertionError.
+	ErrAssertion = errors.New("invalid assertion")
+
+	// ErrAzureAuth matches an AzureAuthError.
+	ErrAzureAuth = azuread.ErrAuth
+
+	// ErrNetwork matches a NetworkError.
+	ErrNetwork = azuread.ErrNetwork
+)
+
+// exit codes of the error classes
+const (
+	exitFailure   = 1
+	exitConfig    = 2
+	exitAssertion = 3
+	exitAzureAuth = 4
+	exitNetwork   = 5
+)
+
+// ConfigError is returned when the settings are missing, malformed
+// or conflicting.
+type ConfigError struct {
+	Err error
+}
+
+func (e *ConfigError) Error() string        { return e.Err.Error() }
+func (e *ConfigError) Unwrap() error        { return e.Err }
+func (e *ConfigError) Is(target error) bool { return target == ErrConfig }
+
+// AssertionError is returned when the OIDC assertion fails local
+// verification, or the managed identity token used as the assertion
+// cannot be acquired.
+type AssertionError struct {
+	Err error
+}
+
+func (e *AssertionError) Error() string        { return e.Err.Error() }
+func (e *AssertionError) Unwrap() error        { return e.Err }
+func (e *AssertionError) Is(target error) bool { return target == ErrAssertion }
+
+// configError returns the error as a ConfigError, or nil.
+func configError(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &ConfigError{Err: err}
+}
+
+// ExitCode returns the process exit code for the error: 2 for
+// configuration errors, 3 for assertion errors, 4 when Azure AD
+// rejects the request, 5 for network errors and 1 otherwise.
+func ExitCode(err error) int {
+	switch {
+	case err == nil:
+		return 0
+	case errors.Is(err, ErrConfig):
+		return exitConfig
+	case errors.Is(err, ErrAssertion):
+		return exitAssertion
+	case errors.Is(err, ErrAzureAuth):
+		return exitAzureAuth
+	case errors.Is(err, ErrNetwork):
+		return exitNetwork
+	default:
+		return exitFailure
+	}
+}
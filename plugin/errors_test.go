@@ -0,0 +1,78 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestErrorClasses(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("HARNESS_OUTPUT_SECRET_FILE", filepath.Join(dir, "secret.env"))
+	t.Setenv("DRONE_OUTPUT", filepath.Join(dir, "out.env"))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadRequest)
+		_, _ = w.Write([]byte(`{"error":"invalid_client","error_description":"AADSTS700016: application not found","error_codes":[700016]}`))
+	}))
+	defer srv.Close()
+	closed := httptest.NewServer(http.NotFoundHandler())
+	closed.Close()
+
+	valid := Args{
+		OIDCToken:     testOIDCToken,
+		TenantID:      "12345678-1234-1234-1234-1234567890ab",
+		ClientID:      "00000000-0000-0000-0000-000000000001",
+		AuthorityHost: srv.URL,
+	}
+	tests := []struct {
+		name     string
+		modify   func(*Args)
+		sentinel error
+		target   interface{}
+		exitCode int
+	}{
+		{"config", func(a *Args) { a.TenantID = "not-a-guid" }, ErrConfig, new(*ConfigError), 2},
+		{"assertion", func(a *Args) {
+			a.OIDCToken = ""
+			a.ManagedIdentityClientID = "00000000-0000-0000-0000-000000000002"
+			a.ManagedIdentityEndpoint = closed.URL
+		}, ErrAssertion, new(*AssertionError), 3},
+		{"azure", func(a *Args) {}, ErrAzureAuth, new(*AzureAuthError), 4},
+		{"network", func(a *Args) { a.AuthorityHost, a.Timeout = closed.URL, time.Second }, ErrNetwork, new(*NetworkError), 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			args := valid
+			tt.modify(&args)
+			err := Exec(context.Background(), args)
+			if !errors.Is(err, tt.sentinel) {
+				t.Fatalf("error %v does not match %v", err, tt.sentinel)
+			}
+			if !errors.As(err, tt.target) {
+				t.Errorf("error %v does not match type %T", err, tt.target)
+			}
+			if code := ExitCode(err); code != tt.exitCode {
+				t.Errorf("ExitCode = %d, want %d", code, tt.exitCode)
+			}
+		})
+	}
+
+	var authErr *AzureAuthError
+	if err := Exec(context.Background(), valid); !errors.As(err, &authErr) || !authErr.HasErrorCode(700016) || authErr.HasErrorCode(70021) {
+		t.Errorf("unexpected error codes of %v", err)
+	}
+	if code := ExitCode(errors.New("other")); code != 1 {
+		t.Errorf("ExitCode = %d, want 1", code)
+	}
+	if code := ExitCode(nil); code != 0 {
+		t.Errorf("ExitCode = %d, want 0", code)
+	}
+}
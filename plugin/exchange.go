@@ -0,0 +1,63 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+
+	"github.com/harness-community/drone-azure-oidc/pkg/azuread"
+)
+
+// The token exchange is implemented by the azuread package. These
+// aliases keep the names the plugin has always exported.
+type (
+	// AzureTokenResponse represents the response from Azure AD token endpoint.
+	AzureTokenResponse = azuread.TokenResponse
+
+	// AzureErrorResponse represents an error response from Azure AD.
+	AzureErrorResponse = azuread.ErrorResponse
+
+	// AzureAuthError is returned when Azure AD rejects a token request.
+	AzureAuthError = azuread.AuthError
+
+	// NetworkError is returned when a request fails before a response
+	// is received, such as on DNS, connection or TLS failures.
+	NetworkError = azuread.NetworkError
+
+	// Exchanger exchanges external OIDC tokens for Azure AD access
+	// tokens.
+	Exchanger = azuread.Exchanger
+
+	// retryableError marks a failure as transient.
+	retryableError = azuread.RetryableError
+)
+
+// default settings for Azure authority and HTTP
+const (
+	defaultAuthorityHost = azuread.DefaultAuthorityHost
+	defaultTimeout       = azuread.DefaultTimeout
+	defaultScope         = azuread.DefaultScope
+)
+
+func init() {
+	azuread.SetHooks(azuread.Hooks{
+		Secret:  redactSecret,
+		Redact:  redactor.Redact,
+		Attempt: observeAttempt,
+	})
+}
+
+// observeAttempt counts the token request in the exchange stats of
+// the context and records it as a span.
+func observeAttempt(ctx context.Context, attempt int, endpoint string) (context.Context, func(error)) {
+	countAttempt(ctx)
+	ctx, span := startSpan(ctx, "attempt")
+	span.SetAttribute("attempt", attempt)
+	span.SetAttribute("http.url", endpoint)
+	return ctx, span.End
+}
+
+// ExchangeOIDCForAzureToken exchanges an external OIDC token for an Azure AD access token.
+func ExchangeOIDCForAzureToken(ctx context.Context, oidcToken, tenantID, clientID, scope, authorityHost string) (*AzureTokenResponse, error) {
+	return new(Exchanger).Exchange(ctx, oidcToken, tenantID, clientID, scope, authorityHost)
+}
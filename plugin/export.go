@@ -0,0 +1,154 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"sort"
+	"strings"
+)
+
+// StageExports maps output names to the names they are exported
+// under for use at the stage level.
+type StageExports map[string]string
+
+// Decode implements the envconfig.Decoder interface. The value is a
+// JSON object or a comma-separated list of output=name pairs.
+func (e *StageExports) Decode(value string) error {
+	value = strings.TrimSpace(value)
+	if value == "" {
+		return nil
+	}
+	exports := StageExports{}
+	if strings.HasPrefix(value, "{") {
+		if err := json.Unmarshal([]byte(value), (*map[string]string)(&exports)); err != nil {
+			return fmt.Errorf("stage-exports must be a JSON object: %w", err)
+		}
+	} else {
+		for _, pair := range strings.Split(value, ",") {
+			output, name, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("stage-exports must be a list of output=name pairs")
+			}
+			exports[strings.TrimSpace(output)] = strings.TrimSpace(name)
+		}
+	}
+	*e = exports
+	return nil
+}
+
+// Outputs returns the exported output names in sorted order.
+func (e StageExports) Outputs() []string {
+	outputs := make([]string, 0, len(e))
+	for output := range e {
+		outputs = append(outputs, output)
+	}
+	sort.Strings(outputs)
+	return outputs
+}
+
+// verifyStageExports validates the exported names.
+func verifyStageExports(args Args) error {
+	seen := map[string]bool{}
+	for _, output := range args.StageExports.Outputs() {
+		name := args.StageExports[output]
+		if output == "" || name == "" || outputSuffix(name) != name {
+			return fmt.Errorf("stage-exports: %q=%q must map an output to an upper case name of letters, digits and underscores", output, name)
+		}
+		if seen[name] {
+			return fmt.Errorf("stage-exports: duplicate name %q", name)
+		}
+		seen[name] = true
+	}
+	return nil
+}
+
+// stageVariable is a stage variable in the exports file.
+type stageVariable struct {
+	Name string
+	Type string
+}
+
+// writeStageExports writes the exported outputs again under their
+// export names, keeping secret outputs secret, and writes the stage
+// variables referencing them to the stage exports file.
+func writeStageExports(ctx context.Context, args Args) error {
+	if len(args.StageExports) == 0 {
+		return nil
+	}
+	secrets, err := readOutputFile(os.Getenv("HARNESS_OUTPUT_SECRET_FILE"))
+	if err != nil {
+		return err
+	}
+	plain, err := readOutputFile(os.Getenv("DRONE_OUTPUT"))
+	if err != nil {
+		return err
+	}
+
+	var variables []stageVariable
+	for _, output := range args.StageExports.Outputs() {
+		name := args.StageExports[output]
+		if value, ok := secrets[output]; ok {
+			if err := secretOutput(ctx, args).Write(name, value); err != nil {
+				return err
+			}
+			variables = append(variables, stageVariable{Name: name, Type: "Secret"})
+		} else if value, ok := plain[output]; ok {
+			if err := plainOutput(ctx).Write(name, value); err != nil {
+				return err
+			}
+			variables = append(variables, stageVariable{Name: name, Type: "String"})
+		} else {
+			logger(ctx).Warnf("output %s was not written, skipping its export as %s", output, name)
+		}
+	}
+	if args.StageExportsFile == "" {
+		return nil
+	}
+
+	step := args.Step.Name
+	if step == "" {
+		step = "STEP_ID"
+	}
+	var b strings.Builder
+	b.WriteString("variables:\n")
+	for _, v := range variables {
+		fmt.Fprintf(&b, "  - name: %s\n    type: %s\n    value: <+execution.steps.%s.output.outputVariables.%s>\n", v.Name, v.Type, step, v.Name)
+	}
+	if err := os.WriteFile(args.StageExportsFile, []byte(b.String()), 0644); err != nil {
+		return fmt.Errorf("failed to write stage exports file: %w", err)
+	}
+	return nil
+}
+
+// readOutputFile reads the key=value pairs of an output file. Later
+// values of a key override earlier ones.
+func readOutputFile(path string) (map[string]string, error) {
+	values := map[string]string{}
+	if path == "" {
+		return values, nil
+	}
+	file, err := os.Open(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return values, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read output file: %w", err)
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		if key, value, ok := strings.Cut(scanner.Text(), "="); ok {
+			values[key] = value
+		}
+	}
+	return values, scanner.Err()
+}
@@ -0,0 +1,94 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestStageExports_Decode(t *testing.T) {
+	for _, value := range []string{
+		"AZURE_ACCESS_TOKEN=DEPLOY_TOKEN, AZURE_TENANT_ID=DEPLOY_TENANT",
+		`{"AZURE_ACCESS_TOKEN":"DEPLOY_TOKEN","AZURE_TENANT_ID":"DEPLOY_TENANT"}`,
+	} {
+		var exports StageExports
+		if err := exports.Decode(value); err != nil {
+			t.Fatalf("Decode(%q) returned error: %v", value, err)
+		}
+		if len(exports) != 2 || exports["AZURE_ACCESS_TOKEN"] != "DEPLOY_TOKEN" || exports["AZURE_TENANT_ID"] != "DEPLOY_TENANT" {
+			t.Errorf("Decode(%q) = %v", value, exports)
+		}
+	}
+	if err := new(StageExports).Decode("AZURE_ACCESS_TOKEN"); err == nil {
+		t.Errorf("expected error for a missing name")
+	}
+}
+
+func TestVerifyStageExports(t *testing.T) {
+	for _, exports := range []StageExports{
+		{"AZURE_ACCESS_TOKEN": "deploy-token"},
+		{"AZURE_ACCESS_TOKEN": ""},
+		{"AZURE_ACCESS_TOKEN": "TOKEN", "AZURE_TENANT_ID": "TOKEN"},
+	} {
+		if err := verifyStageExports(Args{StageExports: exports}); err == nil {
+			t.Errorf("expected error for %v", exports)
+		}
+	}
+}
+
+func TestExec_StageExports(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"abc"}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	t.Setenv("HARNESS_OUTPUT_SECRET_FILE", filepath.Join(dir, "secret.env"))
+	t.Setenv("DRONE_OUTPUT", filepath.Join(dir, "out.env"))
+
+	args := Args{
+		OIDCToken:     testOIDCToken,
+		TenantID:      "12345678-1234-1234-1234-1234567890ab",
+		ClientID:      "12345678-1234-1234-1234-1234567890ab",
+		AuthorityHost: srv.URL,
+		StageExports: StageExports{
+			"AZURE_ACCESS_TOKEN": "DEPLOY_TOKEN",
+			"AZURE_TENANT_ID":    "DEPLOY_TENANT",
+			"AZURE_MISSING":      "DEPLOY_MISSING",
+		},
+		StageExportsFile: filepath.Join(dir, "exports.yaml"),
+	}
+	args.Step.Name = "azure_login"
+	if err := Exec(context.Background(), args); err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+
+	secret, _ := os.ReadFile(filepath.Join(dir, "secret.env"))
+	if !strings.HasSuffix(string(secret), "DEPLOY_TOKEN=abc\n") {
+		t.Errorf("unexpected secret outputs %q", secret)
+	}
+	plain, _ := os.ReadFile(filepath.Join(dir, "out.env"))
+	if !strings.HasSuffix(string(plain), "DEPLOY_TENANT=12345678-1234-1234-1234-1234567890ab\n") || strings.Contains(string(plain), "DEPLOY_TOKEN") {
+		t.Errorf("unexpected outputs %q", plain)
+	}
+
+	data, _ := os.ReadFile(args.StageExportsFile)
+	want := `variables:
+  - name: DEPLOY_TOKEN
+    type: Secret
+    value: <+execution.steps.azure_login.output.outputVariables.DEPLOY_TOKEN>
+  - name: DEPLOY_TENANT
+    type: String
+    value: <+execution.steps.azure_login.output.outputVariables.DEPLOY_TENANT>
+`
+	if string(data) != want {
+		t.Errorf("unexpected stage exports file %q, want %q", data, want)
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// claimCondition is a single comparison of a claims-matching
+// expression, such as claims['sub'] matches 'pipeline:*'.
+type claimCondition struct {
+	Claim    string
+	Operator string
+	Value    string
+}
+
+// String returns the condition in expression syntax.
+func (c claimCondition) String() string {
+	return fmt.Sprintf("claims['%s'] %s '%s'", c.Claim, c.Operator, c.Value)
+}
+
+// parseClaimsExpression parses a federated identity credential
+// claims-matching expression: comparisons of the form
+// claims['name'] eq 'value' or claims['name'] matches 'pattern',
+// joined with and.
+func parseClaimsExpression(expr string) ([]claimCondition, error) {
+	tokens, err := tokenizeExpression(expr)
+	if err != nil {
+		return nil, err
+	}
+	var conditions []claimCondition
+	for len(tokens) > 0 {
+		if len(tokens) < 3 {
+			return nil, fmt.Errorf("incomplete condition near %q", strings.Join(tokens, " "))
+		}
+		claim, ok := parseClaimReference(tokens[0])
+		if !ok {
+			return nil, fmt.Errorf("expected claims['name'], got %q", tokens[0])
+		}
+		operator := strings.ToLower(tokens[1])
+		if operator != "eq" && operator != "matches" {
+			return nil, fmt.Errorf("unsupported operator %q, must be eq or matches", tokens[1])
+		}
+		value, ok := parseStringLiteral(tokens[2])
+		if !ok {
+			return nil, fmt.Errorf("expected a quoted string, got %q", tokens[2])
+		}
+		conditions = append(conditions, claimCondition{Claim: claim, Operator: operator, Value: value})
+
+		tokens = tokens[3:]
+		if len(tokens) == 0 {
+			break
+		}
+		if !strings.EqualFold(tokens[0], "and") || len(tokens) == 1 {
+			return nil, fmt.Errorf("expected and followed by a condition, got %q", strings.Join(tokens, " "))
+		}
+		tokens = tokens[1:]
+	}
+	if len(conditions) == 0 {
+		return nil, fmt.Errorf("expression is empty")
+	}
+	return conditions, nil
+}
+
+// tokenizeExpression splits the expression on whitespace outside of
+// quoted strings. Quotes inside a string are escaped by doubling.
+func tokenizeExpression(expr string) ([]string, error) {
+	var tokens []string
+	var current strings.Builder
+	quoted := false
+	runes := []rune(expr)
+	for i := 0; i < len(runes); i++ {
+		r := runes[i]
+		switch {
+		case r == '\'' && quoted && i+1 < len(runes) && runes[i+1] == '\'':
+			current.WriteString("''")
+			i++
+		case r == '\'':
+			quoted = !quoted
+			current.WriteRune(r)
+		case unicode.IsSpace(r) && !quoted:
+			if current.Len() > 0 {
+				tokens = append(tokens, current.String())
+				current.Reset()
+			}
+		default:
+			current.WriteRune(r)
+		}
+	}
+	if quoted {
+		return nil, fmt.Errorf("unterminated string in expression")
+	}
+	if current.Len() > 0 {
+		tokens = append(tokens, current.String())
+	}
+	return tokens, nil
+}
+
+// parseClaimReference parses claims['name'].
+func parseClaimReference(token string) (string, bool) {
+	if !strings.HasPrefix(token, "claims[") || !strings.HasSuffix(token, "]") {
+		return "", false
+	}
+	return parseStringLiteral(token[len("claims[") : len(token)-1])
+}
+
+// parseStringLiteral parses a single-quoted string.
+func parseStringLiteral(token string) (string, bool) {
+	if len(token) < 2 || token[0] != '\'' || token[len(token)-1] != '\'' {
+		return "", false
+	}
+	return strings.ReplaceAll(token[1:len(token)-1], "''", "'"), true
+}
+
+// Match reports whether the claim satisfies the condition. For
+// multi-valued claims any value may satisfy it.
+func (c claimCondition) Match(token *jwtToken) bool {
+	for _, value := range token.StringsClaim(c.Claim) {
+		if c.Operator == "eq" && value == c.Value {
+			return true
+		}
+		if c.Operator == "matches" && matchGlob(c.Value, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// checkClaimsExpression evaluates the claims-matching expression
+// against the assertion, logging the result of every condition so
+// an expression can be validated before it is configured in Azure.
+func checkClaimsExpression(ctx context.Context, token *jwtToken, expr string) error {
+	conditions, err := parseClaimsExpression(expr)
+	if err != nil {
+		return fmt.Errorf("claims-matching-expression: %w", err)
+	}
+
+	var failed []string
+	for _, condition := range conditions {
+		if condition.Match(token) {
+			logger(ctx).Infof("claims-matching expression: %s: matched", condition)
+			continue
+		}
+		logger(ctx).Infof("claims-matching expression: %s: not matched (claim value %q)", condition, strings.Join(token.StringsClaim(condition.Claim), ", "))
+		failed = append(failed, condition.String())
+	}
+	if len(failed) > 0 {
+		return fmt.Errorf("oidc-token does not satisfy the claims-matching expression: %s", strings.Join(failed, " and "))
+	}
+	return nil
+}
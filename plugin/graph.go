@@ -0,0 +1,107 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/harness-community/drone-azure-oidc/pkg/azuread"
+)
+
+// defaultGraphEndpoint is the Microsoft Graph endpoint of the public
+// cloud.
+const defaultGraphEndpoint = "https://graph.microsoft.com"
+
+// graphEndpoints maps the authority host of each national cloud to
+// its Microsoft Graph endpoint.
+var graphEndpoints = map[string]string{
+	"login.microsoftonline.com": "https://graph.microsoft.com",
+	"login.microsoftonline.us":  "https://graph.microsoft.us",
+	"login.chinacloudapi.cn":    "https://microsoftgraph.chinacloudapi.cn",
+}
+
+// servicePrincipal is the service principal returned by Microsoft
+// Graph.
+type servicePrincipal struct {
+	ID          string `json:"id"`
+	AppID       string `json:"appId"`
+	DisplayName string `json:"displayName"`
+}
+
+// graphEndpoint returns the configured Microsoft Graph endpoint, or
+// the endpoint of the cloud of the authority host.
+func graphEndpoint(args Args) string {
+	if args.GraphEndpoint != "" {
+		return strings.TrimRight(args.GraphEndpoint, "/")
+	}
+	for _, host := range azuread.SplitAuthorityHosts(args.AuthorityHost) {
+		u, err := url.Parse(host)
+		if err != nil {
+			continue
+		}
+		if endpoint, ok := graphEndpoints[strings.ToLower(u.Hostname())]; ok {
+			return endpoint
+		}
+	}
+	return defaultGraphEndpoint
+}
+
+// lookupServicePrincipal reads the service principal of the
+// application from Microsoft Graph.
+func lookupServicePrincipal(ctx context.Context, exchanger *Exchanger, endpoint, accessToken, clientID string) (*servicePrincipal, error) {
+	address := endpoint + "/v1.0/servicePrincipals(appId='" + url.PathEscape(clientID) + "')?$select=id,appId,displayName"
+	if err := azuread.CheckEndpoint(address, nil); err != nil {
+		return nil, err
+	}
+	sp := new(servicePrincipal)
+	if err := getJSON(ctx, exchanger.HTTPClient(), address, accessToken, sp); err != nil {
+		return nil, err
+	}
+	if sp.ID == "" {
+		return nil, errors.New("response has no object id")
+	}
+	return sp, nil
+}
+
+// checkWhoami acquires a Microsoft Graph token, confirms the service
+// principal of the client resolves and writes its object ID and
+// display name to the non-secret output file.
+func checkWhoami(ctx context.Context, args Args, exchanger *Exchanger) error {
+	endpoint := graphEndpoint(args)
+	provider, err := newTokenProvider(args, exchanger)
+	if err != nil {
+		return configError(err)
+	}
+
+	ctx, span := startSpan(ctx, "whoami")
+	sp, err := func() (*servicePrincipal, error) {
+		token, err := provider.Token(ctx, endpoint+"/.default")
+		if err != nil {
+			return nil, fmt.Errorf("failed to acquire Microsoft Graph token: %w", err)
+		}
+		sp, err := lookupServicePrincipal(ctx, exchanger, endpoint, token.AccessToken, args.ClientID)
+		if err != nil {
+			return nil, fmt.Errorf("failed to resolve the service principal of client %s: %w", args.ClientID, err)
+		}
+		return sp, nil
+	}()
+	span.End(err)
+	if err != nil {
+		return err
+	}
+	logger(ctx).Infof("authenticated as service principal %q (object id %s)", sp.DisplayName, sp.ID)
+
+	if output := plainOutput(ctx); output != nil {
+		if err := output.Write("AZURE_SP_OBJECT_ID", sp.ID); err != nil {
+			return err
+		}
+		if err := output.Write("AZURE_SP_DISPLAY_NAME", sp.DisplayName); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExec_Whoami(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case r.Method == http.MethodPost && r.PostFormValue("scope") == "https://management.azure.com/.default":
+			_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"arm-token"}`))
+		case r.Method == http.MethodPost && strings.HasSuffix(r.PostFormValue("scope"), "/.default"):
+			_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"graph-token"}`))
+		case r.URL.Path == "/v1.0/servicePrincipals(appId='00000000-0000-0000-0000-000000000001')":
+			if r.Header.Get("Authorization") != "Bearer graph-token" {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			_, _ = w.Write([]byte(`{"id":"11111111-1111-1111-1111-111111111111","appId":"00000000-0000-0000-0000-000000000001","displayName":"deploy-pipeline"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	t.Setenv("HARNESS_OUTPUT_SECRET_FILE", filepath.Join(dir, "secret.env"))
+	t.Setenv("DRONE_OUTPUT", filepath.Join(dir, "out.env"))
+
+	args := Args{
+		OIDCToken:     testOIDCToken,
+		TenantID:      "12345678-1234-1234-1234-1234567890ab",
+		ClientID:      "00000000-0000-0000-0000-000000000001",
+		AuthorityHost: srv.URL,
+		Whoami:        true,
+		GraphEndpoint: srv.URL,
+	}
+	if err := Exec(context.Background(), args); err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+	data, _ := os.ReadFile(filepath.Join(dir, "out.env"))
+	for _, want := range []string{
+		"AZURE_SP_OBJECT_ID=11111111-1111-1111-1111-111111111111\n",
+		"AZURE_SP_DISPLAY_NAME=deploy-pipeline\n",
+	} {
+		if !strings.Contains(string(data), want) {
+			t.Errorf("outputs %q missing %q", data, want)
+		}
+	}
+
+	args.ClientID = "00000000-0000-0000-0000-000000000002"
+	if err := Exec(context.Background(), args); err == nil || !strings.Contains(err.Error(), "failed to resolve the service principal") {
+		t.Fatalf("expected lookup error, got %v", err)
+	}
+}
+
+func TestGraphEndpoint(t *testing.T) {
+	tests := map[string]Args{
+		"https://graph.microsoft.com":             {},
+		"https://graph.microsoft.us":              {AuthorityHost: "https://login.microsoftonline.us"},
+		"https://microsoftgraph.chinacloudapi.cn": {AuthorityHost: "https://login.chinacloudapi.cn/"},
+		"https://graph.example.com":               {AuthorityHost: "https://login.microsoftonline.us", GraphEndpoint: "https://graph.example.com/"},
+	}
+	for want, args := range tests {
+		if got := graphEndpoint(args); got != want {
+			t.Errorf("graphEndpoint(%+v) = %q, want %q", args, got, want)
+		}
+	}
+}
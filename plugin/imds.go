@@ -0,0 +1,61 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/harness-community/drone-azure-oidc/pkg/azuread"
+)
+
+// defaultExchangeAudience is the audience of a managed identity token
+// used as a federated credential in the public cloud.
+const defaultExchangeAudience = "api://AzureADTokenExchange"
+
+// exchangeAudiences maps the authority host of each national cloud to
+// the audience expected by federated identity credentials.
+var exchangeAudiences = map[string]string{
+	"login.microsoftonline.com": "api://AzureADTokenExchange",
+	"login.microsoftonline.us":  "api://AzureADTokenExchangeUSGov",
+	"login.chinacloudapi.cn":    "api://AzureADTokenExchangeChina",
+}
+
+// exchangeAudience returns the federated credential audience of the
+// cloud of the authority host.
+func exchangeAudience(args Args) string {
+	for _, host := range azuread.SplitAuthorityHosts(args.AuthorityHost) {
+		u, err := url.Parse(host)
+		if err != nil {
+			continue
+		}
+		if audience, ok := exchangeAudiences[strings.ToLower(u.Hostname())]; ok {
+			return audience
+		}
+	}
+	return defaultExchangeAudience
+}
+
+// managedIdentityAssertion acquires a token for the user-assigned
+// managed identity from the Instance Metadata Service, to be used as
+// the client assertion of the application. The request is never
+// proxied since the endpoint is link-local.
+func managedIdentityAssertion(ctx context.Context, args Args) (string, error) {
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+	ctx, span := startSpan(ctx, "managed_identity")
+	provider := &azuread.ManagedIdentityProvider{
+		Endpoint: args.ManagedIdentityEndpoint,
+		ClientID: args.ManagedIdentityClientID,
+		Timeout:  args.AttemptTimeout,
+	}
+	token, err := provider.Token(ctx, exchangeAudience(args))
+	span.End(err)
+	if err != nil {
+		return "", fmt.Errorf("failed to get managed identity token: %w", err)
+	}
+	logger(ctx).Infof("acquired token for managed identity %s", args.ManagedIdentityClientID)
+	return token.AccessToken, nil
+}
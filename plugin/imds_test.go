@@ -0,0 +1,80 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/harness-community/drone-azure-oidc/pkg/azuread"
+)
+
+func TestExec_ManagedIdentityAssertion(t *testing.T) {
+	imds := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query()
+		if r.Header.Get("Metadata") != "true" || query.Get("resource") != "api://AzureADTokenExchange" ||
+			query.Get("client_id") != "00000000-0000-0000-0000-00000000000a" || query.Get("api-version") != azuread.IMDSAPIVersion {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_request","error_description":"unexpected request"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"access_token":"` + testOIDCToken + `","expires_in":"86400"}`))
+	}))
+	defer imds.Close()
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.PostFormValue("client_assertion") != testOIDCToken {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"app-token"}`))
+	}))
+	defer srv.Close()
+
+	outPath := filepath.Join(t.TempDir(), "out.env")
+	t.Setenv("HARNESS_OUTPUT_SECRET_FILE", outPath)
+
+	args := Args{
+		TenantID:                "12345678-1234-1234-1234-1234567890ab",
+		ClientID:                "00000000-0000-0000-0000-000000000001",
+		AuthorityHost:           srv.URL,
+		ManagedIdentityClientID: "00000000-0000-0000-0000-00000000000a",
+		ManagedIdentityEndpoint: imds.URL,
+	}
+	if err := Exec(context.Background(), args); err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+	data, _ := os.ReadFile(outPath)
+	if !strings.Contains(string(data), "AZURE_ACCESS_TOKEN=app-token\n") {
+		t.Fatalf("unexpected outputs %q", data)
+	}
+
+	args.ManagedIdentityClientID = "00000000-0000-0000-0000-00000000000b"
+	if err := Exec(context.Background(), args); err == nil || !strings.Contains(err.Error(), "invalid_request") {
+		t.Fatalf("expected managed identity error, got %v", err)
+	}
+
+	args.OIDCToken = testOIDCToken
+	if err := Exec(context.Background(), args); err == nil || !strings.Contains(err.Error(), "mutually exclusive") {
+		t.Fatalf("expected mutually exclusive error, got %v", err)
+	}
+}
+
+func TestExchangeAudience(t *testing.T) {
+	tests := map[string]string{
+		"":                                 "api://AzureADTokenExchange",
+		"https://login.microsoftonline.us": "api://AzureADTokenExchangeUSGov",
+		"https://login.chinacloudapi.cn":   "api://AzureADTokenExchangeChina",
+	}
+	for host, want := range tests {
+		if got := exchangeAudience(Args{AuthorityHost: host}); got != want {
+			t.Errorf("exchangeAudience(%q) = %q, want %q", host, got, want)
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/harness-community/drone-azure-oidc/pkg/azuread"
+)
+
+// jsonWebKey is a public key from a JSON Web Key Set.
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// jsonWebKeySet is a JSON Web Key Set document.
+type jsonWebKeySet struct {
+	Keys []jsonWebKey `json:"keys"`
+}
+
+// verifyAssertion verifies the issuer, audience, validity period and
+// signature of the OIDC assertion, catching truncated, tampered or
+// forged tokens before they are sent to Azure. The issuer is checked
+// against the allowed issuers before its keys are fetched, since a
+// forged token naming its own issuer would otherwise be verified
+// with the keys of that issuer.
+func verifyAssertion(ctx context.Context, client *http.Client, assertion string, allowedIssuers []string, audience string) error {
+	token, err := parseJWT(assertion)
+	if err != nil {
+		return fmt.Errorf("assertion verification failed: %w", err)
+	}
+	issuer := strings.TrimRight(token.StringClaim("iss"), "/")
+	if issuer == "" {
+		return fmt.Errorf("assertion verification failed: token has no issuer")
+	}
+	if err := checkIssuer(issuer, allowedIssuers); err != nil {
+		return fmt.Errorf("assertion verification failed: %w", err)
+	}
+	if err := azuread.CheckEndpoint(issuer, nil); err != nil {
+		return fmt.Errorf("assertion verification failed: %w", err)
+	}
+	now := wallClock.Now()
+	if exp, ok := token.TimeClaim("exp"); ok && now.After(exp) {
+		return fmt.Errorf("assertion verification failed: token expired at %s", exp.UTC().Format(time.RFC3339))
+	}
+	if nbf, ok := token.TimeClaim("nbf"); ok && now.Before(nbf) {
+		return fmt.Errorf("assertion verification failed: token is not valid before %s", nbf.UTC().Format(time.RFC3339))
+	}
+	if !slices.Contains(token.StringsClaim("aud"), audience) {
+		return fmt.Errorf("assertion verification failed: token audience %q does not include %s", strings.Join(token.StringsClaim("aud"), ", "), audience)
+	}
+
+	config, err := azuread.FetchOpenIDConfiguration(ctx, client, issuer+"/.well-known/openid-configuration")
+	if err != nil {
+		return fmt.Errorf("assertion verification failed: %w", err)
+	}
+	if strings.TrimRight(config.Issuer, "/") != issuer {
+		return fmt.Errorf("assertion verification failed: issuer %q does not match discovery issuer %q", issuer, config.Issuer)
+	}
+	if config.JWKSURI == "" {
+		return fmt.Errorf("assertion verification failed: issuer %s does not publish a jwks_uri", issuer)
+	}
+
+	keys, err := fetchJWKS(ctx, client, config.JWKSURI)
+	if err != nil {
+		return fmt.Errorf("assertion verification failed: %w", err)
+	}
+	for _, key := range keys.Keys {
+		if token.Header.Kid != "" && key.Kid != token.Header.Kid {
+			continue
+		}
+		err := verifySignature(token, key)
+		if err == nil {
+			logger(ctx).Debugf("assertion signature verified with key %s from %s", key.Kid, config.JWKSURI)
+			return nil
+		}
+		if token.Header.Kid != "" {
+			return fmt.Errorf("assertion verification failed: %w", err)
+		}
+	}
+	return fmt.Errorf("assertion verification failed: no key in %s verifies the token signature", config.JWKSURI)
+}
+
+// fetchJWKS downloads the JSON Web Key Set at the address.
+func fetchJWKS(ctx context.Context, client *http.Client, address string) (*jsonWebKeySet, error) {
+	if err := azuread.CheckEndpoint(address, nil); err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, address, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create jwks request: %w", err)
+	}
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, &NetworkError{Err: fmt.Errorf("failed to fetch jwks: %w", err)}
+	}
+	defer drainAndClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch jwks from %s: %s", address, resp.Status)
+	}
+	keys := new(jsonWebKeySet)
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 1<<20)).Decode(keys); err != nil {
+		return nil, fmt.Errorf("failed to decode jwks: %w", err)
+	}
+	return keys, nil
+}
+
+// verifySignature verifies the token signature with the key.
+func verifySignature(token *jwtToken, key jsonWebKey) error {
+	var hash crypto.Hash
+	switch token.Header.Alg {
+	case "RS256", "PS256", "ES256":
+		hash = crypto.SHA256
+	case "RS384", "PS384", "ES384":
+		hash = crypto.SHA384
+	case "RS512", "PS512", "ES512":
+		hash = crypto.SHA512
+	default:
+		return fmt.Errorf("unsupported signing algorithm %q", token.Header.Alg)
+	}
+	h := hash.New()
+	h.Write([]byte(token.signed))
+	digest := h.Sum(nil)
+
+	switch {
+	case strings.HasPrefix(token.Header.Alg, "RS"), strings.HasPrefix(token.Header.Alg, "PS"):
+		pub, err := key.rsaPublicKey()
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(token.Header.Alg, "PS") {
+			err = rsa.VerifyPSS(pub, hash, digest, token.signature, nil)
+		} else {
+			err = rsa.VerifyPKCS1v15(pub, hash, digest, token.signature)
+		}
+		if err != nil {
+			return fmt.Errorf("invalid token signature")
+		}
+		return nil
+	default:
+		pub, err := key.ecdsaPublicKey()
+		if err != nil {
+			return err
+		}
+		size := (pub.Curve.Params().BitSize + 7) / 8
+		if len(token.signature) != 2*size {
+			return fmt.Errorf("invalid token signature")
+		}
+		r := new(big.Int).SetBytes(token.signature[:size])
+		s := new(big.Int).SetBytes(token.signature[size:])
+		if !ecdsa.Verify(pub, digest, r, s) {
+			return fmt.Errorf("invalid token signature")
+		}
+		return nil
+	}
+}
+
+func (k jsonWebKey) rsaPublicKey() (*rsa.PublicKey, error) {
+	if k.Kty != "RSA" {
+		return nil, fmt.Errorf("key %s is not an RSA key", k.Kid)
+	}
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, fmt.Errorf("key %s has an invalid modulus", k.Kid)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil || len(e) == 0 || len(e) > 4 {
+		return nil, fmt.Errorf("key %s has an invalid exponent", k.Kid)
+	}
+	exponent := 0
+	for _, b := range e {
+		exponent = exponent<<8 | int(b)
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: exponent}, nil
+}
+
+func (k jsonWebKey) ecdsaPublicKey() (*ecdsa.PublicKey, error) {
+	if k.Kty != "EC" {
+		return nil, fmt.Errorf("key %s is not an EC key", k.Kid)
+	}
+	var curve elliptic.Curve
+	switch k.Crv {
+	case "P-256":
+		curve = elliptic.P256()
+	case "P-384":
+		curve = elliptic.P384()
+	case "P-521":
+		curve = elliptic.P521()
+	default:
+		return nil, fmt.Errorf("key %s uses unsupported curve %q", k.Kid, k.Crv)
+	}
+	x, err := base64.RawURLEncoding.DecodeString(k.X)
+	if err != nil {
+		return nil, fmt.Errorf("key %s has an invalid x coordinate", k.Kid)
+	}
+	y, err := base64.RawURLEncoding.DecodeString(k.Y)
+	if err != nil {
+		return nil, fmt.Errorf("key %s has an invalid y coordinate", k.Kid)
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+}
@@ -0,0 +1,384 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testIssuer is a mock OIDC issuer publishing a discovery document
+// and a JSON Web Key Set.
+type testIssuer struct {
+	*httptest.Server
+	key *rsa.PrivateKey
+	kid string
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("failed generating key: %v", err)
+	}
+	issuer := &testIssuer{key: key, kid: "test-key"}
+	issuer.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.URL.Path {
+		case "/.well-known/openid-configuration":
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"issuer":   issuer.URL,
+				"jwks_uri": issuer.URL + "/jwks",
+			})
+		case "/jwks":
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"keys": []map[string]string{{
+					"kty": "RSA",
+					"kid": issuer.kid,
+					"n":   base64.RawURLEncoding.EncodeToString(key.N.Bytes()),
+					"e":   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(key.E)).Bytes()),
+				}},
+			})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	t.Cleanup(issuer.Close)
+	return issuer
+}
+
+// sign returns an RS256 JWT with the claims, defaulting the issuer
+// and expiry claims.
+func (i *testIssuer) sign(t *testing.T, claims map[string]interface{}) string {
+	t.Helper()
+	if _, ok := claims["iss"]; !ok {
+		claims["iss"] = i.URL
+	}
+	if _, ok := claims["exp"]; !ok {
+		claims["exp"] = time.Now().Add(time.Hour).Unix()
+	}
+	return signTestJWT(t, i.key, i.kid, claims)
+}
+
+func signTestJWT(t *testing.T, key *rsa.PrivateKey, kid string, claims map[string]interface{}) string {
+	t.Helper()
+	header, _ := json.Marshal(map[string]string{"alg": "RS256", "typ": "JWT", "kid": kid})
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatalf("failed encoding claims: %v", err)
+	}
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+	digest := sha256.Sum256([]byte(signed))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+	if err != nil {
+		t.Fatalf("failed signing token: %v", err)
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(sig)
+}
+
+func TestParseJWT(t *testing.T) {
+	issuer := newTestIssuer(t)
+	token, err := parseJWT(issuer.sign(t, map[string]interface{}{
+		"sub": "pipeline:build",
+		"aud": []string{"api://AzureADTokenExchange"},
+		"exp": 1700000000,
+	}))
+	if err != nil {
+		t.Fatalf("parseJWT returned error: %v", err)
+	}
+	if token.Header.Alg != "RS256" || token.Header.Kid != "test-key" {
+		t.Fatalf("unexpected header: %+v", token.Header)
+	}
+	if got := token.StringClaim("sub"); got != "pipeline:build" {
+		t.Fatalf("unexpected sub claim %q", got)
+	}
+	if got := token.StringsClaim("aud"); len(got) != 1 || got[0] != "api://AzureADTokenExchange" {
+		t.Fatalf("unexpected aud claim %v", got)
+	}
+	if exp, ok := token.TimeClaim("exp"); !ok || exp.Unix() != 1700000000 {
+		t.Fatalf("unexpected exp claim %v", exp)
+	}
+
+	for _, value := range []string{"not-a-jwt", "a.b", "!!!.e30.sig", "e30.!!!.sig"} {
+		if _, err := parseJWT(value); err == nil {
+			t.Errorf("expected error for %q", value)
+		}
+	}
+}
+
+func TestExplainExpiredAssertion(t *testing.T) {
+	assertion := "eyJhbGciOiJub25lIn0." + base64.RawURLEncoding.EncodeToString([]byte(`{"exp":1700000000}`)) + ".c2ln"
+	exp := time.Unix(1700000000, 0)
+	rejected := &AzureAuthError{Code: "invalid_client", Description: "AADSTS700024: Client assertion is not within its valid time range.", ErrorCodes: []int{700024}}
+
+	err := explainExpiredAssertion(rejected, assertion, exp.Add(12*time.Minute+3*time.Second))
+	if err == nil || !strings.HasPrefix(err.Error(), "the OIDC token expired 12m3s ago, at 2023-11-14T22:13:20Z") {
+		t.Fatalf("unexpected error %v", err)
+	}
+	var authErr *AzureAuthError
+	if !errors.As(err, &authErr) {
+		t.Errorf("expected the AzureAuthError to be wrapped")
+	}
+	if err := explainExpiredAssertion(rejected, assertion, exp.Add(-time.Minute)); err == nil || !strings.Contains(err.Error(), "check the clock") {
+		t.Errorf("unexpected error for an unexpired token %v", err)
+	}
+
+	other := &AzureAuthError{Code: "invalid_client", ErrorCodes: []int{700016}}
+	if err := explainExpiredAssertion(other, assertion, exp.Add(time.Minute)); err != other {
+		t.Errorf("expected other errors unchanged, got %v", err)
+	}
+	if err := explainExpiredAssertion(rejected, testOIDCToken, exp.Add(time.Minute)); err != rejected {
+		t.Errorf("expected error unchanged for a token without exp, got %v", err)
+	}
+}
+
+func TestVerifyAssertion(t *testing.T) {
+	issuer := newTestIssuer(t)
+	attacker := newTestIssuer(t)
+	client := http.DefaultClient
+	allowed := []string{issuer.URL}
+	const audience = "api://AzureADTokenExchange"
+
+	valid := issuer.sign(t, map[string]interface{}{"sub": "pipeline:build", "aud": audience})
+	if err := verifyAssertion(context.Background(), client, valid, allowed, audience); err != nil {
+		t.Fatalf("verifyAssertion returned error: %v", err)
+	}
+
+	parts := strings.Split(valid, ".")
+	parts[1] = base64.RawURLEncoding.EncodeToString([]byte(`{"sub":"attacker","iss":"` + issuer.URL + `","aud":"` + audience + `"}`))
+	tests := map[string]string{
+		"truncated":      valid[:len(valid)-10],
+		"tampered":       strings.Join(parts, "."),
+		"expired":        issuer.sign(t, map[string]interface{}{"aud": audience, "exp": time.Now().Add(-time.Minute).Unix()}),
+		"not yet valid":  issuer.sign(t, map[string]interface{}{"aud": audience, "nbf": time.Now().Add(time.Hour).Unix()}),
+		"wrong audience": issuer.sign(t, map[string]interface{}{"aud": "api://other"}),
+		"foreign key": func() string {
+			other, _ := rsa.GenerateKey(rand.Reader, 2048)
+			return signTestJWT(t, other, issuer.kid, map[string]interface{}{"iss": issuer.URL, "aud": audience})
+		}(),
+		"foreign issuer":    attacker.sign(t, map[string]interface{}{"aud": audience}),
+		"plain http issuer": issuer.sign(t, map[string]interface{}{"iss": "http://harness.example.com", "aud": audience}),
+	}
+	for name, assertion := range tests {
+		t.Run(name, func(t *testing.T) {
+			if err := verifyAssertion(context.Background(), client, assertion, append(allowed, "http://harness.example.com"), audience); err == nil {
+				t.Fatalf("expected verification error")
+			}
+		})
+	}
+}
+
+func TestVerifyEnv_VerifyAssertionRequiresAllowedIssuers(t *testing.T) {
+	issuer := newTestIssuer(t)
+	args := Args{
+		OIDCToken:       issuer.sign(t, map[string]interface{}{"sub": "pipeline:build"}),
+		TenantID:        "12345678-1234-1234-1234-1234567890ab",
+		ClientID:        "12345678-1234-1234-1234-1234567890ab",
+		VerifyAssertion: true,
+	}
+	if err := VerifyEnv(context.Background(), args); err == nil || !strings.Contains(err.Error(), "verify-assertion requires allowed-issuers") {
+		t.Fatalf("expected allowed-issuers error, got %v", err)
+	}
+	args.AllowedIssuers = []string{issuer.URL}
+	if err := VerifyEnv(context.Background(), args); err != nil {
+		t.Fatalf("VerifyEnv returned error: %v", err)
+	}
+}
+
+func TestVerifyEnv_AllowedIssuers(t *testing.T) {
+	issuer := newTestIssuer(t)
+	args := Args{
+		TenantID:       "12345678-1234-1234-1234-1234567890ab",
+		ClientID:       "12345678-1234-1234-1234-1234567890ab",
+		AllowedIssuers: []string{"https://app.harness.io/ng/api/oidc/account/*"},
+	}
+
+	args.OIDCToken = issuer.sign(t, map[string]interface{}{"iss": "https://app.harness.io/ng/api/oidc/account/abc123"})
+	if err := VerifyEnv(context.Background(), args); err != nil {
+		t.Fatalf("VerifyEnv returned error: %v", err)
+	}
+
+	args.OIDCToken = issuer.sign(t, map[string]interface{}{"iss": "https://token.actions.githubusercontent.com"})
+	if err := VerifyEnv(context.Background(), args); err == nil || !strings.Contains(err.Error(), "not in the allowed issuers") {
+		t.Fatalf("expected issuer error, got %v", err)
+	}
+
+	args.OIDCToken = issuer.sign(t, map[string]interface{}{"iss": "https://app.harness.io/ng/api/oidc/account/abc/extra"})
+	if err := VerifyEnv(context.Background(), args); err == nil {
+		t.Fatalf("expected wildcard not to match nested paths")
+	}
+
+	args.OIDCToken = "not-a-jwt"
+	if err := VerifyEnv(context.Background(), args); err == nil {
+		t.Fatalf("expected error for a non-JWT assertion")
+	}
+}
+
+func TestCheckTokenRoles(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appToken := signTestJWT(t, key, "kid", map[string]interface{}{"roles": []string{"Deploy.All", "Read.All"}})
+	userToken := signTestJWT(t, key, "kid", map[string]interface{}{"scp": "user_impersonation Files.Read"})
+
+	if err := checkTokenRoles(appToken, []string{"Deploy.All"}); err != nil {
+		t.Errorf("unexpected error for a granted role: %v", err)
+	}
+	if err := checkTokenRoles(userToken, []string{"Files.Read"}); err != nil {
+		t.Errorf("unexpected error for a granted scope: %v", err)
+	}
+	err = checkTokenRoles(appToken, []string{"Deploy.All", "Write.All"})
+	if err == nil || !strings.Contains(err.Error(), "Write.All") {
+		t.Errorf("expected error naming the missing role, got %v", err)
+	}
+	if err := checkTokenRoles("opaque-token", []string{"Deploy.All"}); err == nil {
+		t.Errorf("expected error for an opaque token")
+	}
+}
+
+func TestVerifyEnv_ExpectedSubject(t *testing.T) {
+	issuer := newTestIssuer(t)
+	args := Args{
+		OIDCToken:       issuer.sign(t, map[string]interface{}{"sub": "account/abc/org/default/project/web/pipeline:deploy"}),
+		TenantID:        "12345678-1234-1234-1234-1234567890ab",
+		ClientID:        "12345678-1234-1234-1234-1234567890ab",
+		ExpectedSubject: "account/abc/*/pipeline:*",
+	}
+	if err := VerifyEnv(context.Background(), args); err != nil {
+		t.Fatalf("VerifyEnv returned error: %v", err)
+	}
+
+	args.ExpectedSubject = "account/abc/org/default/project/web/pipeline:build"
+	if err := VerifyEnv(context.Background(), args); err == nil || !strings.Contains(err.Error(), "does not match the expected subject") {
+		t.Fatalf("expected subject error, got %v", err)
+	}
+
+	args.OIDCToken = issuer.sign(t, map[string]interface{}{"sub": "abc"})
+	args.ExpectedSubject = "a?c"
+	if err := VerifyEnv(context.Background(), args); err != nil {
+		t.Fatalf("VerifyEnv returned error: %v", err)
+	}
+}
+
+func TestParseClaimsExpression(t *testing.T) {
+	conditions, err := parseClaimsExpression(`claims['sub'] matches 'pipeline:*' AND claims['name'] eq 'O''Brien build'`)
+	if err != nil {
+		t.Fatalf("parseClaimsExpression returned error: %v", err)
+	}
+	want := []claimCondition{
+		{Claim: "sub", Operator: "matches", Value: "pipeline:*"},
+		{Claim: "name", Operator: "eq", Value: "O'Brien build"},
+	}
+	if len(conditions) != len(want) || conditions[0] != want[0] || conditions[1] != want[1] {
+		t.Fatalf("unexpected conditions %+v", conditions)
+	}
+
+	for _, expr := range []string{
+		"",
+		"claims['sub']",
+		"claims['sub'] ne 'x'",
+		"claims[sub] eq 'x'",
+		"claims['sub'] eq x",
+		"claims['sub'] eq 'x' or claims['aud'] eq 'y'",
+		"claims['sub'] eq 'x' and",
+		"claims['sub'] eq 'x",
+	} {
+		if _, err := parseClaimsExpression(expr); err == nil {
+			t.Errorf("expected error for %q", expr)
+		}
+	}
+}
+
+func TestVerifyEnv_ClaimsMatchingExpression(t *testing.T) {
+	issuer := newTestIssuer(t)
+	args := Args{
+		OIDCToken: issuer.sign(t, map[string]interface{}{
+			"sub": "account/abc/pipeline:deploy",
+			"aud": []string{"api://AzureADTokenExchange"},
+		}),
+		TenantID:                 "12345678-1234-1234-1234-1234567890ab",
+		ClientID:                 "12345678-1234-1234-1234-1234567890ab",
+		ClaimsMatchingExpression: "claims['sub'] matches 'account/abc/*' and claims['aud'] eq 'api://AzureADTokenExchange'",
+	}
+	if err := VerifyEnv(context.Background(), args); err != nil {
+		t.Fatalf("VerifyEnv returned error: %v", err)
+	}
+
+	args.ClaimsMatchingExpression = "claims['sub'] matches 'account/abc/*' and claims['sub'] eq 'pipeline:build'"
+	err := VerifyEnv(context.Background(), args)
+	if err == nil || !strings.Contains(err.Error(), "claims['sub'] eq 'pipeline:build'") {
+		t.Fatalf("expected error naming the failed condition, got %v", err)
+	}
+
+	args.ClaimsMatchingExpression = "claims['sub'] == 'x'"
+	if err := VerifyEnv(context.Background(), args); err == nil || !strings.Contains(err.Error(), "claims-matching-expression") {
+		t.Fatalf("expected syntax error, got %v", err)
+	}
+}
+
+func TestExec_ClaimsOutput(t *testing.T) {
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertion := signTestJWT(t, key, "kid", map[string]interface{}{
+		"iss":        "https://app.harness.io/ng/api/oidc/account/abc",
+		"sub":        "account/abc/pipeline:deploy",
+		"aud":        "api://AzureADTokenExchange",
+		"account_id": "abc",
+		"nonce":      "not-selected",
+	})
+	accessToken := signTestJWT(t, key, "kid", map[string]interface{}{
+		"tid":   "12345678-1234-1234-1234-1234567890ab",
+		"appid": "00000000-0000-0000-0000-000000000001",
+		"roles": []string{"Deploy.All"},
+		"uti":   "not-selected",
+	})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"` + accessToken + `"}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	t.Setenv("HARNESS_OUTPUT_SECRET_FILE", filepath.Join(dir, "secret.env"))
+	t.Setenv("DRONE_OUTPUT", filepath.Join(dir, "out.env"))
+
+	args := Args{
+		OIDCToken:     assertion,
+		TenantID:      "12345678-1234-1234-1234-1234567890ab",
+		ClientID:      "00000000-0000-0000-0000-000000000001",
+		AuthorityHost: srv.URL,
+		ClaimsOutput:  true,
+	}
+	if err := Exec(context.Background(), args); err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+	outputs, err := readOutputFile(filepath.Join(dir, "out.env"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"assertion":{"account_id":"abc","aud":"api://AzureADTokenExchange","iss":"https://app.harness.io/ng/api/oidc/account/abc","sub":"account/abc/pipeline:deploy"},` +
+		`"token":{"appid":"00000000-0000-0000-0000-000000000001","roles":["Deploy.All"],"tid":"12345678-1234-1234-1234-1234567890ab"}}`
+	if got := outputs["AZURE_OIDC_CLAIMS"]; got != want {
+		t.Errorf("AZURE_OIDC_CLAIMS = %s, want %s", got, want)
+	}
+	if secret, _ := os.ReadFile(filepath.Join(dir, "secret.env")); strings.Contains(string(secret), "AZURE_OIDC_CLAIMS") {
+		t.Errorf("claims written to the secret output file")
+	}
+}
@@ -0,0 +1,153 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// jwtHeader is the JOSE header of a JSON Web Token.
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+	Typ string `json:"typ"`
+}
+
+// jwtToken is a decoded, unverified JSON Web Token.
+type jwtToken struct {
+	Header    jwtHeader
+	Claims    map[string]interface{}
+	signed    string
+	signature []byte
+}
+
+// parseJWT decodes the compact serialization of a JWT without
+// verifying its signature.
+func parseJWT(token string) (*jwtToken, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errors.New("token is not a JWT: expected three dot-separated segments")
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("token is not a JWT: invalid header encoding: %w", err)
+	}
+	payloadJSON, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, fmt.Errorf("token is not a JWT: invalid payload encoding: %w", err)
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, fmt.Errorf("token is not a JWT: invalid signature encoding: %w", err)
+	}
+
+	t := &jwtToken{
+		signed:    parts[0] + "." + parts[1],
+		signature: signature,
+	}
+	if err := json.Unmarshal(headerJSON, &t.Header); err != nil {
+		return nil, fmt.Errorf("token is not a JWT: invalid header: %w", err)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(payloadJSON))
+	decoder.UseNumber()
+	if err := decoder.Decode(&t.Claims); err != nil {
+		return nil, fmt.Errorf("token is not a JWT: invalid payload: %w", err)
+	}
+	return t, nil
+}
+
+// maxIdentifierLength is the length below which a value that is not
+// a JWT is reported as an identifier. JWTs are much longer.
+const maxIdentifierLength = 256
+
+// checkAssertionShape verifies that the OIDC token is a JWT. A short
+// value is most likely the ID of the token or a secret identifier,
+// which is a recurring setup mistake, so it is explained.
+func checkAssertionShape(args Args) error {
+	_, err := parseJWT(args.OIDCToken)
+	if err == nil {
+		return nil
+	}
+	if len(strings.Split(args.OIDCToken, ".")) != 3 && len(args.OIDCToken) <= maxIdentifierLength {
+		if platform(args) == platformDrone {
+			return fmt.Errorf("oidc-token looks like an identifier or secret reference rather than a JWT (%d characters): set oidc_token_id from a secret holding the token itself", len(args.OIDCToken))
+		}
+		return fmt.Errorf("oidc-token looks like an identifier or secret reference rather than a JWT (%d characters): the platform passed a token ID rather than the token itself, do not set oidc_token_id in the step settings", len(args.OIDCToken))
+	}
+	return fmt.Errorf("oidc-token is invalid: %w", err)
+}
+
+// StringClaim returns the named claim if it is a string.
+func (t *jwtToken) StringClaim(name string) string {
+	s, _ := t.Claims[name].(string)
+	return s
+}
+
+// StringsClaim returns the named claim as a list of strings. Single
+// string claims are returned as a list of one.
+func (t *jwtToken) StringsClaim(name string) []string {
+	switch v := t.Claims[name].(type) {
+	case string:
+		return []string{v}
+	case []interface{}:
+		var values []string
+		for _, item := range v {
+			if s, ok := item.(string); ok {
+				values = append(values, s)
+			}
+		}
+		return values
+	}
+	return nil
+}
+
+// TimeClaim returns the named NumericDate claim.
+func (t *jwtToken) TimeClaim(name string) (time.Time, bool) {
+	n, ok := t.Claims[name].(json.Number)
+	if !ok {
+		return time.Time{}, false
+	}
+	secs, err := n.Float64()
+	if err != nil {
+		return time.Time{}, false
+	}
+	return time.Unix(int64(secs), 0), true
+}
+
+// expiredAssertionCodes are the AADSTS codes returned when the
+// assertion is outside its valid time range.
+var expiredAssertionCodes = []int{700024, 500133}
+
+// explainExpiredAssertion replaces the generic error of an assertion
+// Azure AD rejected as expired with how long ago it expired, computed
+// from its exp claim. Other errors are returned unchanged.
+func explainExpiredAssertion(err error, assertion string, now time.Time) error {
+	var authErr *AzureAuthError
+	if !errors.As(err, &authErr) || !slices.ContainsFunc(authErr.ErrorCodes, func(code int) bool {
+		return slices.Contains(expiredAssertionCodes, code)
+	}) {
+		return err
+	}
+	token, perr := parseJWT(assertion)
+	if perr != nil {
+		return err
+	}
+	exp, ok := token.TimeClaim("exp")
+	if !ok {
+		return err
+	}
+	if !now.Before(exp) {
+		return fmt.Errorf("the OIDC token expired %s ago, at %s: mint it later, by running this step right before the steps using Azure, or refresh it before the exchange: %w",
+			now.Sub(exp).Truncate(time.Second), exp.UTC().Format(time.RFC3339), err)
+	}
+	return fmt.Errorf("the OIDC token is valid until %s but Azure AD considers it outside its valid time range: check the clock of the token issuer: %w",
+		exp.UTC().Format(time.RFC3339), err)
+}
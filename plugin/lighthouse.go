@@ -0,0 +1,161 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/harness-community/drone-azure-oidc/pkg/azuread"
+)
+
+// subscriptionsAPIVersion is the Resource Manager API version used
+// to list subscriptions.
+const subscriptionsAPIVersion = "2022-12-01"
+
+// maxSubscriptionPages bounds the pages followed when listing
+// subscriptions.
+const maxSubscriptionPages = 50
+
+// subscription is a subscription returned by Resource Manager.
+type subscription struct {
+	SubscriptionID string `json:"subscriptionId"`
+	TenantID       string `json:"tenantId"`
+	DisplayName    string `json:"displayName"`
+}
+
+// delegations is the set of subscriptions in other tenants that the
+// identity can reach through Azure Lighthouse.
+type delegations struct {
+	Tenants       []string
+	Subscriptions []string
+}
+
+// resourceManagerEndpoint returns the Resource Manager endpoint for
+// a management scope such as https://management.azure.com/.default.
+func resourceManagerEndpoint(scope string) (string, error) {
+	u, err := url.Parse(strings.TrimSuffix(scope, "/.default"))
+	if err != nil || u.Host == "" || !strings.HasPrefix(u.Host, "management.") && !azuread.IsLoopback(u.Hostname()) {
+		return "", fmt.Errorf("lighthouse verification requires a Resource Manager scope such as %s", defaultScope)
+	}
+	return u.Scheme + "://" + u.Host, nil
+}
+
+// listDelegations lists the subscriptions accessible with the token
+// and returns those that belong to a tenant other than the home
+// tenant.
+func listDelegations(ctx context.Context, client *http.Client, endpoint, accessToken, homeTenant string) (*delegations, error) {
+	next := endpoint + "/subscriptions?api-version=" + subscriptionsAPIVersion
+	tenants := map[string]bool{}
+	result := new(delegations)
+	for page := 0; next != "" && page < maxSubscriptionPages; page++ {
+		if err := azuread.CheckEndpoint(next, nil); err != nil {
+			return nil, err
+		}
+		var list struct {
+			Value    []subscription `json:"value"`
+			NextLink string         `json:"nextLink"`
+		}
+		if err := getJSON(ctx, client, next, accessToken, &list); err != nil {
+			return nil, fmt.Errorf("failed to list subscriptions: %w", err)
+		}
+		for _, sub := range list.Value {
+			if strings.EqualFold(sub.TenantID, homeTenant) {
+				continue
+			}
+			result.Subscriptions = append(result.Subscriptions, sub.SubscriptionID)
+			if !tenants[sub.TenantID] {
+				tenants[sub.TenantID] = true
+				result.Tenants = append(result.Tenants, sub.TenantID)
+			}
+		}
+		next = list.NextLink
+	}
+	sort.Strings(result.Tenants)
+	sort.Strings(result.Subscriptions)
+	return result, nil
+}
+
+// getJSON makes an authenticated GET request and decodes the JSON
+// response.
+func getJSON(ctx context.Context, client *http.Client, address, accessToken string, v interface{}) error {
+	return doJSON(ctx, client, http.MethodGet, address, accessToken, v)
+}
+
+// postJSON makes an authenticated POST request without body, as used
+// by Resource Manager list actions, and decodes the JSON response.
+func postJSON(ctx context.Context, client *http.Client, address, accessToken string, v interface{}) error {
+	return doJSON(ctx, client, http.MethodPost, address, accessToken, v)
+}
+
+// doJSON makes an authenticated request and decodes the JSON
+// response.
+func doJSON(ctx context.Context, client *http.Client, method, address, accessToken string, v interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, method, address, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+accessToken)
+	req.Header.Set("Accept", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return &NetworkError{Err: err}
+	}
+	defer drainAndClose(resp.Body)
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+// verifyDelegations checks that every expected tenant is reachable.
+func verifyDelegations(found *delegations, expected []string) error {
+	reachable := map[string]bool{}
+	for _, tenant := range found.Tenants {
+		reachable[strings.ToLower(tenant)] = true
+	}
+	var missing []string
+	for _, tenant := range expected {
+		if !reachable[strings.ToLower(tenant)] {
+			missing = append(missing, tenant)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("no delegated access to tenants: %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+// checkLighthouse lists the customer tenants and subscriptions the
+// token can reach through Azure Lighthouse, writes them to the
+// non-secret output file and verifies the expected tenants.
+func checkLighthouse(ctx context.Context, args Args, client *http.Client, token *AzureTokenResponse) error {
+	scope := args.Scope
+	if scope == "" {
+		scope = defaultScope
+	}
+	endpoint, err := resourceManagerEndpoint(scope)
+	if err != nil {
+		return err
+	}
+	found, err := listDelegations(ctx, client, endpoint, token.AccessToken, args.TenantID)
+	if err != nil {
+		return err
+	}
+	logger(ctx).Infof("lighthouse delegations: %d subscriptions in %d tenants", len(found.Subscriptions), len(found.Tenants))
+
+	if output := plainOutput(ctx); output != nil {
+		if err := output.Write("AZURE_LIGHTHOUSE_TENANTS", strings.Join(found.Tenants, ",")); err != nil {
+			return err
+		}
+		if err := output.Write("AZURE_LIGHTHOUSE_SUBSCRIPTIONS", strings.Join(found.Subscriptions, ",")); err != nil {
+			return err
+		}
+	}
+	return verifyDelegations(found, args.LighthouseTenants)
+}
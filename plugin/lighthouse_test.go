@@ -0,0 +1,54 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCheckLighthouse(t *testing.T) {
+	var srv *httptest.Server
+	srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer arm-token" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		if r.URL.Query().Get("page") == "2" {
+			_, _ = w.Write([]byte(`{"value":[{"subscriptionId":"sub-3","tenantId":"customer-b"}]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"value":[
+			{"subscriptionId":"sub-1","tenantId":"home"},
+			{"subscriptionId":"sub-2","tenantId":"customer-a"}
+		],"nextLink":"` + srv.URL + `/subscriptions?page=2"}`))
+	}))
+	defer srv.Close()
+
+	outPath := filepath.Join(t.TempDir(), "output.env")
+	t.Setenv("DRONE_OUTPUT", outPath)
+
+	args := Args{TenantID: "home", Scope: srv.URL + "/.default", LighthouseTenants: []string{"customer-a", "customer-b"}}
+	token := &AzureTokenResponse{AccessToken: "arm-token"}
+	if err := checkLighthouse(context.Background(), args, srv.Client(), token); err != nil {
+		t.Fatalf("checkLighthouse returned error: %v", err)
+	}
+	data, _ := os.ReadFile(outPath)
+	if want := "AZURE_LIGHTHOUSE_TENANTS=customer-a,customer-b\nAZURE_LIGHTHOUSE_SUBSCRIPTIONS=sub-2,sub-3\n"; string(data) != want {
+		t.Fatalf("unexpected outputs %q, want %q", data, want)
+	}
+
+	args.LighthouseTenants = []string{"customer-c"}
+	if err := checkLighthouse(context.Background(), args, srv.Client(), token); err == nil {
+		t.Fatalf("expected error for an unreachable tenant")
+	}
+
+	if _, err := resourceManagerEndpoint("https://storage.azure.com/.default"); err == nil {
+		t.Fatalf("expected error for a non Resource Manager scope")
+	}
+}
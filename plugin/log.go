@@ -0,0 +1,126 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/harness-community/drone-azure-oidc/pkg/azuread"
+
+	"github.com/sirupsen/logrus"
+)
+
+// supported log formats
+const (
+	logFormatText = "text"
+	logFormatJSON = "json"
+)
+
+// verifyLogFormat validates the configured log format.
+func verifyLogFormat(format string) error {
+	switch format {
+	case "", logFormatText, logFormatJSON:
+		return nil
+	}
+	return fmt.Errorf("unsupported log-format %q, must be %s or %s", format, logFormatText, logFormatJSON)
+}
+
+// newRunLogger returns the logger of an execution. Its lines carry
+// the correlation ID and the tenant and client of the execution, so
+// the lines of concurrent executions, such as the identities of a
+// batch, can be told apart.
+func newRunLogger(args Args) *logrus.Entry {
+	fields := logrus.Fields{}
+	if id := correlationID(); id != "" {
+		fields["correlation_id"] = id
+	}
+	if args.TenantID != "" {
+		fields["tenant"] = args.TenantID
+	}
+	if args.ClientID != "" {
+		fields["client"] = args.ClientID
+	}
+	return logrus.NewEntry(logrus.StandardLogger()).WithFields(fields)
+}
+
+// withLogger returns a context carrying the logger. The logger is
+// shared with the azuread package, so the lines of the exchange carry
+// the fields of the execution.
+func withLogger(ctx context.Context, log *logrus.Entry) context.Context {
+	return azuread.WithLogger(ctx, log)
+}
+
+// logger returns the logger of the execution of the context, or a
+// logger without fields when there is none.
+func logger(ctx context.Context) *logrus.Entry {
+	return azuread.Logger(ctx)
+}
+
+// correlationID returns the identifier used to correlate log lines
+// and requests of a pipeline execution: the Harness execution ID,
+// or the repository and build number on Drone.
+func correlationID() string {
+	if id := os.Getenv("HARNESS_EXECUTION_ID"); id != "" {
+		return id
+	}
+	if repo, build := os.Getenv("DRONE_REPO"), os.Getenv("DRONE_BUILD_NUMBER"); repo != "" && build != "" {
+		return repo + "/" + build
+	}
+	return ""
+}
+
+// newClientRequestID returns a client-request-id for a request to
+// Azure AD. The first half of the GUID is derived from the correlation
+// ID, so the requests of an execution share a prefix, and the second
+// half is random, so each attempt, host and identity has its own ID.
+// Without a correlation ID the GUID is random.
+func newClientRequestID() string {
+	var b [16]byte
+	_, _ = rand.Read(b[:])
+	if id := correlationID(); id != "" {
+		sum := sha256.Sum256([]byte(id))
+		copy(b[:8], sum[:])
+		b[6] = b[6]&0x0f | 0x80 // version 8, custom
+	} else {
+		b[6] = b[6]&0x0f | 0x40 // version 4, random
+	}
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// logAuthError logs the Azure AD request identifiers of a rejected
+// token request, which Microsoft support needs to trace it.
+func logAuthError(log *logrus.Entry, err error) {
+	var authErr *AzureAuthError
+	if !errors.As(err, &authErr) {
+		return
+	}
+	log.Errorf("azure ad request identifiers: trace_id=%s correlation_id=%s x-ms-request-id=%s client-request-id=%s",
+		authErr.TraceID, authErr.CorrelationID, authErr.RequestID, authErr.ClientRequestID)
+}
+
+// identityFields returns the structured log fields identifying a
+// token exchange.
+func identityFields(tenantID, clientID, scope string) logrus.Fields {
+	fields := logrus.Fields{
+		"tenant": tenantID,
+		"client": clientID,
+		"scope":  scope,
+	}
+	if id := correlationID(); id != "" {
+		fields["correlation_id"] = id
+	}
+	return fields
+}
+
+// durationField returns the structured log field recording the time
+// elapsed since start.
+func durationField(start time.Time) logrus.Fields {
+	return logrus.Fields{"duration_ms": time.Since(start).Milliseconds()}
+}
@@ -0,0 +1,173 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+func TestStructuredLogFields(t *testing.T) {
+	buf := captureLogs(t)
+	t.Setenv("HARNESS_EXECUTION_ID", "exec-1234")
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"abc"}`))
+	}))
+	defer srv.Close()
+
+	args := Args{OIDCToken: testOIDCToken, TenantID: "tenant", ClientID: "client", AuthorityHost: srv.URL}
+	if _, err := acquireToken(context.Background(), args, &Exchanger{Client: srv.Client()}); err != nil {
+		t.Fatalf("acquireToken returned error: %v", err)
+	}
+
+	var exchange, attempt map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line is not JSON: %q", line)
+		}
+		switch {
+		case entry["msg"] == "exchanging OIDC token for Azure AD access token":
+			exchange = entry
+		case strings.HasPrefix(entry["msg"].(string), "attempt 1 of"):
+			attempt = entry
+		}
+	}
+
+	if exchange == nil || exchange["tenant"] != "tenant" || exchange["client"] != "client" ||
+		exchange["scope"] != defaultScope || exchange["correlation_id"] != "exec-1234" {
+		t.Fatalf("unexpected exchange log fields: %v", exchange)
+	}
+	if attempt == nil || attempt["attempt"] != float64(1) || attempt["duration_ms"] == nil {
+		t.Fatalf("unexpected attempt log fields: %v", attempt)
+	}
+}
+
+func TestRunLogger_Batch(t *testing.T) {
+	buf := captureLogs(t)
+	t.Setenv("HARNESS_EXECUTION_ID", "exec-1234")
+	dir := t.TempDir()
+	t.Setenv("HARNESS_OUTPUT_SECRET_FILE", filepath.Join(dir, "secret.env"))
+	t.Setenv("DRONE_OUTPUT", filepath.Join(dir, "out.env"))
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"abc"}`))
+	}))
+	defer srv.Close()
+
+	args := Args{
+		OIDCToken:     testOIDCToken,
+		TenantID:      "12345678-1234-1234-1234-1234567890ab",
+		AuthorityHost: srv.URL,
+		Identities: Identities{
+			{Alias: "reader", ClientID: "00000000-0000-0000-0000-000000000001"},
+			{Alias: "writer", ClientID: "00000000-0000-0000-0000-000000000002"},
+		},
+	}
+	if err := Exec(context.Background(), args); err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+
+	attempts := map[interface{}]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line is not JSON: %q", line)
+		}
+		if entry["correlation_id"] != "exec-1234" {
+			t.Errorf("log line without the correlation id: %q", line)
+		}
+		if strings.HasPrefix(entry["msg"].(string), "attempt 1 of") {
+			attempts[entry["alias"]] = entry["client"]
+		}
+	}
+	if attempts["reader"] != "00000000-0000-0000-0000-000000000001" || attempts["writer"] != "00000000-0000-0000-0000-000000000002" {
+		t.Errorf("unexpected attempt log fields: %v", attempts)
+	}
+}
+
+func TestContextLogger_Fields(t *testing.T) {
+	buf := captureLogs(t)
+	t.Setenv("DRONE_OUTPUT", filepath.Join(t.TempDir(), "out.env"))
+
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"abc"}`))
+	}))
+	defer srv.Close()
+
+	issuer := newTestIssuer(t)
+	args := Args{
+		OIDCToken:                issuer.sign(t, map[string]interface{}{"sub": "account/abc/pipeline:deploy"}),
+		TenantID:                 "12345678-1234-1234-1234-1234567890ab",
+		ClientID:                 "12345678-1234-1234-1234-1234567890ab",
+		AuthorityHost:            srv.URL,
+		ClaimsMatchingExpression: "claims['sub'] matches 'account/abc/*'",
+	}
+	ctx := withLogger(context.Background(), newRunLogger(Args{}).WithFields(logrus.Fields{
+		"alias":          "reader",
+		"correlation_id": "exec-1234",
+	}))
+	if err := VerifyEnv(ctx, args); err != nil {
+		t.Fatalf("VerifyEnv returned error: %v", err)
+	}
+	if _, err := acquireToken(ctx, args, &Exchanger{Client: srv.Client(), RetryBackoff: time.Millisecond}); err != nil {
+		t.Fatalf("acquireToken returned error: %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := writeFingerprint(ctx, "AZURE_ACCESS_TOKEN_FINGERPRINT", "abc"); err != nil {
+			t.Fatalf("writeFingerprint returned error: %v", err)
+		}
+	}
+
+	seen := map[string]map[string]interface{}{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var entry map[string]interface{}
+		if err := json.Unmarshal([]byte(line), &entry); err != nil {
+			t.Fatalf("log line is not JSON: %q", line)
+		}
+		if entry["alias"] != "reader" || entry["correlation_id"] != "exec-1234" {
+			t.Errorf("log line without the alias and correlation id: %q", line)
+		}
+		msg := entry["msg"].(string)
+		for _, prefix := range []string{"claims-matching expression", "attempt 1 of", "attempt 2 of", "output AZURE_ACCESS_TOKEN_FINGERPRINT"} {
+			if strings.HasPrefix(msg, prefix) {
+				seen[prefix] = entry
+			}
+		}
+	}
+	if len(seen) != 4 {
+		t.Fatalf("expected validation, attempt and output lines, got %v", seen)
+	}
+	if seen["attempt 1 of"]["attempt"] != float64(1) || seen["attempt 2 of"]["attempt"] != float64(2) {
+		t.Errorf("unexpected attempt fields: %v, %v", seen["attempt 1 of"], seen["attempt 2 of"])
+	}
+}
+
+func TestVerifyLogFormat(t *testing.T) {
+	for _, format := range []string{"", "text", "json"} {
+		if err := verifyLogFormat(format); err != nil {
+			t.Errorf("unexpected error for %q: %v", format, err)
+		}
+	}
+	if err := verifyLogFormat("xml"); err == nil {
+		t.Errorf("expected error for an unsupported format")
+	}
+}
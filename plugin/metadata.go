@@ -0,0 +1,109 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// metadataVersion is the version of the metadata file format.
+const metadataVersion = 1
+
+// tokenMetadata is the metadata file describing the outputs of the
+// step, so later stages can discover the available credentials
+// without hardcoding output names. It never contains secret values.
+type tokenMetadata struct {
+	Version       int               `json:"version"`
+	Step          string            `json:"step,omitempty"`
+	CreatedAt     string            `json:"created_at"`
+	SecretOutputs []string          `json:"secret_outputs"`
+	Outputs       map[string]string `json:"outputs"`
+}
+
+// recordedOutputs collects the outputs written during the run so
+// they can be listed in the metadata file.
+var recordedOutputs = new(outputRecorder)
+
+// outputRecorder records the names of secret outputs and the values
+// of non-secret outputs.
+type outputRecorder struct {
+	mu     sync.Mutex
+	secret map[string]bool
+	plain  map[string]string
+}
+
+// Record records an output written to a secret or non-secret file.
+func (r *outputRecorder) Record(key, value string, secret bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if secret {
+		if r.secret == nil {
+			r.secret = map[string]bool{}
+		}
+		r.secret[key] = true
+		return
+	}
+	if r.plain == nil {
+		r.plain = map[string]string{}
+	}
+	r.plain[key] = value
+}
+
+// Reset discards the recorded outputs.
+func (r *outputRecorder) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.secret, r.plain = nil, nil
+}
+
+// Metadata returns the metadata file contents for the recorded
+// outputs. Outputs recorded as secret are never listed with a value.
+func (r *outputRecorder) Metadata() *tokenMetadata {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	meta := &tokenMetadata{
+		Version:       metadataVersion,
+		CreatedAt:     time.Now().UTC().Format(time.RFC3339),
+		SecretOutputs: []string{},
+		Outputs:       map[string]string{},
+	}
+	for key := range r.secret {
+		meta.SecretOutputs = append(meta.SecretOutputs, key)
+	}
+	sort.Strings(meta.SecretOutputs)
+	for key, value := range r.plain {
+		if !r.secret[key] {
+			meta.Outputs[key] = value
+		}
+	}
+	return meta
+}
+
+// writeMetadataFile writes the metadata of the recorded outputs to
+// the metadata file as JSON.
+func writeMetadataFile(args Args) error {
+	if args.MetadataFile == "" {
+		return nil
+	}
+	meta := recordedOutputs.Metadata()
+	meta.Step = args.Step.Name
+	data, err := json.MarshalIndent(meta, "", "  ")
+	if err != nil {
+		return err
+	}
+	if dir := filepath.Dir(args.MetadataFile); dir != "." {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return fmt.Errorf("failed to create metadata file directory: %w", err)
+		}
+	}
+	if err := os.WriteFile(args.MetadataFile, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("failed to write metadata file: %w", err)
+	}
+	return nil
+}
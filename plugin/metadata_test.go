@@ -0,0 +1,67 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExec_MetadataFile(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"metadata-access-token"}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	t.Setenv("HARNESS_OUTPUT_SECRET_FILE", filepath.Join(dir, "secret.env"))
+	t.Setenv("DRONE_OUTPUT", filepath.Join(dir, "out.env"))
+
+	args := Args{
+		OIDCToken:        testOIDCToken,
+		TenantID:         "12345678-1234-1234-1234-1234567890ab",
+		ClientID:         "00000000-0000-0000-0000-000000000001",
+		AuthorityHost:    srv.URL,
+		AzureLoginCompat: true,
+		MetadataFile:     filepath.Join(dir, "artifacts", "azure-oidc.json"),
+	}
+	args.Step.Name = "azure_login"
+	if err := Exec(context.Background(), args); err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+
+	data, err := os.ReadFile(args.MetadataFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(data), "metadata-access-token") || strings.Contains(string(data), testOIDCToken) {
+		t.Fatalf("metadata file contains a secret: %s", data)
+	}
+	var meta tokenMetadata
+	if err := json.Unmarshal(data, &meta); err != nil {
+		t.Fatalf("failed to decode metadata %q: %v", data, err)
+	}
+	if meta.Version != metadataVersion || meta.Step != "azure_login" {
+		t.Errorf("unexpected metadata %+v", meta)
+	}
+	if want := []string{"ARM_OIDC_TOKEN", "AZURE_ACCESS_TOKEN"}; strings.Join(meta.SecretOutputs, ",") != strings.Join(want, ",") {
+		t.Errorf("secret outputs = %v, want %v", meta.SecretOutputs, want)
+	}
+	for key, want := range map[string]string{
+		"AZURE_TENANT_ID":   args.TenantID,
+		"AZURE_CLIENT_ID":   args.ClientID,
+		"AZURE_TOKEN_SCOPE": defaultScope,
+		"ARM_USE_OIDC":      "true",
+	} {
+		if got := meta.Outputs[key]; got != want {
+			t.Errorf("outputs[%s] = %q, want %q", key, got, want)
+		}
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// latencyBuckets are the upper bounds, in seconds, of the exchange
+// latency histogram.
+var latencyBuckets = []float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30}
+
+// metrics records token server activity and renders it in the
+// Prometheus text exposition format.
+type metrics struct {
+	mu          sync.Mutex
+	exchanges   int
+	failures    map[string]int
+	cacheHits   int
+	cacheMisses int
+	buckets     []int
+	latencySum  float64
+	latencyObs  int
+}
+
+// newMetrics returns an empty metrics registry.
+func newMetrics() *metrics {
+	return &metrics{
+		failures: map[string]int{},
+		buckets:  make([]int, len(latencyBuckets)),
+	}
+}
+
+// CacheHit records a token served without an exchange.
+func (m *metrics) CacheHit() {
+	m.mu.Lock()
+	m.cacheHits++
+	m.mu.Unlock()
+}
+
+// CacheMiss records a token request that required an exchange.
+func (m *metrics) CacheMiss() {
+	m.mu.Lock()
+	m.cacheMisses++
+	m.mu.Unlock()
+}
+
+// Exchange records an exchange, its latency and the error code of a
+// failed exchange.
+func (m *metrics) Exchange(d time.Duration, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.exchanges++
+	if err != nil {
+		m.failures[errorCode(err)]++
+	}
+	seconds := d.Seconds()
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			m.buckets[i]++
+		}
+	}
+	m.latencySum += seconds
+	m.latencyObs++
+}
+
+// WriteTo writes the metrics in the Prometheus text format.
+func (m *metrics) WriteTo(w io.Writer) (int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var n int64
+	printf := func(format string, a ...interface{}) {
+		c, _ := fmt.Fprintf(w, format, a...)
+		n += int64(c)
+	}
+
+	printf("# HELP azure_oidc_exchanges_total Token exchanges with Azure AD.\n")
+	printf("# TYPE azure_oidc_exchanges_total counter\n")
+	printf("azure_oidc_exchanges_total %d\n", m.exchanges)
+
+	printf("# HELP azure_oidc_exchange_failures_total Failed token exchanges by error code.\n")
+	printf("# TYPE azure_oidc_exchange_failures_total counter\n")
+	codes := make([]string, 0, len(m.failures))
+	for code := range m.failures {
+		codes = append(codes, code)
+	}
+	sort.Strings(codes)
+	for _, code := range codes {
+		printf("azure_oidc_exchange_failures_total{code=%q} %d\n", code, m.failures[code])
+	}
+
+	printf("# HELP azure_oidc_exchange_duration_seconds Token exchange latency.\n")
+	printf("# TYPE azure_oidc_exchange_duration_seconds histogram\n")
+	for i, bound := range latencyBuckets {
+		printf("azure_oidc_exchange_duration_seconds_bucket{le=%q} %d\n", strconv.FormatFloat(bound, 'g', -1, 64), m.buckets[i])
+	}
+	printf("azure_oidc_exchange_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.latencyObs)
+	printf("azure_oidc_exchange_duration_seconds_sum %g\n", m.latencySum)
+	printf("azure_oidc_exchange_duration_seconds_count %d\n", m.latencyObs)
+
+	printf("# HELP azure_oidc_cache_hits_total Token requests served without an exchange.\n")
+	printf("# TYPE azure_oidc_cache_hits_total counter\n")
+	printf("azure_oidc_cache_hits_total %d\n", m.cacheHits)
+	printf("# HELP azure_oidc_cache_misses_total Token requests that required an exchange.\n")
+	printf("# TYPE azure_oidc_cache_misses_total counter\n")
+	printf("azure_oidc_cache_misses_total %d\n", m.cacheMisses)
+	return n, nil
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	_, _ = m.WriteTo(w)
+}
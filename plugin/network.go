@@ -0,0 +1,96 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"time"
+)
+
+// defaultFallbackDelay is how long the dialer waits for an IPv6
+// connection before racing an IPv4 one, as in RFC 6555 (Happy
+// Eyeballs). On IPv6-only networks only IPv6 addresses are dialed.
+const defaultFallbackDelay = 300 * time.Millisecond
+
+// newDialContext returns the dial function of the shared transport.
+// It dials every address of the host, preferring IPv6, and logs the
+// address family of each connection at debug level.
+func newDialContext(timeout time.Duration) func(context.Context, string, string) (net.Conn, error) {
+	dialer := &net.Dialer{
+		Timeout:       timeout,
+		KeepAlive:     30 * time.Second,
+		FallbackDelay: defaultFallbackDelay,
+	}
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dialer.DialContext(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		logger(ctx).Debugf("connected to %s over %s (%s)", addr, addressFamily(conn.RemoteAddr()), conn.RemoteAddr())
+		return conn, nil
+	}
+}
+
+// addressFamily returns IPv4 or IPv6 for the address of a connection.
+func addressFamily(addr net.Addr) string {
+	var ip net.IP
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return "unknown"
+		}
+		ip = net.ParseIP(host)
+	}
+	switch {
+	case ip == nil:
+		return "unknown"
+	case ip.To4() != nil:
+		return "IPv4"
+	default:
+		return "IPv6"
+	}
+}
+
+// checkConnectivity connects to the endpoint with the client and
+// reports the address family and remote address of the connection.
+// Any HTTP response counts as connected. Behind a proxy the remote
+// address is the address of the proxy.
+func checkConnectivity(ctx context.Context, client *http.Client, endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid endpoint %q", endpoint)
+	}
+	var remote net.Addr
+	ctx = httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			remote = info.Conn.RemoteAddr()
+		},
+	})
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return "", err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to %s: %w", u.Host, err)
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	if remote == nil {
+		return fmt.Sprintf("%s reachable", u.Host), nil
+	}
+	return fmt.Sprintf("%s reachable over %s (%s)", u.Host, addressFamily(remote), remote), nil
+}
@@ -0,0 +1,76 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestAddressFamily(t *testing.T) {
+	tests := []struct {
+		addr net.Addr
+		want string
+	}{
+		{&net.TCPAddr{IP: net.ParseIP("192.0.2.1"), Port: 443}, "IPv4"},
+		{&net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}, "IPv6"},
+		{&net.TCPAddr{IP: net.ParseIP("::ffff:192.0.2.1"), Port: 443}, "IPv4"},
+		{&net.UnixAddr{Name: "/tmp/socket", Net: "unix"}, "unknown"},
+	}
+	for _, tt := range tests {
+		if got := addressFamily(tt.addr); got != tt.want {
+			t.Errorf("addressFamily(%s) = %s, want %s", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestCheckConnectivity_IPv6(t *testing.T) {
+	listener, err := net.Listen("tcp", "[::1]:0")
+	if err != nil {
+		t.Skipf("IPv6 loopback is not available: %v", err)
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	srv.Listener.Close()
+	srv.Listener = listener
+	srv.Start()
+	defer srv.Close()
+
+	client, err := newHTTPClient(transportOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	detail, err := checkConnectivity(context.Background(), client, srv.URL)
+	if err != nil {
+		t.Fatalf("checkConnectivity returned error: %v", err)
+	}
+	if !strings.Contains(detail, "over IPv6 ([::1]:") {
+		t.Errorf("detail %q does not report the IPv6 connection", detail)
+	}
+
+	srv.Close()
+	if _, err := checkConnectivity(context.Background(), client, srv.URL); err == nil {
+		t.Error("expected an error for an unreachable endpoint")
+	}
+}
+
+func TestApplyDelegateProxy_IPv6(t *testing.T) {
+	t.Setenv("PROXY_HOST", "2001:db8::1")
+	t.Setenv("PROXY_PORT", "")
+	var opts transportOptions
+	applyDelegateProxy(&opts)
+	if opts.HTTPSProxy != "http://[2001:db8::1]" {
+		t.Errorf("proxy = %q, want http://[2001:db8::1]", opts.HTTPSProxy)
+	}
+	t.Setenv("PROXY_PORT", "3128")
+	opts = transportOptions{}
+	applyDelegateProxy(&opts)
+	if opts.HTTPSProxy != "http://[2001:db8::1]:3128" {
+		t.Errorf("proxy = %q, want http://[2001:db8::1]:3128", opts.HTTPSProxy)
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"unicode"
+)
+
+// invisibleRunes are zero-width and byte order mark characters, which
+// copying from the Azure portal or rich text documents can introduce.
+const invisibleRunes = "\u200b\u200c\u200d\u2060\ufeff"
+
+// quoteRunes are the quotes that surround values copied from
+// documentation or shell snippets.
+const quoteRunes = "\"'`\u2018\u2019\u201c\u201d"
+
+// normalizeValue returns the value without zero-width characters and
+// surrounding whitespace and quotes.
+func normalizeValue(value string) string {
+	value = strings.Map(func(r rune) rune {
+		if strings.ContainsRune(invisibleRunes, r) {
+			return -1
+		}
+		return r
+	}, value)
+	for {
+		trimmed := strings.TrimFunc(value, unicode.IsSpace)
+		trimmed = strings.Trim(trimmed, quoteRunes)
+		if trimmed == value {
+			return value
+		}
+		value = trimmed
+	}
+}
+
+// normalizeInputs returns the arguments with the tenant, client,
+// subscription and scope values normalized before validation, logging
+// the settings that were changed.
+func normalizeInputs(ctx context.Context, args Args) Args {
+	normalize := func(name string, value *string) {
+		if normalized := normalizeValue(*value); normalized != *value {
+			logger(ctx).Infof("%s normalized: removed surrounding whitespace, quotes or zero-width characters", name)
+			*value = normalized
+		}
+	}
+	normalize("tenant-id", &args.TenantID)
+	normalize("client-id", &args.ClientID)
+	normalize("subscription-id", &args.SubscriptionID)
+	normalize("scope", &args.Scope)
+	normalize("downstream-client-id", &args.DownstreamClientID)
+	normalize("downstream-scope", &args.DownstreamScope)
+	if len(args.Identities) > 0 {
+		identities := make(Identities, len(args.Identities))
+		for i, identity := range args.Identities {
+			normalize(fmt.Sprintf("identities[%d] tenant_id", i), &identity.TenantID)
+			normalize(fmt.Sprintf("identities[%d] client_id", i), &identity.ClientID)
+			normalize(fmt.Sprintf("identities[%d] subscription_id", i), &identity.SubscriptionID)
+			normalize(fmt.Sprintf("identities[%d] scope", i), &identity.Scope)
+			identities[i] = identity
+		}
+		args.Identities = identities
+	}
+	return args
+}
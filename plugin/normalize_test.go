@@ -0,0 +1,46 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"testing"
+)
+
+func TestNormalizeValue(t *testing.T) {
+	tests := map[string]string{
+		"12345678-1234-1234-1234-1234567890ab":                 "12345678-1234-1234-1234-1234567890ab",
+		"  12345678-1234-1234-1234-1234567890ab\n":             "12345678-1234-1234-1234-1234567890ab",
+		"\"12345678-1234-1234-1234-1234567890ab\"":             "12345678-1234-1234-1234-1234567890ab",
+		"' \u201c12345678-1234-1234-1234-1234567890ab\u201d '": "12345678-1234-1234-1234-1234567890ab",
+		"\ufeff12345678-1234-\u200b1234-1234-1234567890ab ":    "12345678-1234-1234-1234-1234567890ab",
+		"`https://vault.azure.net/.default` ":                  "https://vault.azure.net/.default",
+	}
+	for value, want := range tests {
+		if got := normalizeValue(value); got != want {
+			t.Errorf("normalizeValue(%q) = %q, want %q", value, got, want)
+		}
+	}
+}
+
+func TestNormalizeInputs(t *testing.T) {
+	args := normalizeInputs(context.Background(), Args{
+		OIDCToken:  testOIDCToken,
+		TenantID:   " 12345678-1234-1234-1234-1234567890ab\u200b",
+		ClientID:   "'00000000-0000-0000-0000-000000000001'",
+		Scope:      "\"https://vault.azure.net/.default\"",
+		Identities: Identities{{Alias: "prod", ClientID: " 00000000-0000-0000-0000-000000000002 "}},
+	})
+	if args.TenantID != "12345678-1234-1234-1234-1234567890ab" {
+		t.Errorf("unexpected tenant id %q", args.TenantID)
+	}
+	if args.ClientID != "00000000-0000-0000-0000-000000000001" {
+		t.Errorf("unexpected client id %q", args.ClientID)
+	}
+	if args.Scope != "https://vault.azure.net/.default" {
+		t.Errorf("unexpected scope %q", args.Scope)
+	}
+	if got := args.Identities[0].ClientID; got != "00000000-0000-0000-0000-000000000002" {
+		t.Errorf("unexpected identity client id %q", got)
+	}
+}
@@ -0,0 +1,39 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+)
+
+// writeDownstreamToken exchanges the access token for a downstream
+// API token using the on-behalf-of grant and writes it to the output
+// file as AZURE_DOWNSTREAM_ACCESS_TOKEN.
+func writeDownstreamToken(ctx context.Context, args Args, exchanger *Exchanger, tokenResp *AzureTokenResponse) error {
+	clientID := args.DownstreamClientID
+	if clientID == "" {
+		clientID = args.ClientID
+	}
+	authorityHost := args.AuthorityHost
+	if authorityHost == "" {
+		authorityHost = defaultAuthorityHost
+	}
+
+	ctx, span := startSpan(ctx, "exchange_on_behalf_of")
+	logger(ctx).Infof("exchanging access token for downstream API token")
+	downstream, err := exchanger.ExchangeOnBehalfOf(ctx, tokenResp.AccessToken, args.OIDCToken, args.TenantID, clientID, args.DownstreamScope, authorityHost)
+	span.End(err)
+	if err != nil {
+		return fmt.Errorf("failed to exchange token for downstream API: %w", err)
+	}
+
+	if err := secretOutput(ctx, args).Write("AZURE_DOWNSTREAM_ACCESS_TOKEN", downstream.AccessToken); err != nil {
+		return err
+	}
+	if err := writeFingerprint(ctx, "AZURE_DOWNSTREAM_ACCESS_TOKEN_FINGERPRINT", downstream.AccessToken); err != nil {
+		return err
+	}
+	logger(ctx).Infof("downstream API token retrieved successfully")
+	return nil
+}
@@ -0,0 +1,51 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestExec_DownstreamToken(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch r.PostFormValue("grant_type") {
+		case "client_credentials":
+			_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"first-hop-token"}`))
+		case "urn:ietf:params:oauth:grant-type:jwt-bearer":
+			if r.PostFormValue("assertion") != "first-hop-token" || r.PostFormValue("requested_token_use") != "on_behalf_of" ||
+				r.PostFormValue("client_assertion") != testOIDCToken || r.PostFormValue("client_id") != "00000000-0000-0000-0000-000000000002" ||
+				r.PostFormValue("scope") != "api://internal-api/.default" {
+				t.Errorf("unexpected on-behalf-of request: %v", r.PostForm)
+			}
+			_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"downstream-token"}`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer srv.Close()
+
+	outPath := filepath.Join(t.TempDir(), "out.env")
+	t.Setenv("HARNESS_OUTPUT_SECRET_FILE", outPath)
+
+	args := Args{
+		OIDCToken:          testOIDCToken,
+		TenantID:           "12345678-1234-1234-1234-1234567890ab",
+		ClientID:           "00000000-0000-0000-0000-000000000001",
+		AuthorityHost:      srv.URL,
+		DownstreamScope:    "api://internal-api/.default",
+		DownstreamClientID: "00000000-0000-0000-0000-000000000002",
+	}
+	if err := Exec(context.Background(), args); err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+	data, _ := os.ReadFile(outPath)
+	if want := "AZURE_ACCESS_TOKEN=first-hop-token\nAZURE_DOWNSTREAM_ACCESS_TOKEN=downstream-token\n"; string(data) != want {
+		t.Fatalf("unexpected outputs %q, want %q", data, want)
+	}
+}
@@ -0,0 +1,219 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/harness-community/drone-azure-oidc/pkg/azuread"
+	"github.com/harness-community/drone-azure-oidc/pkg/outputs"
+)
+
+// defaultOutputFileMode is the permission of output files. Output
+// files hold access tokens and must not be readable by other users.
+const defaultOutputFileMode os.FileMode = 0600
+
+// defaultPlainOutputFileMode is the permission of the output file
+// for non-secret values.
+const defaultPlainOutputFileMode os.FileMode = 0644
+
+// outputFile writes key=value pairs to a Harness output file and
+// records them for the execution summary.
+type outputFile struct {
+	file   outputs.File
+	secret bool
+}
+
+// newOutputFile returns an output file writer for the path.
+func newOutputFile(path string, mode os.FileMode) *outputFile {
+	return &outputFile{file: outputs.File{Path: path, Mode: mode}}
+}
+
+// secretOutput returns the writer for the Harness output secret file.
+// On Drone, which has no secret outputs, DRONE_OUTPUT is used.
+func secretOutput(ctx context.Context, args Args) *outputFile {
+	mode, err := parseFileMode(args.OutputFileMode)
+	if err != nil {
+		mode = defaultOutputFileMode
+	}
+	path := os.Getenv("HARNESS_OUTPUT_SECRET_FILE")
+	if path == "" && platform(args) == platformDrone {
+		path = os.Getenv("DRONE_OUTPUT")
+	}
+	output := newOutputFile(path, mode)
+	output.file.Log = logger(ctx)
+	output.secret = true
+	return output
+}
+
+// plainOutput returns the writer for the non-secret Harness output
+// file, or nil when the output file is not available.
+func plainOutput(ctx context.Context) *outputFile {
+	path := os.Getenv("DRONE_OUTPUT")
+	if path == "" {
+		return nil
+	}
+	output := newOutputFile(path, defaultPlainOutputFileMode)
+	output.file.Log = logger(ctx)
+	return output
+}
+
+// writeFingerprint writes the fingerprint of the access token to the
+// non-secret output file under the key.
+func writeFingerprint(ctx context.Context, key, token string) error {
+	output := plainOutput(ctx)
+	if output == nil {
+		logger(ctx).Debugf("DRONE_OUTPUT is not set, skipping %s output", key)
+		return nil
+	}
+	return output.Write(key, tokenFingerprint(token))
+}
+
+// writeTokenMetadata writes the non-secret details of the token to
+// the non-secret output file, so they can be referenced in step
+// conditions and notifications without secret masking. The suffix
+// distinguishes identities in batch mode.
+func writeTokenMetadata(ctx context.Context, args Args, suffix string, token *AzureTokenResponse) error {
+	output := plainOutput(ctx)
+	if output == nil {
+		return nil
+	}
+	scope := args.Scope
+	if scope == "" {
+		scope = defaultScope
+	}
+	now := wallClock.Now()
+	expiresOn := token.ExpiresAt(now).UTC()
+	outputs := [][2]string{
+		{"AZURE_TENANT_ID", args.TenantID},
+		{"AZURE_CLIENT_ID", args.ClientID},
+		{"AZURE_TOKEN_SCOPE", scope},
+		{"AZURE_TOKEN_EXPIRES_IN", strconv.Itoa(int(expiresOn.Sub(now).Seconds()))},
+		{"AZURE_TOKEN_EXPIRES_ON", expiresOn.Format(time.RFC3339)},
+	}
+	if extExpiresOn := token.ExtendedExpiresAt(now).UTC(); extExpiresOn.After(expiresOn) {
+		outputs = append(outputs, [2]string{"AZURE_TOKEN_EXT_EXPIRES_ON", extExpiresOn.Format(time.RFC3339)})
+	}
+	if token.Scope != "" {
+		outputs = append(outputs, [2]string{"AZURE_TOKEN_GRANTED_SCOPE", token.Scope})
+	}
+	for _, kv := range outputs {
+		if err := output.Write(kv[0]+suffix, kv[1]); err != nil {
+			return err
+		}
+	}
+	if args.SubscriptionID != "" {
+		return output.Write("AZURE_SUBSCRIPTION_ID"+suffix, args.SubscriptionID)
+	}
+	return nil
+}
+
+// writeErrorOutputs writes the error code and message of a failed
+// execution, and the Azure AD request identifiers of a rejected
+// token request, to the non-secret output file. The suffix
+// distinguishes identities in batch mode.
+func writeErrorOutputs(ctx context.Context, suffix string, err error) {
+	output := plainOutput(ctx)
+	if output == nil {
+		return
+	}
+	outputs := [][2]string{
+		{"AZURE_OIDC_ERROR_CODE", errorCode(err)},
+		{"AZURE_OIDC_ERROR_MESSAGE", strings.Join(strings.Fields(redactor.Redact(err.Error())), " ")},
+	}
+	var authErr *AzureAuthError
+	if errors.As(err, &authErr) {
+		outputs = append(outputs,
+			[2]string{"AZURE_OIDC_TRACE_ID", authErr.TraceID},
+			[2]string{"AZURE_OIDC_CORRELATION_ID", authErr.CorrelationID},
+			[2]string{"AZURE_OIDC_REQUEST_ID", authErr.RequestID},
+			[2]string{"AZURE_OIDC_CLIENT_REQUEST_ID", authErr.ClientRequestID},
+		)
+	}
+	for _, kv := range outputs {
+		if kv[1] == "" {
+			continue
+		}
+		if err := output.Write(kv[0]+suffix, kv[1]); err != nil {
+			logger(ctx).Warnf("failed to write %s output: %s", kv[0]+suffix, err)
+			return
+		}
+	}
+}
+
+// errorCode returns a short code classifying the error. Azure AD
+// rejections report the AADSTS code when available.
+func errorCode(err error) string {
+	var authErr *AzureAuthError
+	var retryErr *azuread.RetryableError
+	switch {
+	case errors.As(err, &authErr) && len(authErr.ErrorCodes) > 0:
+		return fmt.Sprintf("AADSTS%d", authErr.ErrorCodes[0])
+	case errors.As(err, &authErr) && authErr.Code != "":
+		return authErr.Code
+	case errors.As(err, &authErr):
+		return fmt.Sprintf("http_%d", authErr.StatusCode)
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &retryErr):
+		return "unavailable"
+	default:
+		return "error"
+	}
+}
+
+// writeTimingOutputs writes the duration and number of token requests
+// of the exchange to the non-secret output file.
+func writeTimingOutputs(ctx context.Context, suffix string, stats *exchangeStats) {
+	output := plainOutput(ctx)
+	if output == nil {
+		return
+	}
+	for _, kv := range [][2]string{
+		{"AZURE_OIDC_EXCHANGE_MS", strconv.FormatInt(stats.duration.Milliseconds(), 10)},
+		{"AZURE_OIDC_ATTEMPTS", strconv.Itoa(stats.Attempts())},
+	} {
+		if err := output.Write(kv[0]+suffix, kv[1]); err != nil {
+			logger(ctx).Warnf("failed to write %s output: %s", kv[0]+suffix, err)
+			return
+		}
+	}
+}
+
+// tokenFingerprint returns the hex encoded SHA-256 digest of the
+// token. The fingerprint identifies a token without revealing it.
+func tokenFingerprint(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Write writes the key-value pair to the output file, replacing the
+// line of a key already in the file, and records it.
+func (f *outputFile) Write(key, value string) error {
+	if err := f.file.Write(key, value); err != nil {
+		return err
+	}
+	recordedOutputs.Record(key, value, f.secret)
+	return nil
+}
+
+// parseFileMode parses an octal file mode such as 0600. The default
+// output file mode is returned when the value is empty.
+func parseFileMode(value string) (os.FileMode, error) {
+	if value == "" {
+		return defaultOutputFileMode, nil
+	}
+	mode, err := strconv.ParseUint(value, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("output-file-mode must be an octal file mode such as 0600")
+	}
+	return os.FileMode(mode), nil
+}
@@ -0,0 +1,36 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"fmt"
+	"os"
+)
+
+// supported CI platforms
+const (
+	platformHarness = "harness"
+	platformDrone   = "drone"
+)
+
+// platform returns the CI platform the plugin runs on. Unless it is
+// configured, Drone is assumed when the Harness secret output file
+// is not provided and DRONE is set.
+func platform(args Args) string {
+	if args.Platform != "" {
+		return args.Platform
+	}
+	if os.Getenv("HARNESS_OUTPUT_SECRET_FILE") == "" && os.Getenv("DRONE") == "true" {
+		return platformDrone
+	}
+	return platformHarness
+}
+
+// verifyPlatform validates the configured platform.
+func verifyPlatform(value string) error {
+	switch value {
+	case "", platformHarness, platformDrone:
+		return nil
+	}
+	return fmt.Errorf("unsupported platform %q, must be %s or %s", value, platformHarness, platformDrone)
+}
@@ -0,0 +1,73 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+)
+
+func TestPlatform(t *testing.T) {
+	t.Setenv("HARNESS_OUTPUT_SECRET_FILE", "")
+	t.Setenv("DRONE", "true")
+	if got := platform(Args{}); got != platformDrone {
+		t.Errorf("expected drone to be detected, got %q", got)
+	}
+	if got := platform(Args{Platform: platformHarness}); got != platformHarness {
+		t.Errorf("expected the configured platform, got %q", got)
+	}
+	t.Setenv("HARNESS_OUTPUT_SECRET_FILE", "/harness/secret.env")
+	if got := platform(Args{}); got != platformHarness {
+		t.Errorf("expected harness to be detected, got %q", got)
+	}
+	if err := verifyPlatform("jenkins"); err == nil {
+		t.Errorf("expected error for an unsupported platform")
+	}
+}
+
+func TestExec_Drone(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("client-request-id"); got[:18] != newClientRequestID()[:18] {
+			t.Errorf("expected client-request-id prefix derived from the build, got %q", got)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"abc"}`))
+	}))
+	defer srv.Close()
+
+	outPath := filepath.Join(t.TempDir(), "out.env")
+	t.Setenv("HARNESS_OUTPUT_SECRET_FILE", "")
+	t.Setenv("HARNESS_EXECUTION_ID", "")
+	t.Setenv("DRONE", "true")
+	t.Setenv("DRONE_OUTPUT", outPath)
+	t.Setenv("DRONE_REPO", "octocat/hello-world")
+	t.Setenv("DRONE_BUILD_NUMBER", "42")
+
+	args := Args{
+		OIDCToken:     testOIDCToken,
+		TenantID:      "12345678-1234-1234-1234-1234567890ab",
+		ClientID:      "12345678-1234-1234-1234-1234567890ab",
+		AuthorityHost: srv.URL,
+	}
+	if err := Exec(context.Background(), args); err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+	data, _ := os.ReadFile(outPath)
+	if !strings.Contains(string(data), "AZURE_ACCESS_TOKEN=abc\nAZURE_ACCESS_TOKEN_FINGERPRINT=") {
+		t.Fatalf("unexpected outputs %q", data)
+	}
+	if info, err := os.Stat(outPath); runtime.GOOS != "windows" && (err != nil || info.Mode().Perm() != 0600) {
+		t.Fatalf("expected the shared output file to keep its secret permissions, got %v", info.Mode())
+	}
+
+	args.OIDCToken = ""
+	if err := VerifyEnv(context.Background(), args); err == nil || !strings.Contains(err.Error(), "oidc_token_id") {
+		t.Fatalf("expected error naming the oidc_token_id setting, got %v", err)
+	}
+}
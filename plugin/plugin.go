@@ -5,7 +5,14 @@ package plugin
 import (
 	"context"
 	"fmt"
+	"net/http"
 	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/harness-community/drone-azure-oidc/pkg/azuread"
 
 	"github.com/sirupsen/logrus"
 )
@@ -14,63 +21,877 @@ import (
 type Args struct {
 	Pipeline
 	Level         string `envconfig:"PLUGIN_LOG_LEVEL"`
+	LogFormat     string `envconfig:"PLUGIN_LOG_FORMAT"`
+	Quiet         bool   `envconfig:"PLUGIN_QUIET"`
+	Strict        bool   `envconfig:"PLUGIN_STRICT"`
+	Platform      string `envconfig:"PLUGIN_PLATFORM"`
 	OIDCToken     string `envconfig:"PLUGIN_OIDC_TOKEN_ID"`
 	TenantID      string `envconfig:"PLUGIN_TENANT_ID"`
 	ClientID      string `envconfig:"PLUGIN_CLIENT_ID"`
 	Scope         string `envconfig:"PLUGIN_SCOPE"`
 	AuthorityHost string `envconfig:"PLUGIN_AZURE_AUTHORITY_HOST"`
+
+	CustomAuthority bool `envconfig:"PLUGIN_CUSTOM_AUTHORITY"`
+
+	SubscriptionID string `envconfig:"PLUGIN_SUBSCRIPTION_ID"`
+
+	Environment  string       `envconfig:"PLUGIN_ENVIRONMENT"`
+	Environments Environments `envconfig:"PLUGIN_ENVIRONMENTS"`
+
+	Timeout        time.Duration `envconfig:"PLUGIN_TIMEOUT"`
+	AttemptTimeout time.Duration `envconfig:"PLUGIN_ATTEMPT_TIMEOUT"`
+	Region         string        `envconfig:"PLUGIN_AZURE_REGION"`
+	HedgeDelay     time.Duration `envconfig:"PLUGIN_HEDGE_DELAY"`
+	Discovery      bool          `envconfig:"PLUGIN_DISCOVERY"`
+	ExchangeEngine string        `envconfig:"PLUGIN_EXCHANGE_ENGINE"`
+
+	VerifyAssertion bool     `envconfig:"PLUGIN_VERIFY_ASSERTION"`
+	AllowedIssuers  []string `envconfig:"PLUGIN_ALLOWED_ISSUERS"`
+	ExpectedSubject string   `envconfig:"PLUGIN_EXPECTED_SUBJECT"`
+
+	ClaimsMatchingExpression string `envconfig:"PLUGIN_CLAIMS_MATCHING_EXPRESSION"`
+
+	ClaimsOutput bool `envconfig:"PLUGIN_CLAIMS_OUTPUT"`
+
+	DialTimeout           time.Duration `envconfig:"PLUGIN_DIAL_TIMEOUT"`
+	TLSHandshakeTimeout   time.Duration `envconfig:"PLUGIN_TLS_HANDSHAKE_TIMEOUT"`
+	ResponseHeaderTimeout time.Duration `envconfig:"PLUGIN_RESPONSE_HEADER_TIMEOUT"`
+	MaxIdleConns          int           `envconfig:"PLUGIN_MAX_IDLE_CONNS"`
+	UserAgentSuffix       string        `envconfig:"PLUGIN_USER_AGENT_SUFFIX"`
+
+	HTTPSProxy    string `envconfig:"PLUGIN_HTTPS_PROXY"`
+	SocksProxy    string `envconfig:"PLUGIN_SOCKS_PROXY"`
+	NoProxy       string `envconfig:"PLUGIN_NO_PROXY"`
+	ProxyUsername string `envconfig:"PLUGIN_PROXY_USERNAME"`
+	ProxyPassword string `envconfig:"PLUGIN_PROXY_PASSWORD"`
+	CACert        string `envconfig:"PLUGIN_CA_CERT"`
+	TLSMinVersion string `envconfig:"PLUGIN_TLS_MIN_VERSION"`
+	FIPSMode      bool   `envconfig:"PLUGIN_FIPS_MODE"`
+
+	IgnoreDelegateProxy bool `envconfig:"PLUGIN_IGNORE_DELEGATE_PROXY"`
+
+	InsecureSkipVerify bool   `envconfig:"PLUGIN_INSECURE_SKIP_VERIFY"`
+	ClientCert         string `envconfig:"PLUGIN_CLIENT_CERT"`
+	ClientKey          string `envconfig:"PLUGIN_CLIENT_KEY"`
+
+	OutputFileMode string `envconfig:"PLUGIN_OUTPUT_FILE_MODE"`
+	AuditLog       string `envconfig:"PLUGIN_AUDIT_LOG"`
+
+	OnSuccessWebhook string `envconfig:"PLUGIN_ON_SUCCESS_WEBHOOK"`
+	OnFailureWebhook string `envconfig:"PLUGIN_ON_FAILURE_WEBHOOK"`
+
+	AllowedAuthorityHosts []string `envconfig:"PLUGIN_ALLOWED_AUTHORITY_HOSTS"`
+	AllowOrganizations    bool     `envconfig:"PLUGIN_ALLOW_ORGANIZATIONS"`
+	AllowCommon           bool     `envconfig:"PLUGIN_ALLOW_COMMON"`
+	RequireRoles          []string `envconfig:"PLUGIN_REQUIRE_ROLES"`
+
+	Cache         bool          `envconfig:"PLUGIN_CACHE"`
+	CacheDir      string        `envconfig:"PLUGIN_CACHE_DIR"`
+	CacheBuffer   time.Duration `envconfig:"PLUGIN_CACHE_BUFFER"`
+	ForceRefresh  bool          `envconfig:"PLUGIN_FORCE_REFRESH"`
+	EncryptionKey string        `envconfig:"PLUGIN_ENCRYPTION_KEY"`
+
+	MinTokenLifetime time.Duration `envconfig:"PLUGIN_MIN_TOKEN_LIFETIME"`
+
+	Lighthouse        bool     `envconfig:"PLUGIN_LIGHTHOUSE"`
+	LighthouseTenants []string `envconfig:"PLUGIN_LIGHTHOUSE_TENANTS"`
+
+	DownstreamScope    string `envconfig:"PLUGIN_DOWNSTREAM_SCOPE"`
+	DownstreamClientID string `envconfig:"PLUGIN_DOWNSTREAM_CLIENT_ID"`
+
+	ManagedIdentityClientID string `envconfig:"PLUGIN_MANAGED_IDENTITY_CLIENT_ID"`
+	ManagedIdentityEndpoint string `envconfig:"PLUGIN_MANAGED_IDENTITY_ENDPOINT"`
+
+	Credential          string `envconfig:"PLUGIN_CREDENTIAL"`
+	ClientSecret        string `envconfig:"PLUGIN_CLIENT_SECRET"`
+	ClientAssertionCert string `envconfig:"PLUGIN_CLIENT_ASSERTION_CERT"`
+	ClientAssertionKey  string `envconfig:"PLUGIN_CLIENT_ASSERTION_KEY"`
+
+	Whoami        bool   `envconfig:"PLUGIN_WHOAMI"`
+	GraphEndpoint string `envconfig:"PLUGIN_GRAPH_ENDPOINT"`
+
+	AzureLoginCompat bool `envconfig:"PLUGIN_AZURE_LOGIN_COMPAT"`
+	TerraformVars    bool `envconfig:"PLUGIN_TERRAFORM_VARS"`
+
+	AzcopyLogin        string `envconfig:"PLUGIN_AZCOPY_LOGIN"`
+	FederatedTokenFile string `envconfig:"PLUGIN_FEDERATED_TOKEN_FILE"`
+
+	PowerShellScript string `envconfig:"PLUGIN_POWERSHELL_SCRIPT"`
+
+	VeleroCredentials string `envconfig:"PLUGIN_VELERO_CREDENTIALS"`
+
+	AzureJSON       string `envconfig:"PLUGIN_AZURE_JSON"`
+	AzureJSONFormat string `envconfig:"PLUGIN_AZURE_JSON_FORMAT"`
+
+	FunctionApp    string `envconfig:"PLUGIN_FUNCTION_APP"`
+	WebApp         string `envconfig:"PLUGIN_WEB_APP"`
+	ResourceGroup  string `envconfig:"PLUGIN_RESOURCE_GROUP"`
+	PublishProfile bool   `envconfig:"PLUGIN_PUBLISH_PROFILE"`
+
+	StaticWebApp string `envconfig:"PLUGIN_STATIC_WEB_APP"`
+
+	DevOpsOrganization string `envconfig:"PLUGIN_DEVOPS_ORGANIZATION"`
+	DevOpsProject      string `envconfig:"PLUGIN_DEVOPS_PROJECT"`
+
+	ArtifactsFeeds []string `envconfig:"PLUGIN_ARTIFACTS_FEEDS"`
+
+	Preset       string `envconfig:"PLUGIN_PRESET"`
+	AMLWorkspace string `envconfig:"PLUGIN_AML_WORKSPACE"`
+	AMLRegion    string `envconfig:"PLUGIN_AML_REGION"`
+
+	ACRRegistry string `envconfig:"PLUGIN_ACR_REGISTRY"`
+	Command     string `envconfig:"PLUGIN_COMMAND"`
+	SkipAzLogin bool   `envconfig:"PLUGIN_SKIP_AZ_LOGIN"`
+
+	ACRPullSecret          string `envconfig:"PLUGIN_ACR_PULL_SECRET"`
+	ACRPullSecretName      string `envconfig:"PLUGIN_ACR_PULL_SECRET_NAME"`
+	ACRPullSecretNamespace string `envconfig:"PLUGIN_ACR_PULL_SECRET_NAMESPACE"`
+	ACRPullSecretApply     bool   `envconfig:"PLUGIN_ACR_PULL_SECRET_APPLY"`
+
+	StageExports     StageExports `envconfig:"PLUGIN_STAGE_EXPORTS"`
+	StageExportsFile string       `envconfig:"PLUGIN_STAGE_EXPORTS_FILE"`
+
+	MetadataFile string `envconfig:"PLUGIN_METADATA_FILE"`
+
+	Identities  Identities `envconfig:"PLUGIN_IDENTITIES"`
+	ClientIDs   ClientIDs  `envconfig:"PLUGIN_CLIENT_IDS"`
+	Concurrency int        `envconfig:"PLUGIN_CONCURRENCY"`
+
+	FailurePolicy   string   `envconfig:"PLUGIN_FAILURE_POLICY"`
+	RequiredAliases []string `envconfig:"PLUGIN_REQUIRED_ALIASES"`
+
+	Mode             string        `envconfig:"PLUGIN_MODE"`
+	ServeAddr        string        `envconfig:"PLUGIN_SERVE_ADDR"`
+	BreakerThreshold int           `envconfig:"PLUGIN_BREAKER_THRESHOLD"`
+	BreakerCooldown  time.Duration `envconfig:"PLUGIN_BREAKER_COOLDOWN"`
 }
 
-// Exec executes the plugin.
+// tenantOrganizations is the authority tenant for multi-tenant apps
+// that resolves the home tenant of the signed-in organization.
+const tenantOrganizations = "organizations"
+
+// tenantCommon is the authority tenant accepting both work and
+// personal accounts, resolving the home tenant of the application.
+const tenantCommon = "common"
+
+// supported plugin modes
+const (
+	modeExec     = "exec"
+	modeServe    = "serve"
+	modeValidate = "validate"
+)
+
+// Exec executes the plugin. When execution fails, the error details
+// are written to the non-secret output file for follow-up steps.
 func Exec(ctx context.Context, args Args) error {
-	// 1. verify Env variables
-	if err := VerifyEnv(args); err != nil {
-		return err
-	}
-	// 2. Exchange OIDC token for Azure AD access token
-	logrus.Infof("exchanging OIDC token for Azure AD access token")
-	tokenResp, err := ExchangeOIDCForAzureToken(
-		ctx,
-		args.OIDCToken,
-		args.TenantID,
-		args.ClientID,
-		args.Scope,
-		args.AuthorityHost,
-	)
+	redactSecret(args.OIDCToken)
+	redactSecret(args.ProxyPassword)
+	redactSecret(args.ClientKey)
+	redactSecret(args.ClientSecret)
+	redactSecret(args.ClientAssertionKey)
+	redactSecret(args.EncryptionKey)
+	redactSecret(args.OnSuccessWebhook)
+	redactSecret(args.OnFailureWebhook)
+
+	warnings.Reset()
+	recordedOutputs.Reset()
+	if len(args.ClientIDs) > 0 {
+		args.Identities = append(slices.Clip(args.Identities), args.ClientIDs.Identities()...)
+	}
+	// The settings are normalized before the run logger carries them,
+	// so the normalization lines only carry the correlation ID.
+	args = normalizeInputs(withLogger(ctx, newRunLogger(Args{})), args)
+	ctx = withLogger(ctx, newRunLogger(args))
+	tracer := newTracerFromEnv()
+	ctx, root := startSpan(withTracer(ctx, tracer), "azure-oidc")
+	if args.Mode == modeValidate {
+		err := validate(ctx, args, os.Stdout)
+		root.End(err)
+		tracer.Export(context.Background())
+		return err
+	}
+	err := execute(ctx, args)
+	if err == nil {
+		err = writeStageExports(ctx, args)
+	}
+	if err == nil {
+		err = writeMetadataFile(args)
+	}
+	if err != nil {
+		writeErrorOutputs(ctx, "", err)
+	}
+	root.End(err)
+	tracer.Export(context.Background())
+	return err
+}
+
+func execute(ctx context.Context, args Args) error {
+	// 1. Select the identity of the environment and normalize scopes
+	if args.Environment != "" {
+		var err error
+		if args, err = selectEnvironment(ctx, args); err != nil {
+			return configError(err)
+		}
+	}
+	args = normalizeScopes(ctx, applyPreset(args))
+	// 2. Optionally use a managed identity token as the assertion
+	if args.ManagedIdentityClientID != "" && credential(args) == credentialOIDC {
+		if args.OIDCToken != "" {
+			return configError(fmt.Errorf("oidc-token and managed-identity-client-id are mutually exclusive"))
+		}
+		if err := validateGUID(args.ManagedIdentityClientID, "managed-identity-client-id"); err != nil {
+			return configError(err)
+		}
+		token, err := managedIdentityAssertion(ctx, args)
+		if err != nil {
+			return &AssertionError{err}
+		}
+		redactSecret(token)
+		args.OIDCToken = token
+	}
+	// 3. verify Env variables
+	_, validate := startSpan(ctx, "validate")
+	err := VerifyEnv(ctx, args)
+	validate.End(err)
 	if err != nil {
-		return fmt.Errorf("failed to exchange OIDC token: %w", err)
+		return configError(err)
 	}
-	// 3. Write access token to output file
-	if err := WriteEnvToFile("AZURE_ACCESS_TOKEN", tokenResp.AccessToken); err != nil {
+	if strings.EqualFold(args.TenantID, tenantOrganizations) {
+		logger(ctx).Warnf("tenant-id is %q: the token is requested from the multi-tenant authority instead of a specific tenant", args.TenantID)
+	}
+	if strings.EqualFold(args.TenantID, tenantCommon) {
+		logger(ctx).Warnf("tenant-id is %q: the token is issued by the home tenant of the application, which may not be the tenant of the target resources", args.TenantID)
+	}
+	client, err := newHTTPClient(newTransportOptions(args))
+	if err != nil {
+		return configError(err)
+	}
+	if args.TenantID == "" && args.SubscriptionID != "" && len(args.Identities) == 0 {
+		tenant, err := discoverTenant(ctx, client, args)
+		if err != nil {
+			return err
+		}
+		args.TenantID = tenant
+	}
+	if args.Environment != "" {
+		if err := writeEnvironmentOutputs(ctx, args); err != nil {
+			return err
+		}
+	}
+	// 4. Optionally verify the OIDC assertion signature locally
+	if args.VerifyAssertion {
+		verifyCtx, cancel := context.WithTimeout(ctx, defaultTimeout)
+		verifyCtx, verify := startSpan(verifyCtx, "verify_assertion")
+		err := verifyAssertion(verifyCtx, client, args.OIDCToken, args.AllowedIssuers, exchangeAudience(args))
+		verify.End(err)
+		cancel()
+		if err != nil {
+			return &AssertionError{err}
+		}
+	}
+	// 5. Exchange OIDC token for Azure AD access token
+	exchanger := newExchanger(args, client)
+	if args.Mode == modeServe {
+		return serve(ctx, args, exchanger)
+	}
+	if len(args.Identities) > 0 {
+		return execBatch(ctx, args, exchanger)
+	}
+	exchangeCtx, stats := withExchangeStats(ctx)
+	tokenResp, err := acquireToken(exchangeCtx, args, exchanger)
+	stats.Stop()
+	writeTimingOutputs(ctx, "", stats)
+	if err != nil {
 		return err
 	}
+	// 6. Write access token to output file
+	_, write := startSpan(ctx, "write_outputs")
+	err = writeTokenOutputs(ctx, args, tokenResp)
+	write.End(err)
+	if err != nil {
+		return err
+	}
+	checkTokenLifetime(ctx, args, "", tokenResp)
+	writeCard(ctx, newCardIdentity(args, tokenResp, nil))
+	if args.ACRRegistry != "" {
+		if err := writeACRCredentials(ctx, args, client, tokenResp); err != nil {
+			return err
+		}
+	}
+	if args.FunctionApp != "" {
+		if err := writeFunctionAppCredentials(ctx, args, client, tokenResp); err != nil {
+			return err
+		}
+	}
+	if args.WebApp != "" {
+		if err := writeWebAppCredentials(ctx, args, client, tokenResp); err != nil {
+			return err
+		}
+	}
+	if args.StaticWebApp != "" {
+		if err := writeStaticWebAppToken(ctx, args, client, tokenResp); err != nil {
+			return err
+		}
+	}
+	if args.DownstreamScope != "" {
+		if err := writeDownstreamToken(ctx, args, exchanger, tokenResp); err != nil {
+			return err
+		}
+	}
+	if args.Lighthouse || len(args.LighthouseTenants) > 0 {
+		if err := checkLighthouse(ctx, args, client, tokenResp); err != nil {
+			return err
+		}
+	}
+	if args.Whoami {
+		if err := checkWhoami(ctx, args, exchanger); err != nil {
+			return err
+		}
+	}
+	if args.DevOpsOrganization != "" {
+		if err := checkDevOps(ctx, args, client, tokenResp); err != nil {
+			return err
+		}
+	}
 
-	logrus.Infof("Azure access token retrieved successfully")
-	logrus.Debugf("token will expire in %d seconds", tokenResp.ExpiresIn)
+	logger(ctx).Infof("Azure access token retrieved successfully")
+	logger(ctx).Debugf("token will expire in %d seconds", tokenResp.ExpiresIn)
 
+	// 7. Optionally run the wrapped command
+	if args.Command != "" {
+		return runCommand(ctx, args)
+	}
 	return nil
 }
 
+// newExchanger returns the exchanger configured by the plugin
+// arguments.
+func newExchanger(args Args, client *http.Client) *Exchanger {
+	return &Exchanger{
+		Client:            client,
+		Timeout:           args.Timeout,
+		AttemptTimeout:    args.AttemptTimeout,
+		Region:            args.Region,
+		HedgeDelay:        args.HedgeDelay,
+		Discovery:         args.Discovery,
+		DiscoveryCacheDir: metadataCacheDir(args),
+		DiscoveryCacheKey: discoveryCacheKey(args),
+		AllowedHosts:      args.AllowedAuthorityHosts,
+		ClientRequestID:   newClientRequestID,
+	}
+}
+
+// writeTokenOutputs writes the access token to the secret output
+// file, and its fingerprint and metadata to the non-secret output
+// file.
+func writeTokenOutputs(ctx context.Context, args Args, tokenResp *AzureTokenResponse) error {
+	if err := secretOutput(ctx, args).Write("AZURE_ACCESS_TOKEN", tokenResp.AccessToken); err != nil {
+		return err
+	}
+	if err := writeFingerprint(ctx, "AZURE_ACCESS_TOKEN_FINGERPRINT", tokenResp.AccessToken); err != nil {
+		return err
+	}
+	if err := writeTokenMetadata(ctx, args, "", tokenResp); err != nil {
+		return err
+	}
+	if args.ClaimsOutput {
+		if err := writeClaimsOutput(ctx, args, "", tokenResp); err != nil {
+			return err
+		}
+	}
+	if args.AzcopyLogin != "" {
+		if err := writeAzcopyOutputs(ctx, args); err != nil {
+			return err
+		}
+	}
+	if args.PowerShellScript != "" {
+		if err := writePowerShellScript(ctx, args); err != nil {
+			return err
+		}
+	}
+	if args.VeleroCredentials != "" {
+		if err := writeVeleroCredentials(ctx, args); err != nil {
+			return err
+		}
+	}
+	if args.AzureJSON != "" {
+		if err := writeAzureJSON(ctx, args); err != nil {
+			return err
+		}
+	}
+	if len(args.ArtifactsFeeds) > 0 {
+		if err := writeArtifactsCredentials(ctx, args, tokenResp); err != nil {
+			return err
+		}
+	}
+	if args.Preset != "" {
+		if err := writePresetOutputs(ctx, args, tokenResp); err != nil {
+			return err
+		}
+	}
+	if args.AzureLoginCompat {
+		return writeAzureLoginOutputs(ctx, args)
+	}
+	return nil
+}
+
+// checkTokenLifetime logs a structured warning when the lifetime of
+// the token is below the configured minimum, and writes the
+// AZURE_OIDC_LOW_EXPIRY flag to the non-secret output file.
+func checkTokenLifetime(ctx context.Context, args Args, suffix string, tokenResp *AzureTokenResponse) {
+	if args.MinTokenLifetime <= 0 {
+		return
+	}
+	now := wallClock.Now()
+	lifetime := tokenResp.ExpiresAt(now).Sub(now)
+	low := lifetime < args.MinTokenLifetime
+	if low {
+		logger(ctx).WithFields(logrus.Fields{
+			"event":              "token_low_expiry",
+			"expires_in":         tokenResp.ExpiresIn,
+			"min_token_lifetime": int(args.MinTokenLifetime.Seconds()),
+		}).Warnf("access token expires in %s, below the %s minimum lifetime", lifetime, args.MinTokenLifetime)
+	}
+	if output := plainOutput(ctx); output != nil {
+		if err := output.Write("AZURE_OIDC_LOW_EXPIRY"+suffix, strconv.FormatBool(low)); err != nil {
+			logger(ctx).Warnf("failed to write AZURE_OIDC_LOW_EXPIRY%s output: %s", suffix, err)
+		}
+	}
+}
+
+// metadataCacheDir returns the directory where discovery metadata
+// is memoized, or an empty string when memoization is disabled.
+func metadataCacheDir(args Args) string {
+	if !args.Cache && !args.Discovery {
+		return ""
+	}
+	if args.CacheDir != "" {
+		return args.CacheDir
+	}
+	return defaultCacheDir
+}
+
+// acquireToken returns an access token for the configured identity,
+// reusing a token cached in the workspace by an earlier step when
+// caching is enabled and the token is still valid.
+func acquireToken(ctx context.Context, args Args, exchanger *Exchanger) (tokenResp *AzureTokenResponse, err error) {
+	ctx, span := startSpan(ctx, "exchange")
+	defer func() { span.End(err) }()
+
+	var cache *tokenCache
+	authorityHost, scope := args.AuthorityHost, args.Scope
+	if authorityHost == "" {
+		authorityHost = defaultAuthorityHost
+	}
+	if scope == "" {
+		scope = defaultScope
+	}
+	span.SetAttribute("azure.tenant_id", args.TenantID)
+	span.SetAttribute("azure.client_id", args.ClientID)
+	span.SetAttribute("azure.scope", scope)
+
+	if args.Cache {
+		cache = newTokenCache(args.CacheDir, args.EncryptionKey, executionKeyMaterial(args)...)
+		token := lookupCachedToken(ctx, cache, args, authorityHost, scope)
+		span.SetAttribute("azure.cache_hit", token != nil)
+		if token != nil {
+			return token, nil
+		}
+	}
+
+	provider, err := newTokenProvider(args, exchanger)
+	if err != nil {
+		return nil, configError(err)
+	}
+	log := logger(ctx).WithFields(identityFields(args.TenantID, args.ClientID, scope))
+	if credential(args) == credentialOIDC {
+		log.Infof("exchanging OIDC token for Azure AD access token")
+	} else {
+		log.Infof("requesting Azure AD access token with the %s credential", credential(args))
+	}
+	start := time.Now()
+	tokenResp, err = provider.Token(ctx, scope)
+	if err != nil {
+		logAuthError(log, err)
+		rec := newAuditRecord(args, auditTokenFailed, scope)
+		err = explainExpiredAssertion(err, args.OIDCToken, wallClock.Now())
+		rec.Error = redactor.Redact(err.Error())
+		writeAudit(ctx, args.AuditLog, rec)
+		notifyWebhook(ctx, args, exchanger.HTTPClient(), rec)
+		if cache != nil && isOutage(err) {
+			if token := lookupExtendedToken(ctx, cache, args, authorityHost, scope, err); token != nil {
+				return token, nil
+			}
+		}
+		if credential(args) != credentialOIDC {
+			return nil, fmt.Errorf("failed to acquire token with the %s credential: %w", credential(args), err)
+		}
+		return nil, fmt.Errorf("failed to exchange OIDC token: %w", err)
+	}
+	log.WithFields(durationField(start)).Debugf("token exchange completed in %s", time.Since(start).Truncate(time.Millisecond))
+	if err := checkTokenRoles(tokenResp.AccessToken, args.RequireRoles); err != nil {
+		return nil, err
+	}
+	rec := newAuditRecord(args, auditTokenIssued, scope)
+	rec.ExpiresIn = tokenResp.ExpiresIn
+	rec.Fingerprint = tokenFingerprint(tokenResp.AccessToken)
+	writeAudit(ctx, args.AuditLog, rec)
+	notifyWebhook(ctx, args, exchanger.HTTPClient(), rec)
+
+	if cache != nil {
+		entry := newCacheEntry(wallClock.Now(), tokenResp)
+		if err := cache.Store(authorityHost, args.TenantID, args.ClientID, scope, entry); err != nil {
+			logger(ctx).Warnf("failed to cache access token: %s", err)
+		}
+	}
+	return tokenResp, nil
+}
+
+// lookupCachedToken returns the cached token if it can be reused,
+// logging why the cache was bypassed otherwise.
+func lookupCachedToken(ctx context.Context, cache *tokenCache, args Args, authorityHost, scope string) *AzureTokenResponse {
+	log := logger(ctx)
+	if args.ForceRefresh {
+		log.Infof("token cache bypassed: force refresh requested")
+		return nil
+	}
+	entry, err := cache.Load(authorityHost, args.TenantID, args.ClientID, scope)
+	if err != nil {
+		log.Warnf("token cache bypassed: %s", err)
+		return nil
+	}
+	if entry == nil {
+		log.Infof("token cache miss: no cached token found")
+		return nil
+	}
+
+	buffer := args.CacheBuffer
+	if buffer == 0 {
+		buffer = defaultCacheBuffer
+	}
+	remaining := entry.remaining(wallClock.Now()).Truncate(time.Second)
+	if remaining <= buffer {
+		log.Infof("token cache bypassed: cached token expires in %s, below the %s refresh buffer", remaining, buffer)
+		return nil
+	}
+
+	redactSecret(entry.AccessToken)
+	log.Infof("token cache hit: reusing cached token valid for %s", remaining)
+	return entry.token(wallClock.Now())
+}
+
+// lookupExtendedToken returns the cached token if it is within its
+// extended lifetime, for use while Azure AD is unavailable.
+func lookupExtendedToken(ctx context.Context, cache *tokenCache, args Args, authorityHost, scope string, cause error) *AzureTokenResponse {
+	entry, err := cache.Load(authorityHost, args.TenantID, args.ClientID, scope)
+	if err != nil || entry == nil {
+		return nil
+	}
+	now := wallClock.Now()
+	remaining := entry.extendedRemaining(now).Truncate(time.Second)
+	if remaining <= 0 {
+		return nil
+	}
+	redactSecret(entry.AccessToken)
+	logger(ctx).Warnf("azure ad is unavailable, reusing cached token within its extended lifetime for %s: %s", remaining, cause)
+	return entry.token(now)
+}
+
 // VerifyEnv validates that all required environment variables are provided.
-func VerifyEnv(args Args) error {
-	if args.OIDCToken == "" {
-		return fmt.Errorf("oidc-token is not provided")
+// It logs through the logger of the context.
+func VerifyEnv(ctx context.Context, args Args) error {
+	if err := verifyPlatform(args.Platform); err != nil {
+		return err
+	}
+	if err := checkUnresolved(args); err != nil {
+		return err
+	}
+	if err := verifyCredential(args); err != nil {
+		return err
+	}
+	if err := verifyExchangeEngine(args); err != nil {
+		return err
+	}
+	if credential(args) == credentialOIDC {
+		if args.OIDCToken == "" {
+			if platform(args) == platformDrone {
+				return fmt.Errorf("oidc-token is not provided, set the oidc_token_id setting from a secret")
+			}
+			return fmt.Errorf("oidc-token is not provided")
+		}
+		if err := checkAssertionShape(args); err != nil {
+			return err
+		}
+	}
+	if err := verifyLogFormat(args.LogFormat); err != nil {
+		return err
+	}
+	if err := verifyTimeouts(args); err != nil {
+		return err
+	}
+	if err := verifyAuthorityHosts(args); err != nil {
+		return err
+	}
+	if err := verifyScopes(args); err != nil {
+		return err
+	}
+	if args.VerifyAssertion && len(args.AllowedIssuers) == 0 {
+		return fmt.Errorf("verify-assertion requires allowed-issuers, the issuer of the token cannot be trusted to name its own keys")
+	}
+	if err := verifyAssertionClaims(ctx, args); err != nil {
+		return err
+	}
+	if err := verifyWebhooks(args); err != nil {
+		return err
+	}
+	if err := verifyStageExports(args); err != nil {
+		return err
 	}
-	if args.TenantID == "" {
+	if err := verifyAzcopyLogin(args.AzcopyLogin); err != nil {
+		return err
+	}
+	if err := verifyPreset(args); err != nil {
+		return err
+	}
+	if err := verifyDevOps(args); err != nil {
+		return err
+	}
+	if err := verifyAzureJSONFormat(args.AzureJSONFormat); err != nil {
+		return err
+	}
+	if strings.EqualFold(args.AzureJSONFormat, azureJSONExternalDNS) && (args.SubscriptionID == "" || args.ResourceGroup == "") {
+		return fmt.Errorf("azure-json-format %s requires subscription-id and resource-group", azureJSONExternalDNS)
+	}
+	if args.ACRPullSecretApply && args.ACRPullSecret == "" {
+		return fmt.Errorf("acr-pull-secret-apply requires acr-pull-secret")
+	}
+	if args.ACRPullSecret != "" {
+		if args.ACRRegistry == "" {
+			return fmt.Errorf("acr-pull-secret requires acr-registry")
+		}
+		if args.ACRPullSecretName != "" {
+			if err := verifyPullSecretName(args.ACRPullSecretName); err != nil {
+				return err
+			}
+		}
+	}
+	switch args.Mode {
+	case "", modeExec:
+	case modeServe:
+		if err := verifyServeAddr(args.ServeAddr); err != nil {
+			return err
+		}
+		if len(args.Identities) > 0 {
+			return fmt.Errorf("identities are not supported in %s mode", modeServe)
+		}
+		if args.DownstreamScope != "" {
+			return fmt.Errorf("downstream-scope is not supported in %s mode", modeServe)
+		}
+		if args.Whoami {
+			return fmt.Errorf("whoami is not supported in %s mode", modeServe)
+		}
+		if args.ACRRegistry != "" || args.Command != "" {
+			return fmt.Errorf("acr-registry and command are not supported in %s mode", modeServe)
+		}
+		if args.FunctionApp != "" || args.WebApp != "" {
+			return fmt.Errorf("function-app and web-app are not supported in %s mode", modeServe)
+		}
+		if args.StaticWebApp != "" {
+			return fmt.Errorf("static-web-app is not supported in %s mode", modeServe)
+		}
+		if args.DevOpsOrganization != "" {
+			return fmt.Errorf("devops-organization is not supported in %s mode", modeServe)
+		}
+	case modeValidate:
+		if len(args.Identities) > 0 {
+			return fmt.Errorf("identities are not supported in %s mode", modeValidate)
+		}
+	default:
+		return fmt.Errorf("unsupported mode %q", args.Mode)
+	}
+	if len(args.Identities) > 0 {
+		if args.Lighthouse || len(args.LighthouseTenants) > 0 {
+			return fmt.Errorf("lighthouse verification is not supported with identities")
+		}
+		if args.DownstreamScope != "" {
+			return fmt.Errorf("downstream-scope is not supported with identities")
+		}
+		if args.Whoami {
+			return fmt.Errorf("whoami is not supported with identities")
+		}
+		if args.AzureLoginCompat {
+			return fmt.Errorf("azure-login-compat is not supported with identities")
+		}
+		if args.ACRRegistry != "" || args.Command != "" {
+			return fmt.Errorf("acr-registry and command are not supported with identities")
+		}
+		if args.AzcopyLogin != "" {
+			return fmt.Errorf("azcopy-login is not supported with identities")
+		}
+		if args.PowerShellScript != "" {
+			return fmt.Errorf("powershell-script is not supported with identities")
+		}
+		if args.VeleroCredentials != "" {
+			return fmt.Errorf("velero-credentials is not supported with identities")
+		}
+		if args.AzureJSON != "" {
+			return fmt.Errorf("azure-json is not supported with identities")
+		}
+		if args.DevOpsOrganization != "" {
+			return fmt.Errorf("devops-organization is not supported with identities")
+		}
+		if len(args.ArtifactsFeeds) > 0 {
+			return fmt.Errorf("artifacts-feeds is not supported with identities")
+		}
+		if args.Preset != "" {
+			return fmt.Errorf("preset is not supported with identities")
+		}
+		if args.FunctionApp != "" || args.WebApp != "" {
+			return fmt.Errorf("function-app and web-app are not supported with identities")
+		}
+		if args.StaticWebApp != "" {
+			return fmt.Errorf("static-web-app is not supported with identities")
+		}
+		if err := verifyFailurePolicy(args); err != nil {
+			return err
+		}
+		return verifyIdentities(args)
+	}
+	if args.TerraformVars {
+		return fmt.Errorf("terraform-vars requires identities")
+	}
+	if args.FailurePolicy != "" || len(args.RequiredAliases) > 0 {
+		return fmt.Errorf("failure-policy and required-aliases require identities")
+	}
+	// A managed identity needs neither, its tenant and client are
+	// those of the identity.
+	managedIdentity := credential(args) == credentialManagedIdentity
+	if args.TenantID == "" && args.SubscriptionID == "" && !managedIdentity {
 		return fmt.Errorf("tenant-id is not provided")
 	}
-	if args.ClientID == "" {
+	if args.ClientID == "" && !managedIdentity {
 		return fmt.Errorf("client-id is not provided")
 	}
-	if err := validateGUID(args.TenantID, "tenant-id"); err != nil {
+	if args.TenantID != "" {
+		if err := validateTenant(args, args.TenantID); err != nil {
+			return err
+		}
+	}
+	if args.SubscriptionID != "" {
+		if err := validateGUID(args.SubscriptionID, "subscription-id"); err != nil {
+			return err
+		}
+	}
+	if args.FunctionApp != "" && (args.SubscriptionID == "" || args.ResourceGroup == "") {
+		return fmt.Errorf("function-app requires subscription-id and resource-group")
+	}
+	if args.WebApp != "" && (args.SubscriptionID == "" || args.ResourceGroup == "") {
+		return fmt.Errorf("web-app requires subscription-id and resource-group")
+	}
+	if args.PublishProfile && args.FunctionApp == "" && args.WebApp == "" {
+		return fmt.Errorf("publish-profile requires function-app or web-app")
+	}
+	if args.StaticWebApp != "" {
+		if err := verifyStaticWebApp(args.StaticWebApp); err != nil {
+			return err
+		}
+	}
+	if args.ClientID != "" {
+		if err := validateGUID(args.ClientID, "client-id"); err != nil {
+			return err
+		}
+	}
+	if args.DownstreamClientID != "" {
+		if err := validateGUID(args.DownstreamClientID, "downstream-client-id"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyAuthorityHosts validates the configured authority hosts
+// against the allowlist and transport security requirements.
+func verifyAuthorityHosts(args Args) error {
+	hosts := azuread.SplitAuthorityHosts(args.AuthorityHost)
+	if len(hosts) == 0 {
+		hosts = []string{defaultAuthorityHost}
+	}
+	for _, host := range hosts {
+		if err := verifyAuthorityURL(host, args.CustomAuthority); err != nil {
+			return err
+		}
+		if err := azuread.CheckEndpoint(host, args.AllowedAuthorityHosts); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// verifyTimeouts validates the timeout and cache duration settings.
+func verifyTimeouts(args Args) error {
+	if args.Timeout < 0 {
+		return fmt.Errorf("timeout must not be negative")
+	}
+	if args.AttemptTimeout < 0 {
+		return fmt.Errorf("attempt-timeout must not be negative")
+	}
+	for _, r := range args.Region {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9') {
+			return fmt.Errorf("azure-region must be a region name such as westus2")
+		}
+	}
+	if args.HedgeDelay < 0 {
+		return fmt.Errorf("hedge-delay must not be negative")
+	}
+	if args.DialTimeout < 0 || args.TLSHandshakeTimeout < 0 || args.ResponseHeaderTimeout < 0 {
+		return fmt.Errorf("transport timeouts must not be negative")
+	}
+	if args.MaxIdleConns < 0 {
+		return fmt.Errorf("max-idle-conns must not be negative")
+	}
+	if args.HTTPSProxy != "" && args.SocksProxy != "" {
+		return fmt.Errorf("https-proxy and socks-proxy cannot be used together")
+	}
+	if err := verifyTLSVersion(args); err != nil {
 		return err
 	}
-	if err := validateGUID(args.ClientID, "client-id"); err != nil {
+	if _, err := parseFileMode(args.OutputFileMode); err != nil {
 		return err
 	}
+	if args.Cache && args.EncryptionKey == "" {
+		return fmt.Errorf("cache requires encryption-key, the execution metadata alone is readable by every step")
+	}
+	if args.CacheBuffer < 0 {
+		return fmt.Errorf("cache-buffer must not be negative")
+	}
+	if args.BreakerCooldown < 0 {
+		return fmt.Errorf("breaker-cooldown must not be negative")
+	}
+	if args.MinTokenLifetime < 0 {
+		return fmt.Errorf("min-token-lifetime must not be negative")
+	}
 	return nil
 }
 
+// validateTenant validates a tenant ID. The organizations and common
+// tenants of multi-tenant app registrations are accepted when
+// explicitly enabled.
+func validateTenant(args Args, tenantID string) error {
+	if strings.EqualFold(tenantID, tenantOrganizations) {
+		if !args.AllowOrganizations {
+			return fmt.Errorf("tenant-id %q requires allow-organizations to be enabled", tenantID)
+		}
+		return nil
+	}
+	if strings.EqualFold(tenantID, tenantCommon) {
+		if !args.AllowCommon {
+			return fmt.Errorf("tenant-id %q requires allow-common to be enabled", tenantID)
+		}
+		return nil
+	}
+	return validateGUID(tenantID, "tenant-id")
+}
+
 func validateGUID(value, fieldName string) error {
 	if len(value) == 36 && value[8] == '-' && value[13] == '-' && value[18] == '-' && value[23] == '-' {
 		return nil
@@ -80,20 +901,7 @@ func validateGUID(value, fieldName string) error {
 
 // WriteEnvToFile writes a key-value pair to the Harness output secret file.
 func WriteEnvToFile(key, value string) error {
-	outputFile, err := os.OpenFile(
-		os.Getenv("HARNESS_OUTPUT_SECRET_FILE"),
-		os.O_APPEND|os.O_CREATE|os.O_WRONLY,
-		0644,
-	)
-	if err != nil {
-		return fmt.Errorf("failed to open output file: %w", err)
-	}
-	defer outputFile.Close()
-
-	_, err = fmt.Fprintf(outputFile, "%s=%s\n", key, value)
-	if err != nil {
-		return fmt.Errorf("failed to write to env: %w", err)
-	}
-
-	return nil
+	output := newOutputFile(os.Getenv("HARNESS_OUTPUT_SECRET_FILE"), defaultOutputFileMode)
+	output.secret = true
+	return output.Write(key, value)
 }
@@ -0,0 +1,65 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// powershellScript is the bootstrap script connecting the Az
+// PowerShell module with the access token. The token is read from
+// the environment so the script never contains it. Az.Accounts 5 and
+// later take the token as a SecureString.
+const powershellScript = `# Generated by drone-azure-oidc. Connects the Az PowerShell module
+# with the access token in $env:AZURE_ACCESS_TOKEN.
+$ErrorActionPreference = 'Stop'
+if (-not $env:AZURE_ACCESS_TOKEN) {
+    throw 'AZURE_ACCESS_TOKEN is not set, map the AZURE_ACCESS_TOKEN output of the plugin step to it'
+}
+$token = $env:AZURE_ACCESS_TOKEN
+if ((Get-Command Connect-AzAccount).Parameters['AccessToken'].ParameterType -eq [securestring]) {
+    $token = ConvertTo-SecureString -String $token -AsPlainText -Force
+}
+$params = @{
+    AccessToken = $token
+    AccountId   = %s
+    TenantId    = %s
+}
+%sConnect-AzAccount @params | Out-Null
+Get-AzContext | Format-List Account, Tenant, Subscription
+`
+
+// psQuote returns the value as a PowerShell single-quoted string.
+func psQuote(value string) string {
+	return "'" + strings.ReplaceAll(value, "'", "''") + "'"
+}
+
+// writePowerShellScript writes the Connect-AzAccount bootstrap script
+// and its path to the non-secret output file, so PowerShell steps
+// can dot-source it. The script requires a Resource Manager token.
+func writePowerShellScript(ctx context.Context, args Args) error {
+	var subscription string
+	if args.SubscriptionID != "" {
+		subscription = "$params.Subscription = " + psQuote(args.SubscriptionID) + "\n"
+	}
+	script := fmt.Sprintf(powershellScript, psQuote(args.ClientID), psQuote(args.TenantID), subscription)
+
+	path, err := filepath.Abs(args.PowerShellScript)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return fmt.Errorf("failed to create PowerShell script directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(script), 0644); err != nil {
+		return fmt.Errorf("failed to write PowerShell script: %w", err)
+	}
+	if output := plainOutput(ctx); output != nil {
+		return output.Write("AZURE_POWERSHELL_SCRIPT", path)
+	}
+	return nil
+}
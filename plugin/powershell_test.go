@@ -0,0 +1,53 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestWritePowerShellScript(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("DRONE_OUTPUT", filepath.Join(dir, "out.env"))
+
+	args := Args{
+		OIDCToken:        testOIDCToken,
+		TenantID:         "12345678-1234-1234-1234-1234567890ab",
+		ClientID:         "00000000-0000-0000-0000-000000000001",
+		SubscriptionID:   "11111111-1111-1111-1111-111111111111",
+		PowerShellScript: filepath.Join(dir, "scripts", "connect.ps1"),
+	}
+	if err := writePowerShellScript(context.Background(), args); err != nil {
+		t.Fatalf("writePowerShellScript returned error: %v", err)
+	}
+	data, err := os.ReadFile(args.PowerShellScript)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := string(data)
+	for _, want := range []string{
+		"AccountId   = '00000000-0000-0000-0000-000000000001'\n",
+		"TenantId    = '12345678-1234-1234-1234-1234567890ab'\n",
+		"$params.Subscription = '11111111-1111-1111-1111-111111111111'\nConnect-AzAccount @params",
+		"$token = $env:AZURE_ACCESS_TOKEN\n",
+	} {
+		if !strings.Contains(script, want) {
+			t.Errorf("script missing %q:\n%s", want, script)
+		}
+	}
+	if strings.Contains(script, testOIDCToken) {
+		t.Errorf("script contains the OIDC token")
+	}
+	outputs, _ := readOutputFile(filepath.Join(dir, "out.env"))
+	if outputs["AZURE_POWERSHELL_SCRIPT"] != args.PowerShellScript {
+		t.Errorf("unexpected outputs %v", outputs)
+	}
+
+	if got := psQuote("it's"); got != "'it''s'" {
+		t.Errorf("psQuote = %s", got)
+	}
+}
@@ -0,0 +1,81 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// supported presets
+const presetAML = "aml"
+
+// amlScope is the Azure Machine Learning scope.
+const amlScope = "https://ml.azure.com/.default"
+
+// verifyPreset validates the preset and the settings it requires.
+func verifyPreset(args Args) error {
+	switch strings.ToLower(args.Preset) {
+	case "":
+		return nil
+	case presetAML:
+		if args.SubscriptionID == "" || args.ResourceGroup == "" || args.AMLWorkspace == "" || args.AMLRegion == "" {
+			return fmt.Errorf("preset %s requires subscription-id, resource-group, aml-workspace and aml-region", presetAML)
+		}
+		for _, c := range args.AMLRegion {
+			if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') {
+				return fmt.Errorf("invalid aml-region %q, expected a region name such as westeurope", args.AMLRegion)
+			}
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported preset %q", args.Preset)
+}
+
+// applyPreset returns the arguments with the default scope of the
+// preset, or of the Azure DevOps settings, applied.
+func applyPreset(args Args) Args {
+	if strings.EqualFold(args.Preset, presetAML) && args.Scope == "" {
+		args.Scope = amlScope
+	}
+	if (args.DevOpsOrganization != "" || len(args.ArtifactsFeeds) > 0) && args.Scope == "" {
+		args.Scope = devopsScope
+	}
+	return args
+}
+
+// writePresetOutputs writes the outputs of the preset.
+func writePresetOutputs(ctx context.Context, args Args, token *AzureTokenResponse) error {
+	if strings.EqualFold(args.Preset, presetAML) {
+		return writeAMLOutputs(ctx, args, token)
+	}
+	return nil
+}
+
+// amlTrackingURI returns the MLflow tracking URI of the workspace.
+func amlTrackingURI(args Args) string {
+	return fmt.Sprintf("https://%s.api.azureml.ms/mlflow/v1.0/subscriptions/%s/resourceGroups/%s/providers/Microsoft.MachineLearningServices/workspaces/%s",
+		strings.ToLower(args.AMLRegion), url.PathEscape(args.SubscriptionID), url.PathEscape(args.ResourceGroup), url.PathEscape(args.AMLWorkspace))
+}
+
+// writeAMLOutputs writes the workspace variables read by the Azure
+// Machine Learning SDK and the MLflow tracking URI as non-secret
+// outputs, and the access token as MLFLOW_TRACKING_TOKEN, so MLflow
+// authenticates without the azureml-mlflow plugin.
+func writeAMLOutputs(ctx context.Context, args Args, token *AzureTokenResponse) error {
+	if output := plainOutput(ctx); output != nil {
+		for _, kv := range [][2]string{
+			{"AZUREML_ARM_SUBSCRIPTION", args.SubscriptionID},
+			{"AZUREML_ARM_RESOURCEGROUP", args.ResourceGroup},
+			{"AZUREML_ARM_WORKSPACE_NAME", args.AMLWorkspace},
+			{"MLFLOW_TRACKING_URI", amlTrackingURI(args)},
+		} {
+			if err := output.Write(kv[0], kv[1]); err != nil {
+				return err
+			}
+		}
+	}
+	return secretOutput(ctx, args).Write("MLFLOW_TRACKING_TOKEN", token.AccessToken)
+}
@@ -0,0 +1,63 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestExec_AMLPreset(t *testing.T) {
+	var scope string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_ = r.ParseForm()
+		scope = r.PostForm.Get("scope")
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"ml-token"}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	t.Setenv("HARNESS_OUTPUT_SECRET_FILE", filepath.Join(dir, "secret.env"))
+	t.Setenv("DRONE_OUTPUT", filepath.Join(dir, "out.env"))
+
+	args := Args{
+		OIDCToken:      testOIDCToken,
+		TenantID:       "12345678-1234-1234-1234-1234567890ab",
+		ClientID:       "00000000-0000-0000-0000-000000000001",
+		SubscriptionID: "11111111-1111-1111-1111-111111111111",
+		ResourceGroup:  "ml",
+		AuthorityHost:  srv.URL,
+		Preset:         "aml",
+		AMLWorkspace:   "models",
+		AMLRegion:      "westeurope",
+	}
+	if err := Exec(context.Background(), args); err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+	if scope != amlScope {
+		t.Errorf("scope = %q, want %q", scope, amlScope)
+	}
+	secrets, _ := readOutputFile(filepath.Join(dir, "secret.env"))
+	if secrets["MLFLOW_TRACKING_TOKEN"] != "ml-token" {
+		t.Errorf("unexpected secret outputs %v", secrets)
+	}
+	plain, _ := readOutputFile(filepath.Join(dir, "out.env"))
+	want := "https://westeurope.api.azureml.ms/mlflow/v1.0/subscriptions/11111111-1111-1111-1111-111111111111/resourceGroups/ml/providers/Microsoft.MachineLearningServices/workspaces/models"
+	if plain["MLFLOW_TRACKING_URI"] != want || plain["AZUREML_ARM_WORKSPACE_NAME"] != "models" || plain["AZUREML_ARM_RESOURCEGROUP"] != "ml" {
+		t.Errorf("unexpected outputs %v", plain)
+	}
+
+	for _, bad := range []Args{
+		{Preset: "sagemaker"},
+		{Preset: "aml", SubscriptionID: args.SubscriptionID, ResourceGroup: "ml", AMLWorkspace: "models"},
+		{Preset: "aml", SubscriptionID: args.SubscriptionID, ResourceGroup: "ml", AMLWorkspace: "models", AMLRegion: "evil.com/x"},
+	} {
+		if err := verifyPreset(bad); err == nil {
+			t.Errorf("expected error for preset arguments %+v", bad)
+		}
+	}
+}
@@ -0,0 +1,97 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// redactedText replaces secrets in log output.
+const redactedText = "[REDACTED]"
+
+// minSecretLength is the minimum length of a registered secret.
+// Shorter values are ignored to avoid mangling unrelated log text.
+const minSecretLength = 6
+
+// jwtPattern matches JSON Web Tokens, which are redacted from logs
+// even when they were not registered as secrets.
+var jwtPattern = regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+
+// redactionHook is a logrus hook that scrubs registered secrets and
+// anything that looks like a JWT from every log entry, at every
+// level, before the entry is formatted.
+type redactionHook struct {
+	mu      sync.RWMutex
+	secrets []string
+}
+
+// redactor is the hook registered with the standard logger.
+var redactor = new(redactionHook)
+
+func init() {
+	logrus.AddHook(redactor)
+}
+
+// redactSecret registers a value that must never appear in logs.
+func redactSecret(secret string) {
+	redactor.Add(secret)
+}
+
+// Add registers a secret with the hook.
+func (h *redactionHook) Add(secret string) {
+	if len(secret) < minSecretLength {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for _, s := range h.secrets {
+		if s == secret {
+			return
+		}
+	}
+	h.secrets = append(h.secrets, secret)
+}
+
+// Levels implements the logrus.Hook interface.
+func (h *redactionHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+// Fire implements the logrus.Hook interface.
+func (h *redactionHook) Fire(entry *logrus.Entry) error {
+	entry.Message = h.Redact(entry.Message)
+	if len(entry.Data) == 0 {
+		return nil
+	}
+	// copy the fields, the map may be shared with other entries.
+	data := make(logrus.Fields, len(entry.Data))
+	for key, value := range entry.Data {
+		switch v := value.(type) {
+		case string:
+			data[key] = h.Redact(v)
+		case error:
+			data[key] = h.Redact(v.Error())
+		case fmt.Stringer:
+			data[key] = h.Redact(v.String())
+		default:
+			data[key] = value
+		}
+	}
+	entry.Data = data
+	return nil
+}
+
+// Redact replaces registered secrets and JWTs in the text.
+func (h *redactionHook) Redact(text string) string {
+	h.mu.RLock()
+	for _, secret := range h.secrets {
+		text = strings.ReplaceAll(text, secret, redactedText)
+	}
+	h.mu.RUnlock()
+	return jwtPattern.ReplaceAllString(text, redactedText)
+}
@@ -0,0 +1,121 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// defaultScopeSuffix is the suffix requesting all the application
+// permissions granted on a resource.
+const defaultScopeSuffix = "/.default"
+
+// openIDScopes are OpenID Connect scopes, which the client
+// credentials grant does not accept.
+var openIDScopes = map[string]bool{
+	"openid":         true,
+	"profile":        true,
+	"email":          true,
+	"offline_access": true,
+}
+
+// normalizeScope validates the scope and returns it in the
+// <resource>/.default form required by the client credentials grant,
+// appending /.default to a bare resource URI or application ID.
+func normalizeScope(scope string) (string, error) {
+	scope = strings.TrimSpace(scope)
+	if scope == "" {
+		return "", nil
+	}
+	if strings.ContainsAny(scope, " \t\r\n,") {
+		return "", fmt.Errorf("scope %q contains several scopes, the client credentials grant accepts a single <resource>/.default scope such as %s", scope, defaultScope)
+	}
+	if openIDScopes[strings.ToLower(scope)] {
+		return "", fmt.Errorf("scope %q is an OpenID Connect scope, use a resource scope such as %s", scope, defaultScope)
+	}
+	if resource, ok := delegatedScopeResource(scope); ok {
+		return "", fmt.Errorf("scope %q is a delegated permission copied from the portal, the client credentials grant requires %s%s", scope, resource, defaultScopeSuffix)
+	}
+	resource := strings.TrimSuffix(scope, defaultScopeSuffix)
+	if resource == "" {
+		return "", fmt.Errorf("scope %q has no resource, use a resource scope such as %s", scope, defaultScope)
+	}
+	if validateGUID(resource, "scope") == nil && !strings.Contains(resource, "/") {
+		return resource + defaultScopeSuffix, nil
+	}
+
+	u, err := url.Parse(resource)
+	if err != nil || u.Scheme == "" || u.Opaque == "" && u.Host == "" {
+		if strings.Contains(resource, ".") && !strings.Contains(resource, ":") {
+			return "", fmt.Errorf("scope %q has no scheme, did you mean https://%s%s?", scope, strings.TrimRight(resource, "/"), defaultScopeSuffix)
+		}
+		return "", fmt.Errorf("scope %q is not a resource URI or application ID, use a resource scope such as %s", scope, defaultScope)
+	}
+	if resource != scope {
+		return scope, nil
+	}
+	if strings.EqualFold(u.Hostname(), "graph.microsoft.com") && strings.Trim(u.Path, "/") != "" {
+		return "", fmt.Errorf("scope %q is a delegated permission, the client credentials grant requires https://graph.microsoft.com%s", scope, defaultScopeSuffix)
+	}
+	return strings.TrimRight(resource, "/") + defaultScopeSuffix, nil
+}
+
+// delegatedScopeResource returns the resource of a delegated
+// permission such as https://management.azure.com/user_impersonation,
+// as shown in the API permissions of the portal, adding the https
+// scheme to a resource URI copied without it.
+func delegatedScopeResource(scope string) (string, bool) {
+	i := strings.LastIndex(scope, "/")
+	if i <= 0 || !strings.EqualFold(scope[i+1:], "user_impersonation") {
+		return "", false
+	}
+	resource := strings.TrimRight(scope[:i], "/")
+	if !strings.Contains(resource, "://") && !strings.HasPrefix(resource, "api:") && validateGUID(resource, "scope") != nil {
+		resource = "https://" + resource
+	}
+	return resource, true
+}
+
+// verifyScopes validates the configured scopes.
+func verifyScopes(args Args) error {
+	if _, err := normalizeScope(args.Scope); err != nil {
+		return err
+	}
+	if _, err := normalizeScope(args.DownstreamScope); err != nil {
+		return fmt.Errorf("downstream-scope: %w", err)
+	}
+	for i, identity := range args.Identities {
+		if _, err := normalizeScope(identity.Scope); err != nil {
+			return fmt.Errorf("identities[%d]: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// normalizeScopes returns the arguments with every scope normalized,
+// logging the scopes that were rewritten. Invalid scopes are left
+// as is for VerifyEnv to report.
+func normalizeScopes(ctx context.Context, args Args) Args {
+	normalize := func(name, scope string) string {
+		normalized, err := normalizeScope(scope)
+		if err != nil || normalized == scope {
+			return scope
+		}
+		logger(ctx).Infof("%s %q normalized to %q", name, scope, normalized)
+		return normalized
+	}
+	args.Scope = normalize("scope", args.Scope)
+	args.DownstreamScope = normalize("downstream-scope", args.DownstreamScope)
+	if len(args.Identities) > 0 {
+		identities := make(Identities, len(args.Identities))
+		for i, identity := range args.Identities {
+			identity.Scope = normalize(fmt.Sprintf("identities[%d] scope", i), identity.Scope)
+			identities[i] = identity
+		}
+		args.Identities = identities
+	}
+	return args
+}
@@ -0,0 +1,73 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestNormalizeScope(t *testing.T) {
+	tests := map[string]string{
+		"":                                      "",
+		"https://management.azure.com/.default": "https://management.azure.com/.default",
+		"https://management.azure.com/":         "https://management.azure.com/.default",
+		"https://vault.azure.net":               "https://vault.azure.net/.default",
+		" api://internal-api ":                  "api://internal-api/.default",
+		"12345678-1234-1234-1234-1234567890ab":  "12345678-1234-1234-1234-1234567890ab/.default",
+		"urn:contoso:api":                       "urn:contoso:api/.default",
+	}
+	for scope, want := range tests {
+		got, err := normalizeScope(scope)
+		if err != nil {
+			t.Errorf("normalizeScope(%q) returned error: %v", scope, err)
+		} else if got != want {
+			t.Errorf("normalizeScope(%q) = %q, want %q", scope, got, want)
+		}
+	}
+
+	invalid := map[string]string{
+		"https://management.azure.com/.default https://vault.azure.net/.default": "single <resource>/.default scope",
+		"openid":                                "OpenID Connect scope",
+		"/.default":                             "has no resource",
+		"management.azure.com":                  "did you mean https://management.azure.com/.default",
+		"user_impersonation":                    "not a resource URI",
+		"https://graph.microsoft.com/User.Read": "delegated permission",
+		"https://management.azure.com/user_impersonation":         "requires https://management.azure.com/.default",
+		"storage.azure.com/user_impersonation":                    "requires https://storage.azure.com/.default",
+		"499b84ac-1321-427f-aa17-267ca6975798/user_impersonation": "requires 499b84ac-1321-427f-aa17-267ca6975798/.default",
+		"api://internal-api/user_impersonation":                   "requires api://internal-api/.default",
+	}
+	for scope, want := range invalid {
+		if _, err := normalizeScope(scope); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("normalizeScope(%q) error = %v, want %q", scope, err, want)
+		}
+	}
+}
+
+func TestVerifyEnv_Scope(t *testing.T) {
+	args := Args{
+		OIDCToken: testOIDCToken,
+		TenantID:  "12345678-1234-1234-1234-1234567890ab",
+		ClientID:  "12345678-1234-1234-1234-1234567890ab",
+		Scope:     "https://vault.azure.net",
+	}
+	if err := VerifyEnv(context.Background(), args); err != nil {
+		t.Fatalf("VerifyEnv returned error: %v", err)
+	}
+	if got := normalizeScopes(context.Background(), args).Scope; got != "https://vault.azure.net/.default" {
+		t.Fatalf("unexpected normalized scope %q", got)
+	}
+
+	args.Scope = "management.azure.com"
+	if err := VerifyEnv(context.Background(), args); err == nil {
+		t.Fatalf("expected error for a scope without scheme")
+	}
+
+	args.Scope = ""
+	args.DownstreamScope = "openid"
+	if err := VerifyEnv(context.Background(), args); err == nil || !strings.HasPrefix(err.Error(), "downstream-scope:") {
+		t.Fatalf("expected downstream-scope error, got %v", err)
+	}
+}
@@ -0,0 +1,10 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+// wipe zeroes a transient buffer, such as a decoded key or a request
+// dump, once it has been used. Strings the secret was copied from or
+// into, like Args.OIDCToken or the access token, are not affected.
+func wipe(b []byte) {
+	clear(b)
+}
@@ -0,0 +1,255 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/harness-community/drone-azure-oidc/pkg/azuread"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
+)
+
+// defaultServeAddr is the address the token server listens on.
+const defaultServeAddr = "127.0.0.1:8181"
+
+// defaultServeAddr6 is the address the token server listens on when
+// the IPv4 loopback address is not available, as on IPv6-only hosts.
+const defaultServeAddr6 = "[::1]:8181"
+
+// errCircuitOpen is returned when the circuit breaker is open and
+// no valid last-known-good token is available.
+var errCircuitOpen = errors.New("azure token exchange is unavailable: circuit breaker is open")
+
+// tokenServer serves access tokens to other steps over HTTP,
+// refreshing the token before it expires. Repeated Azure failures
+// trip a circuit breaker, during which the last-known-good token is
+// served for as long as it remains valid.
+type tokenServer struct {
+	args      Args
+	exchanger *Exchanger
+	breaker   *circuitBreaker
+	metrics   *metrics
+	clock     clock
+	log       *logrus.Entry
+
+	// ctx is the context of the exchanges, which outlive the
+	// requests that trigger them.
+	ctx   context.Context
+	group singleflight.Group
+
+	mu   sync.Mutex
+	last *cacheEntry
+}
+
+// newTokenServer returns a token server for the plugin arguments.
+// Its exchanges run on the context.
+func newTokenServer(ctx context.Context, args Args, exchanger *Exchanger) *tokenServer {
+	return &tokenServer{
+		args:      args,
+		exchanger: exchanger,
+		breaker:   newCircuitBreaker(args.BreakerThreshold, args.BreakerCooldown),
+		metrics:   newMetrics(),
+		clock:     wallClock,
+		log:       logger(ctx),
+		ctx:       ctx,
+	}
+}
+
+// Token returns a valid access token, exchanging a new one when the
+// current token is within the refresh buffer of its expiry. The
+// exchange runs on the context of the server and is shared by
+// concurrent requests, so a client that disconnects neither cancels
+// it nor counts as an Azure failure; the context only bounds the wait.
+func (s *tokenServer) Token(ctx context.Context) (*cacheEntry, error) {
+	if entry := s.fresh(s.clock.Now()); entry != nil {
+		s.metrics.CacheHit()
+		return entry, nil
+	}
+	s.metrics.CacheMiss()
+
+	result := s.group.DoChan("token", func() (interface{}, error) {
+		return s.refresh()
+	})
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case r := <-result:
+		if r.Err != nil {
+			return nil, r.Err
+		}
+		return r.Val.(*cacheEntry), nil
+	}
+}
+
+// fresh returns the current token when it is outside the refresh
+// buffer of its expiry, and nil otherwise.
+func (s *tokenServer) fresh(now time.Time) *cacheEntry {
+	buffer := s.args.CacheBuffer
+	if buffer == 0 {
+		buffer = defaultCacheBuffer
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.last != nil && s.last.remaining(now) > buffer {
+		return s.last
+	}
+	return nil
+}
+
+// refresh exchanges a new token unless the circuit breaker is open.
+// Only outages count towards the breaker and fall back to the last
+// token; a rejected request, such as a misconfigured federated
+// credential, is returned as is so the error is not masked.
+func (s *tokenServer) refresh() (*cacheEntry, error) {
+	now := s.clock.Now()
+	// A refresh that completed since the caller checked is reused.
+	if entry := s.fresh(now); entry != nil {
+		return entry, nil
+	}
+	if !s.breaker.Allow(now) {
+		return s.lastKnownGood(now, errCircuitOpen)
+	}
+
+	start := time.Now()
+	tokenResp, err := acquireToken(withLogger(s.ctx, s.log), s.args, s.exchanger)
+	s.metrics.Exchange(time.Since(start), err)
+	if err != nil {
+		if !isOutage(err) {
+			return nil, err
+		}
+		if until := s.breaker.Failure(s.clock.Now()); !until.IsZero() {
+			s.log.Warnf("circuit breaker open until %s after repeated failures", until.Format(time.RFC3339))
+		}
+		return s.lastKnownGood(now, err)
+	}
+	s.breaker.Success()
+
+	entry := newCacheEntry(now, tokenResp)
+	s.mu.Lock()
+	s.last = entry
+	s.mu.Unlock()
+	return entry, nil
+}
+
+// lastKnownGood returns the last token if it has not yet expired,
+// or is within its extended lifetime while Azure AD is unavailable,
+// and the provided error otherwise.
+func (s *tokenServer) lastKnownGood(now time.Time, err error) (*cacheEntry, error) {
+	s.mu.Lock()
+	last := s.last
+	s.mu.Unlock()
+	if last == nil {
+		return nil, err
+	}
+	if remaining := last.remaining(now); remaining > 0 {
+		s.log.Warnf("serving last-known-good token expiring in %s: %s", remaining.Truncate(time.Second), err)
+		return last, nil
+	}
+	if remaining := last.extendedRemaining(now); remaining > 0 && (errors.Is(err, errCircuitOpen) || isOutage(err)) {
+		s.log.Warnf("serving last-known-good token within its extended lifetime for %s: %s", remaining.Truncate(time.Second), err)
+		return last, nil
+	}
+	return nil, err
+}
+
+// ServeHTTP implements the http.Handler interface.
+func (s *tokenServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/metrics" {
+		s.metrics.ServeHTTP(w, r)
+		return
+	}
+	if r.URL.Path != "/token" {
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+
+	entry, err := s.Token(r.Context())
+	if err != nil {
+		s.log.Errorf("failed to serve token: %s", err)
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	body := map[string]interface{}{
+		"token_type":   entry.TokenType,
+		"access_token": entry.AccessToken,
+		"expires_in":   int64(entry.usable(s.clock.Now()).Seconds()),
+		"expires_on":   entry.ExpiresOn,
+	}
+	if entry.ExtExpiresOn != 0 {
+		body["ext_expires_on"] = entry.ExtExpiresOn
+	}
+	if entry.Scope != "" {
+		body["scope"] = entry.Scope
+	}
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+// verifyServeAddr validates the listen address of the token server.
+// Tokens are served without authentication, so only loopback
+// addresses, reachable from the steps of the same pod or host, are
+// accepted.
+func verifyServeAddr(addr string) error {
+	if addr == "" {
+		return nil
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return fmt.Errorf("invalid serve-addr %q: %w", addr, err)
+	}
+	if !azuread.IsLoopback(strings.ToLower(host)) {
+		return fmt.Errorf("serve-addr %s is not a loopback address: tokens are served without authentication", addr)
+	}
+	return nil
+}
+
+// serve runs the token server until the context is cancelled.
+func serve(ctx context.Context, args Args, exchanger *Exchanger) error {
+	addr := args.ServeAddr
+	if addr == "" {
+		addr = defaultServeAddr
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil && args.ServeAddr == "" {
+		logger(ctx).Debugf("failed to listen on %s, trying %s: %s", addr, defaultServeAddr6, err)
+		addr = defaultServeAddr6
+		listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to listen on %s: %w", addr, err)
+	}
+
+	handler := newTokenServer(ctx, args, exchanger)
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	logger(ctx).Infof("serving Azure access tokens on http://%s/token", listener.Addr())
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
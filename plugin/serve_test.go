@@ -0,0 +1,266 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	now := time.Now()
+	b := newCircuitBreaker(2, time.Minute)
+
+	if until := b.Failure(now); !until.IsZero() || !b.Allow(now) {
+		t.Fatalf("expected circuit to stay closed below the threshold")
+	}
+	if until := b.Failure(now); !until.Equal(now.Add(time.Minute)) {
+		t.Fatalf("expected circuit open for the cooldown, got %s", until)
+	}
+	if b.Allow(now.Add(30 * time.Second)) {
+		t.Fatalf("expected circuit to be open during the cooldown")
+	}
+	if !b.Allow(now.Add(time.Minute)) {
+		t.Fatalf("expected a trial request after the cooldown")
+	}
+
+	// a failed trial doubles the cooldown
+	if until := b.Failure(now); !until.Equal(now.Add(2 * time.Minute)) {
+		t.Fatalf("expected doubled cooldown, got %s", until)
+	}
+
+	b.Success()
+	if !b.Allow(now) {
+		t.Fatalf("expected circuit closed after success")
+	}
+}
+
+func TestTokenServer_LastKnownGood(t *testing.T) {
+	fail := false
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if fail {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		// lifetime within the refresh buffer forces a refresh on every request
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":120,"access_token":"abc"}`))
+	}))
+	defer srv.Close()
+
+	args := Args{
+		OIDCToken:        testOIDCToken,
+		TenantID:         "12345678-1234-1234-1234-1234567890ab",
+		ClientID:         "12345678-1234-1234-1234-1234567890ab",
+		AuthorityHost:    srv.URL,
+		BreakerThreshold: 1,
+		BreakerCooldown:  time.Hour,
+	}
+	ts := newTokenServer(context.Background(), args, &Exchanger{MaxAttempts: 1})
+
+	rec := httptest.NewRecorder()
+	ts.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/token", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected status %d", rec.Code)
+	}
+	var body struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil || body.AccessToken != "abc" {
+		t.Fatalf("unexpected body: %+v, %v", body, err)
+	}
+
+	// the failed refresh opens the circuit and serves the last token
+	fail = true
+	for i := 0; i < 3; i++ {
+		entry, err := ts.Token(context.Background())
+		if err != nil || entry.AccessToken != "abc" {
+			t.Fatalf("expected last-known-good token, got %+v, %v", entry, err)
+		}
+	}
+	if calls != 2 {
+		t.Fatalf("expected the open circuit to stop calling Azure, got %d calls", calls)
+	}
+
+	// an expired last-known-good token is not served
+	ts.last.ExpiresOn = time.Now().Add(-time.Second).Unix()
+	if _, err := ts.Token(context.Background()); err != errCircuitOpen {
+		t.Fatalf("expected circuit open error, got %v", err)
+	}
+}
+
+func TestTokenServer_ConfigErrorKeepsBreakerClosed(t *testing.T) {
+	fail := false
+	calls := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		w.Header().Set("Content-Type", "application/json")
+		if fail {
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_request","error_description":"AADSTS70021: No matching federated identity record found for presented assertion.","error_codes":[70021]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":120,"access_token":"abc"}`))
+	}))
+	defer srv.Close()
+
+	args := Args{
+		OIDCToken:        testOIDCToken,
+		TenantID:         "12345678-1234-1234-1234-1234567890ab",
+		ClientID:         "12345678-1234-1234-1234-1234567890ab",
+		AuthorityHost:    srv.URL,
+		BreakerThreshold: 1,
+		BreakerCooldown:  time.Hour,
+	}
+	ts := newTokenServer(context.Background(), args, new(Exchanger))
+	if _, err := ts.Token(context.Background()); err != nil {
+		t.Fatalf("Token returned error: %v", err)
+	}
+
+	// a rejected request is returned as is, without serving the last
+	// token or opening the circuit
+	fail = true
+	for i := 0; i < 2; i++ {
+		_, err := ts.Token(context.Background())
+		var authErr *AzureAuthError
+		if !errors.As(err, &authErr) {
+			t.Fatalf("expected the Azure error, got %v", err)
+		}
+	}
+	if calls != 3 {
+		t.Fatalf("expected every request to reach Azure, got %d calls", calls)
+	}
+	if !ts.breaker.Allow(time.Now()) {
+		t.Errorf("expected the circuit to stay closed")
+	}
+}
+
+func TestTokenServer_Metrics(t *testing.T) {
+	fail := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if fail {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"invalid_client","error_codes":[700016]}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"abc"}`))
+	}))
+	defer srv.Close()
+
+	args := Args{
+		OIDCToken:     testOIDCToken,
+		TenantID:      "12345678-1234-1234-1234-1234567890ab",
+		ClientID:      "12345678-1234-1234-1234-1234567890ab",
+		AuthorityHost: srv.URL,
+	}
+	ts := newTokenServer(context.Background(), args, new(Exchanger))
+	for i := 0; i < 2; i++ {
+		if _, err := ts.Token(context.Background()); err != nil {
+			t.Fatalf("Token returned error: %v", err)
+		}
+	}
+	fail = true
+	ts.last = nil
+	if _, err := ts.Token(context.Background()); err == nil {
+		t.Fatalf("expected an error")
+	}
+
+	rec := httptest.NewRecorder()
+	ts.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	for _, want := range []string{
+		"azure_oidc_exchanges_total 2\n",
+		"azure_oidc_exchange_failures_total{code=\"AADSTS700016\"} 1\n",
+		"azure_oidc_exchange_duration_seconds_count 2\n",
+		"azure_oidc_cache_hits_total 1\n",
+		"azure_oidc_cache_misses_total 2\n",
+	} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("metrics missing %q:\n%s", want, rec.Body.String())
+		}
+	}
+}
+
+func TestTokenServer_SharedExchange(t *testing.T) {
+	var calls int32
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-release
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"abc"}`))
+	}))
+	defer srv.Close()
+
+	args := Args{
+		OIDCToken:        testOIDCToken,
+		TenantID:         "12345678-1234-1234-1234-1234567890ab",
+		ClientID:         "12345678-1234-1234-1234-1234567890ab",
+		AuthorityHost:    srv.URL,
+		BreakerThreshold: 1,
+		BreakerCooldown:  time.Hour,
+	}
+	ts := newTokenServer(context.Background(), args, new(Exchanger))
+
+	// a client that gives up does not cancel the exchange or trip
+	// the circuit breaker
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := ts.Token(ctx); err != context.Canceled {
+		t.Fatalf("expected context canceled, got %v", err)
+	}
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := ts.Token(context.Background())
+			errs <- err
+		}()
+	}
+	time.Sleep(50 * time.Millisecond)
+	close(release)
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatalf("Token returned error: %v", err)
+		}
+	}
+	if got := atomic.LoadInt32(&calls); got != 1 {
+		t.Errorf("expected a single shared exchange, got %d", got)
+	}
+}
+
+func TestVerifyServeAddr(t *testing.T) {
+	tests := []struct {
+		addr    string
+		wantErr bool
+	}{
+		{addr: ""},
+		{addr: "127.0.0.1:8181"},
+		{addr: "[::1]:8181"},
+		{addr: "localhost:8181"},
+		{addr: ":8181", wantErr: true},
+		{addr: "0.0.0.0:8181", wantErr: true},
+		{addr: "10.0.0.5:8181", wantErr: true},
+		{addr: "127.0.0.1", wantErr: true},
+	}
+	for _, test := range tests {
+		if err := verifyServeAddr(test.addr); (err != nil) != test.wantErr {
+			t.Errorf("verifyServeAddr(%q) error = %v, wantErr %v", test.addr, err, test.wantErr)
+		}
+	}
+}
@@ -0,0 +1,230 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+// settingsEnv is the variable holding the settings as a single JSON
+// object, as passed by some step templates.
+const settingsEnv = "PLUGIN_SETTINGS"
+
+// ApplySettings sets the PLUGIN_* variables from the JSON object in
+// PLUGIN_SETTINGS, so the settings can be processed as if they were
+// passed individually. Variables that are already set take
+// precedence. It returns the JSON key of every variable it set.
+func ApplySettings() (map[string]string, error) {
+	value := strings.TrimSpace(os.Getenv(settingsEnv))
+	if value == "" {
+		return nil, nil
+	}
+	decoder := json.NewDecoder(strings.NewReader(value))
+	decoder.UseNumber()
+	var settings map[string]interface{}
+	if err := decoder.Decode(&settings); err != nil {
+		return nil, configError(fmt.Errorf("%s must be a JSON object: %w", settingsEnv, err))
+	}
+
+	known := settingsKeys()
+	keys := make([]string, 0, len(settings))
+	for key := range settings {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	applied := map[string]string{}
+	for _, key := range keys {
+		name := "PLUGIN_" + strings.ToUpper(strings.ReplaceAll(key, "-", "_"))
+		if !known[name] {
+			return nil, configError(fmt.Errorf("%s: unknown setting %q", settingsEnv, key))
+		}
+		if settings[key] == nil || os.Getenv(name) != "" {
+			continue
+		}
+		value, err := settingValue(settings[key])
+		if err != nil {
+			return nil, configError(fmt.Errorf("%s: setting %q: %w", settingsEnv, key, err))
+		}
+		if err := os.Setenv(name, value); err != nil {
+			return nil, err
+		}
+		applied[name] = key
+	}
+	return applied, nil
+}
+
+// settingAliases maps PLUGIN_* variables to the variables used by
+// other Azure tooling, such as the Azure SDKs and the Azure CLI.
+var settingAliases = [][2]string{
+	{"PLUGIN_TENANT_ID", "AZURE_TENANT_ID"},
+	{"PLUGIN_CLIENT_ID", "AZURE_CLIENT_ID"},
+	{"PLUGIN_AZURE_AUTHORITY_HOST", "AZURE_AUTHORITY_HOST"},
+}
+
+// ApplyAliases sets the PLUGIN_* variables that are not set from the
+// AZURE_* variables used by other Azure tooling, so step templates
+// can reuse their environment. It returns the alias of every
+// variable it set.
+func ApplyAliases() map[string]string {
+	applied := map[string]string{}
+	for _, alias := range settingAliases {
+		if os.Getenv(alias[0]) != "" {
+			continue
+		}
+		if value := os.Getenv(alias[1]); value != "" {
+			os.Setenv(alias[0], value)
+			applied[alias[0]] = alias[1]
+		}
+	}
+	return applied
+}
+
+// SettingsError returns the error processing the settings as a
+// ConfigError, naming the JSON key of the setting that failed to
+// parse when the variable was set from PLUGIN_SETTINGS.
+func SettingsError(err error, applied map[string]string) error {
+	var parseErr *envconfig.ParseError
+	if errors.As(err, &parseErr) {
+		if key, ok := applied[parseErr.KeyName]; ok {
+			return configError(fmt.Errorf("%s: setting %q: %w", settingsEnv, key, parseErr.Err))
+		}
+	}
+	return configError(err)
+}
+
+// CheckUnknownSettings returns an error naming the PLUGIN_* variables
+// that are not settings of the plugin, with the closest setting as a
+// suggestion, so a misnamed setting such as PLUGIN_TENANT fails the
+// step instead of surfacing as a setting that is not provided.
+func CheckUnknownSettings() error {
+	known := settingsKeys()
+	known[settingsEnv] = true
+	var unknown []string
+	for _, env := range os.Environ() {
+		name, _, _ := strings.Cut(env, "=")
+		name = strings.ToUpper(name)
+		if !strings.HasPrefix(name, "PLUGIN_") || known[name] {
+			continue
+		}
+		if suggestion := closestSetting(name, known); suggestion != "" {
+			name += " (did you mean " + suggestion + "?)"
+		}
+		unknown = append(unknown, name)
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	return configError(fmt.Errorf("unknown settings: %s", strings.Join(unknown, ", ")))
+}
+
+// closestSetting returns the known setting with the smallest edit
+// distance to the name, or an empty string when none is close.
+func closestSetting(name string, known map[string]bool) string {
+	keys := make([]string, 0, len(known))
+	for key := range known {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	best, bestDistance := "", 4
+	for _, key := range keys {
+		if d := editDistance(name, key); d < bestDistance {
+			best, bestDistance = key, d
+		}
+	}
+	return best
+}
+
+// editDistance returns the Levenshtein distance of the strings.
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		curr := make([]int, len(b)+1)
+		curr[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			curr[j] = min(prev[j]+1, curr[j-1]+1, prev[j-1]+cost)
+		}
+		prev = curr
+	}
+	return prev[len(b)]
+}
+
+// settingValue converts a JSON value to its environment variable
+// form. Lists of scalars are comma-separated, while objects and
+// lists of objects are passed as JSON.
+func settingValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		return fmt.Sprint(v), nil
+	case json.Number:
+		return v.String(), nil
+	case []interface{}:
+		items := make([]string, 0, len(v))
+		for _, item := range v {
+			switch item.(type) {
+			case string, bool, json.Number:
+				s, _ := settingValue(item)
+				items = append(items, s)
+			default:
+				return encodeSetting(v)
+			}
+		}
+		return strings.Join(items, ","), nil
+	case map[string]interface{}:
+		return encodeSetting(v)
+	}
+	return "", fmt.Errorf("unsupported value %v", value)
+}
+
+func encodeSetting(v interface{}) (string, error) {
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(v); err != nil {
+		return "", err
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// settingsKeys returns the PLUGIN_* variables of the plugin
+// arguments.
+func settingsKeys() map[string]bool {
+	keys := map[string]bool{}
+	var walk func(t reflect.Type)
+	walk = func(t reflect.Type) {
+		for i := 0; i < t.NumField(); i++ {
+			field := t.Field(i)
+			if tag := field.Tag.Get("envconfig"); tag != "" {
+				if strings.HasPrefix(tag, "PLUGIN_") {
+					keys[tag] = true
+				}
+				continue
+			}
+			if field.Type.Kind() == reflect.Struct {
+				walk(field.Type)
+			}
+		}
+	}
+	walk(reflect.TypeOf(Args{}))
+	return keys
+}
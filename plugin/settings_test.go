@@ -0,0 +1,161 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/kelseyhightower/envconfig"
+)
+
+func TestApplySettings(t *testing.T) {
+	unsetEnv(t, "PLUGIN_TENANT_ID", "PLUGIN_ALLOWED_ISSUERS", "PLUGIN_IDENTITIES", "PLUGIN_CACHE", "PLUGIN_CONCURRENCY", "PLUGIN_TIMEOUT")
+	t.Setenv("PLUGIN_CLIENT_ID", "00000000-0000-0000-0000-000000000002")
+	t.Setenv("PLUGIN_SETTINGS", `{
+		"tenant_id": "12345678-1234-1234-1234-1234567890ab",
+		"client-id": "00000000-0000-0000-0000-000000000001",
+		"allowed_issuers": ["https://a.example.com", "https://b.example.com"],
+		"identities": [{"alias": "reader", "scope": "https://vault.azure.net/.default"}],
+		"cache": true,
+		"concurrency": 2,
+		"timeout": null
+	}`)
+
+	applied, err := ApplySettings()
+	if err != nil {
+		t.Fatalf("ApplySettings returned error: %v", err)
+	}
+	var args Args
+	if err := envconfig.Process("", &args); err != nil {
+		t.Fatalf("envconfig.Process returned error: %v", err)
+	}
+	if args.TenantID != "12345678-1234-1234-1234-1234567890ab" {
+		t.Errorf("unexpected tenant %q", args.TenantID)
+	}
+	// individual variables take precedence over the settings
+	if args.ClientID != "00000000-0000-0000-0000-000000000002" {
+		t.Errorf("unexpected client %q", args.ClientID)
+	}
+	if len(args.AllowedIssuers) != 2 || args.AllowedIssuers[1] != "https://b.example.com" {
+		t.Errorf("unexpected allowed issuers %v", args.AllowedIssuers)
+	}
+	if len(args.Identities) != 1 || args.Identities[0].Alias != "reader" {
+		t.Errorf("unexpected identities %v", args.Identities)
+	}
+	if !args.Cache || args.Concurrency != 2 || args.Timeout != 0 {
+		t.Errorf("unexpected args %+v", args)
+	}
+	if applied["PLUGIN_TENANT_ID"] != "tenant_id" || applied["PLUGIN_CLIENT_ID"] != "" {
+		t.Errorf("unexpected applied settings %v", applied)
+	}
+}
+
+func TestApplySettings_Errors(t *testing.T) {
+	unsetEnv(t, "PLUGIN_TENANT_ID", "PLUGIN_ALLOWED_ISSUERS", "PLUGIN_LOG_LEVEL")
+	for value, want := range map[string]string{
+		`["tenant_id"]`:                    `must be a JSON object`,
+		`{"tenant":"x"}`:                   `unknown setting "tenant"`,
+		`{"allowed_issuers":[["x"]]}`:      ``,
+		`{"tenant_id":{"id":"x"}}`:         ``,
+		`{"log_level":"debug","oidc":"x"}`: `unknown setting "oidc"`,
+	} {
+		t.Setenv("PLUGIN_SETTINGS", value)
+		_, err := ApplySettings()
+		if want == "" {
+			if err != nil {
+				t.Errorf("ApplySettings(%s) returned error: %v", value, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("ApplySettings(%s) error = %v, want %q", value, err, want)
+		}
+	}
+}
+
+func TestSettingsError(t *testing.T) {
+	unsetEnv(t, "PLUGIN_CONCURRENCY")
+	t.Setenv("PLUGIN_SETTINGS", `{"concurrency": "many"}`)
+	applied, err := ApplySettings()
+	if err != nil {
+		t.Fatalf("ApplySettings returned error: %v", err)
+	}
+
+	var args Args
+	err = SettingsError(envconfig.Process("", &args), applied)
+	if err == nil || !strings.Contains(err.Error(), `setting "concurrency"`) {
+		t.Fatalf("expected error naming the setting, got %v", err)
+	}
+}
+
+func TestApplyAliases(t *testing.T) {
+	unsetEnv(t, "PLUGIN_TENANT_ID", "PLUGIN_CLIENT_ID", "PLUGIN_AZURE_AUTHORITY_HOST", "AZURE_AUTHORITY_HOST", "PLUGIN_SETTINGS")
+	t.Setenv("AZURE_TENANT_ID", "12345678-1234-1234-1234-1234567890ab")
+	t.Setenv("AZURE_CLIENT_ID", "00000000-0000-0000-0000-000000000001")
+	t.Setenv("PLUGIN_SETTINGS", `{"client_id": "00000000-0000-0000-0000-000000000002"}`)
+
+	if _, err := ApplySettings(); err != nil {
+		t.Fatalf("ApplySettings returned error: %v", err)
+	}
+	applied := ApplyAliases()
+	var args Args
+	if err := envconfig.Process("", &args); err != nil {
+		t.Fatalf("envconfig.Process returned error: %v", err)
+	}
+	if args.TenantID != "12345678-1234-1234-1234-1234567890ab" {
+		t.Errorf("unexpected tenant %q", args.TenantID)
+	}
+	// plugin settings take precedence over the aliases
+	if args.ClientID != "00000000-0000-0000-0000-000000000002" {
+		t.Errorf("unexpected client %q", args.ClientID)
+	}
+	if args.AuthorityHost != "" {
+		t.Errorf("unexpected authority host %q", args.AuthorityHost)
+	}
+	if len(applied) != 1 || applied["PLUGIN_TENANT_ID"] != "AZURE_TENANT_ID" {
+		t.Errorf("unexpected aliases applied %v", applied)
+	}
+}
+
+// unsetEnv unsets the variables for the test, restoring them when
+// the test completes.
+func unsetEnv(t *testing.T, keys ...string) {
+	t.Helper()
+	for _, key := range keys {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+}
+
+func TestCheckUnknownSettings(t *testing.T) {
+	for _, env := range os.Environ() {
+		if name, _, _ := strings.Cut(env, "="); strings.HasPrefix(name, "PLUGIN_") {
+			unsetEnv(t, name)
+		}
+	}
+	t.Setenv("PLUGIN_TENANT_ID", "12345678-1234-1234-1234-1234567890ab")
+	t.Setenv("PLUGIN_SETTINGS", `{}`)
+	t.Setenv("PLUGIN_STRICT", "true")
+	if err := CheckUnknownSettings(); err != nil {
+		t.Fatalf("CheckUnknownSettings returned error: %v", err)
+	}
+
+	t.Setenv("PLUGIN_TENANT", "12345678-1234-1234-1234-1234567890ab")
+	t.Setenv("PLUGIN_CLEINT_ID", "00000000-0000-0000-0000-000000000001")
+	t.Setenv("PLUGIN_SOMETHING_ELSE_ENTIRELY", "x")
+	err := CheckUnknownSettings()
+	if err == nil {
+		t.Fatal("expected an error for unknown settings")
+	}
+	for _, want := range []string{
+		"PLUGIN_CLEINT_ID (did you mean PLUGIN_CLIENT_ID?)",
+		"PLUGIN_SOMETHING_ELSE_ENTIRELY,",
+		"PLUGIN_TENANT (did you mean PLUGIN_TENANT_ID?)",
+	} {
+		if !strings.Contains(err.Error(), want) {
+			t.Errorf("error %q does not contain %q", err, want)
+		}
+	}
+}
@@ -0,0 +1,62 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"regexp"
+
+	"github.com/harness-community/drone-azure-oidc/pkg/azuread"
+)
+
+// staticSitePattern matches the resource ID of a static web app.
+var staticSitePattern = regexp.MustCompile(`(?i)^/subscriptions/[^/]+/resourceGroups/[^/]+/providers/Microsoft\.Web/staticSites/[^/]+$`)
+
+// verifyStaticWebApp validates the resource ID of the static web app.
+func verifyStaticWebApp(resourceID string) error {
+	if !staticSitePattern.MatchString(resourceID) {
+		return fmt.Errorf("invalid static-web-app %q, expected a resource ID such as /subscriptions/{subscription}/resourceGroups/{group}/providers/Microsoft.Web/staticSites/{name}", resourceID)
+	}
+	return nil
+}
+
+// writeStaticWebAppToken fetches the deployment token of the static
+// web app and writes it to the secret output file as
+// AZURE_STATIC_WEB_APPS_API_TOKEN, the name read by the Static Web
+// Apps deploy action and CLI, so deployments work without a stored
+// token.
+func writeStaticWebAppToken(ctx context.Context, args Args, client *http.Client, token *AzureTokenResponse) error {
+	scope := args.Scope
+	if scope == "" {
+		scope = defaultScope
+	}
+	endpoint, err := resourceManagerEndpoint(scope)
+	if err != nil {
+		return fmt.Errorf("static-web-app requires a Resource Manager scope such as %s", defaultScope)
+	}
+	address := endpoint + args.StaticWebApp + "/listSecrets?api-version=" + webAppsAPIVersion
+	if err := azuread.CheckEndpoint(address, nil); err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+	ctx, span := startSpan(ctx, "static_web_app_token")
+	var secrets struct {
+		Properties struct {
+			APIKey string `json:"apiKey"`
+		} `json:"properties"`
+	}
+	err = postJSON(ctx, client, address, token.AccessToken, &secrets)
+	span.End(err)
+	if err != nil {
+		return fmt.Errorf("failed to read the deployment token of static web app %s: %w", args.StaticWebApp, err)
+	}
+	if secrets.Properties.APIKey == "" {
+		return fmt.Errorf("static web app %s returned no deployment token", args.StaticWebApp)
+	}
+	redactSecret(secrets.Properties.APIKey)
+	return secretOutput(ctx, args).Write("AZURE_STATIC_WEB_APPS_API_TOKEN", secrets.Properties.APIKey)
+}
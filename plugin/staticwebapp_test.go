@@ -0,0 +1,45 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteStaticWebAppToken(t *testing.T) {
+	resourceID := "/subscriptions/11111111-1111-1111-1111-111111111111/resourceGroups/web/providers/Microsoft.Web/staticSites/docs"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost || r.Header.Get("Authorization") != "Bearer arm-token" || r.URL.Path != resourceID+"/listSecrets" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"properties":{"apiKey":"swa-deployment-token"}}`))
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	t.Setenv("HARNESS_OUTPUT_SECRET_FILE", filepath.Join(dir, "secret.env"))
+
+	args := Args{Scope: srv.URL + "/.default", StaticWebApp: resourceID}
+	token := &AzureTokenResponse{AccessToken: "arm-token"}
+	if err := writeStaticWebAppToken(context.Background(), args, srv.Client(), token); err != nil {
+		t.Fatalf("writeStaticWebAppToken returned error: %v", err)
+	}
+	secrets, _ := readOutputFile(filepath.Join(dir, "secret.env"))
+	if secrets["AZURE_STATIC_WEB_APPS_API_TOKEN"] != "swa-deployment-token" {
+		t.Errorf("unexpected secret outputs %v", secrets)
+	}
+
+	args.StaticWebApp = "/subscriptions/11111111-1111-1111-1111-111111111111/resourceGroups/web/providers/Microsoft.Web/staticSites/missing"
+	if err := writeStaticWebAppToken(context.Background(), args, srv.Client(), token); err == nil {
+		t.Errorf("expected error for a missing static web app")
+	}
+	if err := verifyStaticWebApp("docs"); err == nil {
+		t.Errorf("expected error for a name instead of a resource ID")
+	}
+}
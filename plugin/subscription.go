@@ -0,0 +1,102 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/harness-community/drone-azure-oidc/pkg/azuread"
+)
+
+// resourceManagerEndpoints maps the authority host of each national
+// cloud to its Resource Manager endpoint.
+var resourceManagerEndpoints = map[string]string{
+	"login.microsoftonline.com": "https://management.azure.com",
+	"login.microsoftonline.us":  "https://management.usgovcloudapi.net",
+	"login.chinacloudapi.cn":    "https://management.chinacloudapi.cn",
+}
+
+// discoveryEndpoint returns the Resource Manager endpoint used for
+// tenant discovery: the endpoint of a Resource Manager scope, or the
+// endpoint of the cloud of the authority host.
+func discoveryEndpoint(args Args) string {
+	if args.Scope != "" {
+		if endpoint, err := resourceManagerEndpoint(args.Scope); err == nil {
+			return endpoint
+		}
+	}
+	for _, host := range azuread.SplitAuthorityHosts(args.AuthorityHost) {
+		u, err := url.Parse(host)
+		if err != nil {
+			continue
+		}
+		if endpoint, ok := resourceManagerEndpoints[strings.ToLower(u.Hostname())]; ok {
+			return endpoint
+		}
+	}
+	return strings.TrimSuffix(defaultScope, "/.default")
+}
+
+// discoverTenant returns the tenant owning the subscription. An
+// unauthenticated Resource Manager request is challenged with a
+// WWW-Authenticate header naming the tenant's authorization URI.
+func discoverTenant(ctx context.Context, client *http.Client, args Args) (string, error) {
+	address := discoveryEndpoint(args) + "/subscriptions/" + url.PathEscape(args.SubscriptionID) + "?api-version=" + subscriptionsAPIVersion
+	if err := azuread.CheckEndpoint(address, nil); err != nil {
+		return "", err
+	}
+	ctx, cancel := context.WithTimeout(ctx, defaultTimeout)
+	defer cancel()
+	ctx, span := startSpan(ctx, "discover_tenant")
+	tenant, err := func() (string, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, address, nil)
+		if err != nil {
+			return "", err
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return "", &NetworkError{Err: err}
+		}
+		defer drainAndClose(resp.Body)
+		if resp.StatusCode != http.StatusUnauthorized {
+			return "", fmt.Errorf("unexpected status %s", resp.Status)
+		}
+		return parseChallengeTenant(resp.Header.Get("WWW-Authenticate"))
+	}()
+	span.End(err)
+	if err != nil {
+		return "", fmt.Errorf("failed to discover the tenant of subscription %s: %w", args.SubscriptionID, err)
+	}
+	logger(ctx).Infof("subscription %s belongs to tenant %s", args.SubscriptionID, tenant)
+	return tenant, nil
+}
+
+// parseChallengeTenant returns the tenant ID from the
+// authorization_uri parameter of a Bearer challenge, such as
+// Bearer authorization_uri="https://login.windows.net/<tenant>".
+func parseChallengeTenant(challenge string) (string, error) {
+	scheme, params, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	if !strings.EqualFold(scheme, "Bearer") {
+		return "", fmt.Errorf("unexpected authentication challenge %q", challenge)
+	}
+	for _, param := range strings.Split(params, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(param), "=")
+		if !ok || !strings.EqualFold(key, "authorization_uri") {
+			continue
+		}
+		u, err := url.Parse(strings.Trim(value, `"`))
+		if err != nil {
+			break
+		}
+		tenant := strings.Trim(u.Path, "/")
+		if err := validateGUID(tenant, "tenant-id"); err != nil {
+			return "", fmt.Errorf("challenge has an unexpected authorization_uri %q", u)
+		}
+		return tenant, nil
+	}
+	return "", fmt.Errorf("challenge has no authorization_uri")
+}
@@ -0,0 +1,73 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestExec_DiscoverTenant(t *testing.T) {
+	const tenant = "87654321-4321-4321-4321-ba0987654321"
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/subscriptions/11111111-1111-1111-1111-111111111111":
+			if r.Header.Get("Authorization") != "" {
+				t.Errorf("discovery request must be unauthenticated")
+			}
+			w.Header().Set("WWW-Authenticate", `Bearer authorization_uri="https://login.windows.net/`+tenant+`", error="invalid_token", error_description="The authentication failed because of missing 'Authorization' header."`)
+			w.WriteHeader(http.StatusUnauthorized)
+		case "/" + tenant + "/oauth2/v2.0/token":
+			w.Header().Set("Content-Type", "application/json")
+			_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"arm-token"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	outPath := filepath.Join(t.TempDir(), "out.env")
+	t.Setenv("HARNESS_OUTPUT_SECRET_FILE", outPath)
+
+	args := Args{
+		OIDCToken:      testOIDCToken,
+		ClientID:       "00000000-0000-0000-0000-000000000001",
+		SubscriptionID: "11111111-1111-1111-1111-111111111111",
+		Scope:          srv.URL + "/.default",
+		AuthorityHost:  srv.URL,
+	}
+	if err := Exec(context.Background(), args); err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+	data, _ := os.ReadFile(outPath)
+	if !strings.Contains(string(data), "AZURE_ACCESS_TOKEN=arm-token\n") {
+		t.Fatalf("unexpected outputs %q", data)
+	}
+
+	args.SubscriptionID = "22222222-2222-2222-2222-222222222222"
+	if err := Exec(context.Background(), args); err == nil || !strings.Contains(err.Error(), "failed to discover the tenant") {
+		t.Fatalf("expected discovery error, got %v", err)
+	}
+}
+
+func TestParseChallengeTenant(t *testing.T) {
+	tenant, err := parseChallengeTenant(`Bearer authorization_uri="https://login.microsoftonline.us/87654321-4321-4321-4321-ba0987654321", error="invalid_token"`)
+	if err != nil || tenant != "87654321-4321-4321-4321-ba0987654321" {
+		t.Fatalf("unexpected tenant %q, error %v", tenant, err)
+	}
+	for _, challenge := range []string{
+		"",
+		`Basic realm="x"`,
+		`Bearer error="invalid_token"`,
+		`Bearer authorization_uri="https://login.windows.net/common"`,
+	} {
+		if _, err := parseChallengeTenant(challenge); err == nil {
+			t.Errorf("expected error for %q", challenge)
+		}
+	}
+}
@@ -0,0 +1,43 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// exchangeStats records the duration and number of token requests
+// of an exchange.
+type exchangeStats struct {
+	start    time.Time
+	duration time.Duration
+	attempts int32
+}
+
+type statsKey struct{}
+
+// withExchangeStats returns a context that records the token requests
+// made with it in the returned stats.
+func withExchangeStats(ctx context.Context) (context.Context, *exchangeStats) {
+	stats := &exchangeStats{start: time.Now()}
+	return context.WithValue(ctx, statsKey{}, stats), stats
+}
+
+// countAttempt records a token request made with the context.
+func countAttempt(ctx context.Context) {
+	if stats, ok := ctx.Value(statsKey{}).(*exchangeStats); ok {
+		atomic.AddInt32(&stats.attempts, 1)
+	}
+}
+
+// Stop records the duration of the exchange.
+func (s *exchangeStats) Stop() {
+	s.duration = time.Since(s.start)
+}
+
+// Attempts returns the number of token requests made.
+func (s *exchangeStats) Attempts() int {
+	return int(atomic.LoadInt32(&s.attempts))
+}
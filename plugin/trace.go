@@ -0,0 +1,298 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultServiceName is the service name reported with spans.
+const defaultServiceName = "drone-azure-oidc"
+
+// traceExportTimeout bounds the export of spans to the collector.
+const traceExportTimeout = 5 * time.Second
+
+// tracer records spans and exports them to an OTLP/HTTP collector
+// using the JSON encoding. A nil tracer records nothing.
+type tracer struct {
+	endpoint string
+	headers  map[string]string
+	service  string
+	traceID  [16]byte
+	parentID [8]byte
+
+	mu    sync.Mutex
+	spans []*span
+}
+
+// span is a timed operation within the trace.
+type span struct {
+	tracer   *tracer
+	name     string
+	spanID   [8]byte
+	parentID [8]byte
+	start    time.Time
+	end      time.Time
+	attrs    map[string]interface{}
+	err      error
+}
+
+type tracerKey struct{}
+type spanKey struct{}
+
+// newTracerFromEnv returns a tracer configured from the standard
+// OpenTelemetry environment variables, or nil when no OTLP endpoint
+// is configured. A W3C TRACEPARENT links the spans to the caller's
+// trace.
+func newTracerFromEnv() *tracer {
+	endpoint := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if endpoint == "" {
+		base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+		if base == "" {
+			return nil
+		}
+		endpoint = strings.TrimRight(base, "/") + "/v1/traces"
+	}
+
+	t := &tracer{
+		endpoint: endpoint,
+		headers:  parseOTLPHeaders(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS")),
+		service:  os.Getenv("OTEL_SERVICE_NAME"),
+	}
+	if t.service == "" {
+		t.service = defaultServiceName
+	}
+	if traceID, parentID, ok := parseTraceparent(os.Getenv("TRACEPARENT")); ok {
+		t.traceID, t.parentID = traceID, parentID
+	} else {
+		_, _ = rand.Read(t.traceID[:])
+	}
+	return t
+}
+
+// parseOTLPHeaders parses a comma-separated list of key=value pairs.
+func parseOTLPHeaders(value string) map[string]string {
+	headers := map[string]string{}
+	for _, pair := range strings.Split(value, ",") {
+		key, val, ok := strings.Cut(pair, "=")
+		if !ok || strings.TrimSpace(key) == "" {
+			continue
+		}
+		headers[strings.TrimSpace(key)] = strings.TrimSpace(val)
+	}
+	return headers
+}
+
+// parseTraceparent parses a W3C trace context traceparent header.
+func parseTraceparent(value string) (traceID [16]byte, parentID [8]byte, ok bool) {
+	parts := strings.Split(strings.TrimSpace(value), "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return traceID, parentID, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, parentID, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil {
+		return traceID, parentID, false
+	}
+	return traceID, parentID, traceID != [16]byte{}
+}
+
+// withTracer returns a context that records spans with the tracer.
+func withTracer(ctx context.Context, t *tracer) context.Context {
+	if t == nil {
+		return ctx
+	}
+	return context.WithValue(ctx, tracerKey{}, t)
+}
+
+// startSpan starts a span as a child of the span in the context. It
+// returns a nil span, which is safe to use, when tracing is disabled.
+func startSpan(ctx context.Context, name string) (context.Context, *span) {
+	t, _ := ctx.Value(tracerKey{}).(*tracer)
+	if t == nil {
+		return ctx, nil
+	}
+	s := &span{
+		tracer:   t,
+		name:     name,
+		parentID: t.parentID,
+		start:    time.Now(),
+		attrs:    map[string]interface{}{},
+	}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok {
+		s.parentID = parent.spanID
+	}
+	_, _ = rand.Read(s.spanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// SetAttribute records an attribute on the span.
+func (s *span) SetAttribute(key string, value interface{}) {
+	if s == nil {
+		return
+	}
+	s.attrs[key] = value
+}
+
+// End completes the span, recording the error if any.
+func (s *span) End(err error) {
+	if s == nil {
+		return
+	}
+	s.end, s.err = time.Now(), err
+	s.tracer.mu.Lock()
+	s.tracer.spans = append(s.tracer.spans, s)
+	s.tracer.mu.Unlock()
+}
+
+// Export sends the completed spans to the collector. Export
+// failures are logged and do not fail the step.
+func (t *tracer) Export(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	t.mu.Lock()
+	spans := t.spans
+	t.spans = nil
+	t.mu.Unlock()
+	if len(spans) == 0 {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, traceExportTimeout)
+	defer cancel()
+	if err := t.export(ctx, spans); err != nil {
+		logrus.Warnf("failed to export trace spans: %s", err)
+	}
+}
+
+func (t *tracer) export(ctx context.Context, spans []*span) error {
+	data, err := json.Marshal(t.encode(spans))
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for key, value := range t.headers {
+		req.Header.Set(key, value)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer drainAndClose(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector returned %s", resp.Status)
+	}
+	return nil
+}
+
+// OTLP JSON encoding of the trace export request.
+type (
+	otlpExportRequest struct {
+		ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+	}
+	otlpResourceSpans struct {
+		Resource   otlpResource     `json:"resource"`
+		ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+	}
+	otlpResource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	}
+	otlpScopeSpans struct {
+		Scope otlpScope  `json:"scope"`
+		Spans []otlpSpan `json:"spans"`
+	}
+	otlpScope struct {
+		Name string `json:"name"`
+	}
+	otlpSpan struct {
+		TraceID           string         `json:"traceId"`
+		SpanID            string         `json:"spanId"`
+		ParentSpanID      string         `json:"parentSpanId,omitempty"`
+		Name              string         `json:"name"`
+		Kind              int            `json:"kind"`
+		StartTimeUnixNano string         `json:"startTimeUnixNano"`
+		EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+		Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+		Status            otlpStatus     `json:"status"`
+	}
+	otlpKeyValue struct {
+		Key   string                 `json:"key"`
+		Value map[string]interface{} `json:"value"`
+	}
+	otlpStatus struct {
+		Code    int    `json:"code"`
+		Message string `json:"message,omitempty"`
+	}
+)
+
+// span kinds and status codes defined by OTLP
+const (
+	otlpSpanKindInternal = 1
+	otlpStatusOK         = 1
+	otlpStatusError      = 2
+)
+
+func (t *tracer) encode(spans []*span) otlpExportRequest {
+	encoded := make([]otlpSpan, 0, len(spans))
+	for _, s := range spans {
+		out := otlpSpan{
+			TraceID:           hex.EncodeToString(t.traceID[:]),
+			SpanID:            hex.EncodeToString(s.spanID[:]),
+			Name:              s.name,
+			Kind:              otlpSpanKindInternal,
+			StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+			Status:            otlpStatus{Code: otlpStatusOK},
+		}
+		if s.parentID != [8]byte{} {
+			out.ParentSpanID = hex.EncodeToString(s.parentID[:])
+		}
+		for key, value := range s.attrs {
+			out.Attributes = append(out.Attributes, otlpAttribute(key, value))
+		}
+		if s.err != nil {
+			out.Status = otlpStatus{Code: otlpStatusError, Message: redactor.Redact(s.err.Error())}
+		}
+		encoded = append(encoded, out)
+	}
+	return otlpExportRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{Attributes: []otlpKeyValue{otlpAttribute("service.name", t.service)}},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: defaultServiceName},
+				Spans: encoded,
+			}},
+		}},
+	}
+}
+
+// otlpAttribute encodes an attribute as an OTLP AnyValue.
+func otlpAttribute(key string, value interface{}) otlpKeyValue {
+	switch v := value.(type) {
+	case int:
+		return otlpKeyValue{Key: key, Value: map[string]interface{}{"intValue": strconv.Itoa(v)}}
+	case bool:
+		return otlpKeyValue{Key: key, Value: map[string]interface{}{"boolValue": v}}
+	default:
+		return otlpKeyValue{Key: key, Value: map[string]interface{}{"stringValue": fmt.Sprint(v)}}
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+)
+
+func TestExec_Tracing(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"abc"}`))
+	}))
+	defer srv.Close()
+
+	exported := make(chan otlpExportRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/traces" || r.Header.Get("x-api-key") != "secret" {
+			t.Errorf("unexpected export request %s %v", r.URL.Path, r.Header)
+		}
+		var req otlpExportRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("failed to decode export request: %v", err)
+		}
+		exported <- req
+	}))
+	defer collector.Close()
+
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", collector.URL)
+	t.Setenv("OTEL_EXPORTER_OTLP_HEADERS", "x-api-key=secret")
+	t.Setenv("TRACEPARENT", "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+	t.Setenv("HARNESS_OUTPUT_SECRET_FILE", filepath.Join(t.TempDir(), "out.env"))
+
+	args := Args{
+		OIDCToken:     testOIDCToken,
+		TenantID:      "2d4b6c8e-1f3a-4b5c-9d7e-0a1b2c3d4e5f",
+		ClientID:      "8f7e6d5c-4b3a-4291-8e7f-6a5b4c3d2e1f",
+		AuthorityHost: srv.URL,
+	}
+	if err := Exec(context.Background(), args); err != nil {
+		t.Fatalf("Exec returned error: %v", err)
+	}
+
+	req := <-exported
+	spans := map[string]otlpSpan{}
+	for _, s := range req.ResourceSpans[0].ScopeSpans[0].Spans {
+		if s.TraceID != "4bf92f3577b34da6a3ce929d0e0e4736" {
+			t.Errorf("span %s has trace id %s", s.Name, s.TraceID)
+		}
+		spans[s.Name] = s
+	}
+	for _, name := range []string{"azure-oidc", "validate", "exchange", "attempt", "write_outputs"} {
+		if _, ok := spans[name]; !ok {
+			t.Fatalf("missing span %s in %v", name, spans)
+		}
+	}
+	if spans["azure-oidc"].ParentSpanID != "00f067aa0ba902b7" {
+		t.Errorf("root span is not linked to the traceparent")
+	}
+	if spans["attempt"].ParentSpanID != spans["exchange"].SpanID || spans["exchange"].ParentSpanID != spans["azure-oidc"].SpanID {
+		t.Errorf("unexpected span hierarchy: %v", spans)
+	}
+}
+
+func TestTracer_Disabled(t *testing.T) {
+	t.Setenv("OTEL_EXPORTER_OTLP_ENDPOINT", "")
+	t.Setenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT", "")
+	tracer := newTracerFromEnv()
+	if tracer != nil {
+		t.Fatalf("expected tracing to be disabled")
+	}
+
+	// a nil tracer and span are safe to use
+	ctx, span := startSpan(withTracer(context.Background(), tracer), "noop")
+	span.SetAttribute("key", "value")
+	span.End(nil)
+	tracer.Export(ctx)
+}
@@ -0,0 +1,390 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"golang.org/x/net/http/httpproxy"
+)
+
+// default settings for the shared HTTP transport
+const (
+	defaultDialTimeout         = 30 * time.Second
+	defaultTLSHandshakeTimeout = 10 * time.Second
+	defaultMaxIdleConns        = 32
+	defaultIdleConnTimeout     = 90 * time.Second
+)
+
+// Version is the plugin version reported in the User-Agent. It is
+// set at build time with -ldflags "-X ...plugin.Version=1.2.3".
+var Version = "dev"
+
+// clientSKU identifies the plugin in the x-client-SKU header.
+const clientSKU = "drone-azure-oidc"
+
+// transportOptions configures the shared HTTP transport. Zero
+// values select the defaults.
+type transportOptions struct {
+	DialTimeout           time.Duration
+	TLSHandshakeTimeout   time.Duration
+	ResponseHeaderTimeout time.Duration
+	MaxIdleConns          int
+
+	// HTTPSProxy or SocksProxy is the proxy used for token
+	// requests. When both are empty the standard proxy environment
+	// variables apply.
+	HTTPSProxy    string
+	SocksProxy    string
+	NoProxy       string
+	ProxyUsername string
+	ProxyPassword string
+
+	// CACert is a PEM bundle, or the path to one, appended to the
+	// system trust store.
+	CACert string
+
+	// TLSMinVersion is the minimum TLS version, 1.2 or 1.3.
+	TLSMinVersion string
+
+	// FIPSMode restricts TLS 1.2 cipher suites and curves to
+	// FIPS-approved algorithms.
+	FIPSMode bool
+
+	// InsecureSkipVerify disables certificate verification. It is
+	// intended for lab and mock endpoints only.
+	InsecureSkipVerify bool
+
+	// ClientCert and ClientKey are the PEM encoded certificate and
+	// key, or paths to them, presented for mutual TLS.
+	ClientCert string
+	ClientKey  string
+
+	// UserAgentSuffix is appended to the User-Agent, for example
+	// to identify the organization.
+	UserAgentSuffix string
+}
+
+// newTransportOptions returns the transport options for the
+// plugin arguments. Without an explicit or standard proxy
+// configuration, the Harness delegate proxy is used when present.
+func newTransportOptions(args Args) transportOptions {
+	opts := transportOptions{
+		DialTimeout:           args.DialTimeout,
+		TLSHandshakeTimeout:   args.TLSHandshakeTimeout,
+		ResponseHeaderTimeout: args.ResponseHeaderTimeout,
+		MaxIdleConns:          args.MaxIdleConns,
+		HTTPSProxy:            args.HTTPSProxy,
+		SocksProxy:            args.SocksProxy,
+		NoProxy:               args.NoProxy,
+		ProxyUsername:         args.ProxyUsername,
+		ProxyPassword:         args.ProxyPassword,
+		CACert:                args.CACert,
+		TLSMinVersion:         args.TLSMinVersion,
+		FIPSMode:              args.FIPSMode,
+		InsecureSkipVerify:    args.InsecureSkipVerify,
+		ClientCert:            args.ClientCert,
+		ClientKey:             args.ClientKey,
+		UserAgentSuffix:       args.UserAgentSuffix,
+	}
+	if opts.HTTPSProxy == "" && opts.SocksProxy == "" && !args.IgnoreDelegateProxy && !hasProxyEnv() {
+		applyDelegateProxy(&opts)
+	}
+	return opts
+}
+
+// hasProxyEnv reports whether the standard proxy environment
+// variables are set.
+func hasProxyEnv() bool {
+	for _, key := range []string{"HTTPS_PROXY", "https_proxy", "HTTP_PROXY", "http_proxy"} {
+		if os.Getenv(key) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// applyDelegateProxy configures the proxy from the PROXY_HOST,
+// PROXY_PORT, PROXY_SCHEME, PROXY_USER, PROXY_PASSWORD and NO_PROXY
+// variables of a Harness delegate, so steps behind a delegate proxy
+// need no proxy settings of their own.
+func applyDelegateProxy(opts *transportOptions) {
+	host := os.Getenv("PROXY_HOST")
+	if host == "" {
+		return
+	}
+	scheme := strings.ToLower(os.Getenv("PROXY_SCHEME"))
+	if scheme == "" {
+		scheme = "http"
+	}
+	address := host
+	if ip := net.ParseIP(host); ip != nil && ip.To4() == nil {
+		// an IPv6 literal must be bracketed in a URL
+		address = "[" + host + "]"
+	}
+	if port := os.Getenv("PROXY_PORT"); port != "" {
+		address = net.JoinHostPort(host, port)
+	}
+	proxy := scheme + "://" + address
+	if strings.HasPrefix(scheme, "socks5") {
+		opts.SocksProxy = proxy
+	} else {
+		opts.HTTPSProxy = proxy
+	}
+	if opts.NoProxy == "" {
+		opts.NoProxy = os.Getenv("NO_PROXY")
+	}
+	if opts.ProxyUsername == "" {
+		opts.ProxyUsername = os.Getenv("PROXY_USER")
+		opts.ProxyPassword = os.Getenv("PROXY_PASSWORD")
+		redactSecret(opts.ProxyPassword)
+	}
+	logrus.Infof("using the delegate proxy %s", proxy)
+}
+
+// newHTTPClient returns an HTTP client with a keep-alive transport
+// that pools connections, so a single client can be shared by all
+// token requests made during a run instead of paying for a new TLS
+// handshake on every exchange.
+func newHTTPClient(opts transportOptions) (*http.Client, error) {
+	dialTimeout := opts.DialTimeout
+	if dialTimeout <= 0 {
+		dialTimeout = defaultDialTimeout
+	}
+	maxIdleConns := opts.MaxIdleConns
+	if maxIdleConns <= 0 {
+		maxIdleConns = defaultMaxIdleConns
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.DialContext = newDialContext(dialTimeout)
+	transport.TLSHandshakeTimeout = defaultTLSHandshakeTimeout
+	if opts.TLSHandshakeTimeout > 0 {
+		transport.TLSHandshakeTimeout = opts.TLSHandshakeTimeout
+	}
+	transport.ResponseHeaderTimeout = opts.ResponseHeaderTimeout
+	transport.MaxIdleConns = maxIdleConns
+	transport.MaxIdleConnsPerHost = maxIdleConns
+	transport.IdleConnTimeout = defaultIdleConnTimeout
+	transport.ForceAttemptHTTP2 = true
+
+	tlsConfig, err := newTLSConfig(opts)
+	if err != nil {
+		return nil, err
+	}
+	transport.TLSClientConfig = tlsConfig
+
+	if opts.HTTPSProxy != "" || opts.SocksProxy != "" {
+		proxy, err := proxyFunc(opts)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = proxy
+	}
+	var base http.RoundTripper = transport
+	if logrus.IsLevelEnabled(logrus.TraceLevel) {
+		base = &dumpTransport{base: transport}
+	}
+	return &http.Client{Transport: &userAgentTransport{
+		base:      base,
+		userAgent: userAgent(opts.UserAgentSuffix),
+	}}, nil
+}
+
+// userAgent returns the User-Agent sent with every request.
+func userAgent(suffix string) string {
+	ua := clientSKU + "/" + Version
+	if suffix = strings.TrimSpace(suffix); suffix != "" {
+		ua += " " + suffix
+	}
+	return ua
+}
+
+// userAgentTransport identifies the plugin to Azure AD and egress
+// proxies with a User-Agent and MSAL-style client telemetry headers.
+type userAgentTransport struct {
+	base      http.RoundTripper
+	userAgent string
+}
+
+// RoundTrip implements the http.RoundTripper interface.
+func (t *userAgentTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("User-Agent", t.userAgent)
+	req.Header.Set("x-client-SKU", clientSKU)
+	req.Header.Set("x-client-VER", Version)
+	req.Header.Set("x-client-OS", runtime.GOOS)
+	return t.base.RoundTrip(req)
+}
+
+// proxyFunc returns a proxy selection function for the explicitly
+// configured HTTP or SOCKS5 proxy, honoring the no-proxy list and
+// embedding the proxy credentials for authentication.
+func proxyFunc(opts transportOptions) (func(*http.Request) (*url.URL, error), error) {
+	raw, name, scheme := opts.HTTPSProxy, "https-proxy", "http"
+	if opts.SocksProxy != "" {
+		raw, name, scheme = opts.SocksProxy, "socks-proxy", "socks5"
+	}
+	if !strings.Contains(raw, "://") {
+		raw = scheme + "://" + raw
+	}
+	proxyURL, err := url.Parse(raw)
+	if err != nil || proxyURL.Host == "" {
+		return nil, fmt.Errorf("%s must be a valid proxy URL", name)
+	}
+	if opts.SocksProxy != "" {
+		// the SOCKS5 dialer always resolves host names through the
+		// proxy, so socks5h is equivalent to socks5.
+		if proxyURL.Scheme != "socks5" && proxyURL.Scheme != "socks5h" {
+			return nil, fmt.Errorf("socks-proxy must use the socks5 scheme")
+		}
+		proxyURL.Scheme = "socks5"
+	}
+	if opts.ProxyUsername != "" {
+		proxyURL.User = url.UserPassword(opts.ProxyUsername, opts.ProxyPassword)
+	}
+
+	config := &httpproxy.Config{
+		HTTPProxy:  proxyURL.String(),
+		HTTPSProxy: proxyURL.String(),
+		NoProxy:    opts.NoProxy,
+	}
+	selectProxy := config.ProxyFunc()
+	return func(req *http.Request) (*url.URL, error) {
+		return selectProxy(req.URL)
+	}, nil
+}
+
+// newTLSConfig returns the TLS configuration for the transport.
+func newTLSConfig(opts transportOptions) (*tls.Config, error) {
+	minVersion, err := parseTLSVersion(opts.TLSMinVersion)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{MinVersion: minVersion}
+	if opts.FIPSMode {
+		if minVersion > tls.VersionTLS12 {
+			return nil, errFIPSTLS13
+		}
+		config.MaxVersion = tls.VersionTLS12
+		config.CipherSuites = fipsCipherSuites
+		config.CurvePreferences = []tls.CurveID{tls.CurveP256, tls.CurveP384}
+	}
+	if opts.CACert != "" {
+		data, err := loadPEM(opts.CACert)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load ca-cert: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(data) {
+			return nil, fmt.Errorf("ca-cert does not contain any PEM encoded certificates")
+		}
+		config.RootCAs = pool
+	}
+	if opts.ClientCert != "" || opts.ClientKey != "" {
+		cert, err := loadClientCertificate(opts.ClientCert, opts.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if opts.InsecureSkipVerify {
+		logrus.Warnln("WARNING: TLS certificate verification is disabled (insecure_skip_verify).")
+		logrus.Warnln("WARNING: the OIDC assertion and access token can be intercepted. Do not use this setting in production.")
+		config.InsecureSkipVerify = true
+	}
+	return config, nil
+}
+
+// errFIPSTLS13 is returned when TLS 1.3 is required in FIPS mode.
+var errFIPSTLS13 = errors.New("tls-min-version 1.3 is not supported with fips-mode")
+
+// fipsCipherSuites are the FIPS-approved TLS 1.2 cipher suites. The
+// TLS 1.3 suites cannot be configured and include
+// TLS_CHACHA20_POLY1305_SHA256, which is not FIPS-approved, so FIPS
+// mode is limited to TLS 1.2.
+var fipsCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+// verifyTLSVersion validates the minimum TLS version, which FIPS
+// mode limits to TLS 1.2.
+func verifyTLSVersion(args Args) error {
+	version, err := parseTLSVersion(args.TLSMinVersion)
+	if err != nil {
+		return err
+	}
+	if args.FIPSMode && version > tls.VersionTLS12 {
+		return errFIPSTLS13
+	}
+	return nil
+}
+
+// parseTLSVersion returns the TLS version for the setting value.
+// TLS 1.2 is the minimum when the value is empty.
+func parseTLSVersion(value string) (uint16, error) {
+	switch strings.TrimPrefix(strings.ToLower(value), "tls") {
+	case "", "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	default:
+		return 0, fmt.Errorf("tls-min-version must be 1.2 or 1.3")
+	}
+}
+
+// loadClientCertificate loads the client certificate and key used
+// for mutual TLS.
+func loadClientCertificate(certValue, keyValue string) (tls.Certificate, error) {
+	if certValue == "" || keyValue == "" {
+		return tls.Certificate{}, fmt.Errorf("client-cert and client-key must be provided together")
+	}
+	certPEM, err := loadPEM(certValue)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to load client-cert: %w", err)
+	}
+	keyPEM, err := loadPEM(keyValue)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to load client-key: %w", err)
+	}
+	defer wipe(keyPEM)
+	cert, err := tls.X509KeyPair(certPEM, keyPEM)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("invalid client certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// loadPEM returns inline PEM data as is, and otherwise reads the
+// PEM data from the file at the given path.
+func loadPEM(value string) ([]byte, error) {
+	if strings.Contains(value, "-----BEGIN") {
+		return []byte(value), nil
+	}
+	return os.ReadFile(value)
+}
+
+// drainAndClose discards any unread response body before closing
+// it, allowing the underlying connection to be reused.
+func drainAndClose(body io.ReadCloser) {
+	_, _ = io.Copy(io.Discard, io.LimitReader(body, 64<<10))
+	body.Close()
+}
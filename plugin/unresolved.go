@@ -0,0 +1,70 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// unresolvedPattern matches Harness expressions and secret reference
+// placeholders that were passed through without being resolved.
+var unresolvedPattern = regexp.MustCompile(`<\+[^>]*>?|\$\{\{[^}]*\}?\}?|\$\{secrets\.[^}]*\}?`)
+
+// checkUnresolved fails when a setting still contains an unresolved
+// expression, naming the setting, instead of sending the placeholder
+// to Azure AD.
+func checkUnresolved(args Args) error {
+	var err error
+	walkSettings(reflect.ValueOf(args), func(name string, value string) bool {
+		if match := unresolvedPattern.FindString(value); match != "" {
+			err = fmt.Errorf("setting %s contains the unresolved expression %q, check that the expression or secret reference exists and is in scope", name, truncate(match, 64))
+			return false
+		}
+		return true
+	})
+	return err
+}
+
+// walkSettings calls fn with the setting name and value of every
+// string and string list plugin argument until fn returns false.
+func walkSettings(v reflect.Value, fn func(name, value string) bool) bool {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		field, value := t.Field(i), v.Field(i)
+		tag := field.Tag.Get("envconfig")
+		if tag == "" {
+			if field.Type.Kind() == reflect.Struct && !walkSettings(value, fn) {
+				return false
+			}
+			continue
+		}
+		if !strings.HasPrefix(tag, "PLUGIN_") {
+			continue
+		}
+		name := strings.ToLower(strings.TrimPrefix(tag, "PLUGIN_"))
+		switch {
+		case field.Type.Kind() == reflect.String:
+			if !fn(name, value.String()) {
+				return false
+			}
+		case field.Type.Kind() == reflect.Slice && field.Type.Elem().Kind() == reflect.String:
+			for j := 0; j < value.Len(); j++ {
+				if !fn(name, value.Index(j).String()) {
+					return false
+				}
+			}
+		}
+	}
+	return true
+}
+
+// truncate shortens the value to at most n bytes.
+func truncate(value string, n int) string {
+	if len(value) <= n {
+		return value
+	}
+	return value[:n] + "..."
+}
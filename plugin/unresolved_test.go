@@ -0,0 +1,46 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestVerifyEnv_Unresolved(t *testing.T) {
+	valid := Args{
+		OIDCToken: testOIDCToken,
+		TenantID:  "12345678-1234-1234-1234-1234567890ab",
+		ClientID:  "12345678-1234-1234-1234-1234567890ab",
+	}
+	if err := VerifyEnv(context.Background(), valid); err != nil {
+		t.Fatalf("VerifyEnv returned error: %v", err)
+	}
+
+	tests := map[string]func(*Args){
+		"setting oidc_token_id contains the unresolved expression \"<+pipeline.variables.token>\"": func(a *Args) {
+			a.OIDCToken = "<+pipeline.variables.token>"
+		},
+		"setting client_id contains the unresolved expression \"<+secrets.getValue(\\\"azure_client\\\")>\"": func(a *Args) {
+			a.ClientID = `<+secrets.getValue("azure_client")>`
+		},
+		"setting scope contains the unresolved expression \"${{ secrets.SCOPE }}\"": func(a *Args) {
+			a.Scope = "${{ secrets.SCOPE }}"
+		},
+		"setting allowed_issuers contains the unresolved expression \"${secrets.issuer}\"": func(a *Args) {
+			a.AllowedIssuers = []string{"https://token.example.com", "${secrets.issuer}"}
+		},
+		"setting azure_authority_host contains the unresolved expression \"<+stage.variables.host\"": func(a *Args) {
+			a.AuthorityHost = "https://<+stage.variables.host"
+		},
+	}
+	for want, mutate := range tests {
+		args := valid
+		mutate(&args)
+		err := VerifyEnv(context.Background(), args)
+		if err == nil || !strings.HasPrefix(err.Error(), want) {
+			t.Errorf("expected error %q, got %v", want, err)
+		}
+	}
+}
@@ -0,0 +1,188 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/harness-community/drone-azure-oidc/pkg/azuread"
+)
+
+// validation check statuses
+const (
+	checkPass = "pass"
+	checkFail = "fail"
+	checkSkip = "skip"
+)
+
+// validationResult is the structured result of validate mode.
+type validationResult struct {
+	Status string            `json:"status"`
+	Checks []validationCheck `json:"checks"`
+}
+
+// validationCheck is the result of a single validation check.
+type validationCheck struct {
+	Name       string `json:"name"`
+	Status     string `json:"status"`
+	Detail     string `json:"detail,omitempty"`
+	ErrorCode  string `json:"error_code,omitempty"`
+	Error      string `json:"error,omitempty"`
+	DurationMS int64  `json:"duration_ms"`
+}
+
+// run runs the check, skipping it when an earlier check failed.
+func (r *validationResult) run(ctx context.Context, name string, fn func() (string, error)) {
+	if r.Status == checkFail {
+		r.Checks = append(r.Checks, validationCheck{Name: name, Status: checkSkip})
+		return
+	}
+	start := time.Now()
+	detail, err := fn()
+	check := validationCheck{
+		Name:       name,
+		Status:     checkPass,
+		Detail:     detail,
+		DurationMS: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		check.Status = checkFail
+		check.ErrorCode = errorCode(err)
+		check.Error = strings.Join(strings.Fields(redactor.Redact(err.Error())), " ")
+		r.Status = checkFail
+		logger(ctx).Errorf("validation check %s failed: %s", name, check.Error)
+	} else {
+		logger(ctx).Infof("validation check %s passed", name)
+	}
+	r.Checks = append(r.Checks, check)
+}
+
+// validate checks the configuration, the connectivity to the
+// authority and the token exchange without writing any output, and
+// writes the result as JSON to out. It is meant for connector test
+// flows, which only need to know whether the credentials work.
+func validate(ctx context.Context, args Args, out io.Writer) error {
+	result := &validationResult{Status: checkPass}
+	var client *http.Client
+
+	result.run(ctx, "assertion", func() (string, error) {
+		if args.Environment != "" {
+			var err error
+			if args, err = selectEnvironment(ctx, args); err != nil {
+				return "", err
+			}
+		}
+		args = normalizeScopes(ctx, args)
+		if credential(args) != credentialOIDC {
+			return fmt.Sprintf("%s credential does not use an assertion", credential(args)), nil
+		}
+		if args.ManagedIdentityClientID == "" {
+			if args.OIDCToken == "" {
+				return "", fmt.Errorf("oidc-token is not provided")
+			}
+			return "oidc token provided", nil
+		}
+		if args.OIDCToken != "" {
+			return "", fmt.Errorf("oidc-token and managed-identity-client-id are mutually exclusive")
+		}
+		if err := validateGUID(args.ManagedIdentityClientID, "managed-identity-client-id"); err != nil {
+			return "", err
+		}
+		token, err := managedIdentityAssertion(ctx, args)
+		if err != nil {
+			return "", err
+		}
+		redactSecret(token)
+		args.OIDCToken = token
+		return "managed identity token acquired", nil
+	})
+	result.run(ctx, "configuration", func() (string, error) {
+		if err := VerifyEnv(ctx, args); err != nil {
+			return "", err
+		}
+		var err error
+		if client, err = newHTTPClient(newTransportOptions(args)); err != nil {
+			return "", err
+		}
+		if args.TenantID == "" && args.SubscriptionID != "" {
+			if args.TenantID, err = discoverTenant(ctx, client, args); err != nil {
+				return "", err
+			}
+			return fmt.Sprintf("tenant %s discovered from subscription %s", args.TenantID, args.SubscriptionID), nil
+		}
+		return "settings are valid", nil
+	})
+	result.run(ctx, "connectivity", func() (string, error) {
+		hosts := azuread.SplitAuthorityHosts(args.AuthorityHost)
+		if len(hosts) == 0 {
+			hosts = []string{defaultAuthorityHost}
+		}
+		var errs []string
+		for _, host := range hosts {
+			detail, err := checkConnectivity(ctx, client, host)
+			if err == nil {
+				return detail, nil
+			}
+			errs = append(errs, err.Error())
+		}
+		return "", fmt.Errorf("no authority host reachable: %s", strings.Join(errs, "; "))
+	})
+	result.run(ctx, "authority", func() (string, error) {
+		if credential(args) == credentialManagedIdentity {
+			return "managed identity tokens are issued by the Instance Metadata Service", nil
+		}
+		hosts := azuread.SplitAuthorityHosts(args.AuthorityHost)
+		if len(hosts) == 0 {
+			hosts = []string{defaultAuthorityHost}
+		}
+		var errs []string
+		for _, host := range hosts {
+			reqCtx, cancel := context.WithTimeout(ctx, defaultTimeout)
+			_, err := azuread.FetchOpenIDConfiguration(reqCtx, client, azuread.TenantDiscoveryURL(host, args.TenantID))
+			cancel()
+			if err == nil {
+				return fmt.Sprintf("tenant %s reachable on %s", args.TenantID, host), nil
+			}
+			errs = append(errs, err.Error())
+		}
+		return "", fmt.Errorf("no authority host reachable: %s", strings.Join(errs, "; "))
+	})
+	result.run(ctx, "exchange", func() (string, error) {
+		scope := args.Scope
+		if scope == "" {
+			scope = defaultScope
+		}
+		provider, err := newTokenProvider(args, newExchanger(args, client))
+		if err != nil {
+			return "", err
+		}
+		token, err := provider.Token(ctx, scope)
+		if err != nil {
+			return "", err
+		}
+		if err := checkTokenRoles(token.AccessToken, args.RequireRoles); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("token issued for %s, expires in %d seconds", scope, token.ExpiresIn), nil
+	})
+
+	encoder := json.NewEncoder(out)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(result); err != nil {
+		return err
+	}
+	if result.Status == checkFail {
+		for _, check := range result.Checks {
+			if check.Status == checkFail {
+				return fmt.Errorf("validation failed: %s: %s", check.Name, check.Error)
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestValidate(t *testing.T) {
+	reject := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/.well-known/openid-configuration"):
+			_, _ = w.Write([]byte(`{"issuer":"https://login.example.com/v2.0","token_endpoint":"https://login.example.com/oauth2/v2.0/token"}`))
+		case reject:
+			w.WriteHeader(http.StatusBadRequest)
+			_, _ = w.Write([]byte(`{"error":"invalid_client","error_description":"AADSTS700016: application not found","error_codes":[700016]}`))
+		default:
+			_, _ = w.Write([]byte(`{"token_type":"Bearer","expires_in":3600,"access_token":"validate-access-token"}`))
+		}
+	}))
+	defer srv.Close()
+
+	dir := t.TempDir()
+	t.Setenv("HARNESS_OUTPUT_SECRET_FILE", filepath.Join(dir, "secret.env"))
+	t.Setenv("DRONE_OUTPUT", filepath.Join(dir, "out.env"))
+
+	args := Args{
+		OIDCToken:     testOIDCToken,
+		TenantID:      "12345678-1234-1234-1234-1234567890ab",
+		ClientID:      "00000000-0000-0000-0000-000000000001",
+		AuthorityHost: srv.URL,
+		Mode:          modeValidate,
+	}
+	var out bytes.Buffer
+	if err := validate(context.Background(), args, &out); err != nil {
+		t.Fatalf("validate returned error: %v", err)
+	}
+	var result validationResult
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+		t.Fatalf("failed to decode result %q: %v", out.String(), err)
+	}
+	if result.Status != checkPass || len(result.Checks) != 5 {
+		t.Fatalf("unexpected result %+v", result)
+	}
+	for _, check := range result.Checks {
+		if check.Status != checkPass {
+			t.Errorf("check %s: status %q, want %q", check.Name, check.Status, checkPass)
+		}
+	}
+	if strings.Contains(out.String(), "validate-access-token") {
+		t.Errorf("result contains the access token: %s", out.String())
+	}
+	for _, name := range []string{"secret.env", "out.env"} {
+		if _, err := os.Stat(filepath.Join(dir, name)); err == nil {
+			t.Errorf("%s written in validate mode", name)
+		}
+	}
+
+	reject = true
+	out.Reset()
+	err := validate(context.Background(), args, &out)
+	if err == nil || !strings.Contains(err.Error(), "validation failed: exchange") {
+		t.Fatalf("expected exchange failure, got %v", err)
+	}
+	result = validationResult{}
+	if err := json.Unmarshal(out.Bytes(), &result); err != nil {
+		t.Fatalf("failed to decode result %q: %v", out.String(), err)
+	}
+	if last := result.Checks[len(result.Checks)-1]; result.Status != checkFail || last.Status != checkFail || last.ErrorCode != "AADSTS700016" {
+		t.Errorf("unexpected result %+v", result)
+	}
+
+	args.ClientID = "not-a-guid"
+	out.Reset()
+	if err := validate(context.Background(), args, &out); err == nil {
+		t.Fatal("expected configuration failure")
+	}
+	result = validationResult{}
+	_ = json.Unmarshal(out.Bytes(), &result)
+	if got := []string{result.Checks[1].Status, result.Checks[2].Status, result.Checks[3].Status}; got[0] != checkFail || got[1] != checkSkip || got[2] != checkSkip {
+		t.Errorf("check statuses = %v, want fail, skip, skip", got)
+	}
+}
@@ -0,0 +1,74 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/harness-community/drone-azure-oidc/pkg/azuread"
+)
+
+// cloudNames maps the authority host of each national cloud to the
+// cloud name read by Velero and other go-autorest based tools.
+var cloudNames = map[string]string{
+	"login.microsoftonline.com": "AzurePublicCloud",
+	"login.microsoftonline.us":  "AzureUSGovernmentCloud",
+	"login.chinacloudapi.cn":    "AzureChinaCloud",
+}
+
+// cloudName returns the cloud name of the authority host, defaulting
+// to the public cloud.
+func cloudName(args Args) string {
+	for _, host := range azuread.SplitAuthorityHosts(args.AuthorityHost) {
+		if u, err := url.Parse(host); err == nil {
+			if name, ok := cloudNames[strings.ToLower(u.Hostname())]; ok {
+				return name
+			}
+		}
+	}
+	return cloudNames["login.microsoftonline.com"]
+}
+
+// writeVeleroCredentials writes a credentials-velero file, the
+// KEY=value format read by the Velero Azure plugin. There is no
+// client secret: the file points AZURE_FEDERATED_TOKEN_FILE at the
+// OIDC token, which the Azure SDK workload identity credential
+// exchanges.
+func writeVeleroCredentials(ctx context.Context, args Args) error {
+	if err := writeFederatedTokenFile(args); err != nil {
+		return err
+	}
+	var b strings.Builder
+	for _, kv := range [][2]string{
+		{"AZURE_SUBSCRIPTION_ID", args.SubscriptionID},
+		{"AZURE_TENANT_ID", args.TenantID},
+		{"AZURE_CLIENT_ID", args.ClientID},
+		{"AZURE_RESOURCE_GROUP", args.ResourceGroup},
+		{"AZURE_CLOUD_NAME", cloudName(args)},
+		{"AZURE_FEDERATED_TOKEN_FILE", federatedTokenFile(args)},
+	} {
+		if kv[1] != "" {
+			fmt.Fprintf(&b, "%s=%s\n", kv[0], kv[1])
+		}
+	}
+
+	path, err := filepath.Abs(args.VeleroCredentials)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("failed to create credentials file directory: %w", err)
+	}
+	if err := os.WriteFile(path, []byte(b.String()), 0600); err != nil {
+		return fmt.Errorf("failed to write credentials file: %w", err)
+	}
+	if output := plainOutput(ctx); output != nil {
+		return output.Write("AZURE_CREDENTIALS_FILE", path)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestWriteVeleroCredentials(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("DRONE_OUTPUT", filepath.Join(dir, "out.env"))
+
+	args := Args{
+		OIDCToken:          testOIDCToken,
+		TenantID:           "12345678-1234-1234-1234-1234567890ab",
+		ClientID:           "00000000-0000-0000-0000-000000000001",
+		SubscriptionID:     "11111111-1111-1111-1111-111111111111",
+		ResourceGroup:      "backups",
+		AuthorityHost:      "https://login.microsoftonline.us/",
+		FederatedTokenFile: filepath.Join(dir, "token"),
+		VeleroCredentials:  filepath.Join(dir, "credentials-velero"),
+	}
+	if err := writeVeleroCredentials(context.Background(), args); err != nil {
+		t.Fatalf("writeVeleroCredentials returned error: %v", err)
+	}
+	data, err := os.ReadFile(args.VeleroCredentials)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "AZURE_SUBSCRIPTION_ID=11111111-1111-1111-1111-111111111111\n" +
+		"AZURE_TENANT_ID=12345678-1234-1234-1234-1234567890ab\n" +
+		"AZURE_CLIENT_ID=00000000-0000-0000-0000-000000000001\n" +
+		"AZURE_RESOURCE_GROUP=backups\n" +
+		"AZURE_CLOUD_NAME=AzureUSGovernmentCloud\n" +
+		"AZURE_FEDERATED_TOKEN_FILE=" + args.FederatedTokenFile + "\n"
+	if string(data) != want {
+		t.Errorf("credentials file = %q, want %q", data, want)
+	}
+	if info, _ := os.Stat(args.VeleroCredentials); info.Mode().Perm() != 0600 {
+		t.Errorf("mode = %v, want 0600", info.Mode().Perm())
+	}
+	if token, _ := os.ReadFile(args.FederatedTokenFile); string(token) != testOIDCToken {
+		t.Errorf("federated token file = %q", token)
+	}
+	outputs, _ := readOutputFile(filepath.Join(dir, "out.env"))
+	if outputs["AZURE_CREDENTIALS_FILE"] != args.VeleroCredentials {
+		t.Errorf("unexpected outputs %v", outputs)
+	}
+
+	args.AuthorityHost = ""
+	if got := cloudName(args); got != "AzurePublicCloud" {
+		t.Errorf("cloudName = %q, want AzurePublicCloud", got)
+	}
+}
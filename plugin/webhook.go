@@ -0,0 +1,110 @@
+// Copyright 2020 the Drone Authors. All rights reserved.
+
+package plugin
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// webhookTimeout bounds the delivery of a webhook notification.
+const webhookTimeout = 10 * time.Second
+
+// verifyWebhooks validates the configured webhook URLs.
+func verifyWebhooks(args Args) error {
+	for name, value := range map[string]string{
+		"on-success-webhook": args.OnSuccessWebhook,
+		"on-failure-webhook": args.OnFailureWebhook,
+	} {
+		if value == "" {
+			continue
+		}
+		u, err := url.Parse(value)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("%s must be an http or https URL", name)
+		}
+	}
+	return nil
+}
+
+// notifyWebhook posts the audit record to the webhook configured for
+// its event. Delivery failures are logged and do not fail the step.
+func notifyWebhook(ctx context.Context, args Args, client *http.Client, rec *auditRecord) {
+	address := args.OnSuccessWebhook
+	if rec.Event == auditTokenFailed {
+		address = args.OnFailureWebhook
+	}
+	if address == "" {
+		return
+	}
+	marker := webhookMarker(args, address, rec)
+	if marker != "" {
+		if _, err := os.Stat(marker); err == nil {
+			logger(ctx).Debugf("%s webhook already sent for this execution, skipped", rec.Event)
+			return
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), webhookTimeout)
+	defer cancel()
+	if err := postWebhook(ctx, client, address, rec); err != nil {
+		logger(ctx).Warnf("failed to send %s webhook: %s", rec.Event, err)
+		return
+	}
+	if marker != "" {
+		err := os.MkdirAll(filepath.Dir(marker), 0700)
+		if err == nil {
+			err = os.WriteFile(marker, nil, 0600)
+		}
+		if err != nil {
+			logger(ctx).Debugf("failed to record %s webhook delivery: %s", rec.Event, err)
+		}
+	}
+}
+
+// webhookMarker returns the file recording the delivery of the
+// notification, keyed by the execution, step, event and identity, so
+// a retried step does not notify twice. Without execution metadata
+// notifications are not deduplicated and the path is empty.
+func webhookMarker(args Args, address string, rec *auditRecord) string {
+	if rec.ExecutionID == "" && rec.BuildNumber == 0 {
+		return ""
+	}
+	key := append(executionKeyMaterial(args), rec.Stage, rec.Step, rec.Event, rec.TenantID, rec.ClientID, rec.Scope, address)
+	sum := sha256.Sum256([]byte(strings.Join(key, "\x00")))
+	dir := args.CacheDir
+	if dir == "" {
+		dir = defaultCacheDir
+	}
+	return filepath.Join(dir, "webhooks", hex.EncodeToString(sum[:]))
+}
+
+func postWebhook(ctx context.Context, client *http.Client, address string, rec *auditRecord) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, address, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer drainAndClose(resp.Body)
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+	return nil
+}
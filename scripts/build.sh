@@ -9,9 +9,12 @@ export CGO_ENABLED=0
 set -e
 set -x
 
+# embed the release version in the User-Agent
+LDFLAGS="-X github.com/harness-community/drone-azure-oidc/plugin.Version=${DRONE_TAG:-dev}"
+
 # linux
-GOOS=linux GOARCH=amd64 go build -o release/linux/amd64/drone-azure-oidc
-GOOS=linux GOARCH=arm64 go build -o release/linux/arm64/drone-azure-oidc
+GOOS=linux GOARCH=amd64 go build -ldflags "$LDFLAGS" -o release/linux/amd64/drone-azure-oidc
+GOOS=linux GOARCH=arm64 go build -ldflags "$LDFLAGS" -o release/linux/arm64/drone-azure-oidc
 
 # windows
-GOOS=windows go build -o release/windows/amd64/drone-azure-oidc.exe
+GOOS=windows go build -ldflags "$LDFLAGS" -o release/windows/amd64/drone-azure-oidc.exe